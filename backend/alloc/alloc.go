@@ -23,10 +23,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func init() {
-	backend.Register("alloc", New)
-}
-
 type AllocBackend struct {
 	sm       subnet.Manager
 	extIface *backend.ExternalInterface
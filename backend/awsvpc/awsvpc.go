@@ -30,10 +30,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func init() {
-	backend.Register("aws-vpc", New)
-}
-
 type AwsVpcBackend struct {
 	sm       subnet.Manager
 	extIface *backend.ExternalInterface
@@ -132,12 +128,39 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, network string, co
 		}
 	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    be.extIface,
+	return &vpcNetwork{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    be.extIface,
+		},
+		routeTableID: cfg.RouteTableID,
+		ec2c:         ec2c,
 	}, nil
 }
 
+type vpcNetwork struct {
+	backend.SimpleNetwork
+	routeTableID string
+	ec2c         *ec2.EC2
+}
+
+// Cleanup deletes the route to the subnet from the VPC route table on
+// teardown
+func (n *vpcNetwork) Cleanup(teardown bool) error {
+	if !teardown {
+		return nil
+	}
+
+	cidrBlock := n.SubnetLease.Subnet.String()
+	deleteRouteInput := &ec2.DeleteRouteInput{RouteTableId: &n.routeTableID, DestinationCidrBlock: &cidrBlock}
+	if _, err := n.ec2c.DeleteRoute(deleteRouteInput); err != nil {
+		if ec2err, ok := err.(awserr.Error); !ok || ec2err.Code() != "InvalidRoute.NotFound" {
+			return fmt.Errorf("error deleting route for %s: %v", cidrBlock, err)
+		}
+	}
+	return nil
+}
+
 func (be *AwsVpcBackend) checkMatchingRoutes(routeTableID, instanceID, subnet string, ec2c *ec2.EC2) (bool, error) {
 	matchingRouteFound := false
 
@@ -26,6 +26,10 @@ type ExternalInterface struct {
 	Iface     *net.Interface
 	IfaceAddr net.IP
 	ExtAddr   net.IP
+	// IPv6 counterparts of IfaceAddr and ExtAddr, nil if the interface
+	// has no global IPv6 address
+	IfaceV6Addr net.IP
+	ExtV6Addr   net.IP
 }
 
 // Besides the entry points in the Backend interface, the backend's New()
@@ -50,6 +54,11 @@ type Network interface {
 	Lease() *subnet.Lease
 	MTU() int
 	Run(ctx context.Context)
+	// Called after Run has returned, when the network is removed, registered
+	// again or flanneld exits. With teardown the devices and routes set up
+	// for the network are removed, otherwise they are left in place so that
+	// traffic keeps flowing until flanneld is back and takes them over.
+	Cleanup(teardown bool) error
 }
 
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
@@ -70,3 +79,8 @@ func (n *SimpleNetwork) MTU() int {
 func (_ *SimpleNetwork) Run(ctx context.Context) {
 	<-ctx.Done()
 }
+
+// Cleanup does nothing as SimpleNetwork sets nothing up on the host
+func (_ *SimpleNetwork) Cleanup(teardown bool) error {
+	return nil
+}
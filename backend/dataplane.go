@@ -0,0 +1,163 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Route is a route a network programs to reach other hosts
+type Route struct {
+	Dst string
+	Gw  string `json:",omitempty"`
+	Dev string `json:",omitempty"`
+}
+
+func (r Route) String() string {
+	s := r.Dst
+	if r.Gw != "" {
+		s += " via " + r.Gw
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	return s
+}
+
+// Neighbor is an FDB or neighbor entry mapping an IP to a MAC address
+type Neighbor struct {
+	IP  string
+	MAC string
+	Dev string
+}
+
+func (n Neighbor) String() string {
+	return fmt.Sprintf("%s lladdr %s dev %s", n.IP, n.MAC, n.Dev)
+}
+
+// Dataplane is the kernel state a network programs to reach other hosts
+type Dataplane struct {
+	Routes    []Route    `json:",omitempty"`
+	FDB       []Neighbor `json:",omitempty"`
+	Neighbors []Neighbor `json:",omitempty"`
+}
+
+// Empty returns true if there are no entries
+func (d Dataplane) Empty() bool {
+	return len(d.Routes) == 0 && len(d.FDB) == 0 && len(d.Neighbors) == 0
+}
+
+// Sort puts the entries in a stable order for display
+func (d Dataplane) Sort() {
+	sort.Sort(routesByString(d.Routes))
+	sort.Sort(neighborsByString(d.FDB))
+	sort.Sort(neighborsByString(d.Neighbors))
+}
+
+type routesByString []Route
+
+func (r routesByString) Len() int           { return len(r) }
+func (r routesByString) Less(i, j int) bool { return r[i].String() < r[j].String() }
+func (r routesByString) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type neighborsByString []Neighbor
+
+func (n neighborsByString) Len() int           { return len(n) }
+func (n neighborsByString) Less(i, j int) bool { return n[i].String() < n[j].String() }
+func (n neighborsByString) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+// Inspector is implemented by networks that program kernel state to reach
+// other hosts, so that it can be checked against the kernel tables
+type Inspector interface {
+	// Programmed returns the entries the network believes it has programmed
+	Programmed() Dataplane
+	// Installed reads the entries of the tables and devices the network
+	// manages from the kernel
+	Installed() (Dataplane, error)
+}
+
+// DiffDataplane returns the entries of want that are missing from have and
+// those of have that aren't in want
+func DiffDataplane(want, have Dataplane) (missing, unexpected Dataplane) {
+	missing.Routes, unexpected.Routes = diffRoutes(want.Routes, have.Routes)
+	missing.FDB, unexpected.FDB = diffNeighbors(want.FDB, have.FDB)
+	missing.Neighbors, unexpected.Neighbors = diffNeighbors(want.Neighbors, have.Neighbors)
+	return missing, unexpected
+}
+
+func diffRoutes(want, have []Route) (missing, unexpected []Route) {
+	in := func(rts []Route, r Route) bool {
+		for _, x := range rts {
+			if x == r {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, r := range want {
+		if !in(have, r) {
+			missing = append(missing, r)
+		}
+	}
+	for _, r := range have {
+		if !in(want, r) {
+			unexpected = append(unexpected, r)
+		}
+	}
+	return missing, unexpected
+}
+
+func diffNeighbors(want, have []Neighbor) (missing, unexpected []Neighbor) {
+	in := func(ns []Neighbor, n Neighbor) bool {
+		for _, x := range ns {
+			if x == n {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, n := range want {
+		if !in(have, n) {
+			missing = append(missing, n)
+		}
+	}
+	for _, n := range have {
+		if !in(want, n) {
+			unexpected = append(unexpected, n)
+		}
+	}
+	return missing, unexpected
+}
+
+// NewRoute describes a netlink route, with dev as the name of its device if
+// it is to be included
+func NewRoute(r netlink.Route, dev string) Route {
+	rt := Route{Dst: r.Dst.String(), Dev: dev}
+	if r.Gw != nil {
+		rt.Gw = r.Gw.String()
+	}
+	return rt
+}
+
+// NewNeighbor describes an FDB or neighbor entry
+func NewNeighbor(ip net.IP, mac net.HardwareAddr, dev string) Neighbor {
+	return Neighbor{IP: ip.String(), MAC: mac.String(), Dev: dev}
+}
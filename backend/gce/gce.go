@@ -51,10 +51,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func init() {
-	backend.Register("gce", New)
-}
-
 var metadataEndpoint = "http://169.254.169.254/computeMetadata/v1"
 
 var replacer = strings.NewReplacer(".", "-", "/", "-")
@@ -123,12 +119,37 @@ func (g *GCEBackend) RegisterNetwork(ctx context.Context, network string, config
 		}
 	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    g.extIface,
+	return &gceNetwork{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    g.extIface,
+		},
+		api: g.api,
 	}, nil
 }
 
+type gceNetwork struct {
+	backend.SimpleNetwork
+	api *gceAPI
+}
+
+// Cleanup deletes the route to the subnet from the GCE network on teardown
+func (n *gceNetwork) Cleanup(teardown bool) error {
+	if !teardown {
+		return nil
+	}
+
+	operation, err := n.api.deleteRoute(n.SubnetLease.Subnet.String())
+	if err != nil {
+		return fmt.Errorf("error deleting route: %v", err)
+	}
+
+	if err = n.api.pollOperationStatus(operation.Name); err != nil {
+		return fmt.Errorf("delete operation failed: %v", err)
+	}
+	return nil
+}
+
 //returns true if an exact matching rule is found
 func (g *GCEBackend) handleMatchingRoute(subnet string) (bool, error) {
 	matchingRoute, err := g.api.getRoute(subnet)
@@ -23,10 +23,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func init() {
-	backend.Register("host-gw", New)
-}
-
 const (
 	routeCheckRetries = 10
 )
@@ -60,12 +56,18 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, netname string, co
 		name:     netname,
 		extIface: be.extIface,
 		sm:       be.sm,
+		networks: config.Networks,
+		network6: config.IPv6Network,
 	}
 
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
 		BackendType: "host-gw",
 	}
+	if config.IPv6Enabled() && be.extIface.ExtV6Addr != nil {
+		pubIPv6 := ip.FromIP6(be.extIface.ExtV6Addr)
+		attrs.PublicIPv6 = &pubIPv6
+	}
 
 	l, err := be.sm.AcquireLease(ctx, netname, &attrs)
 	switch err {
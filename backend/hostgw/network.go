@@ -16,6 +16,7 @@ package hostgw
 
 import (
 	"bytes"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -25,6 +26,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -32,9 +34,17 @@ type network struct {
 	name      string
 	extIface  *backend.ExternalInterface
 	linkIndex int
-	rl        []netlink.Route
 	lease     *subnet.Lease
 	sm        subnet.Manager
+	// networks and network6 are the blocks of the network, to tell the
+	// routes to other hosts apart
+	networks []ip.IP4Net
+	network6 ip.IP6Net
+
+	// mux guards rl, which the route check and Programmed read while Run
+	// updates it
+	mux sync.Mutex
+	rl  []netlink.Route
 }
 
 func (n *network) Lease() *subnet.Lease {
@@ -56,7 +66,6 @@ func (n *network) Run(ctx context.Context) {
 		wg.Done()
 	}()
 
-	n.rl = make([]netlink.Route, 0, 10)
 	wg.Add(1)
 	go func() {
 		n.routeCheck(ctx)
@@ -64,11 +73,14 @@ func (n *network) Run(ctx context.Context) {
 	}()
 
 	defer wg.Wait()
+	defer backend.Routes.Delete(n.name)
 
 	for {
 		select {
 		case evtBatch := <-evts:
 			n.handleSubnetEvents(evtBatch)
+			subnet.LeasesHandled(n.name)
+			backend.Routes.Set(float64(len(n.routeList())), n.name)
 
 		case <-ctx.Done():
 			return
@@ -76,6 +88,58 @@ func (n *network) Run(ctx context.Context) {
 	}
 }
 
+// Cleanup deletes the routes to the other hosts' subnets on teardown
+func (n *network) Cleanup(teardown bool) error {
+	if !teardown {
+		return nil
+	}
+
+	rl := n.routeList()
+	log.Infof("Deleting %d routes to other hosts", len(rl))
+	for _, route := range rl {
+		n.delRoute(route)
+	}
+	return nil
+}
+
+// Programmed returns the routes to the other hosts
+func (n *network) Programmed() backend.Dataplane {
+	var dp backend.Dataplane
+	for _, r := range n.routeList() {
+		dp.Routes = append(dp.Routes, backend.NewRoute(r, ""))
+	}
+	return dp
+}
+
+// Installed reads the routes into the network via a gateway from the kernel
+func (n *network) Installed() (backend.Dataplane, error) {
+	var dp backend.Dataplane
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return dp, fmt.Errorf("failed to list routes: %v", err)
+		}
+		for _, r := range routes {
+			if r.Dst != nil && r.Gw != nil && n.inNetwork(r.Dst) {
+				dp.Routes = append(dp.Routes, backend.NewRoute(r, ""))
+			}
+		}
+	}
+	return dp, nil
+}
+
+func (n *network) inNetwork(dst *net.IPNet) bool {
+	if dst.IP.To4() != nil {
+		for _, nw := range n.networks {
+			if nw.Contains(ip.FromIP(dst.IP)) {
+				return true
+			}
+		}
+		return false
+	}
+	return !n.network6.Empty() && n.network6.Contains(ip.FromIP6(dst.IP))
+}
+
 func (n *network) handleSubnetEvents(batch []subnet.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
@@ -87,36 +151,25 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				continue
 			}
 
-			route := netlink.Route{
+			n.addRoute(netlink.FAMILY_V4, netlink.Route{
 				Dst:       evt.Lease.Subnet.ToIPNet(),
 				Gw:        evt.Lease.Attrs.PublicIP.ToIP(),
 				LinkIndex: n.linkIndex,
-			}
+			})
 
-			// Check if route exists before attempting to add it
-			routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
-				Dst: route.Dst,
-			}, netlink.RT_FILTER_DST)
-			if err != nil {
-				log.Warningf("Unable to list routes: %v", err)
-			}
-			//   Check match on Dst for match on Gw
-			if len(routeList) > 0 && !routeList[0].Gw.Equal(route.Gw) {
-				// Same Dst different Gw. Remove it, correct route will be added below.
-				log.Warningf("Replacing existing route to %v via %v with %v via %v.", evt.Lease.Subnet, routeList[0].Gw, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
-				if err := netlink.RouteDel(&route); err != nil {
-					log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+			if !evt.Lease.IPv6Subnet.Empty() {
+				if evt.Lease.Attrs.PublicIPv6 == nil {
+					log.Warningf("Not routing %v: host %v has no public IPv6 address", evt.Lease.IPv6Subnet, evt.Lease.Attrs.PublicIP)
 					continue
 				}
+
+				log.Infof("Subnet added: %v via %v", evt.Lease.IPv6Subnet, evt.Lease.Attrs.PublicIPv6)
+				n.addRoute(netlink.FAMILY_V6, netlink.Route{
+					Dst:       evt.Lease.IPv6Subnet.ToIPNet(),
+					Gw:        evt.Lease.Attrs.PublicIPv6.ToIP(),
+					LinkIndex: n.linkIndex,
+				})
 			}
-			if len(routeList) > 0 && routeList[0].Gw.Equal(route.Gw) {
-				// Same Dst and same Gw, keep it and do not attempt to add it.
-				log.Infof("Route to %v via %v already exists, skipping.", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
-			} else if err := netlink.RouteAdd(&route); err != nil {
-				log.Errorf("Error adding route to %v via %v: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, err)
-				continue
-			}
-			n.addToRouteList(route)
 
 		case subnet.EventRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
@@ -126,16 +179,22 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				continue
 			}
 
-			route := netlink.Route{
+			n.delRoute(netlink.Route{
 				Dst:       evt.Lease.Subnet.ToIPNet(),
 				Gw:        evt.Lease.Attrs.PublicIP.ToIP(),
 				LinkIndex: n.linkIndex,
+			})
+
+			if !evt.Lease.IPv6Subnet.Empty() {
+				route := netlink.Route{
+					Dst:       evt.Lease.IPv6Subnet.ToIPNet(),
+					LinkIndex: n.linkIndex,
+				}
+				if evt.Lease.Attrs.PublicIPv6 != nil {
+					route.Gw = evt.Lease.Attrs.PublicIPv6.ToIP()
+				}
+				n.delRoute(route)
 			}
-			if err := netlink.RouteDel(&route); err != nil {
-				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
-				continue
-			}
-			n.removeFromRouteList(route)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -143,19 +202,66 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 	}
 }
 
+func (n *network) addRoute(family int, route netlink.Route) {
+	// Check if route exists before attempting to add it
+	routeList, err := netlink.RouteListFiltered(family, &netlink.Route{
+		Dst: route.Dst,
+	}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Warningf("Unable to list routes: %v", err)
+	}
+	//   Check match on Dst for match on Gw
+	if len(routeList) > 0 && !routeList[0].Gw.Equal(route.Gw) {
+		// Same Dst different Gw. Remove it, correct route will be added below.
+		log.Warningf("Replacing existing route to %v via %v with %v via %v.", route.Dst, routeList[0].Gw, route.Dst, route.Gw)
+		if err := netlink.RouteDel(&route); err != nil {
+			log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+			return
+		}
+	}
+	if len(routeList) > 0 && routeList[0].Gw.Equal(route.Gw) {
+		// Same Dst and same Gw, keep it and do not attempt to add it.
+		log.Infof("Route to %v via %v already exists, skipping.", route.Dst, route.Gw)
+	} else if err := netlink.RouteAdd(&route); err != nil {
+		log.Errorf("Error adding route to %v via %v: %v", route.Dst, route.Gw, err)
+		return
+	}
+	n.addToRouteList(route)
+}
+
+func (n *network) delRoute(route netlink.Route) {
+	if err := netlink.RouteDel(&route); err != nil {
+		log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+		return
+	}
+	n.removeFromRouteList(route)
+}
+
 func (n *network) addToRouteList(route netlink.Route) {
+	n.mux.Lock()
 	n.rl = append(n.rl, route)
+	n.mux.Unlock()
 }
 
 func (n *network) removeFromRouteList(route netlink.Route) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
 	for index, r := range n.rl {
-		if routeEqual(r, route) {
+		if r.Dst.String() == route.Dst.String() && (route.Gw == nil || r.Gw.Equal(route.Gw)) {
 			n.rl = append(n.rl[:index], n.rl[index+1:]...)
 			return
 		}
 	}
 }
 
+// routeList returns a copy of the routes to the other hosts
+func (n *network) routeList() []netlink.Route {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return append([]netlink.Route(nil), n.rl...)
+}
+
 func (n *network) routeCheck(ctx context.Context) {
 	for {
 		select {
@@ -168,9 +274,9 @@ func (n *network) routeCheck(ctx context.Context) {
 }
 
 func (n *network) checkSubnetExistInRoutes() {
-	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	routeList, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
 	if err == nil {
-		for _, route := range n.rl {
+		for _, route := range n.routeList() {
 			exist := false
 			for _, r := range routeList {
 				if r.Dst == nil {
@@ -189,6 +295,7 @@ func (n *network) checkSubnetExistInRoutes() {
 					continue
 				} else {
 					log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
+					routesRecovered.Inc(n.name)
 				}
 			}
 		}
@@ -19,14 +19,11 @@ import (
 	"strings"
 	"sync"
 
-	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/subnet"
 )
 
-var backendCtors map[string]BackendCtor = make(map[string]BackendCtor)
-
 type Manager interface {
 	GetBackend(backendType string) (Backend, error)
 	Wait()
@@ -36,16 +33,18 @@ type manager struct {
 	ctx      context.Context
 	sm       subnet.Manager
 	extIface *ExternalInterface
+	registry *Registry
 	mux      sync.Mutex
 	active   map[string]Backend
 	wg       sync.WaitGroup
 }
 
-func NewManager(ctx context.Context, sm subnet.Manager, extIface *ExternalInterface) Manager {
+func NewManager(ctx context.Context, sm subnet.Manager, extIface *ExternalInterface, registry *Registry) Manager {
 	return &manager{
 		ctx:      ctx,
 		sm:       sm,
 		extIface: extIface,
+		registry: registry,
 		active:   make(map[string]Backend),
 	}
 }
@@ -61,9 +60,9 @@ func (bm *manager) GetBackend(backendType string) (Backend, error) {
 	}
 
 	// first request, need to create and run it
-	befunc, ok := backendCtors[betype]
+	befunc, ok := bm.registry.Lookup(betype)
 	if !ok {
-		return nil, fmt.Errorf("unknown backend type: %v", betype)
+		return nil, fmt.Errorf("unknown backend type: %v (known: %v)", betype, strings.Join(bm.registry.Types(), ", "))
 	}
 
 	be, err := befunc(bm.sm, bm.extIface)
@@ -94,8 +93,3 @@ func (bm *manager) GetBackend(backendType string) (Backend, error) {
 func (bm *manager) Wait() {
 	bm.wg.Wait()
 }
-
-func Register(name string, ctor BackendCtor) {
-	log.Infof("Register: %v", name)
-	backendCtors[name] = ctor
-}
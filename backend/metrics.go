@@ -0,0 +1,25 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+// Routes is the number of routes to other hosts' subnets a backend keeps
+// for a network. Backends that route peers themselves set it as their
+// routes change and delete it when their Run returns.
+var Routes = metrics.NewGaugeVec("flannel_routes",
+	"Number of routes to the subnets of other hosts the backend keeps for a network.", "network")
@@ -0,0 +1,61 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry maps backend types, as given in the network config, to their
+// constructors. Backend packages don't register themselves: whoever runs
+// the networks decides which backends are available.
+type Registry struct {
+	mux   sync.Mutex
+	ctors map[string]BackendCtor
+}
+
+func NewRegistry() *Registry {
+	return &Registry{ctors: make(map[string]BackendCtor)}
+}
+
+// Register adds a backend type, replacing any backend of the same type
+func (r *Registry) Register(backendType string, ctor BackendCtor) {
+	r.mux.Lock()
+	r.ctors[strings.ToLower(backendType)] = ctor
+	r.mux.Unlock()
+}
+
+// Lookup returns the constructor of a backend type
+func (r *Registry) Lookup(backendType string) (BackendCtor, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	ctor, ok := r.ctors[strings.ToLower(backendType)]
+	return ctor, ok
+}
+
+// Types returns the registered backend types
+func (r *Registry) Types() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	types := make([]string, 0, len(r.ctors))
+	for t := range r.ctors {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -43,10 +43,12 @@ type network struct {
 	tun    *os.File
 	conn   *net.UDPConn
 	tunNet ip.IP4Net
-	sm     subnet.Manager
+	// otherNets are the blocks of the network not containing tunNet
+	otherNets []ip.IP4Net
+	sm        subnet.Manager
 }
 
-func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, port int, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
+func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, port int, nw ip.IP4Net, otherNets []ip.IP4Net, l *subnet.Lease) (*network, error) {
 	n := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: l,
@@ -58,6 +60,7 @@ func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterf
 	}
 
 	n.tunNet = nw
+	n.otherNets = otherNets
 
 	if err := n.initTun(); err != nil {
 		return nil, err
@@ -109,6 +112,7 @@ func (n *network) Run(ctx context.Context) {
 		select {
 		case evtBatch := <-evts:
 			n.processSubnetEvents(evtBatch)
+			subnet.LeasesHandled(n.name)
 
 		case <-ctx.Done():
 			stopProxy(n.ctl)
@@ -121,6 +125,13 @@ func (n *network) MTU() int {
 	return n.ExtIface.Iface.MTU - encapOverhead
 }
 
+// Cleanup does nothing: the TUN device and its routes go away with the file
+// descriptor closed when Run returns, and without the proxy there would be
+// no dataplane to keep anyway
+func (n *network) Cleanup(teardown bool) error {
+	return nil
+}
+
 func newCtlSockets() (*os.File, *os.File, error) {
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
 	if err != nil {
@@ -141,7 +152,7 @@ func (n *network) initTun() error {
 		return fmt.Errorf("failed to open TUN device: %v", err)
 	}
 
-	err = configureIface(tunName, n.tunNet, n.MTU())
+	err = configureIface(tunName, n.tunNet, n.otherNets, n.MTU())
 	if err != nil {
 		return err
 	}
@@ -149,7 +160,7 @@ func (n *network) initTun() error {
 	return nil
 }
 
-func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
+func configureIface(ifname string, ipn ip.IP4Net, otherNets []ip.IP4Net, mtu int) error {
 	iface, err := netlink.LinkByName(ifname)
 	if err != nil {
 		return fmt.Errorf("failed to lookup interface %v", ifname)
@@ -172,13 +183,15 @@ func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
 
 	// explicitly add a route since there might be a route for a subnet already
 	// installed by Docker and then it won't get auto added
-	err = netlink.RouteAdd(&netlink.Route{
-		LinkIndex: iface.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       ipn.Network().ToIPNet(),
-	})
-	if err != nil && err != syscall.EEXIST {
-		return fmt.Errorf("failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
+	for _, nw := range append([]ip.IP4Net{ipn.Network()}, otherNets...) {
+		err = netlink.RouteAdd(&netlink.Route{
+			LinkIndex: iface.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       nw.ToIPNet(),
+		})
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route (%v -> %v): %v", nw.String(), ifname, err)
+		}
 	}
 
 	return nil
@@ -25,10 +25,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func init() {
-	backend.Register("udp", New)
-}
-
 const (
 	defaultPort = 8285
 )
@@ -78,12 +74,24 @@ func (be *UdpBackend) RegisterNetwork(ctx context.Context, netname string, confi
 
 	// Tunnel's subnet is that of the whole overlay network (e.g. /16)
 	// and not that of the individual host (e.g. /24)
+	nw, ok := config.NetworkOf(l.Subnet)
+	if !ok {
+		nw = config.Network
+	}
 	tunNet := ip.IP4Net{
 		IP:        l.Subnet.IP,
-		PrefixLen: config.Network.PrefixLen,
+		PrefixLen: nw.PrefixLen,
+	}
+
+	// the other blocks of the network are routed to the tunnel too
+	var otherNets []ip.IP4Net
+	for _, n := range config.Networks {
+		if !n.Equal(nw) {
+			otherNets = append(otherNets, n)
+		}
 	}
 
-	return newNetwork(netname, be.sm, be.extIface, cfg.Port, tunNet, l)
+	return newNetwork(netname, be.sm, be.extIface, cfg.Port, tunNet, otherNets, l)
 }
 
 func (_ *UdpBackend) Run(ctx context.Context) {
@@ -15,6 +15,9 @@
 package vxlan
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"os"
@@ -35,10 +38,16 @@ type vxlanDeviceAttrs struct {
 	vtepAddr  net.IP
 	vtepPort  int
 	gbp       bool
+	// appSolicit sends the ARP requests and neighbor solicitations of the
+	// device to userspace, as L3 misses
+	appSolicit bool
+	// mac is the MAC address of the device, random if nil
+	mac net.HardwareAddr
 }
 
 type vxlanDevice struct {
-	link *netlink.Vxlan
+	link  *netlink.Vxlan
+	attrs vxlanDeviceAttrs
 }
 
 func sysctlSet(path, value string) error {
@@ -53,31 +62,97 @@ func sysctlSet(path, value string) error {
 }
 
 func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
+	dev := &vxlanDevice{attrs: *devAttrs}
+	if err := dev.create(); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// create creates the device, or adopts an existing one with a compatible
+// configuration
+func (dev *vxlanDevice) create() error {
 	link := &netlink.Vxlan{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: devAttrs.name,
+			Name: dev.attrs.name,
 		},
-		VxlanId:      int(devAttrs.vni),
-		VtepDevIndex: devAttrs.vtepIndex,
-		SrcAddr:      devAttrs.vtepAddr,
-		Port:         devAttrs.vtepPort,
+		VxlanId:      int(dev.attrs.vni),
+		VtepDevIndex: dev.attrs.vtepIndex,
+		SrcAddr:      dev.attrs.vtepAddr,
+		Port:         dev.attrs.vtepPort,
 		Learning:     false,
-		GBP:          devAttrs.gbp,
+		GBP:          dev.attrs.gbp,
 	}
 
 	link, err := ensureLink(link)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if dev.attrs.mac != nil && !bytes.Equal(link.HardwareAddr, dev.attrs.mac) {
+		if err := netlink.LinkSetHardwareAddr(link, dev.attrs.mac); err != nil {
+			return fmt.Errorf("failed to set the MAC address of %v: %v", dev.attrs.name, err)
+		}
+		link.HardwareAddr = dev.attrs.mac
 	}
+
 	// this enables ARP requests being sent to userspace via netlink
-	sysctlPath := fmt.Sprintf("/proc/sys/net/ipv4/neigh/%s/app_solicit", devAttrs.name)
-	if err := sysctlSet(sysctlPath, "3"); err != nil {
-		return nil, err
+	sysctlPath := fmt.Sprintf("/proc/sys/net/ipv4/neigh/%s/app_solicit", dev.attrs.name)
+	if err := sysctlSet(sysctlPath, appSolicitValue(dev.attrs.appSolicit)); err != nil {
+		return err
+	}
+
+	dev.link = link
+	return nil
+}
+
+// Recreate creates the device again after it was deleted or replaced,
+// keeping its MAC address
+func (dev *vxlanDevice) Recreate() error {
+	if dev.attrs.mac == nil {
+		dev.attrs.mac = dev.link.HardwareAddr
 	}
+	return dev.create()
+}
 
-	return &vxlanDevice{
-		link: link,
-	}, nil
+// vtepMAC derives the MAC address of the device from the public IP of the
+// host and the VNI, so that it stays the same when the device is created
+// again, after a restart or a reboot, and the other hosts keep their
+// entries for it
+func vtepMAC(publicIP net.IP, vni uint32) net.HardwareAddr {
+	h := sha256.New()
+	h.Write(publicIP.To16())
+	binary.Write(h, binary.BigEndian, vni)
+	sum := h.Sum(nil)
+
+	mac := net.HardwareAddr(sum[:6])
+	// a locally administered unicast address
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
+// DelNeighsTo deletes the neighbor entries resolving to mac
+func (dev *vxlanDevice) DelNeighsTo(mac net.HardwareAddr) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		neighs, err := netlink.NeighList(dev.link.Index, family)
+		if err != nil {
+			return err
+		}
+		for _, nb := range neighs {
+			if bytes.Equal(nb.HardwareAddr, mac) {
+				if err := dev.DelNeigh(nb); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func appSolicitValue(on bool) string {
+	if on {
+		return "3"
+	}
+	return "0"
 }
 
 func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
@@ -122,14 +197,69 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 }
 
 func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
+	if err := dev.ConfigureAddr(ipn); err != nil {
+		return err
+	}
+
+	// explicitly add a route since there might be a route for a subnet already
+	// installed by Docker and then it won't get auto added
+	return dev.AddRoute(ipn.Network())
+}
+
+// ConfigureAddr sets the address of the device and brings it up, without
+// adding a route for its network
+func (dev *vxlanDevice) ConfigureAddr(ipn ip.IP4Net) error {
 	setAddr4(dev.link, ipn.ToIPNet())
 
 	if err := netlink.LinkSetUp(dev.link); err != nil {
 		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
 	}
+	return nil
+}
+
+// AddRoute routes the network ipn through the device
+func (dev *vxlanDevice) AddRoute(ipn ip.IP4Net) error {
+	route := netlink.Route{
+		LinkIndex: dev.link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       ipn.ToIPNet(),
+	}
+	if err := netlink.RouteAdd(&route); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add route (%s -> %s): %v", ipn.String(), dev.link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// DelRoutes deletes the routes through the device to the destinations in
+// dsts that have no gateway, if there are any
+func (dev *vxlanDevice) DelRoutes(dsts []*net.IPNet) error {
+	routes, err := netlink.RouteList(dev.link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list the routes of %s: %v", dev.link.Attrs().Name, err)
+	}
+	for _, r := range routes {
+		if r.Dst == nil || r.Gw != nil {
+			continue
+		}
+		for _, dst := range dsts {
+			if r.Dst.String() == dst.String() {
+				if err := netlink.RouteDel(&r); err != nil && err != syscall.ESRCH {
+					return fmt.Errorf("failed to delete route (%s -> %s): %v", r.Dst, dev.link.Attrs().Name, err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigureIPv6 is the IPv6 counterpart of Configure, for dual-stack networks
+func (dev *vxlanDevice) ConfigureIPv6(ipn ip.IP6Net) error {
+	if err := dev.ConfigureAddr6(ipn); err != nil {
+		return err
+	}
 
-	// explicitly add a route since there might be a route for a subnet already
-	// installed by Docker and then it won't get auto added
 	route := netlink.Route{
 		LinkIndex: dev.link.Attrs().Index,
 		Scope:     netlink.SCOPE_UNIVERSE,
@@ -142,8 +272,20 @@ func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
 	return nil
 }
 
-func (dev *vxlanDevice) Destroy() {
-	netlink.LinkDel(dev.link)
+// ConfigureAddr6 sets the global IPv6 address of the device, without adding
+// a route for its network
+func (dev *vxlanDevice) ConfigureAddr6(ipn ip.IP6Net) error {
+	// this enables neighbor solicitations being sent to userspace via netlink
+	sysctlPath := fmt.Sprintf("/proc/sys/net/ipv6/neigh/%s/app_solicit", dev.link.Attrs().Name)
+	if err := sysctlSet(sysctlPath, appSolicitValue(dev.attrs.appSolicit)); err != nil {
+		return err
+	}
+
+	return setAddr6(dev.link, ipn.ToIPNet())
+}
+
+func (dev *vxlanDevice) Destroy() error {
+	return netlink.LinkDel(dev.link)
 }
 
 func (dev *vxlanDevice) MACAddr() net.HardwareAddr {
@@ -159,6 +301,11 @@ type neigh struct {
 	IP  ip.IP4
 }
 
+type neigh6 struct {
+	MAC net.HardwareAddr
+	IP  ip.IP6
+}
+
 func (dev *vxlanDevice) GetL2List() ([]netlink.Neigh, error) {
 	log.Infof("calling GetL2List() dev.link.Index: %d ", dev.link.Index)
 	return netlink.NeighList(dev.link.Index, syscall.AF_BRIDGE)
@@ -209,6 +356,49 @@ func (dev *vxlanDevice) DelL3(n neigh) error {
 	})
 }
 
+func (dev *vxlanDevice) AddV6L3(n neigh6) error {
+	log.Infof("calling NeighSet: %v, %v", n.IP, n.MAC)
+	return netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		Family:       syscall.AF_INET6,
+		State:        netlink.NUD_REACHABLE,
+		Type:         syscall.RTN_UNICAST,
+		IP:           n.IP.ToIP(),
+		HardwareAddr: n.MAC,
+	})
+}
+
+// SetNeigh adds or replaces a permanent neighbor entry
+func (dev *vxlanDevice) SetNeigh(nb netlink.Neigh) error {
+	log.Infof("calling NeighSet: %v, %v", nb.IP, nb.HardwareAddr)
+	nb.LinkIndex = dev.link.Index
+	nb.State = netlink.NUD_PERMANENT
+	nb.Type = syscall.RTN_UNICAST
+	return netlink.NeighSet(&nb)
+}
+
+// DelNeigh deletes a neighbor entry
+func (dev *vxlanDevice) DelNeigh(nb netlink.Neigh) error {
+	log.Infof("calling NeighDel: %v, %v", nb.IP, nb.HardwareAddr)
+	nb.LinkIndex = dev.link.Index
+	return netlink.NeighDel(&nb)
+}
+
+// GetNeighList returns the permanent neighbor entries of the device
+func (dev *vxlanDevice) GetNeighList(family int) ([]netlink.Neigh, error) {
+	neighs, err := netlink.NeighList(dev.link.Index, family)
+	if err != nil {
+		return nil, err
+	}
+	var permanent []netlink.Neigh
+	for _, nb := range neighs {
+		if nb.State&netlink.NUD_PERMANENT != 0 {
+			permanent = append(permanent, nb)
+		}
+	}
+	return permanent, nil
+}
+
 func (dev *vxlanDevice) MonitorMisses(misses chan *netlink.Neigh) {
 	nlsock, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_NEIGH)
 	if err != nil {
@@ -231,6 +421,74 @@ func (dev *vxlanDevice) MonitorMisses(misses chan *netlink.Neigh) {
 	}
 }
 
+// MonitorChanges sends the index of the links that change and of those that
+// lose FDB entries or, with neighbors set, permanent neighbor entries to
+// changes, until done is closed
+func (dev *vxlanDevice) MonitorChanges(changes chan<- int, neighbors bool, done <-chan struct{}) {
+	nlsock, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_LINK, syscall.RTNLGRP_NEIGH)
+	if err != nil {
+		log.Error("Failed to subscribe to netlink RTNLGRP_LINK and RTNLGRP_NEIGH messages")
+		return
+	}
+	go func() {
+		<-done
+		nlsock.Close()
+	}()
+
+	for {
+		msgs, err := nlsock.Receive()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			log.Errorf("Failed to receive from netlink: %v ", err)
+
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		for _, msg := range msgs {
+			index, ok := changedLink(msg, neighbors)
+			if !ok {
+				continue
+			}
+
+			select {
+			case changes <- index:
+			default:
+				// the periodic reconciliation catches up
+			}
+		}
+	}
+}
+
+// changedLink returns the index of the link of a netlink message that
+// MonitorChanges reports. The kernel deletes neighbor entries it resolved
+// itself as they age out, so only the deletions of the entries flannel
+// manages count: FDB entries and, with neighbors set, permanent neighbors.
+func changedLink(msg syscall.NetlinkMessage, neighbors bool) (int, bool) {
+	switch msg.Header.Type {
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+		return int(nl.DeserializeIfInfomsg(msg.Data).Index), true
+
+	case syscall.RTM_DELNEIGH:
+		neigh, err := netlink.NeighDeserialize(msg.Data)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case neigh.Family == syscall.AF_BRIDGE:
+		case neighbors && neigh.State&netlink.NUD_PERMANENT != 0:
+		default:
+			return 0, false
+		}
+		return neigh.LinkIndex, true
+	}
+	return 0, false
+}
+
 func isNeighResolving(state int) bool {
 	return (state & (netlink.NUD_INCOMPLETE | netlink.NUD_STALE | netlink.NUD_DELAY | netlink.NUD_PROBE)) != 0
 }
@@ -313,3 +571,28 @@ func setAddr4(link *netlink.Vxlan, ipn *net.IPNet) error {
 
 	return nil
 }
+
+// sets the global IP6 addr on link removing any existing global ones first;
+// the link-local address is left alone
+func setAddr6(link *netlink.Vxlan, ipn *net.IPNet) error {
+	addrs, err := netlink.AddrList(link, syscall.AF_INET6)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !addr.IP.IsGlobalUnicast() {
+			continue
+		}
+		if err = netlink.AddrDel(link, &addr); err != nil {
+			return fmt.Errorf("failed to delete IPv6 addr %s from %s", addr.String(), link.Attrs().Name)
+		}
+	}
+
+	addr := netlink.Addr{IPNet: ipn, Label: ""}
+	if err = netlink.AddrAdd(link, &addr); err != nil {
+		return fmt.Errorf("failed to add IP address %s to %s: %s", ipn.String(), link.Attrs().Name, err)
+	}
+
+	return nil
+}
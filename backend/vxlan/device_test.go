@@ -0,0 +1,80 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestVTEPMAC(t *testing.T) {
+	mac := vtepMAC(net.ParseIP("192.168.1.10"), 1)
+	if s := mac.String(); s != vtepMAC(net.ParseIP("192.168.1.10"), 1).String() {
+		t.Errorf("vtepMAC returned %v and then %v for the same IP and VNI", mac, s)
+	}
+	if s := vtepMAC(net.ParseIP("192.168.1.10").To4(), 1).String(); s != mac.String() {
+		t.Errorf("vtepMAC of a 4-byte IP is %v, want %v", s, mac)
+	}
+	if vtepMAC(net.ParseIP("192.168.1.11"), 1).String() == mac.String() {
+		t.Errorf("vtepMAC is %v for another IP", mac)
+	}
+	if vtepMAC(net.ParseIP("192.168.1.10"), 2).String() == mac.String() {
+		t.Errorf("vtepMAC is %v for another VNI", mac)
+	}
+
+	for i := 0; i < 256; i++ {
+		publicIP := net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/16, i))
+		mac := vtepMAC(publicIP, uint32(i))
+		if len(mac) != 6 {
+			t.Fatalf("vtepMAC of %v is %v, want 6 bytes", publicIP, mac)
+		}
+		if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 {
+			t.Errorf("vtepMAC of %v is %v, not a locally administered unicast address", publicIP, mac)
+		}
+	}
+}
+
+func TestChangedLink(t *testing.T) {
+	neighMsg := func(typ uint16, family uint8, state uint16) syscall.NetlinkMessage {
+		ndm := &netlink.Ndmsg{Family: family, Index: 7, State: state}
+		return syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: typ},
+			Data:   append([]byte(nil), ndm.Serialize()...),
+		}
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		msg       syscall.NetlinkMessage
+		neighbors bool
+		changed   bool
+	}{
+		{"FDB entry deleted", neighMsg(syscall.RTM_DELNEIGH, syscall.AF_BRIDGE, netlink.NUD_PERMANENT), false, true},
+		{"permanent neighbor deleted", neighMsg(syscall.RTM_DELNEIGH, syscall.AF_INET, netlink.NUD_PERMANENT), false, false},
+		{"permanent neighbor deleted, proactive", neighMsg(syscall.RTM_DELNEIGH, syscall.AF_INET, netlink.NUD_PERMANENT), true, true},
+		{"resolved neighbor aged out", neighMsg(syscall.RTM_DELNEIGH, syscall.AF_INET, netlink.NUD_STALE), false, false},
+		{"resolved neighbor aged out, proactive", neighMsg(syscall.RTM_DELNEIGH, syscall.AF_INET6, netlink.NUD_REACHABLE), true, false},
+		{"FDB entry added", neighMsg(syscall.RTM_NEWNEIGH, syscall.AF_BRIDGE, netlink.NUD_PERMANENT), true, false},
+	} {
+		index, changed := changedLink(tc.msg, tc.neighbors)
+		if changed != tc.changed || (changed && index != 7) {
+			t.Errorf("%s: changedLink returned %d, %v, want %v", tc.desc, index, changed, tc.changed)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"net"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// With DirectRouting, the subnets of the hosts on the same L2 segment as the
+// external interface are routed to them like the host-gw backend does,
+// without encapsulation. The other hosts are reached through the device.
+
+// onLink tells whether addr is in one of the subnets of the external
+// interface
+func (n *network) onLink(addr net.IP) bool {
+	addrs, err := n.extIface.Iface.Addrs()
+	if err != nil {
+		log.Warningf("Failed to list the addresses of %v: %v", n.extIface.Iface.Name, err)
+		return false
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// directRoutesTo returns the routes to the subnets of a lease via its
+// public IPs, or false if the host isn't on our L2 segment
+func (n *network) directRoutesTo(l *subnet.Lease) ([]netlink.Route, bool) {
+	if !n.directRouting || !n.onLink(l.Attrs.PublicIP.ToIP()) {
+		return nil, false
+	}
+
+	routes := []netlink.Route{{
+		Dst:       l.Subnet.ToIPNet(),
+		Gw:        l.Attrs.PublicIP.ToIP(),
+		LinkIndex: n.extIface.Iface.Index,
+	}}
+
+	if !l.IPv6Subnet.Empty() {
+		// both subnets go the same way, so the IPv6 one has to be direct too
+		if l.Attrs.PublicIPv6 == nil || !n.onLink(l.Attrs.PublicIPv6.ToIP()) {
+			return nil, false
+		}
+		routes = append(routes, netlink.Route{
+			Dst:       l.IPv6Subnet.ToIPNet(),
+			Gw:        l.Attrs.PublicIPv6.ToIP(),
+			LinkIndex: n.extIface.Iface.Index,
+		})
+	}
+	return routes, true
+}
+
+// setDirect routes the subnets of a lease directly, replacing the routes of
+// the lease added before and its FDB entry if it was reached through the
+// device
+func (n *network) setDirect(l *subnet.Lease, routes []netlink.Route) {
+	n.mux.Lock()
+	old, ok := n.direct[l.Subnet]
+	nb, inFDB := n.fdb[l.Attrs.PublicIP]
+	n.mux.Unlock()
+
+	if ok && routesEqual(old, routes) {
+		return
+	}
+	if inFDB {
+		log.Infof("Routing %v directly via %v instead of through %v", l.Subnet, l.Attrs.PublicIP, n.dev.link.Attrs().Name)
+		if err := n.delL2(nb); err != nil {
+			log.Error("Delete L2 failed: ", err)
+		}
+	}
+	n.removeRoute(l.Subnet)
+	n.delDirect(l.Subnet)
+
+	for _, r := range routes {
+		if err := addDirectRoute(r); err != nil {
+			log.Errorf("Error adding route to %v via %v: %v", r.Dst, r.Gw, err)
+		}
+	}
+
+	// the routes that failed are added by the reconciliation
+	n.mux.Lock()
+	n.direct[l.Subnet] = routes
+	n.mux.Unlock()
+}
+
+// delDirect deletes the direct routes to a subnet, if any. It reports
+// whether there were some.
+func (n *network) delDirect(sn ip.IP4Net) bool {
+	n.mux.Lock()
+	routes, ok := n.direct[sn]
+	delete(n.direct, sn)
+	n.mux.Unlock()
+
+	for _, r := range routes {
+		if err := netlink.RouteDel(&r); err != nil {
+			log.Errorf("Error deleting route to %v: %v", r.Dst, err)
+		}
+	}
+	return ok
+}
+
+// directRoutes returns a copy of the direct routes
+func (n *network) directRoutes() []netlink.Route {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	var routes []netlink.Route
+	for _, rs := range n.direct {
+		routes = append(routes, rs...)
+	}
+	return routes
+}
+
+// routeCount is the number of other hosts routed to, either way
+func (n *network) routeCount() int {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return len(n.rts) + len(n.direct)
+}
+
+// addDirectRoute adds a route, replacing one to the same destination via
+// another gateway
+func addDirectRoute(route netlink.Route) error {
+	family := netlink.FAMILY_V4
+	if route.Dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	existing, err := netlink.RouteListFiltered(family, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Warningf("Unable to list routes: %v", err)
+	}
+	if len(existing) > 0 {
+		if existing[0].Gw.Equal(route.Gw) && existing[0].LinkIndex == route.LinkIndex {
+			return nil
+		}
+		log.Warningf("Replacing existing route to %v via %v with %v via %v.", route.Dst, existing[0].Gw, route.Dst, route.Gw)
+		if err := netlink.RouteDel(&existing[0]); err != nil {
+			return err
+		}
+	}
+	return netlink.RouteAdd(&route)
+}
+
+// routesEqual tells whether the routes go to the same destinations via the
+// same gateways and links, in the same order
+func routesEqual(x, y []netlink.Route) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !x[i].Dst.IP.Equal(y[i].Dst.IP) || !bytes.Equal(x[i].Dst.Mask, y[i].Dst.Mask) || !x[i].Gw.Equal(y[i].Gw) || x[i].LinkIndex != y[i].LinkIndex {
+			return false
+		}
+	}
+	return true
+}
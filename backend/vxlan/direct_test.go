@@ -0,0 +1,211 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func testRoute(dst, gw string, link int) netlink.Route {
+	_, ipn, err := net.ParseCIDR(dst)
+	if err != nil {
+		panic(err)
+	}
+	return netlink.Route{Dst: ipn, Gw: net.ParseIP(gw), LinkIndex: link}
+}
+
+func TestRoutesEqual(t *testing.T) {
+	routes := []netlink.Route{
+		testRoute("10.3.8.0/24", "192.168.1.11", 2),
+		testRoute("fd00:10:0:8::/64", "fd00:1::11", 2),
+	}
+
+	for _, tc := range []struct {
+		other []netlink.Route
+		equal bool
+	}{
+		{
+			[]netlink.Route{
+				testRoute("10.3.8.0/24", "192.168.1.11", 2),
+				testRoute("fd00:10:0:8::/64", "fd00:1::11", 2),
+			},
+			true,
+		},
+		{
+			// another link
+			[]netlink.Route{
+				testRoute("10.3.8.0/24", "192.168.1.11", 3),
+				testRoute("fd00:10:0:8::/64", "fd00:1::11", 3),
+			},
+			false,
+		},
+		{
+			// another gateway
+			[]netlink.Route{
+				testRoute("10.3.8.0/24", "192.168.1.12", 2),
+				testRoute("fd00:10:0:8::/64", "fd00:1::11", 2),
+			},
+			false,
+		},
+		{
+			// another mask
+			[]netlink.Route{
+				testRoute("10.3.8.0/25", "192.168.1.11", 2),
+				testRoute("fd00:10:0:8::/64", "fd00:1::11", 2),
+			},
+			false,
+		},
+		{
+			// another order
+			[]netlink.Route{
+				testRoute("fd00:10:0:8::/64", "fd00:1::11", 2),
+				testRoute("10.3.8.0/24", "192.168.1.11", 2),
+			},
+			false,
+		},
+		{
+			// the IPv4 route only
+			[]netlink.Route{testRoute("10.3.8.0/24", "192.168.1.11", 2)},
+			false,
+		},
+		{nil, false},
+	} {
+		if got := routesEqual(routes, tc.other); got != tc.equal {
+			t.Errorf("routesEqual(%v, %v) = %v, want %v", routes, tc.other, got, tc.equal)
+		}
+	}
+}
+
+func TestDirectRoutesTo(t *testing.T) {
+	defer setUpNetns(t)()
+	extIface := newTestExtIface(t)
+	n := newTestNetwork(t, extIface, false)
+	link := extIface.Iface.Index
+
+	l := peerLease(t, "10.3.8.0/24", "192.168.1.11", "", "", "0a:00:00:00:00:08")
+	if _, ok := n.directRoutesTo(&l); ok {
+		t.Errorf("routing %v directly without DirectRouting", l.Subnet)
+	}
+	n.directRouting = true
+
+	for _, tc := range []struct {
+		lease  subnet.Lease
+		routes []netlink.Route
+	}{
+		{
+			peerLease(t, "10.3.8.0/24", "192.168.1.11", "", "", "0a:00:00:00:00:08"),
+			[]netlink.Route{testRoute("10.3.8.0/24", "192.168.1.11", link)},
+		},
+		{
+			// not on our L2 segment
+			peerLease(t, "10.3.9.0/24", "192.168.2.11", "", "", "0a:00:00:00:00:09"),
+			nil,
+		},
+		{
+			peerLease(t, "10.3.8.0/24", "192.168.1.11", "fd00:10:0:8::/64", "fd00:1::11", "0a:00:00:00:00:08"),
+			[]netlink.Route{
+				testRoute("10.3.8.0/24", "192.168.1.11", link),
+				testRoute("fd00:10:0:8::/64", "fd00:1::11", link),
+			},
+		},
+		{
+			// both subnets or neither are routed directly
+			peerLease(t, "10.3.8.0/24", "192.168.1.11", "fd00:10:0:8::/64", "", "0a:00:00:00:00:08"),
+			nil,
+		},
+		{
+			peerLease(t, "10.3.8.0/24", "192.168.1.11", "fd00:10:0:8::/64", "fd00:2::11", "0a:00:00:00:00:08"),
+			nil,
+		},
+	} {
+		routes, ok := n.directRoutesTo(&tc.lease)
+		if ok != (tc.routes != nil) || !routesEqual(routes, tc.routes) {
+			t.Errorf("directRoutesTo(%v via %v) = %v, %v, want %v", tc.lease.Subnet, tc.lease.Attrs.PublicIP, routes, ok, tc.routes)
+		}
+	}
+}
+
+func TestSetDirect(t *testing.T) {
+	defer setUpNetns(t)()
+	extIface := newTestExtIface(t)
+	n := newTestNetwork(t, extIface, false)
+
+	// the host is reached through the device at first
+	l := peerLease(t, "10.3.8.0/24", "192.168.1.11", "", "", "0a:00:00:00:00:08")
+	n.handleSubnetEvents(added(l))
+	if fdb := kernelFDB(t, n); fdb["192.168.1.11"] != "0a:00:00:00:00:08" {
+		t.Fatalf("FDB entries are %v, want one for 192.168.1.11", fdb)
+	}
+
+	// then directly
+	n.directRouting = true
+	n.handleSubnetEvents(added(l))
+	if fdb := kernelFDB(t, n); fdb["192.168.1.11"] != "" {
+		t.Errorf("FDB entry for 192.168.1.11 left after routing it directly: %v", fdb)
+	}
+	if _, ok := n.fdb[l.Attrs.PublicIP]; ok {
+		t.Errorf("FDB entry for 192.168.1.11 still recorded after routing it directly")
+	}
+	if _, ok := n.rts.find(l.Subnet); ok {
+		t.Errorf("route to %v through the device still recorded after routing it directly", l.Subnet)
+	}
+	r, ok := kernelRoute(t, "10.3.8.0/24")
+	if !ok || !r.Gw.Equal(net.ParseIP("192.168.1.11")) || r.LinkIndex != extIface.Iface.Index {
+		t.Errorf("route to 10.3.8.0/24 is %v, want one via 192.168.1.11 on ext0", r)
+	}
+	if routes := n.directRoutes(); len(routes) != 1 {
+		t.Errorf("direct routes are %v, want one", routes)
+	}
+
+	// setting the same routes again changes nothing
+	n.handleSubnetEvents(added(l))
+	if routes := n.directRoutes(); len(routes) != 1 {
+		t.Errorf("direct routes are %v after adding the lease again, want one", routes)
+	}
+	if _, ok := kernelRoute(t, "10.3.8.0/24"); !ok {
+		t.Errorf("route to 10.3.8.0/24 deleted after adding the lease again")
+	}
+
+	// and through the device again once it moved off the segment
+	moved := peerLease(t, "10.3.8.0/24", "192.168.2.11", "", "", "0a:00:00:00:00:08")
+	n.handleSubnetEvents(added(moved))
+	if routes := n.directRoutes(); len(routes) != 0 {
+		t.Errorf("direct routes are %v after the host moved, want none", routes)
+	}
+	if r, ok := kernelRoute(t, "10.3.8.0/24"); ok {
+		t.Errorf("direct route %v left after the host moved", r)
+	}
+	if fdb := kernelFDB(t, n); fdb["192.168.2.11"] != "0a:00:00:00:00:08" {
+		t.Errorf("FDB entries are %v, want one for 192.168.2.11", fdb)
+	}
+	if _, ok := n.rts.find(l.Subnet); !ok {
+		t.Errorf("route to %v through the device not recorded after the host moved", l.Subnet)
+	}
+
+	// removing a lease routed directly deletes its routes
+	n.handleSubnetEvents(added(l))
+	n.handleSubnetEvents(removed(l))
+	if n.routeCount() != 0 {
+		t.Errorf("%d hosts routed to after removing the lease", n.routeCount())
+	}
+	if r, ok := kernelRoute(t, "10.3.8.0/24"); ok {
+		t.Errorf("direct route %v left after removing the lease", r)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+var l3Misses = metrics.NewCounterVec("flannel_vxlan_l3_misses_total",
+	"Number of L3 misses handled on the VXLAN device of a network, by result (resolved, no_route or failed).", "network", "result")
+
+var repaired = metrics.NewCounterVec("flannel_vxlan_repairs_total",
+	"Number of devices, routes, FDB and neighbor entries of a network found drifted from the leases and repaired, by kind.", "network", "kind")
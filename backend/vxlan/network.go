@@ -38,28 +38,58 @@ type network struct {
 	dev      *vxlanDevice
 	rts      routes
 	sm       subnet.Manager
+	config   *subnet.Config
+	// release tells the backend the network is gone, freeing its VNI
+	release func()
+
+	// devRoutes are the routes to the network's blocks through the device
+	devRoutes []*net.IPNet
+	// directRouting routes to the hosts on the same L2 segment without
+	// encapsulation
+	directRouting bool
+	// proactive programs the neighbor entries for the other hosts up front
+	// instead of on L3 misses
+	proactive bool
+
+	// mux guards fdb, direct, devRoutes, the updates of rts and the
+	// recreation of the device, which Programmed and Installed read while
+	// Run updates them
+	mux sync.Mutex
+	// fdb has the FDB entries added for the other hosts by public IP
+	fdb map[ip.IP4]neigh
+	// direct has the routes added for the hosts routed to directly, by
+	// subnet
+	direct map[ip.IP4Net][]netlink.Route
 }
 
-func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
+func newNetwork(name string, sm subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, config *subnet.Config, l *subnet.Lease) (*network, error) {
 	n := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: l,
 			ExtIface:    extIface,
 		},
-		name: name,
-		sm:   sm,
-		dev:  dev,
+		name:     name,
+		extIface: extIface,
+		sm:       sm,
+		dev:      dev,
+		config:   config,
+		fdb:      make(map[ip.IP4]neigh),
+		direct:   make(map[ip.IP4Net][]netlink.Route),
 	}
 
 	return n, nil
 }
 
 func (n *network) Run(ctx context.Context) {
-	log.Info("Watching for L3 misses")
-	misses := make(chan *netlink.Neigh, 100)
-	// Unfrtunately MonitorMisses does not take a cancel channel
-	// as there's no wait to interrupt netlink socket recv
-	go n.dev.MonitorMisses(misses)
+	// misses stays nil with ProactiveNeighbors, there are none to handle
+	var misses chan *netlink.Neigh
+	if !n.proactive {
+		log.Info("Watching for L3 misses")
+		misses = make(chan *netlink.Neigh, 100)
+		// Unfrtunately MonitorMisses does not take a cancel channel
+		// as there's no wait to interrupt netlink socket recv
+		go n.dev.MonitorMisses(misses)
+	}
 
 	wg := sync.WaitGroup{}
 
@@ -73,7 +103,15 @@ func (n *network) Run(ctx context.Context) {
 	}()
 
 	defer wg.Wait()
-	initialEvtsBatch := <-evts
+	defer backend.Routes.Delete(n.name)
+
+	var initialEvtsBatch []subnet.Event
+	select {
+	case initialEvtsBatch = <-evts:
+	case <-ctx.Done():
+		return
+	}
+
 	for {
 		err := n.handleInitialSubnetEvents(initialEvtsBatch)
 		if err == nil {
@@ -82,6 +120,17 @@ func (n *network) Run(ctx context.Context) {
 		log.Error(err, " About to retry")
 		time.Sleep(time.Second)
 	}
+	subnet.LeasesHandled(n.name)
+	backend.Routes.Set(float64(n.routeCount()), n.name)
+
+	log.Info("Watching for changes of the device")
+	changes := make(chan int, 100)
+	go n.dev.MonitorChanges(changes, n.proactive, ctx.Done())
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	// pending fires once the notifications of a change are in
+	var pending <-chan time.Time
 
 	for {
 		select {
@@ -90,6 +139,19 @@ func (n *network) Run(ctx context.Context) {
 
 		case evtBatch := <-evts:
 			n.handleSubnetEvents(evtBatch)
+			backend.Routes.Set(float64(n.routeCount()), n.name)
+
+		case index := <-changes:
+			if pending == nil && (index == n.dev.link.Index || index == n.extIface.Iface.Index) {
+				pending = time.After(reconcileDelay)
+			}
+
+		case <-pending:
+			pending = nil
+			n.reconcile()
+
+		case <-ticker.C:
+			n.reconcile()
 
 		case <-ctx.Done():
 			return
@@ -101,6 +163,32 @@ func (n *network) MTU() int {
 	return n.dev.MTU()
 }
 
+// Cleanup deletes the direct routes and the VXLAN device on teardown, the
+// latter taking its addresses, routes and neighbor entries with it
+func (n *network) Cleanup(teardown bool) error {
+	if n.release != nil {
+		defer n.release()
+	}
+	if !teardown {
+		return nil
+	}
+
+	if routes := n.directRoutes(); len(routes) > 0 {
+		log.Infof("Deleting %d direct routes to other hosts", len(routes))
+		for _, r := range routes {
+			if err := netlink.RouteDel(&r); err != nil {
+				log.Errorf("Error deleting route to %v: %v", r.Dst, err)
+			}
+		}
+	}
+
+	log.Infof("Deleting %v", n.dev.link.Attrs().Name)
+	if err := n.dev.Destroy(); err != nil {
+		return fmt.Errorf("failed to delete %v: %v", n.dev.link.Attrs().Name, err)
+	}
+	return nil
+}
+
 type vxlanLeaseAttrs struct {
 	VtepMAC hardwareAddr
 }
@@ -121,8 +209,16 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				log.Error("Error decoding subnet lease JSON: ", err)
 				continue
 			}
-			n.rts.set(evt.Lease.Subnet, net.HardwareAddr(attrs.VtepMAC))
-			n.dev.AddL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
+
+			if routes, ok := n.directRoutesTo(&evt.Lease); ok {
+				n.setDirect(&evt.Lease, routes)
+				continue
+			}
+			if n.delDirect(evt.Lease.Subnet) {
+				log.Infof("Routing %v through %v instead of directly", evt.Lease.Subnet, n.dev.link.Attrs().Name)
+			}
+			n.setRoute(&evt.Lease, net.HardwareAddr(attrs.VtepMAC))
+			n.addL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
 
 		case subnet.EventRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
@@ -132,6 +228,10 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				continue
 			}
 
+			if n.delDirect(evt.Lease.Subnet) {
+				continue
+			}
+
 			var attrs vxlanLeaseAttrs
 			if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &attrs); err != nil {
 				log.Error("Error decoding subnet lease JSON: ", err)
@@ -139,9 +239,9 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 			}
 
 			if len(attrs.VtepMAC) > 0 {
-				n.dev.DelL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
+				n.delL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(attrs.VtepMAC)})
 			}
-			n.rts.remove(evt.Lease.Subnet)
+			n.removeRoute(evt.Lease.Subnet)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -177,19 +277,27 @@ func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 			continue
 		}
 
+		// the FDB entries of the hosts routed to directly are stale
+		if routes, ok := n.directRoutesTo(&evt.Lease); ok {
+			n.setDirect(&evt.Lease, routes)
+			evtMarker[i] = true
+			continue
+		}
+
 		for j, fdbEntry := range fdbTable {
 			if evt.Lease.Attrs.PublicIP.ToIP().Equal(fdbEntry.IP) && bytes.Equal([]byte(leaseAttrsList[i].VtepMAC), []byte(fdbEntry.HardwareAddr)) {
 				evtMarker[i] = true
 				fdbEntryMarker[j] = true
+				n.recordL2(neigh{IP: evt.Lease.Attrs.PublicIP, MAC: fdbEntry.HardwareAddr})
 				break
 			}
 		}
-		n.rts.set(evt.Lease.Subnet, net.HardwareAddr(leaseAttrsList[i].VtepMAC))
+		n.setRoute(&evt.Lease, net.HardwareAddr(leaseAttrsList[i].VtepMAC))
 	}
 
 	for j, marker := range fdbEntryMarker {
 		if !marker && fdbTable[j].IP != nil {
-			err := n.dev.DelL2(neigh{IP: ip.FromIP(fdbTable[j].IP), MAC: fdbTable[j].HardwareAddr})
+			err := n.delL2(neigh{IP: ip.FromIP(fdbTable[j].IP), MAC: fdbTable[j].HardwareAddr})
 			if err != nil {
 				log.Error("Delete L2 failed: ", err)
 			}
@@ -198,7 +306,7 @@ func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 
 	for i, marker := range evtMarker {
 		if !marker {
-			err := n.dev.AddL2(neigh{IP: batch[i].Lease.Attrs.PublicIP, MAC: net.HardwareAddr(leaseAttrsList[i].VtepMAC)})
+			err := n.addL2(neigh{IP: batch[i].Lease.Attrs.PublicIP, MAC: net.HardwareAddr(leaseAttrsList[i].VtepMAC)})
 			if err != nil {
 				log.Error("Add L2 failed: ", err)
 			}
@@ -208,6 +316,204 @@ func (n *network) handleInitialSubnetEvents(batch []subnet.Event) error {
 	return nil
 }
 
+// addL2 adds the FDB entry for another host and records it
+func (n *network) addL2(nb neigh) error {
+	if err := n.dev.AddL2(nb); err != nil {
+		return err
+	}
+	n.recordL2(nb)
+	return nil
+}
+
+func (n *network) recordL2(nb neigh) {
+	n.mux.Lock()
+	n.fdb[nb.IP] = nb
+	n.mux.Unlock()
+}
+
+// delL2 deletes the FDB entry for another host and forgets it
+func (n *network) delL2(nb neigh) error {
+	n.mux.Lock()
+	delete(n.fdb, nb.IP)
+	n.mux.Unlock()
+
+	return n.dev.DelL2(nb)
+}
+
+// Programmed returns the routes through the device, the direct routes and
+// the FDB entries for the other hosts, and with ProactiveNeighbors their
+// neighbor entries. The neighbor entries resolved on L3 misses age out and
+// aren't included.
+func (n *network) Programmed() backend.Dataplane {
+	var dp backend.Dataplane
+	name := n.dev.attrs.name
+
+	for _, r := range n.wantRoutes() {
+		dp.Routes = append(dp.Routes, backend.NewRoute(r, n.linkName(r.LinkIndex)))
+	}
+	for _, nb := range n.wantNeighbors() {
+		dp.Neighbors = append(dp.Neighbors, backend.NewNeighbor(nb.IP, nb.HardwareAddr, name))
+	}
+
+	n.mux.Lock()
+	for _, nb := range n.fdb {
+		dp.FDB = append(dp.FDB, backend.NewNeighbor(nb.IP.ToIP(), nb.MAC, name))
+	}
+	n.mux.Unlock()
+
+	return dp
+}
+
+// Installed reads the routes and FDB entries of the device from the kernel,
+// with ProactiveNeighbors its permanent neighbor entries and with
+// DirectRouting the routes on the external interface to the hosts routed to
+// directly
+func (n *network) Installed() (backend.Dataplane, error) {
+	var dp backend.Dataplane
+	name := n.dev.attrs.name
+	direct := n.directRoutes()
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	routes, err := n.installedRoutes(direct)
+	if err != nil {
+		return dp, err
+	}
+	for _, r := range routes {
+		dp.Routes = append(dp.Routes, backend.NewRoute(r, n.linkName(r.LinkIndex)))
+	}
+
+	if n.proactive {
+		neighs, err := n.installedNeighbors()
+		if err != nil {
+			return dp, err
+		}
+		for _, nb := range neighs {
+			dp.Neighbors = append(dp.Neighbors, backend.NewNeighbor(nb.IP, nb.HardwareAddr, name))
+		}
+	}
+
+	fdb, err := n.dev.GetL2List()
+	if err != nil {
+		return dp, fmt.Errorf("failed to list FDB entries: %v", err)
+	}
+	for _, e := range fdb {
+		if e.IP != nil {
+			dp.FDB = append(dp.FDB, backend.NewNeighbor(e.IP, e.HardwareAddr, name))
+		}
+	}
+
+	return dp, nil
+}
+
+// wantRoutes returns the routes to the other hosts: through the device to
+// the blocks of the network or, with ProactiveNeighbors, to each host, and
+// the direct ones
+func (n *network) wantRoutes() []netlink.Route {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	var want []netlink.Route
+	for _, dst := range n.devRoutes {
+		want = append(want, netlink.Route{LinkIndex: n.dev.link.Index, Dst: dst})
+	}
+	if n.proactive {
+		for _, rt := range n.rts {
+			want = append(want, n.peerRoutes(rt)...)
+		}
+	}
+	for _, rs := range n.direct {
+		want = append(want, rs...)
+	}
+	return want
+}
+
+// wantNeighbors returns the neighbor entries for the other hosts with
+// ProactiveNeighbors
+func (n *network) wantNeighbors() []netlink.Neigh {
+	if !n.proactive {
+		return nil
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	var want []netlink.Neigh
+	for _, rt := range n.rts {
+		want = append(want, n.peerNeighbors(rt)...)
+	}
+	return want
+}
+
+// installedRoutes reads the routes through the device and those on the
+// external interface to the destinations of the direct routes from the
+// kernel. Other routes on the external interface aren't flannel's, even if
+// they go into the network.
+func (n *network) installedRoutes(direct []netlink.Route) ([]netlink.Route, error) {
+	var have []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(n.dev.link, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %v", err)
+		}
+		for _, r := range routes {
+			if r.Dst == nil || r.Dst.IP.IsLinkLocalUnicast() || n.isOwnAddr(r.Dst) {
+				continue
+			}
+			have = append(have, r)
+		}
+	}
+
+	for _, d := range direct {
+		family := netlink.FAMILY_V4
+		if d.Dst.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{LinkIndex: d.LinkIndex, Dst: d.Dst}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_DST)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %v", err)
+		}
+		have = append(have, routes...)
+	}
+	return have, nil
+}
+
+// installedNeighbors reads the permanent neighbor entries of the device from
+// the kernel
+func (n *network) installedNeighbors() ([]netlink.Neigh, error) {
+	var have []netlink.Neigh
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		neighs, err := n.dev.GetNeighList(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list neighbor entries: %v", err)
+		}
+		have = append(have, neighs...)
+	}
+	return have, nil
+}
+
+// linkName returns the name of the device or of the external interface
+func (n *network) linkName(index int) string {
+	if index == n.extIface.Iface.Index {
+		return n.extIface.Iface.Name
+	}
+	return n.dev.attrs.name
+}
+
+// isOwnAddr tells whether dst is the host route to the address of the
+// device, which the kernel adds for IPv6
+func (n *network) isOwnAddr(dst *net.IPNet) bool {
+	ones, bits := dst.Mask.Size()
+	if ones != bits {
+		return false
+	}
+	if dst.IP.To4() != nil {
+		return ip.FromIP(dst.IP) == n.SubnetLease.Subnet.IP
+	}
+	return !n.SubnetLease.IPv6Subnet.Empty() && ip.FromIP6(dst.IP) == n.SubnetLease.IPv6Subnet.IP
+}
+
 func (n *network) handleMiss(miss *netlink.Neigh) {
 	switch {
 	case len(miss.IP) == 0 && len(miss.HardwareAddr) == 0:
@@ -224,15 +530,40 @@ func (n *network) handleMiss(miss *netlink.Neigh) {
 func (n *network) handleL3Miss(miss *netlink.Neigh) {
 	log.Infof("L3 miss: %v", miss.IP)
 
+	if miss.IP.To4() == nil {
+		n.handleV6L3Miss(miss)
+		return
+	}
+
 	rt := n.rts.findByNetwork(ip.FromIP(miss.IP))
 	if rt == nil {
 		log.Infof("Route for %v not found", miss.IP)
+		l3Misses.Inc(n.name, "no_route")
 		return
 	}
 
 	if err := n.dev.AddL3(neigh{IP: ip.FromIP(miss.IP), MAC: rt.vtepMAC}); err != nil {
 		log.Errorf("AddL3 failed: %v", err)
+		l3Misses.Inc(n.name, "failed")
 	} else {
 		log.Info("AddL3 succeeded")
+		l3Misses.Inc(n.name, "resolved")
+	}
+}
+
+func (n *network) handleV6L3Miss(miss *netlink.Neigh) {
+	rt := n.rts.findByNetwork6(ip.FromIP6(miss.IP))
+	if rt == nil {
+		log.Infof("Route for %v not found", miss.IP)
+		l3Misses.Inc(n.name, "no_route")
+		return
+	}
+
+	if err := n.dev.AddV6L3(neigh6{IP: ip.FromIP6(miss.IP), MAC: rt.vtepMAC}); err != nil {
+		log.Errorf("AddV6L3 failed: %v", err)
+		l3Misses.Inc(n.name, "failed")
+	} else {
+		log.Info("AddV6L3 succeeded")
+		l3Misses.Inc(n.name, "resolved")
 	}
 }
@@ -0,0 +1,248 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The tests that program the kernel run in a network namespace of their
+// own, with the external interface ext0 on 192.168.1.10/24 and
+// fd00:1::10/64, and need root.
+
+const testConfig = `{ "Network": "10.3.0.0/16", "IPv6Network": "fd00:10::/48", "Backend": { "Type": "vxlan" } }`
+
+// setUpNetns switches the test to a new network namespace and returns the
+// function that switches it back
+func setUpNetns(t *testing.T) func() {
+	if os.Getuid() != 0 {
+		t.Skip("programming the kernel needs root")
+	}
+
+	runtime.LockOSThread()
+	origns, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("failed to get the network namespace: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origns.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("failed to create a network namespace: %v", err)
+	}
+
+	return func() {
+		ns.Close()
+		netns.Set(origns)
+		origns.Close()
+		runtime.UnlockOSThread()
+	}
+}
+
+// newTestExtIface sets up ext0 and its peer
+func newTestExtIface(t *testing.T) *backend.ExternalInterface {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ext0"}, PeerName: "ext1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatalf("failed to add ext0: %v", err)
+	}
+	link, err := netlink.LinkByName("ext0")
+	if err != nil {
+		t.Fatalf("failed to find ext0: %v", err)
+	}
+	for _, addr := range []string{"192.168.1.10/24", "fd00:1::10/64"} {
+		a, err := netlink.ParseAddr(addr)
+		if err != nil {
+			t.Fatalf("failed to parse %v: %v", addr, err)
+		}
+		if err := netlink.AddrAdd(link, a); err != nil {
+			t.Fatalf("failed to add %v to ext0: %v", addr, err)
+		}
+	}
+	for _, name := range []string{"ext0", "ext1"} {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("failed to find %v: %v", name, err)
+		}
+		if err := netlink.LinkSetUp(l); err != nil {
+			t.Fatalf("failed to set %v up: %v", name, err)
+		}
+	}
+
+	iface, err := net.InterfaceByName("ext0")
+	if err != nil {
+		t.Fatalf("failed to look up ext0: %v", err)
+	}
+	return &backend.ExternalInterface{
+		Iface:     iface,
+		IfaceAddr: net.ParseIP("192.168.1.10"),
+		ExtAddr:   net.ParseIP("192.168.1.10"),
+	}
+}
+
+// newTestNetwork sets up the device of a network with the lease 10.3.7.0/24
+// and fd00:10:0:7::/64 in the namespace of setUpNetns
+func newTestNetwork(t *testing.T, extIface *backend.ExternalInterface, proactive bool) *network {
+	config, err := subnet.ParseConfig(testConfig)
+	if err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+
+	dev, err := newVXLANDevice(&vxlanDeviceAttrs{
+		vni:        1,
+		name:       "flannel.1",
+		vtepIndex:  extIface.Iface.Index,
+		vtepAddr:   extIface.IfaceAddr,
+		appSolicit: !proactive,
+		mac:        vtepMAC(extIface.ExtAddr, 1),
+	})
+	if err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+
+	l := &subnet.Lease{
+		Subnet:     mustParseIP4Net(t, "10.3.7.0/24"),
+		IPv6Subnet: mustParseIP6Net(t, "fd00:10:0:7::/64"),
+		Attrs:      subnet.LeaseAttrs{PublicIP: ip.FromIP(extIface.ExtAddr)},
+	}
+	n, err := newNetwork("", nil, extIface, dev, config, l)
+	if err != nil {
+		t.Fatalf("newNetwork failed: %v", err)
+	}
+	n.proactive = proactive
+	if err := n.configureDevice(); err != nil {
+		t.Fatalf("failed to configure the device: %v", err)
+	}
+	return n
+}
+
+func mustParseIP4Net(t *testing.T, s string) ip.IP4Net {
+	_, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", s, err)
+	}
+	return ip.FromIPNet(ipn)
+}
+
+func mustParseIP6Net(t *testing.T, s string) ip.IP6Net {
+	_, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", s, err)
+	}
+	return ip.FromIP6Net(ipn)
+}
+
+func mustParseMAC(t *testing.T, s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", s, err)
+	}
+	return mac
+}
+
+// peerLease returns the lease of another host, dual-stack if sn6 is set
+func peerLease(t *testing.T, sn, publicIP, sn6, publicIPv6, mac string) subnet.Lease {
+	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(mustParseMAC(t, mac))})
+	if err != nil {
+		t.Fatalf("failed to marshal the lease attrs: %v", err)
+	}
+	l := subnet.Lease{
+		Subnet: mustParseIP4Net(t, sn),
+		Attrs: subnet.LeaseAttrs{
+			PublicIP:    ip.MustParseIP4(publicIP),
+			BackendType: "vxlan",
+			BackendData: json.RawMessage(data),
+		},
+	}
+	if sn6 != "" {
+		l.IPv6Subnet = mustParseIP6Net(t, sn6)
+	}
+	if publicIPv6 != "" {
+		ip6 := ip.MustParseIP6(publicIPv6)
+		l.Attrs.PublicIPv6 = &ip6
+	}
+	return l
+}
+
+func added(l subnet.Lease) []subnet.Event {
+	return []subnet.Event{{Type: subnet.EventAdded, Lease: l}}
+}
+
+func removed(l subnet.Lease) []subnet.Event {
+	return []subnet.Event{{Type: subnet.EventRemoved, Lease: l}}
+}
+
+// kernelFDB returns the FDB entries of the device as IP to MAC
+func kernelFDB(t *testing.T, n *network) map[string]string {
+	neighs, err := n.dev.GetL2List()
+	if err != nil {
+		t.Fatalf("failed to list the FDB entries: %v", err)
+	}
+	fdb := make(map[string]string)
+	for _, nb := range neighs {
+		if nb.IP != nil {
+			fdb[nb.IP.String()] = nb.HardwareAddr.String()
+		}
+	}
+	return fdb
+}
+
+// kernelRoute returns the route to dst, if there is one
+func kernelRoute(t *testing.T, dst string) (netlink.Route, bool) {
+	_, ipn, err := net.ParseCIDR(dst)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", dst, err)
+	}
+	family := netlink.FAMILY_V4
+	if ipn.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Dst: ipn}, netlink.RT_FILTER_DST)
+	if err != nil {
+		t.Fatalf("failed to list the routes: %v", err)
+	}
+	if len(routes) == 0 {
+		return netlink.Route{}, false
+	}
+	return routes[0], true
+}
+
+// kernelNeighbors returns the permanent neighbor entries of the device as IP
+// to MAC
+func kernelNeighbors(t *testing.T, n *network) map[string]string {
+	neighs := make(map[string]string)
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		nbs, err := n.dev.GetNeighList(family)
+		if err != nil {
+			t.Fatalf("failed to list the neighbor entries: %v", err)
+		}
+		for _, nb := range nbs {
+			neighs[nb.IP.String()] = nb.HardwareAddr.String()
+		}
+	}
+	return neighs
+}
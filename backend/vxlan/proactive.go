@@ -0,0 +1,144 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// With ProactiveNeighbors, the device only has the host's own address and
+// every other host gets a route to its subnet via the first address of the
+// subnet, with a permanent neighbor entry resolving that address to the
+// host's VTEP MAC. Nothing is left to resolve on L3 misses.
+
+// setRoute records the route to another host through the device and, with
+// ProactiveNeighbors, programs its gateway routes and neighbor entries
+func (n *network) setRoute(l *subnet.Lease, mac net.HardwareAddr) {
+	n.mux.Lock()
+	old, ok := n.rts.find(l.Subnet)
+	n.rts.set(l.Subnet, l.IPv6Subnet, mac, l.Attrs.PublicIP)
+	n.mux.Unlock()
+
+	if ok && (old.publicIP != l.Attrs.PublicIP || !bytes.Equal(old.vtepMAC, mac)) {
+		log.Infof("VTEP of %v changed from %v %v to %v %v", l.Subnet, old.publicIP, old.vtepMAC, l.Attrs.PublicIP, mac)
+		n.forgetVTEP(old)
+	}
+
+	if !n.proactive {
+		return
+	}
+	rt := route{l.Subnet, l.IPv6Subnet, mac, l.Attrs.PublicIP}
+	for _, nb := range n.peerNeighbors(rt) {
+		if err := n.dev.SetNeigh(nb); err != nil {
+			log.Errorf("Error adding neighbor entry for %v: %v", nb.IP, err)
+		}
+	}
+	for _, r := range n.peerRoutes(rt) {
+		if err := netlink.RouteAdd(&r); err != nil && err != syscall.EEXIST {
+			log.Errorf("Error adding route to %v via %v: %v", r.Dst, r.Gw, err)
+		}
+	}
+}
+
+// forgetVTEP deletes the FDB entry of the VTEP a route was to and the
+// neighbor entries resolving to its MAC, which would send traffic to where
+// the host no longer is
+func (n *network) forgetVTEP(rt route) {
+	n.mux.Lock()
+	nb, ok := n.fdb[rt.publicIP]
+	n.mux.Unlock()
+
+	if ok && bytes.Equal(nb.MAC, rt.vtepMAC) {
+		if err := n.delL2(nb); err != nil {
+			log.Error("Delete L2 failed: ", err)
+		}
+	}
+	if err := n.dev.DelNeighsTo(rt.vtepMAC); err != nil {
+		log.Errorf("Error deleting the neighbor entries for %v: %v", rt.vtepMAC, err)
+	}
+}
+
+// removeRoute forgets the route to a subnet through the device and deletes
+// what setRoute programmed for it
+func (n *network) removeRoute(sn ip.IP4Net) {
+	n.mux.Lock()
+	rt, ok := n.rts.find(sn)
+	n.rts.remove(sn)
+	n.mux.Unlock()
+
+	if !n.proactive || !ok {
+		return
+	}
+	for _, r := range n.peerRoutes(rt) {
+		if err := netlink.RouteDel(&r); err != nil {
+			log.Errorf("Error deleting route to %v: %v", r.Dst, err)
+		}
+	}
+	for _, nb := range n.peerNeighbors(rt) {
+		if err := n.dev.DelNeigh(nb); err != nil {
+			log.Errorf("Error deleting neighbor entry for %v: %v", nb.IP, err)
+		}
+	}
+}
+
+// peerRoutes returns the routes to the subnets of another host via their
+// first addresses
+func (n *network) peerRoutes(rt route) []netlink.Route {
+	r := netlink.Route{
+		LinkIndex: n.dev.link.Index,
+		Dst:       rt.network.ToIPNet(),
+		Gw:        rt.network.IP.ToIP(),
+	}
+	r.SetFlag(netlink.FLAG_ONLINK)
+	routes := []netlink.Route{r}
+
+	if !rt.network6.Empty() && !n.SubnetLease.IPv6Subnet.Empty() {
+		r6 := netlink.Route{
+			LinkIndex: n.dev.link.Index,
+			Dst:       rt.network6.ToIPNet(),
+			Gw:        rt.network6.IP.ToIP(),
+		}
+		r6.SetFlag(netlink.FLAG_ONLINK)
+		routes = append(routes, r6)
+	}
+	return routes
+}
+
+// peerNeighbors returns the neighbor entries resolving the gateways of
+// peerRoutes to the VTEP MAC of another host
+func (n *network) peerNeighbors(rt route) []netlink.Neigh {
+	neighs := []netlink.Neigh{{
+		Family:       syscall.AF_INET,
+		IP:           rt.network.IP.ToIP(),
+		HardwareAddr: rt.vtepMAC,
+	}}
+
+	if !rt.network6.Empty() && !n.SubnetLease.IPv6Subnet.Empty() {
+		neighs = append(neighs, netlink.Neigh{
+			Family:       syscall.AF_INET6,
+			IP:           rt.network6.IP.ToIP(),
+			HardwareAddr: rt.vtepMAC,
+		})
+	}
+	return neighs
+}
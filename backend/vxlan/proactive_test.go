@@ -0,0 +1,259 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestPeerRoutes(t *testing.T) {
+	dualStack := &subnet.Lease{
+		Subnet:     mustParseIP4Net(t, "10.3.7.0/24"),
+		IPv6Subnet: mustParseIP6Net(t, "fd00:10:0:7::/64"),
+	}
+	ipv4Only := &subnet.Lease{Subnet: mustParseIP4Net(t, "10.3.7.0/24")}
+	mac := mustParseMAC(t, "0a:00:00:00:00:08")
+	peer := route{network: mustParseIP4Net(t, "10.3.8.0/24"), vtepMAC: mac}
+	dualPeer := route{network: peer.network, network6: mustParseIP6Net(t, "fd00:10:0:8::/64"), vtepMAC: mac}
+
+	for _, tc := range []struct {
+		own    *subnet.Lease
+		peer   route
+		routes []string
+		neighs []string
+	}{
+		{
+			ipv4Only, peer,
+			[]string{"10.3.8.0/24 via 10.3.8.0"},
+			[]string{"10.3.8.0 is 0a:00:00:00:00:08"},
+		},
+		{
+			dualStack, peer,
+			[]string{"10.3.8.0/24 via 10.3.8.0"},
+			[]string{"10.3.8.0 is 0a:00:00:00:00:08"},
+		},
+		{
+			dualStack, dualPeer,
+			[]string{"10.3.8.0/24 via 10.3.8.0", "fd00:10:0:8::/64 via fd00:10:0:8::"},
+			[]string{"10.3.8.0 is 0a:00:00:00:00:08", "fd00:10:0:8:: is 0a:00:00:00:00:08"},
+		},
+		{
+			// without an IPv6 address of our own the device can't route IPv6
+			ipv4Only, dualPeer,
+			[]string{"10.3.8.0/24 via 10.3.8.0"},
+			[]string{"10.3.8.0 is 0a:00:00:00:00:08"},
+		},
+	} {
+		n := &network{
+			SimpleNetwork: backend.SimpleNetwork{SubnetLease: tc.own},
+			dev:           &vxlanDevice{link: &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Index: 5}}},
+		}
+
+		var routes []string
+		for _, r := range n.peerRoutes(tc.peer) {
+			if r.LinkIndex != 5 || r.Flags&int(netlink.FLAG_ONLINK) == 0 {
+				t.Errorf("route to %v isn't on-link through the device: %+v", r.Dst, r)
+			}
+			routes = append(routes, fmt.Sprintf("%v via %v", r.Dst, r.Gw))
+		}
+		if !reflect.DeepEqual(routes, tc.routes) {
+			t.Errorf("routes to %v from %v are %v, want %v", tc.peer.network, tc.own.Subnet, routes, tc.routes)
+		}
+
+		var neighs []string
+		for _, nb := range n.peerNeighbors(tc.peer) {
+			family := syscall.AF_INET
+			if nb.IP.To4() == nil {
+				family = syscall.AF_INET6
+			}
+			if nb.Family != family {
+				t.Errorf("neighbor entry for %v has family %d", nb.IP, nb.Family)
+			}
+			neighs = append(neighs, fmt.Sprintf("%v is %v", nb.IP, nb.HardwareAddr))
+		}
+		if !reflect.DeepEqual(neighs, tc.neighs) {
+			t.Errorf("neighbor entries for %v from %v are %v, want %v", tc.peer.network, tc.own.Subnet, neighs, tc.neighs)
+		}
+	}
+}
+
+// expectPeerRoute checks the route to dst via gw through the device, or that
+// there's none if gw is empty
+func expectPeerRoute(t *testing.T, n *network, dst, gw string) {
+	r, ok := kernelRoute(t, dst)
+	switch {
+	case gw == "" && ok:
+		t.Errorf("route %v left", r)
+	case gw != "" && (!ok || !r.Gw.Equal(net.ParseIP(gw)) || r.LinkIndex != n.dev.link.Index):
+		t.Errorf("route to %v is %v, want one via %v through the device", dst, r, gw)
+	}
+}
+
+func TestSetRemoveRoute(t *testing.T) {
+	defer setUpNetns(t)()
+	n := newTestNetwork(t, newTestExtIface(t), true)
+
+	l := peerLease(t, "10.3.8.0/24", "192.168.2.11", "fd00:10:0:8::/64", "", "0a:00:00:00:00:08")
+	n.handleSubnetEvents(added(l))
+	expectPeerRoute(t, n, "10.3.8.0/24", "10.3.8.0")
+	expectPeerRoute(t, n, "fd00:10:0:8::/64", "fd00:10:0:8::")
+	want := map[string]string{"10.3.8.0": "0a:00:00:00:00:08", "fd00:10:0:8::": "0a:00:00:00:00:08"}
+	if neighs := kernelNeighbors(t, n); !reflect.DeepEqual(neighs, want) {
+		t.Errorf("neighbor entries are %v, want %v", neighs, want)
+	}
+	if fdb := kernelFDB(t, n); fdb["192.168.2.11"] != "0a:00:00:00:00:08" {
+		t.Errorf("FDB entries are %v, want one for 192.168.2.11", fdb)
+	}
+
+	// adding the lease again changes nothing
+	n.handleSubnetEvents(added(l))
+	expectPeerRoute(t, n, "10.3.8.0/24", "10.3.8.0")
+	if neighs := kernelNeighbors(t, n); !reflect.DeepEqual(neighs, want) {
+		t.Errorf("neighbor entries are %v after adding the lease again, want %v", neighs, want)
+	}
+
+	n.handleSubnetEvents(removed(l))
+	expectPeerRoute(t, n, "10.3.8.0/24", "")
+	expectPeerRoute(t, n, "fd00:10:0:8::/64", "")
+	if neighs := kernelNeighbors(t, n); len(neighs) != 0 {
+		t.Errorf("neighbor entries %v left after removing the lease", neighs)
+	}
+	if _, ok := n.rts.find(l.Subnet); ok {
+		t.Errorf("route to %v still recorded after removing the lease", l.Subnet)
+	}
+
+	// removing a route that isn't there is fine
+	n.removeRoute(l.Subnet)
+}
+
+func TestSetRouteOnL3Misses(t *testing.T) {
+	defer setUpNetns(t)()
+	n := newTestNetwork(t, newTestExtIface(t), false)
+
+	// the route is only recorded, the network-wide route takes the traffic
+	// and the neighbor entries come from the L3 misses
+	l := peerLease(t, "10.3.8.0/24", "192.168.2.11", "", "", "0a:00:00:00:00:08")
+	n.handleSubnetEvents(added(l))
+	if rt, ok := n.rts.find(l.Subnet); !ok || rt.publicIP != l.Attrs.PublicIP {
+		t.Errorf("route to %v recorded as %+v", l.Subnet, rt)
+	}
+	expectPeerRoute(t, n, "10.3.8.0/24", "")
+	if neighs := kernelNeighbors(t, n); len(neighs) != 0 {
+		t.Errorf("neighbor entries %v added on L3 misses", neighs)
+	}
+
+	n.handleSubnetEvents(removed(l))
+	if _, ok := n.rts.find(l.Subnet); ok {
+		t.Errorf("route to %v still recorded after removing the lease", l.Subnet)
+	}
+}
+
+func TestSwitchToProactiveNeighbors(t *testing.T) {
+	defer setUpNetns(t)()
+	extIface := newTestExtIface(t)
+	n := newTestNetwork(t, extIface, false)
+	expectDeviceRoute(t, n, "10.3.0.0/16", true)
+	expectDeviceRoute(t, n, "fd00:10::/48", true)
+
+	// the device is set up again, as on a restart with the setting changed
+	n.proactive = true
+	if err := n.configureDevice(); err != nil {
+		t.Fatalf("failed to configure the device: %v", err)
+	}
+	expectDeviceRoute(t, n, "10.3.0.0/16", false)
+	expectDeviceRoute(t, n, "fd00:10::/48", false)
+	if len(n.devRoutes) != 0 {
+		t.Errorf("routes through the device are %v with ProactiveNeighbors", n.devRoutes)
+	}
+
+	addrs, err := netlink.AddrList(n.dev.link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatalf("failed to list the addresses: %v", err)
+	}
+	var global []string
+	for _, a := range addrs {
+		if a.IP.IsGlobalUnicast() {
+			global = append(global, a.IPNet.String())
+		}
+	}
+	if want := []string{"10.3.7.0/32", "fd00:10:0:7::/128"}; !reflect.DeepEqual(global, want) {
+		t.Errorf("addresses of the device are %v, want %v", global, want)
+	}
+
+	// the peers get their own routes
+	l := peerLease(t, "10.3.8.0/24", "192.168.2.11", "", "", "0a:00:00:00:00:08")
+	n.handleSubnetEvents(added(l))
+	expectPeerRoute(t, n, "10.3.8.0/24", "10.3.8.0")
+}
+
+// expectDeviceRoute checks whether there's a route to dst through the device
+// without a gateway
+func expectDeviceRoute(t *testing.T, n *network, dst string, want bool) {
+	r, ok := kernelRoute(t, dst)
+	ok = ok && r.LinkIndex == n.dev.link.Index && r.Gw == nil
+	if ok != want {
+		t.Errorf("route to %v through the device: %v, want %v", dst, ok, want)
+	}
+}
+
+func TestForgetVTEP(t *testing.T) {
+	defer setUpNetns(t)()
+	n := newTestNetwork(t, newTestExtIface(t), true)
+
+	n.handleSubnetEvents(added(peerLease(t, "10.3.8.0/24", "192.168.2.11", "", "", "0a:00:00:00:00:08")))
+
+	// only the MAC changes, as when the device of the host was created again
+	// by an older flanneld
+	n.handleSubnetEvents(added(peerLease(t, "10.3.8.0/24", "192.168.2.11", "", "", "0a:00:00:00:00:09")))
+	if fdb, want := kernelFDB(t, n), map[string]string{"192.168.2.11": "0a:00:00:00:00:09"}; !reflect.DeepEqual(fdb, want) {
+		t.Errorf("FDB entries are %v after the MAC changed, want %v", fdb, want)
+	}
+	if neighs, want := kernelNeighbors(t, n), map[string]string{"10.3.8.0": "0a:00:00:00:00:09"}; !reflect.DeepEqual(neighs, want) {
+		t.Errorf("neighbor entries are %v after the MAC changed, want %v", neighs, want)
+	}
+	if nb := n.fdb[ip.MustParseIP4("192.168.2.11")]; nb.MAC.String() != "0a:00:00:00:00:09" {
+		t.Errorf("FDB entry for 192.168.2.11 recorded with %v after the MAC changed", nb.MAC)
+	}
+
+	// only the public IP changes, as when the host got another address
+	n.handleSubnetEvents(added(peerLease(t, "10.3.8.0/24", "192.168.2.12", "", "", "0a:00:00:00:00:09")))
+	if fdb, want := kernelFDB(t, n), map[string]string{"192.168.2.12": "0a:00:00:00:00:09"}; !reflect.DeepEqual(fdb, want) {
+		t.Errorf("FDB entries are %v after the public IP changed, want %v", fdb, want)
+	}
+	if neighs, want := kernelNeighbors(t, n), map[string]string{"10.3.8.0": "0a:00:00:00:00:09"}; !reflect.DeepEqual(neighs, want) {
+		t.Errorf("neighbor entries are %v after the public IP changed, want %v", neighs, want)
+	}
+	if _, ok := n.fdb[ip.MustParseIP4("192.168.2.11")]; ok {
+		t.Errorf("FDB entry for the old public IP still recorded")
+	}
+	expectPeerRoute(t, n, "10.3.8.0/24", "10.3.8.0")
+
+	// the FDB entry of another host with the old MAC is left alone
+	n.handleSubnetEvents(added(peerLease(t, "10.3.9.0/24", "192.168.2.13", "", "", "0a:00:00:00:00:0a")))
+	n.forgetVTEP(route{network: mustParseIP4Net(t, "10.3.8.0/24"), vtepMAC: mustParseMAC(t, "0a:00:00:00:00:0a"), publicIP: ip.MustParseIP4("192.168.2.12")})
+	if fdb := kernelFDB(t, n); fdb["192.168.2.12"] != "0a:00:00:00:00:09" || fdb["192.168.2.13"] != "0a:00:00:00:00:0a" {
+		t.Errorf("FDB entries are %v after forgetting a VTEP that didn't match", fdb)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	// reconcileInterval is how often the kernel state is compared with the
+	// leases when nothing changes
+	reconcileInterval = 10 * time.Second
+	// reconcileDelay gathers the netlink notifications of one change
+	reconcileDelay = time.Second
+)
+
+// repairs counts the entries a reconciliation fixed, by kind
+type repairs map[string]int
+
+func (r repairs) String() string {
+	var s []string
+	for kind, count := range r {
+		s = append(s, fmt.Sprintf("%d %v", count, kind))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+// reconcile compares the device, its routes, FDB and neighbor entries and
+// the direct routes with the leases and repairs what drifted
+func (n *network) reconcile() {
+	fixed := make(repairs)
+
+	if err := n.reconcileDevice(fixed); err != nil {
+		log.Errorf("Failed to repair %v: %v", n.dev.attrs.name, err)
+		return
+	}
+	if err := n.reconcileRoutes(fixed); err != nil {
+		log.Errorf("Failed to reconcile the routes of network %q: %v", n.name, err)
+	}
+	if err := n.reconcileFDB(fixed); err != nil {
+		log.Errorf("Failed to reconcile the FDB of %v: %v", n.dev.attrs.name, err)
+	}
+	if err := n.reconcileNeighbors(fixed); err != nil {
+		log.Errorf("Failed to reconcile the neighbor entries of %v: %v", n.dev.attrs.name, err)
+	}
+
+	if len(fixed) > 0 {
+		log.Infof("Repaired the state of network %q: %v", n.name, fixed)
+		for kind, count := range fixed {
+			repaired.Add(float64(count), n.name, kind)
+		}
+	}
+}
+
+// reconcileDevice recreates the device if it is gone or was replaced, and
+// configures it again if it is down or lost its address
+func (n *network) reconcileDevice(fixed repairs) error {
+	name := n.dev.attrs.name
+
+	link, err := netlink.LinkByName(name)
+	if err != nil || link.Attrs().Index != n.dev.link.Index || vxlanLinksIncompat(n.dev.link, link) != "" {
+		log.Warningf("%v is gone or was replaced, creating it again", name)
+
+		n.mux.Lock()
+		err = n.dev.Recreate()
+		n.mux.Unlock()
+		if err != nil {
+			return err
+		}
+		if err = n.configureDevice(); err != nil {
+			return err
+		}
+		fixed["device"]++
+		return nil
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	hasAddr := false
+	for _, a := range addrs {
+		if a.IP.Equal(n.SubnetLease.Subnet.IP.ToIP()) {
+			hasAddr = true
+		}
+	}
+	if !hasAddr || link.Attrs().Flags&net.FlagUp == 0 {
+		log.Warningf("%v is down or lost its address, configuring it again", name)
+		if err = n.configureDevice(); err != nil {
+			return err
+		}
+		fixed["device"]++
+	}
+	return nil
+}
+
+func routeKey(r netlink.Route) string {
+	return fmt.Sprintf("%v %v %v", r.Dst, r.Gw, r.LinkIndex)
+}
+
+// reconcileRoutes deletes the routes to hosts that are gone or that go the
+// wrong way and adds back the missing ones
+func (n *network) reconcileRoutes(fixed repairs) error {
+	have, err := n.installedRoutes(n.directRoutes())
+	if err != nil {
+		return err
+	}
+	missing, unexpected := routeDiff(n.wantRoutes(), have, n.dev.link.Index)
+
+	for _, r := range unexpected {
+		log.Infof("Deleting unexpected route to %v via %v", r.Dst, n.linkName(r.LinkIndex))
+		if err := netlink.RouteDel(&r); err != nil {
+			log.Errorf("Error deleting route to %v: %v", r.Dst, err)
+			continue
+		}
+		fixed["routes"]++
+	}
+
+	for _, r := range missing {
+		log.Infof("Route to %v via %v is missing, adding it back", r.Dst, n.linkName(r.LinkIndex))
+		if r.LinkIndex == n.extIface.Iface.Index {
+			err = addDirectRoute(r)
+		} else if err = netlink.RouteAdd(&r); err == syscall.EEXIST {
+			err = nil
+		}
+		if err != nil {
+			log.Errorf("Error adding route to %v: %v", r.Dst, err)
+			continue
+		}
+		fixed["routes"]++
+	}
+	return nil
+}
+
+// routeDiff returns the routes of want that are missing from have and those
+// of have that aren't wanted. Only the routes through the device with the
+// index dev and those to the destinations of wanted routes are flannel's;
+// the others are never unexpected.
+func routeDiff(want, have []netlink.Route, dev int) (missing, unexpected []netlink.Route) {
+	haveKeys := make(map[string]bool)
+	for _, r := range have {
+		haveKeys[routeKey(r)] = true
+	}
+	wantKeys := make(map[string]bool)
+	wantDsts := make(map[string]bool)
+	for _, r := range want {
+		wantKeys[routeKey(r)] = true
+		wantDsts[r.Dst.String()] = true
+	}
+
+	for _, r := range want {
+		if !haveKeys[routeKey(r)] {
+			missing = append(missing, r)
+		}
+	}
+	for _, r := range have {
+		if wantKeys[routeKey(r)] {
+			continue
+		}
+		if r.LinkIndex == dev || wantDsts[r.Dst.String()] {
+			unexpected = append(unexpected, r)
+		}
+	}
+	return missing, unexpected
+}
+
+// reconcileFDB adds back the missing FDB entries of the hosts reached
+// through the device and deletes the others
+func (n *network) reconcileFDB(fixed repairs) error {
+	have, err := n.dev.GetL2List()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]neigh)
+	for _, rt := range n.rts {
+		want[rt.publicIP.String()] = neigh{IP: rt.publicIP, MAC: rt.vtepMAC}
+	}
+
+	found := make(map[string]bool)
+	for _, e := range have {
+		if e.IP == nil {
+			continue
+		}
+		if nb, ok := want[e.IP.String()]; ok && nb.MAC.String() == e.HardwareAddr.String() {
+			found[e.IP.String()] = true
+			continue
+		}
+		log.Infof("Deleting unexpected FDB entry %v %v", e.IP, e.HardwareAddr)
+		if err := n.dev.DelL2(neigh{IP: ip.FromIP(e.IP), MAC: e.HardwareAddr}); err != nil {
+			log.Error("Delete L2 failed: ", err)
+			continue
+		}
+		fixed["FDB entries"]++
+	}
+
+	for key, nb := range want {
+		if found[key] {
+			continue
+		}
+		log.Infof("FDB entry %v %v is missing, adding it back", nb.IP, nb.MAC)
+		if err := n.addL2(nb); err != nil {
+			log.Error("Add L2 failed: ", err)
+			continue
+		}
+		fixed["FDB entries"]++
+	}
+	return nil
+}
+
+// reconcileNeighbors adds back the missing neighbor entries for the other
+// hosts with ProactiveNeighbors and deletes the others
+func (n *network) reconcileNeighbors(fixed repairs) error {
+	if !n.proactive {
+		return nil
+	}
+
+	have, err := n.installedNeighbors()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]netlink.Neigh)
+	for _, nb := range n.wantNeighbors() {
+		want[nb.IP.String()] = nb
+	}
+
+	found := make(map[string]bool)
+	for _, e := range have {
+		if nb, ok := want[e.IP.String()]; ok && nb.HardwareAddr.String() == e.HardwareAddr.String() {
+			found[e.IP.String()] = true
+			continue
+		}
+		log.Infof("Deleting unexpected neighbor entry %v %v", e.IP, e.HardwareAddr)
+		if err := n.dev.DelNeigh(e); err != nil {
+			log.Errorf("Error deleting neighbor entry for %v: %v", e.IP, err)
+			continue
+		}
+		fixed["neighbor entries"]++
+	}
+
+	for key, nb := range want {
+		if found[key] {
+			continue
+		}
+		log.Infof("Neighbor entry %v %v is missing, adding it back", nb.IP, nb.HardwareAddr)
+		if err := n.dev.SetNeigh(nb); err != nil {
+			log.Errorf("Error adding neighbor entry for %v: %v", nb.IP, err)
+			continue
+		}
+		fixed["neighbor entries"]++
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func routeKeys(routes []netlink.Route) []string {
+	var keys []string
+	for _, r := range routes {
+		keys = append(keys, routeKey(r))
+	}
+	return keys
+}
+
+func TestRouteDiff(t *testing.T) {
+	// the device is link 5, the external interface link 2
+	network := testRoute("10.3.0.0/16", "", 5)
+	peer := testRoute("10.3.8.0/24", "10.3.8.0", 5)
+	direct := testRoute("10.3.9.0/24", "192.168.1.12", 2)
+
+	for _, tc := range []struct {
+		desc       string
+		want       []netlink.Route
+		have       []netlink.Route
+		missing    []netlink.Route
+		unexpected []netlink.Route
+	}{
+		{
+			desc: "in sync",
+			want: []netlink.Route{network, peer, direct},
+			have: []netlink.Route{direct, peer, network},
+		},
+		{
+			desc:    "missing routes",
+			want:    []netlink.Route{network, peer, direct},
+			have:    []netlink.Route{network},
+			missing: []netlink.Route{peer, direct},
+		},
+		{
+			desc:       "a route through the device to a host that's gone",
+			want:       []netlink.Route{network},
+			have:       []netlink.Route{network, peer},
+			unexpected: []netlink.Route{peer},
+		},
+		{
+			desc:       "a direct route via another gateway",
+			want:       []netlink.Route{direct},
+			have:       []netlink.Route{testRoute("10.3.9.0/24", "192.168.1.99", 2)},
+			missing:    []netlink.Route{direct},
+			unexpected: []netlink.Route{testRoute("10.3.9.0/24", "192.168.1.99", 2)},
+		},
+		{
+			desc: "a route into the network on the external interface that isn't flannel's",
+			want: []netlink.Route{network, direct},
+			have: []netlink.Route{network, direct, testRoute("10.3.10.0/24", "192.168.1.99", 2)},
+		},
+		{
+			desc:       "a route through the device moved to a direct one",
+			want:       []netlink.Route{testRoute("10.3.8.0/24", "192.168.1.11", 2)},
+			have:       []netlink.Route{peer},
+			missing:    []netlink.Route{testRoute("10.3.8.0/24", "192.168.1.11", 2)},
+			unexpected: []netlink.Route{peer},
+		},
+	} {
+		missing, unexpected := routeDiff(tc.want, tc.have, 5)
+		if !reflect.DeepEqual(routeKeys(missing), routeKeys(tc.missing)) {
+			t.Errorf("%s: missing routes are %v, want %v", tc.desc, routeKeys(missing), routeKeys(tc.missing))
+		}
+		if !reflect.DeepEqual(routeKeys(unexpected), routeKeys(tc.unexpected)) {
+			t.Errorf("%s: unexpected routes are %v, want %v", tc.desc, routeKeys(unexpected), routeKeys(tc.unexpected))
+		}
+	}
+}
+
+func TestReconcileRoutes(t *testing.T) {
+	defer setUpNetns(t)()
+	extIface := newTestExtIface(t)
+	n := newTestNetwork(t, extIface, false)
+	n.directRouting = true
+
+	n.handleSubnetEvents(added(peerLease(t, "10.3.8.0/24", "192.168.1.11", "", "", "0a:00:00:00:00:08")))
+	foreign := testRoute("10.3.10.0/24", "192.168.1.99", extIface.Iface.Index)
+	if err := netlink.RouteAdd(&foreign); err != nil {
+		t.Fatalf("failed to add %v: %v", foreign.Dst, err)
+	}
+	ours, _ := kernelRoute(t, "10.3.8.0/24")
+	if err := netlink.RouteDel(&ours); err != nil {
+		t.Fatalf("failed to delete %v: %v", ours.Dst, err)
+	}
+
+	fixed := make(repairs)
+	if err := n.reconcileRoutes(fixed); err != nil {
+		t.Fatalf("reconcileRoutes failed: %v", err)
+	}
+	if fixed["routes"] != 1 {
+		t.Errorf("repaired %v, want 1 routes", fixed)
+	}
+	if _, ok := kernelRoute(t, "10.3.8.0/24"); !ok {
+		t.Errorf("direct route to 10.3.8.0/24 not added back")
+	}
+	if _, ok := kernelRoute(t, "10.3.10.0/24"); !ok {
+		t.Errorf("route to 10.3.10.0/24 that isn't flannel's was deleted")
+	}
+
+	dp, err := n.Installed()
+	if err != nil {
+		t.Fatalf("Installed failed: %v", err)
+	}
+	for _, r := range dp.Routes {
+		if r.Dst == "10.3.10.0/24" {
+			t.Errorf("route to 10.3.10.0/24 that isn't flannel's reported as installed")
+		}
+	}
+}
@@ -21,20 +21,24 @@ import (
 )
 
 type route struct {
-	network ip.IP4Net
-	vtepMAC net.HardwareAddr
+	network  ip.IP4Net
+	network6 ip.IP6Net
+	vtepMAC  net.HardwareAddr
+	publicIP ip.IP4
 }
 
 type routes []route
 
-func (rts *routes) set(nw ip.IP4Net, vtepMAC net.HardwareAddr) {
+func (rts *routes) set(nw ip.IP4Net, nw6 ip.IP6Net, vtepMAC net.HardwareAddr, publicIP ip.IP4) {
 	for i, rt := range *rts {
 		if rt.network.Equal(nw) {
+			(*rts)[i].network6 = nw6
 			(*rts)[i].vtepMAC = vtepMAC
+			(*rts)[i].publicIP = publicIP
 			return
 		}
 	}
-	*rts = append(*rts, route{nw, vtepMAC})
+	*rts = append(*rts, route{nw, nw6, vtepMAC, publicIP})
 }
 
 func (rts *routes) remove(nw ip.IP4Net) {
@@ -47,6 +51,15 @@ func (rts *routes) remove(nw ip.IP4Net) {
 	}
 }
 
+func (rts routes) find(nw ip.IP4Net) (route, bool) {
+	for _, rt := range rts {
+		if rt.network.Equal(nw) {
+			return rt, true
+		}
+	}
+	return route{}, false
+}
+
 func (rts routes) findByNetwork(ipAddr ip.IP4) *route {
 	for i, rt := range rts {
 		if rt.network.Contains(ipAddr) {
@@ -55,3 +68,12 @@ func (rts routes) findByNetwork(ipAddr ip.IP4) *route {
 	}
 	return nil
 }
+
+func (rts routes) findByNetwork6(ipAddr ip.IP6) *route {
+	for i, rt := range rts {
+		if !rt.network6.Empty() && rt.network6.Contains(ipAddr) {
+			return &rts[i]
+		}
+	}
+	return nil
+}
@@ -17,7 +17,9 @@ package vxlan
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"sync"
 
 	"golang.org/x/net/context"
 
@@ -26,12 +28,12 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func init() {
-	backend.Register("vxlan", New)
-}
-
 const (
 	defaultVNI = 1
+	maxVNI     = 1<<24 - 1
+	// maxDerivedVNI keeps the names of the devices of the VNIs derived from
+	// network names, flannel.<VNI>, within the 15 characters Linux allows
+	maxDerivedVNI = 9999999
 )
 
 type VXLANBackend struct {
@@ -48,6 +50,65 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
+// defaultNetworkVNI returns the VNI of a network whose config has none: 1
+// for the default network, and for the networks of multi-network mode one
+// derived from their name so that all hosts agree on it
+func defaultNetworkVNI(network string) int {
+	if network == "" {
+		return defaultVNI
+	}
+	h := fnv.New32a()
+	h.Write([]byte(network))
+	return 2 + int(h.Sum32()%(maxDerivedVNI-1))
+}
+
+// deviceRegistry has the devices of the networks served by all the
+// VXLANBackends, as the networks overriding the external interface get
+// backends of their own, by network name
+type deviceRegistry struct {
+	mux      sync.Mutex
+	networks map[string]vxlanDeviceAttrs
+}
+
+var devices = &deviceRegistry{networks: make(map[string]vxlanDeviceAttrs)}
+
+// add records the device of a network, unless another network uses its VNI
+// or device already, or its UDP port with another GBP setting. Networks may
+// share a port otherwise, the VNI tells their packets apart, but the kernel
+// has one socket per port with one set of flags.
+func (r *deviceRegistry) add(network string, devAttrs vxlanDeviceAttrs) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for name, other := range r.networks {
+		if name == network {
+			continue
+		}
+		switch {
+		case other.vni == devAttrs.vni || other.name == devAttrs.name:
+			return fmt.Errorf("VNI %d of network %q is used by network %q already, for %v; set another VNI in the backend config", devAttrs.vni, network, name, other.name)
+		case other.vtepPort == devAttrs.vtepPort && other.gbp != devAttrs.gbp:
+			return fmt.Errorf("port %v of network %q is used by network %q already with GBP %v; set another Port or the same GBP in the backend config", portName(devAttrs.vtepPort), network, name, other.gbp)
+		}
+	}
+	r.networks[network] = devAttrs
+	return nil
+}
+
+// portName names the UDP port of a device, 0 being the kernel default
+func portName(port int) string {
+	if port == 0 {
+		return "default"
+	}
+	return fmt.Sprint(port)
+}
+
+func (r *deviceRegistry) remove(network string) {
+	r.mux.Lock()
+	delete(r.networks, network)
+	r.mux.Unlock()
+}
+
 func newSubnetAttrs(extEaddr net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
 	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(mac)})
 	if err != nil {
@@ -68,29 +129,68 @@ func (be *VXLANBackend) Run(ctx context.Context) {
 func (be *VXLANBackend) RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (backend.Network, error) {
 	// Parse our configuration
 	cfg := struct {
-		VNI  int
-		Port int
-		GBP  bool
-	}{
-		VNI: defaultVNI,
-	}
+		VNI                *int
+		Port               int
+		GBP                bool
+		DirectRouting      bool
+		ProactiveNeighbors bool
+	}{}
 
 	if len(config.Backend) > 0 {
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
 			return nil, fmt.Errorf("error decoding VXLAN backend config: %v", err)
 		}
 	}
+	vni, err := networkVNI(network, cfg.VNI)
+	if err != nil {
+		return nil, err
+	}
 
 	devAttrs := vxlanDeviceAttrs{
-		vni:       uint32(cfg.VNI),
-		name:      fmt.Sprintf("flannel.%v", cfg.VNI),
-		vtepIndex: be.extIface.Iface.Index,
-		vtepAddr:  be.extIface.IfaceAddr,
-		vtepPort:  cfg.Port,
-		gbp:       cfg.GBP,
+		vni:        uint32(vni),
+		name:       fmt.Sprintf("flannel.%v", vni),
+		vtepIndex:  be.extIface.Iface.Index,
+		vtepAddr:   be.extIface.IfaceAddr,
+		vtepPort:   cfg.Port,
+		gbp:        cfg.GBP,
+		appSolicit: !cfg.ProactiveNeighbors,
+		mac:        vtepMAC(be.extIface.ExtAddr, uint32(vni)),
+	}
+
+	if err := devices.add(network, devAttrs); err != nil {
+		return nil, err
+	}
+	n, err := be.registerNetwork(ctx, network, config, &devAttrs)
+	if err != nil {
+		devices.remove(network)
+		return nil, err
+	}
+	n.directRouting = cfg.DirectRouting
+	n.proactive = cfg.ProactiveNeighbors
+	n.release = func() { devices.remove(network) }
+
+	if err = n.configureDevice(); err != nil {
+		devices.remove(network)
+		return nil, err
+	}
+	return n, nil
+}
+
+// networkVNI returns the VNI set in the backend config of a network, if any,
+// or its default, checking that it is in range
+func networkVNI(network string, vni *int) (int, error) {
+	if vni == nil {
+		return defaultNetworkVNI(network), nil
 	}
+	if *vni < 1 || *vni > maxVNI {
+		return 0, fmt.Errorf("VNI %d is out of range, it must be between 1 and %d", *vni, maxVNI)
+	}
+	return *vni, nil
+}
 
-	dev, err := newVXLANDevice(&devAttrs)
+// registerNetwork sets up the device and acquires the lease of a network
+func (be *VXLANBackend) registerNetwork(ctx context.Context, network string, config *subnet.Config, devAttrs *vxlanDeviceAttrs) (*network, error) {
+	dev, err := newVXLANDevice(devAttrs)
 	if err != nil {
 		return nil, err
 	}
@@ -111,17 +211,96 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, network string, con
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
+	return newNetwork(network, be.sm, be.extIface, dev, config, l)
+}
+
+// configureDevice gives the device its addresses and routes
+func (n *network) configureDevice() error {
+	if !n.proactive {
+		devRoutes, err := configureNetwork(n.dev, n.config, n.SubnetLease)
+		if err != nil {
+			return err
+		}
+		n.mux.Lock()
+		n.devRoutes = devRoutes
+		n.mux.Unlock()
+		return nil
+	}
+
+	// the device only has the host's address, the other hosts are routed
+	// to one by one
+	l := n.SubnetLease
+	if err := n.dev.ConfigureAddr(ip.IP4Net{IP: l.Subnet.IP, PrefixLen: 32}); err != nil {
+		return err
+	}
+	if n.config.IPv6Enabled() && !l.IPv6Subnet.Empty() {
+		if err := n.dev.ConfigureAddr6(ip.IP6Net{IP: l.IPv6Subnet.IP, PrefixLen: 128}); err != nil {
+			return err
+		}
+	}
+
+	// a device set up for L3 misses before still routes the whole network
+	if err := n.dev.DelRoutes(networkRoutes(n.config)); err != nil {
+		return err
+	}
+	n.mux.Lock()
+	n.devRoutes = nil
+	n.mux.Unlock()
+	return nil
+}
+
+// networkRoutes returns the destinations of the routes to the network's
+// blocks that configureNetwork may have added
+func networkRoutes(config *subnet.Config) []*net.IPNet {
+	var dsts []*net.IPNet
+	for _, nw := range config.Networks {
+		dsts = append(dsts, nw.ToIPNet())
+	}
+	if config.IPv6Enabled() {
+		dsts = append(dsts, config.IPv6Network.ToIPNet())
+	}
+	return dsts
+}
+
+// configureNetwork gives the device an address in the network and routes the
+// network through it, returning the routes
+func configureNetwork(dev *vxlanDevice, config *subnet.Config, l *subnet.Lease) ([]*net.IPNet, error) {
 	// vxlan's subnet is that of the whole overlay network (e.g. /16)
 	// and not that of the individual host (e.g. /24)
+	nw, ok := config.NetworkOf(l.Subnet)
+	if !ok {
+		nw = config.Network
+	}
 	vxlanNet := ip.IP4Net{
 		IP:        l.Subnet.IP,
-		PrefixLen: config.Network.PrefixLen,
+		PrefixLen: nw.PrefixLen,
 	}
-	if err = dev.Configure(vxlanNet); err != nil {
+	if err := dev.Configure(vxlanNet); err != nil {
 		return nil, err
 	}
+	devRoutes := []*net.IPNet{vxlanNet.Network().ToIPNet()}
+
+	// the other blocks of the network are reached through the device too
+	for _, n := range config.Networks {
+		if !n.Equal(nw) {
+			if err := dev.AddRoute(n); err != nil {
+				return nil, err
+			}
+			devRoutes = append(devRoutes, n.ToIPNet())
+		}
+	}
 
-	return newNetwork(network, be.sm, be.extIface, dev, vxlanNet, l)
+	if config.IPv6Enabled() && !l.IPv6Subnet.Empty() {
+		vxlanNet6 := ip.IP6Net{
+			IP:        l.IPv6Subnet.IP,
+			PrefixLen: config.IPv6Network.PrefixLen,
+		}
+		if err := dev.ConfigureIPv6(vxlanNet6); err != nil {
+			return nil, err
+		}
+		devRoutes = append(devRoutes, vxlanNet6.Network().ToIPNet())
+	}
+	return devRoutes, nil
 }
 
 // So we can make it JSON (un)marshalable
@@ -0,0 +1,162 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestDefaultNetworkVNI(t *testing.T) {
+	// the default network keeps VNI 1
+	if vni := defaultNetworkVNI(""); vni != 1 {
+		t.Errorf("VNI of the default network is %d, want 1", vni)
+	}
+
+	seen := make(map[int]string)
+	for i := 0; i < 100; i++ {
+		network := fmt.Sprintf("network-%d", i)
+		vni := defaultNetworkVNI(network)
+		if vni != defaultNetworkVNI(network) {
+			t.Errorf("VNI derived from %q changed from %d", network, vni)
+		}
+		if vni < 2 || vni > maxDerivedVNI {
+			t.Errorf("VNI derived from %q is %d, want one between 2 and %d", network, vni, maxDerivedVNI)
+		}
+		if name := fmt.Sprintf("flannel.%d", vni); len(name) > 15 {
+			t.Errorf("device name %v of %q is longer than Linux allows", name, network)
+		}
+		if other, ok := seen[vni]; ok {
+			t.Errorf("VNI %d derived from both %q and %q", vni, other, network)
+		}
+		seen[vni] = network
+	}
+}
+
+func TestNetworkVNI(t *testing.T) {
+	for _, tc := range []struct {
+		vni  int
+		want int
+		err  string
+	}{
+		{1, 1, ""},
+		{4096, 4096, ""},
+		{maxVNI, maxVNI, ""},
+		{0, 0, "VNI 0 is out of range"},
+		{-1, 0, "VNI -1 is out of range"},
+		{maxVNI + 1, 0, "VNI 16777216 is out of range"},
+	} {
+		vni := tc.vni
+		got, err := networkVNI("blue", &vni)
+		switch {
+		case tc.err == "" && (err != nil || got != tc.want):
+			t.Errorf("networkVNI of %d returned %d, %v, want %d", tc.vni, got, err, tc.want)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("networkVNI of %d returned %d, %v, want an error with %q", tc.vni, got, err, tc.err)
+		}
+	}
+
+	if got, err := networkVNI("blue", nil); err != nil || got != defaultNetworkVNI("blue") {
+		t.Errorf("networkVNI without a VNI returned %d, %v, want the derived one", got, err)
+	}
+
+	// RegisterNetwork checks the range before setting up anything
+	config, err := subnet.ParseConfig(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 16777216 } }`)
+	if err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+	if _, err := (&VXLANBackend{}).RegisterNetwork(context.Background(), "blue", config); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("RegisterNetwork with VNI 16777216 returned %v", err)
+	}
+}
+
+func TestDeviceRegistry(t *testing.T) {
+	r := &deviceRegistry{networks: make(map[string]vxlanDeviceAttrs)}
+	blue := vxlanDeviceAttrs{vni: 1, name: "flannel.1"}
+	green := vxlanDeviceAttrs{vni: 2, name: "flannel.2"}
+
+	if err := r.add("blue", blue); err != nil {
+		t.Fatalf("adding blue failed: %v", err)
+	}
+	if err := r.add("green", green); err != nil {
+		t.Fatalf("adding green failed: %v", err)
+	}
+	// a network registered again keeps its device
+	if err := r.add("blue", blue); err != nil {
+		t.Errorf("adding blue again failed: %v", err)
+	}
+
+	err := r.add("red", vxlanDeviceAttrs{vni: 1, name: "flannel.1"})
+	if want := `VNI 1 of network "red" is used by network "blue" already, for flannel.1`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("adding red with the VNI of blue returned %v, want an error with %q", err, want)
+	}
+
+	// networks may share a port with the same GBP setting only
+	if err := r.add("red", vxlanDeviceAttrs{vni: 3, name: "flannel.3"}); err != nil {
+		t.Errorf("adding red on the default port failed: %v", err)
+	}
+	err = r.add("yellow", vxlanDeviceAttrs{vni: 4, name: "flannel.4", gbp: true})
+	if want := `port default of network "yellow" is used by network`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("adding yellow with GBP on the default port returned %v, want an error with %q", err, want)
+	}
+	if err := r.add("yellow", vxlanDeviceAttrs{vni: 4, name: "flannel.4", vtepPort: 4789, gbp: true}); err != nil {
+		t.Errorf("adding yellow with GBP on another port failed: %v", err)
+	}
+	err = r.add("purple", vxlanDeviceAttrs{vni: 5, name: "flannel.5", vtepPort: 4789})
+	if want := `port 4789 of network "purple" is used by network "yellow" already with GBP true`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("adding purple without GBP on the port of yellow returned %v, want an error with %q", err, want)
+	}
+	r.remove("red")
+
+	// the VNI is free once blue is gone
+	r.remove("blue")
+	if err := r.add("red", vxlanDeviceAttrs{vni: 1, name: "flannel.1"}); err != nil {
+		t.Errorf("adding red after removing blue failed: %v", err)
+	}
+}
+
+func TestDevicesSharedByBackends(t *testing.T) {
+	// the backends of networks overriding the external interface are others
+	// than that of the default interface, but share the VNIs
+	defer func() {
+		devices.remove("blue")
+		devices.remove("red")
+	}()
+
+	if err := devices.add("blue", vxlanDeviceAttrs{vni: 7, name: "flannel.7"}); err != nil {
+		t.Fatalf("adding blue failed: %v", err)
+	}
+	config, err := subnet.ParseConfig(`{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 7 } }`)
+	if err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+	for _, iface := range []string{"eth0", "eth1"} {
+		be := &VXLANBackend{extIface: &backend.ExternalInterface{
+			Iface:     &net.Interface{Index: 2, Name: iface},
+			IfaceAddr: net.ParseIP("192.168.1.10"),
+			ExtAddr:   net.ParseIP("192.168.1.10"),
+		}}
+		if _, err := be.RegisterNetwork(context.Background(), "red", config); err == nil || !strings.Contains(err.Error(), `used by network "blue" already`) {
+			t.Errorf("RegisterNetwork of red with the VNI of blue returned %v", err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/network"
+)
+
+// overridesKey holds the per-network settings in the config file
+const overridesKey = "network-overrides"
+
+// configFile is the contents of --config-file: values for the command line
+// options, by flag name, and the settings of single networks
+type configFile struct {
+	flags     map[string]string
+	overrides map[string]network.NetworkOptions
+}
+
+// loadConfigFile reads a YAML or JSON config file
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(j, &raw); err != nil {
+		return nil, fmt.Errorf("%v: not a mapping of options: %v", path, err)
+	}
+
+	c := &configFile{flags: make(map[string]string)}
+	for name, v := range raw {
+		if name == overridesKey {
+			if c.overrides, err = parseOverrides(v); err != nil {
+				return nil, fmt.Errorf("%v: %v: %v", path, overridesKey, err)
+			}
+			continue
+		}
+
+		if f := flag.Lookup(name); f == nil || name == "config-file" {
+			return nil, fmt.Errorf("%v: unknown option %q", path, name)
+		}
+		val, ok, err := flagValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v: %v", path, name, err)
+		}
+		if ok {
+			c.flags[name] = val
+		}
+	}
+	return c, nil
+}
+
+// flagValue formats a value of the config file as a flag value: lists are
+// joined with commas. ok is false for null, which leaves the flag alone.
+func flagValue(raw json.RawMessage) (val string, ok bool, err error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", false, err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", false, nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case string, bool, json.Number:
+				items[i] = fmt.Sprint(item)
+			default:
+				return "", false, fmt.Errorf("lists may only hold strings, numbers and booleans")
+			}
+		}
+		return strings.Join(items, ","), true, nil
+	case map[string]interface{}:
+		return "", false, fmt.Errorf("expected a value, not a mapping")
+	default:
+		return fmt.Sprint(v), true, nil
+	}
+}
+
+func parseOverrides(raw json.RawMessage) (map[string]network.NetworkOptions, error) {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(network.NetworkOptions{})
+	for i := 0; i < t.NumField(); i++ {
+		known[t.Field(i).Tag.Get("json")] = true
+	}
+
+	var keys map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, fmt.Errorf("expected a mapping of network names to settings: %v", err)
+	}
+	for name, settings := range keys {
+		for k := range settings {
+			if !known[k] {
+				return nil, fmt.Errorf("unknown setting %q of network %q", k, name)
+			}
+		}
+	}
+
+	var overrides map[string]network.NetworkOptions
+	if err := json.Unmarshal(raw, &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// setFlags returns the flags set on the command line or in the environment
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// apply sets the flags of the config file, except the explicit ones
+func (c *configFile) apply(fs *flag.FlagSet, explicit map[string]bool) error {
+	for name, val := range c.flags {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, val); err != nil {
+			return fmt.Errorf("invalid value %q for %v in %v: %v", val, name, opts.configFile, err)
+		}
+	}
+	return nil
+}
+
+// networkSettings is what a reload of the config file changes in the
+// network manager
+type networkSettings interface {
+	SetAllowedNetworks(names []string) error
+	SetNetworkOptions(o map[string]network.NetworkOptions)
+}
+
+// reloadConfigFile applies the changes to the config file that are safe to
+// make while flanneld runs: the list of networks and the overrides, which
+// apply to the networks started afterwards. Other changes are logged as
+// needing a restart. It returns the config now in effect.
+func reloadConfigFile(nm networkSettings, old *configFile, explicit map[string]bool) *configFile {
+	log.Infof("Reloading %v", opts.configFile)
+
+	c, err := loadConfigFile(opts.configFile)
+	if err != nil {
+		log.Errorf("Failed to reload the config file, keeping the current one: %v", err)
+		return old
+	}
+
+	var changed []string
+	for name := range c.flags {
+		if v, ok := old.flags[name]; !ok || v != c.flags[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old.flags {
+		if _, ok := c.flags[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	for _, name := range changed {
+		switch {
+		case explicit[name]:
+			// the command line or environment wins
+		case name == "networks":
+			val, ok := c.flags[name]
+			if !ok {
+				val = flag.Lookup(name).DefValue
+			}
+			if err := nm.SetAllowedNetworks(strings.Split(val, ",")); err != nil {
+				log.Errorf("Failed to change the networks to %q: %v", val, err)
+				if v, ok := old.flags[name]; ok {
+					c.flags[name] = v
+				} else {
+					delete(c.flags, name)
+				}
+				continue
+			}
+			flag.Set(name, val)
+			log.Infof("Networks changed to %q", val)
+		default:
+			log.Warningf("Ignoring the change of %v until flanneld is restarted", name)
+			if v, ok := old.flags[name]; ok {
+				c.flags[name] = v
+			} else {
+				delete(c.flags, name)
+			}
+		}
+	}
+
+	nm.SetNetworkOptions(c.overrides)
+	return c
+}
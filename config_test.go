@@ -0,0 +1,262 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/flannel/network"
+)
+
+// writeConfigFile writes data to a config file in dir and points
+// --config-file at it
+func writeConfigFile(t *testing.T, dir, data string) string {
+	path := filepath.Join(dir, "flanneld.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+	opts.configFile = path
+	return path
+}
+
+func tempConfigDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flannel-config")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := tempConfigDir(t)
+	defer os.RemoveAll(dir)
+	defer func(path string) { opts.configFile = path }(opts.configFile)
+
+	for _, tc := range []struct {
+		data      string
+		flags     map[string]string
+		overrides map[string]network.NetworkOptions
+	}{
+		{
+			data: `
+# the etcd cluster
+etcd-endpoints: [http://10.0.0.2:2379, http://10.0.0.3:2379]
+ip-masq: yes
+subnet-len: 26
+iface: null
+networks:
+  - blue
+  - green
+network-overrides:
+  green:
+    iface: eth1
+    ip-masq: off
+    hook: "/usr/local/bin/green hook"
+`,
+			flags: map[string]string{
+				"etcd-endpoints": "http://10.0.0.2:2379,http://10.0.0.3:2379",
+				"ip-masq":        "true",
+				"subnet-len":     "26",
+				"networks":       "blue,green",
+			},
+			overrides: map[string]network.NetworkOptions{
+				"green": {Iface: "eth1", IPMasq: boolPtr(false), Hook: "/usr/local/bin/green hook"},
+			},
+		},
+		{
+			// multi-line scalars and flow mappings
+			data: `
+hook: >
+  /usr/local/bin/hook
+network-overrides: {blue: {subnet-file: /run/flannel/blue.env}, "": {public-ip: 10.0.0.5}}
+`,
+			flags: map[string]string{"hook": "/usr/local/bin/hook\n"},
+			overrides: map[string]network.NetworkOptions{
+				"blue": {SubnetFile: "/run/flannel/blue.env"},
+				"":     {PublicIP: "10.0.0.5"},
+			},
+		},
+		{
+			data:  `{ "etcd-prefix": "/flannel", "ip-masq": false, "networks": ["blue"] }`,
+			flags: map[string]string{"etcd-prefix": "/flannel", "ip-masq": "false", "networks": "blue"},
+		},
+		{
+			data:  "",
+			flags: map[string]string{},
+		},
+	} {
+		path := writeConfigFile(t, dir, tc.data)
+		c, err := loadConfigFile(path)
+		if err != nil {
+			t.Errorf("failed to load %q: %v", tc.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.flags, tc.flags) {
+			t.Errorf("flags of %q are %v, want %v", tc.data, c.flags, tc.flags)
+		}
+		if !reflect.DeepEqual(c.overrides, tc.overrides) {
+			t.Errorf("overrides of %q are %+v, want %+v", tc.data, c.overrides, tc.overrides)
+		}
+	}
+
+	for _, tc := range []struct {
+		data string
+		err  string
+	}{
+		{"etcd-endpoint: http://10.0.0.2:2379\n", `unknown option "etcd-endpoint"`},
+		{"config-file: /etc/flanneld.yaml\n", `unknown option "config-file"`},
+		{"iface: {name: eth0}\n", "iface: expected a value, not a mapping"},
+		{"networks: [blue, [green]]\n", "lists may only hold strings, numbers and booleans"},
+		{"network-overrides:\n  green:\n    ifac: eth1\n", `unknown setting "ifac" of network "green"`},
+		{"network-overrides: [green]\n", "expected a mapping of network names to settings"},
+		{"- blue\n- green\n", "not a mapping of options"},
+		{"iface: [eth0\n", "flanneld.yaml"},
+	} {
+		path := writeConfigFile(t, dir, tc.data)
+		if _, err := loadConfigFile(path); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("loading %q returned %v, want an error with %q", tc.data, err, tc.err)
+		}
+	}
+}
+
+func TestConfigFileApply(t *testing.T) {
+	dir := tempConfigDir(t)
+	defer os.RemoveAll(dir)
+	defer func(path string) { opts.configFile = path }(opts.configFile)
+
+	path := writeConfigFile(t, dir, "iface: eth1\nip-masq: true\nnetworks: [blue, green]\n")
+	c, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("failed to load the config file: %v", err)
+	}
+
+	var iface, networks string
+	var ipMasq bool
+	fs := flag.NewFlagSet("flanneld", flag.ContinueOnError)
+	fs.StringVar(&iface, "iface", "", "")
+	fs.StringVar(&networks, "networks", "", "")
+	fs.BoolVar(&ipMasq, "ip-masq", false, "")
+
+	// the command line wins over the file
+	if err := fs.Parse([]string{"--iface=eth0"}); err != nil {
+		t.Fatalf("failed to parse the flags: %v", err)
+	}
+	explicit := setFlags(fs)
+	if err := c.apply(fs, explicit); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if iface != "eth0" || networks != "blue,green" || !ipMasq {
+		t.Errorf("flags are iface=%q networks=%q ip-masq=%v after apply", iface, networks, ipMasq)
+	}
+
+	c.flags["ip-masq"] = "maybe"
+	if err := c.apply(fs, explicit); err == nil || !strings.Contains(err.Error(), `invalid value "maybe" for ip-masq`) {
+		t.Errorf("apply of an invalid value returned %v", err)
+	}
+}
+
+// fakeNetworkSettings records what a reload changes
+type fakeNetworkSettings struct {
+	allowed   []string
+	overrides map[string]network.NetworkOptions
+	err       error
+}
+
+func (s *fakeNetworkSettings) SetAllowedNetworks(names []string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.allowed = names
+	return nil
+}
+
+func (s *fakeNetworkSettings) SetNetworkOptions(o map[string]network.NetworkOptions) {
+	s.overrides = o
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	dir := tempConfigDir(t)
+	defer os.RemoveAll(dir)
+	defer func(path string) { opts.configFile = path }(opts.configFile)
+	defer func(networks string) { flag.Set("networks", networks) }(flag.Lookup("networks").Value.String())
+
+	const initial = "networks: [blue]\nip-masq: true\n"
+	load := func() *configFile {
+		c, err := loadConfigFile(writeConfigFile(t, dir, initial))
+		if err != nil {
+			t.Fatalf("failed to load the config file: %v", err)
+		}
+		return c
+	}
+
+	// the networks and overrides change right away, other options only
+	// after a restart
+	old := load()
+	nm := &fakeNetworkSettings{}
+	writeConfigFile(t, dir, "networks: [blue, green]\nip-masq: false\nsubnet-len: 26\nnetwork-overrides:\n  green:\n    iface: eth1\n")
+	c := reloadConfigFile(nm, old, map[string]bool{})
+	if !reflect.DeepEqual(nm.allowed, []string{"blue", "green"}) {
+		t.Errorf("networks changed to %v, want [blue green]", nm.allowed)
+	}
+	if want := map[string]network.NetworkOptions{"green": {Iface: "eth1"}}; !reflect.DeepEqual(nm.overrides, want) {
+		t.Errorf("overrides changed to %+v, want %+v", nm.overrides, want)
+	}
+	if v := flag.Lookup("networks").Value.String(); v != "blue,green" {
+		t.Errorf("--networks is %q after the reload", v)
+	}
+	if want := map[string]string{"networks": "blue,green", "ip-masq": "true"}; !reflect.DeepEqual(c.flags, want) {
+		t.Errorf("config in effect has flags %v, want %v", c.flags, want)
+	}
+
+	// networks given on the command line aren't changed
+	old = load()
+	nm = &fakeNetworkSettings{}
+	writeConfigFile(t, dir, "networks: [green]\nip-masq: true\n")
+	reloadConfigFile(nm, old, map[string]bool{"networks": true})
+	if nm.allowed != nil {
+		t.Errorf("networks given on the command line changed to %v", nm.allowed)
+	}
+
+	// networks that can't be changed stay as they were
+	old = load()
+	nm = &fakeNetworkSettings{err: errors.New("not in multi-network mode")}
+	writeConfigFile(t, dir, "networks: [green]\nip-masq: true\n")
+	c = reloadConfigFile(nm, old, map[string]bool{})
+	if c.flags["networks"] != "blue" {
+		t.Errorf("config in effect has networks %q after a failed change, want blue", c.flags["networks"])
+	}
+
+	// a file that fails to load leaves everything alone
+	old = load()
+	nm = &fakeNetworkSettings{}
+	writeConfigFile(t, dir, "networks: [green\n")
+	if c := reloadConfigFile(nm, old, map[string]bool{}); c != old {
+		t.Errorf("reload of a broken file returned %+v", c)
+	}
+	if nm.allowed != nil || nm.overrides != nil {
+		t.Errorf("reload of a broken file changed the networks to %v and the overrides to %v", nm.allowed, nm.overrides)
+	}
+}
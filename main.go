@@ -17,28 +17,32 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/coreos/pkg/flagutil"
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/backend/alloc"
+	"github.com/coreos/flannel/backend/awsvpc"
+	"github.com/coreos/flannel/backend/gce"
+	"github.com/coreos/flannel/backend/hostgw"
+	"github.com/coreos/flannel/backend/udp"
+	"github.com/coreos/flannel/backend/vxlan"
 	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/metrics"
 	"github.com/coreos/flannel/remote"
 	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/kube"
 	"github.com/coreos/flannel/version"
-
-	// Backends need to be imported for their init() to get executed and them to register
-	_ "github.com/coreos/flannel/backend/alloc"
-	_ "github.com/coreos/flannel/backend/awsvpc"
-	_ "github.com/coreos/flannel/backend/gce"
-	_ "github.com/coreos/flannel/backend/hostgw"
-	_ "github.com/coreos/flannel/backend/udp"
-	_ "github.com/coreos/flannel/backend/vxlan"
 )
 
 type CmdLineOpts struct {
@@ -49,6 +53,8 @@ type CmdLineOpts struct {
 	etcdCAFile     string
 	etcdUsername   string
 	etcdPassword   string
+	etcdAPI        string
+	etcdMigrateV2  bool
 	help           bool
 	version        bool
 	listen         string
@@ -56,6 +62,37 @@ type CmdLineOpts struct {
 	remoteKeyfile  string
 	remoteCertfile string
 	remoteCAFile   string
+	registryFile   string
+	kubeSubnetMgr  bool
+	kubeAPIServer  string
+	kubeNodeName   string
+	kubeConfigMap  string
+	cleanup        bool
+	cleanupDryRun  bool
+	cleanupRevoke  bool
+	metricsListen  string
+	healthzListen  string
+	statusSocket   string
+	configFile     string
+
+	publicIP              string
+	publicIPv6            string
+	ipMasq                bool
+	subnetFile            string
+	subnetDir             string
+	subnetFormat          string
+	subnetTemplates       listFlag
+	iface                 string
+	networks              string
+	watchNetworks         bool
+	subnetLen             uint
+	nodeID                string
+	teardown              bool
+	revokeLease           bool
+	healthzWatchThreshold time.Duration
+	hook                  string
+	hookTimeout           time.Duration
+	hookBlocksReady       bool
 }
 
 var opts CmdLineOpts
@@ -68,21 +105,108 @@ func init() {
 	flag.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
 	flag.StringVar(&opts.etcdUsername, "etcd-username", "", "Username for BasicAuth to etcd")
 	flag.StringVar(&opts.etcdPassword, "etcd-password", "", "Password for BasicAuth to etcd")
+	flag.StringVar(&opts.etcdAPI, "etcd-api", "v2", "etcd API version used to store the subnet registry (v2 or v3)")
+	flag.BoolVar(&opts.etcdMigrateV2, "etcd-migrate-v2", false, "copy the registry under etcd-prefix from the etcd v2 keyspace into v3 and exit")
 	flag.StringVar(&opts.listen, "listen", "", "run as server and listen on specified address (e.g. ':8080')")
 	flag.StringVar(&opts.remote, "remote", "", "run as client and connect to server on specified address (e.g. '10.1.2.3:8080')")
 	flag.StringVar(&opts.remoteKeyfile, "remote-keyfile", "", "SSL key file used to secure client/server communication")
 	flag.StringVar(&opts.remoteCertfile, "remote-certfile", "", "SSL certification file used to secure client/server communication")
 	flag.StringVar(&opts.remoteCAFile, "remote-cafile", "", "SSL Certificate Authority file used to secure client/server communication")
+	flag.StringVar(&opts.registryFile, "registry-file", "", "keep the subnet registry in this local file instead of etcd")
+	flag.BoolVar(&opts.kubeSubnetMgr, "kube-subnet-mgr", false, "use the Kubernetes API (node podCIDRs) instead of etcd for subnet assignment")
+	flag.StringVar(&opts.kubeAPIServer, "kube-api-server", "", "Kubernetes API server URL; defaults to the in-cluster service address")
+	flag.StringVar(&opts.kubeNodeName, "kube-node-name", "", "name of the Kubernetes node this host runs as; defaults to $NODE_NAME, then the hostname")
+	flag.StringVar(&opts.kubeConfigMap, "kube-configmap", "kube-system/kube-flannel-cfg", "namespace/name of the ConfigMap holding the network config under the net-conf.json key")
+	flag.BoolVar(&opts.cleanup, "cleanup", false, "remove the devices, routes, iptables rules and subnet files flanneld may have created on this host and exit")
+	flag.BoolVar(&opts.cleanupDryRun, "cleanup-dry-run", false, "with --cleanup, only list what would be removed")
+	flag.BoolVar(&opts.cleanupRevoke, "cleanup-revoke-leases", false, "with --cleanup, also give up the subnet leases of this host")
+	flag.StringVar(&opts.metricsListen, "metrics-listen", "", "serve Prometheus metrics at /metrics on the specified address (e.g. ':9325')")
+	flag.StringVar(&opts.healthzListen, "healthz-listen", "", "serve the /healthz and /readyz health checks on the specified address (e.g. ':9326'), which may be the metrics address")
+	flag.StringVar(&opts.statusSocket, "status-socket", "/run/flannel/flanneld.sock", "unix socket to serve the status of the networks on for 'flanneld status'; empty to disable")
+	flag.StringVar(&opts.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication")
+	flag.StringVar(&opts.publicIPv6, "public-ipv6", "", "IPv6 address accessible by other nodes for inter-host communication in dual-stack networks")
+	flag.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where the subnet, MTU, ... will be written to")
+	flag.StringVar(&opts.subnetDir, "subnet-dir", "/run/flannel/networks", "directory where files with the subnet, MTU, ... of each network will be written to")
+	flag.StringVar(&opts.subnetFormat, "subnet-file-format", "env", "format of the subnet files: env, json or yaml")
+	flag.Var(&opts.subnetTemplates, "subnet-template", "template:dest, render the template (docker, env, json, yaml or a file) to dest whenever a subnet file is written. dest may refer to the network as {{.Name}}. May be repeated.")
+	flag.StringVar(&opts.iface, "iface", "", "interface to use (IP or name) for inter-host communication")
+	flag.StringVar(&opts.networks, "networks", "", "run in multi-network mode and service the specified networks")
+	flag.BoolVar(&opts.watchNetworks, "watch-networks", false, "run in multi-network mode and watch for networks from 'networks' or all networks")
+	flag.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
+	flag.UintVar(&opts.subnetLen, "subnet-len", 0, "prefix length of the subnet to request, within the network's MinSubnetLen and MaxSubnetLen (defaults to its SubnetLen)")
+	flag.BoolVar(&opts.teardown, "teardown-on-exit", false, "remove the devices and routes set up for the networks on exit instead of keeping traffic flowing until flanneld is restarted")
+	flag.BoolVar(&opts.revokeLease, "revoke-lease-on-exit", false, "give up the subnet leases on exit instead of keeping them for when flanneld is restarted")
+	flag.DurationVar(&opts.healthzWatchThreshold, "healthz-watch-threshold", 5*time.Minute, "how long a watch of the registry may keep failing before the health check fails")
+	flag.StringVar(&opts.hook, "hook", "", "executable to run with the event type and a JSON description of it when the lease is acquired, renewed, lost or revoked and when other hosts' leases are added or removed")
+	flag.DurationVar(&opts.hookTimeout, "hook-timeout", 30*time.Second, "how long the hook may run before it is killed")
+	flag.BoolVar(&opts.hookBlocksReady, "hook-blocks-ready", false, "fail the readiness check until the hook has succeeded for the acquired lease")
+	flag.StringVar(&opts.nodeID, "node-id", "", "identity of this node, used to find its lease again when its public IP changes (defaults to /etc/machine-id)")
+	flag.StringVar(&opts.configFile, "config-file", "", "YAML or JSON file with values for these options, keyed by flag name, and per-network settings under network-overrides. Reloaded on SIGHUP.")
 	flag.BoolVar(&opts.help, "help", false, "print this message")
 	flag.BoolVar(&opts.version, "version", false, "print version and exit")
 }
 
-func newSubnetManager() (subnet.Manager, error) {
-	if opts.remote != "" {
-		return remote.NewRemoteManager(opts.remote, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile)
+// listFlag collects the values of a flag that may be repeated. A value may
+// also hold several comma separated ones, as from the environment.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// newBackendRegistry returns the backends flanneld supports
+func newBackendRegistry() *backend.Registry {
+	r := backend.NewRegistry()
+	r.Register("alloc", alloc.New)
+	r.Register("aws-vpc", awsvpc.New)
+	r.Register("gce", gce.New)
+	r.Register("host-gw", hostgw.New)
+	r.Register("udp", udp.New)
+	r.Register("vxlan", vxlan.New)
+	return r
+}
+
+func newNetworkOptions(overrides map[string]network.NetworkOptions) network.Options {
+	var networks []string
+	if opts.networks != "" {
+		networks = strings.Split(opts.networks, ",")
 	}
 
-	cfg := &subnet.EtcdConfig{
+	return network.Options{
+		Backends:              newBackendRegistry(),
+		Iface:                 opts.iface,
+		PublicIP:              opts.publicIP,
+		PublicIPv6:            opts.publicIPv6,
+		IPMasq:                opts.ipMasq,
+		Networks:              networks,
+		WatchNetworks:         opts.watchNetworks,
+		Overrides:             overrides,
+		SubnetFile:            opts.subnetFile,
+		SubnetDir:             opts.subnetDir,
+		SubnetFileFormat:      opts.subnetFormat,
+		SubnetTemplates:       opts.subnetTemplates,
+		SubnetLen:             opts.subnetLen,
+		NodeID:                opts.nodeID,
+		Teardown:              opts.teardown,
+		RevokeLease:           opts.revokeLease,
+		HealthzWatchThreshold: opts.healthzWatchThreshold,
+		Hook:                  opts.hook,
+		HookTimeout:           opts.hookTimeout,
+		HookBlocksReady:       opts.hookBlocksReady,
+	}
+}
+
+func newEtcdConfig() *subnet.EtcdConfig {
+	return &subnet.EtcdConfig{
 		Endpoints: strings.Split(opts.etcdEndpoints, ","),
 		Keyfile:   opts.etcdKeyfile,
 		Certfile:  opts.etcdCertfile,
@@ -91,8 +215,110 @@ func newSubnetManager() (subnet.Manager, error) {
 		Username:  opts.etcdUsername,
 		Password:  opts.etcdPassword,
 	}
+}
+
+func newKubeConfig() (*kube.Config, error) {
+	parts := strings.SplitN(opts.kubeConfigMap, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("--kube-configmap must be in namespace/name form, got %q", opts.kubeConfigMap)
+	}
+
+	nodeName := opts.kubeNodeName
+	if nodeName == "" {
+		nodeName = os.Getenv("NODE_NAME")
+	}
+	if nodeName == "" {
+		var err error
+		if nodeName, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("failed to determine node name: %v", err)
+		}
+	}
+
+	return &kube.Config{
+		APIServer:          opts.kubeAPIServer,
+		NodeName:           nodeName,
+		ConfigMapNamespace: parts[0],
+		ConfigMapName:      parts[1],
+	}, nil
+}
+
+func newSubnetManager() (subnet.Manager, error) {
+	if opts.remote != "" {
+		return remote.NewRemoteManager(opts.remote, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile)
+	}
+
+	if opts.kubeSubnetMgr {
+		cfg, err := newKubeConfig()
+		if err != nil {
+			return nil, err
+		}
+		return kube.NewSubnetManager(cfg)
+	}
+
+	if opts.registryFile != "" {
+		return subnet.NewLocalManagerFile(opts.registryFile)
+	}
+
+	switch opts.etcdAPI {
+	case "v2":
+		return subnet.NewLocalManager(newEtcdConfig())
+	case "v3":
+		return subnet.NewLocalManagerV3(newEtcdConfig())
+	default:
+		return nil, fmt.Errorf("unknown etcd API version: %q", opts.etcdAPI)
+	}
+}
+
+// listenHTTP binds the listeners for the metrics and health checks up front
+// so that a bad address is reported before flanneld starts, and serves them
+// in the background. nm is nil in server mode, where there are no health
+// checks.
+func listenHTTP(nm *network.Manager) error {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if opts.metricsListen != "" {
+		mux(opts.metricsListen).Handle("/metrics", metrics.Handler())
+	}
+	if opts.healthzListen != "" {
+		if nm == nil {
+			return fmt.Errorf("--healthz-listen can't be used with --listen")
+		}
+		mux(opts.healthzListen).Handle("/healthz", healthHandler(nm.Healthy))
+		mux(opts.healthzListen).Handle("/readyz", healthHandler(nm.Ready))
+	}
+
+	for addr, m := range muxes {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
 
-	return subnet.NewLocalManager(cfg)
+		log.Infof("Serving HTTP on %v", addr)
+		go func(m *http.ServeMux) {
+			if err := http.Serve(l, m); err != nil {
+				log.Error("HTTP listener failed: ", err)
+			}
+		}(m)
+	}
+	return nil
+}
+
+// healthHandler serves a health check: 200 if it passes, 503 with the reason
+// if it doesn't
+func healthHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
 }
 
 func main() {
@@ -103,8 +329,9 @@ func main() {
 	// now parse command line args
 	flag.Parse()
 
-	if flag.NArg() > 0 || opts.help {
+	if (flag.NArg() > 0 && flag.Arg(0) != "status") || opts.help {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTION]... status [--diff] [--json]\n", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -116,10 +343,52 @@ func main() {
 
 	flagutil.SetFlagsFromEnv(flag.CommandLine, "FLANNELD")
 
+	// the command line and environment take precedence over the config file
+	explicit := setFlags(flag.CommandLine)
+	cfg := &configFile{}
+	if opts.configFile != "" {
+		c, err := loadConfigFile(opts.configFile)
+		if err == nil {
+			err = c.apply(flag.CommandLine, explicit)
+		}
+		if err != nil {
+			log.Error("Failed to load the config file: ", err)
+			os.Exit(1)
+		}
+		cfg = c
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runStatus(flag.Args()[1:]))
+	}
+
+	if opts.etcdMigrateV2 {
+		n, err := subnet.MigrateEtcdV2ToV3(context.Background(), newEtcdConfig())
+		if err != nil {
+			log.Error("Failed to migrate etcd v2 registry to v3: ", err)
+			os.Exit(1)
+		}
+		log.Infof("Migrated %d keys from etcd v2 to v3", n)
+		os.Exit(0)
+	}
+
 	sm, err := newSubnetManager()
 	if err != nil {
-		log.Error("Failed to create SubnetManager: ", err)
-		os.Exit(1)
+		if !opts.cleanup || opts.cleanupRevoke {
+			log.Error("Failed to create SubnetManager: ", err)
+			os.Exit(1)
+		}
+		// the host can be cleaned up from its subnet files alone
+		log.Warning("Failed to create SubnetManager: ", err)
+		sm = nil
+	}
+
+	if opts.cleanup {
+		if err := network.Cleanup(context.Background(), sm, newNetworkOptions(cfg.overrides), opts.cleanupDryRun, opts.cleanupRevoke); err != nil {
+			log.Error("Cleanup failed: ", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
 	// Register for SIGINT and SIGTERM
@@ -130,6 +399,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var runFunc func(ctx context.Context)
+	var nm *network.Manager
 
 	if opts.listen != "" {
 		if opts.remote != "" {
@@ -141,7 +411,7 @@ func main() {
 			remote.RunServer(ctx, sm, opts.listen, opts.remoteCAFile, opts.remoteCertfile, opts.remoteKeyfile)
 		}
 	} else {
-		nm, err := network.NewNetworkManager(ctx, sm)
+		nm, err = network.NewNetworkManager(ctx, sm, newNetworkOptions(cfg.overrides))
 		if err != nil {
 			log.Error("Failed to create NetworkManager: ", err)
 			os.Exit(1)
@@ -152,6 +422,18 @@ func main() {
 		}
 	}
 
+	if err := listenHTTP(nm); err != nil {
+		log.Error("Failed to listen: ", err)
+		os.Exit(1)
+	}
+
+	if nm != nil && opts.statusSocket != "" {
+		if err := listenStatus(nm, opts.statusSocket); err != nil {
+			log.Error("Failed to listen for status requests: ", err)
+			os.Exit(1)
+		}
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -159,9 +441,22 @@ func main() {
 		wg.Done()
 	}()
 
-	<-sigs
+	hups := make(chan os.Signal, 1)
+	if opts.configFile != "" && nm != nil {
+		signal.Notify(hups, syscall.SIGHUP)
+	}
+
+	for running := true; running; {
+		select {
+		case <-sigs:
+			running = false
+		case <-hups:
+			cfg = reloadConfigFile(nm, cfg, explicit)
+		}
+	}
 	// unregister to get default OS nuke behaviour in case we don't exit cleanly
 	signal.Stop(sigs)
+	signal.Stop(hups)
 
 	log.Info("Exiting...")
 	cancel()
@@ -0,0 +1,447 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// hostNetwork is a network flanneld has run on this host, as found in its
+// subnet file or, failing that, in the network config
+type hostNetwork struct {
+	name     string
+	file     string
+	networks []ip.IP4Net
+	network6 ip.IP6Net
+	// lease is the subnet of this host, zero if not known
+	lease ip.IP4Net
+}
+
+type cleanupStep struct {
+	desc string
+	run  func() error
+}
+
+// Cleanup removes everything flanneld may have set up on this host: the
+// VXLAN and TUN devices, the host-gw routes, the IP masquerade rules and the
+// subnet files, found where opts says they are. With revoke it also gives
+// up the host's leases, which needs sm; otherwise sm may be nil. With
+// dryRun the steps are only listed.
+func Cleanup(ctx context.Context, sm subnet.Manager, opts Options, dryRun, revoke bool) error {
+	nets := findHostNetworks(ctx, sm, &opts)
+
+	var steps []cleanupStep
+	if revoke {
+		nodeID := opts.NodeID
+		if nodeID == "" {
+			nodeID = machineID()
+		}
+		steps = append(steps, leaseSteps(ctx, sm, nets, nodeID)...)
+	}
+
+	links, err := linkSteps()
+	if err != nil {
+		return err
+	}
+	steps = append(steps, links...)
+
+	routes, err := routeSteps(nets)
+	if err != nil {
+		return err
+	}
+	steps = append(steps, routes...)
+	steps = append(steps, ipMasqSteps(nets)...)
+
+	for _, n := range nets {
+		if n.file != "" {
+			path := n.file
+			steps = append(steps, cleanupStep{"file " + path, func() error { return os.Remove(path) }})
+		}
+	}
+
+	if dryRun {
+		if len(steps) == 0 {
+			fmt.Println("Nothing to clean up")
+		}
+		for _, s := range steps {
+			fmt.Println("Would remove", s.desc)
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, s := range steps {
+		log.Info("Removing ", s.desc)
+		if err := s.run(); err != nil {
+			log.Errorf("Failed to remove %s: %v", s.desc, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cleanup steps failed", failed, len(steps))
+	}
+	return nil
+}
+
+// findHostNetworks reads the subnet files, falling back to the config in
+// the registry for the default network if there is no subnet file for it
+func findHostNetworks(ctx context.Context, sm subnet.Manager, opts *Options) []*hostNetwork {
+	var nets []*hostNetwork
+
+	// the config file may have moved the subnet files of some networks
+	overrides := subnetFileOverrides(opts)
+	defaultFile := opts.SubnetFile
+	if path, ok := overrides[""]; ok {
+		defaultFile = path
+		delete(overrides, "")
+	}
+
+	if defaultFile == "" {
+		// no subnet file to read
+	} else if n, err := readHostNetwork("", defaultFile); err == nil {
+		nets = append(nets, n)
+	} else if !os.IsNotExist(err) {
+		log.Warningf("Ignoring %v: %v", defaultFile, err)
+	} else if sm != nil {
+		cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		config, err := sm.GetNetworkConfig(cctx, "")
+		cancel()
+		if err != nil {
+			log.Warningf("No subnet file and failed to retrieve the network config, host-gw routes and IP masquerade rules can't be found: %v", err)
+		} else {
+			nets = append(nets, &hostNetwork{networks: config.Networks, network6: config.IPv6Network})
+		}
+	}
+
+	// flanneld may have run with other subnet file formats before
+	for _, ext := range subnetFileExt {
+		if opts.SubnetDir == "" {
+			break
+		}
+		paths, _ := filepath.Glob(filepath.Join(opts.SubnetDir, "*"+ext))
+		for _, path := range paths {
+			name := strings.TrimSuffix(filepath.Base(path), ext)
+			n, err := readHostNetwork(name, path)
+			if err != nil {
+				log.Warningf("Ignoring %v: %v", path, err)
+				continue
+			}
+			nets = append(nets, n)
+		}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, err := readHostNetwork(name, overrides[name])
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warningf("Ignoring %v: %v", overrides[name], err)
+			}
+			continue
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// readHostNetwork reads a subnet file in any of the formats
+func readHostNetwork(name, path string) (*hostNetwork, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &hostNetwork{name: name, file: path}
+
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("{")) {
+		var c SubnetFileContext
+		if err := json.Unmarshal(trimmed, &c); err != nil {
+			return nil, err
+		}
+		n.setContext(&c)
+		return n, nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "FLANNEL_") {
+			if err := n.setEnv(line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// the yaml format is a "Key: <JSON value>" per line
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var c SubnetFileContext
+		if err := json.Unmarshal([]byte(fmt.Sprintf("{%q: %s}", kv[0], kv[1])), &c); err != nil {
+			return nil, err
+		}
+		n.setContext(&c)
+	}
+
+	return n, s.Err()
+}
+
+func (n *hostNetwork) setEnv(line string) error {
+	kv := strings.SplitN(line, "=", 2)
+	if len(kv) != 2 {
+		return nil
+	}
+
+	switch kv[0] {
+	case "FLANNEL_NETWORK":
+		for _, cidr := range strings.Split(kv[1], ",") {
+			nw, err := parseIP4Net(cidr)
+			if err != nil {
+				return err
+			}
+			n.networks = append(n.networks, nw)
+		}
+
+	case "FLANNEL_SUBNET":
+		sn, err := parseIP4Net(kv[1])
+		if err != nil {
+			return err
+		}
+		n.lease = sn.Network()
+
+	case "FLANNEL_IPV6_NETWORK":
+		return n.network6.UnmarshalJSON([]byte(kv[1]))
+	}
+	return nil
+}
+
+// setContext takes the fields that are set in c
+func (n *hostNetwork) setContext(c *SubnetFileContext) {
+	if len(c.Networks) > 0 {
+		n.networks = c.Networks
+	}
+	if c.Subnet.PrefixLen != 0 {
+		n.lease = c.Subnet
+	}
+	if c.IPv6Network != nil {
+		n.network6 = *c.IPv6Network
+	}
+}
+
+func parseIP4Net(s string) (ip.IP4Net, error) {
+	var n ip.IP4Net
+	err := n.UnmarshalJSON([]byte(s))
+	return n, err
+}
+
+// leaseSteps gives up the leases of the networks. Those of the networks
+// without a subnet file to tell are looked up by the identity of the node.
+func leaseSteps(ctx context.Context, sm subnet.Manager, nets []*hostNetwork, nodeID string) []cleanupStep {
+	var steps []cleanupStep
+	for _, n := range nets {
+		name, sn := n.name, n.lease
+		if sn.PrefixLen == 0 {
+			var err error
+			if sn, err = findNodeLease(ctx, sm, name, nodeID); err != nil {
+				log.Warningf("Not revoking the lease of network %q: %v", name, err)
+				continue
+			}
+		}
+
+		steps = append(steps, cleanupStep{
+			fmt.Sprintf("lease %v of network %q", sn, name),
+			func() error {
+				cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				defer cancel()
+				return sm.RevokeLease(cctx, name, sn)
+			},
+		})
+	}
+	return steps
+}
+
+// findNodeLease returns the subnet of the lease of the node in a network
+func findNodeLease(ctx context.Context, sm subnet.Manager, network, nodeID string) (ip.IP4Net, error) {
+	if nodeID == "" {
+		return ip.IP4Net{}, fmt.Errorf("no subnet file and no node ID to find the lease by")
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	wr, err := sm.WatchLeases(cctx, network, nil)
+	if err != nil {
+		return ip.IP4Net{}, fmt.Errorf("failed to retrieve the leases: %v", err)
+	}
+	for _, l := range wr.Snapshot {
+		if l.Attrs.NodeID == nodeID {
+			return l.Subnet, nil
+		}
+	}
+	return ip.IP4Net{}, fmt.Errorf("no lease of node %q", nodeID)
+}
+
+// isFlannelLink returns true for the devices the vxlan (flannel.<VNI>) and
+// udp (flannel<N>) backends create
+func isFlannelLink(link netlink.Link) bool {
+	name := link.Attrs().Name
+	switch link.Type() {
+	case "vxlan":
+		return strings.HasPrefix(name, "flannel.")
+	case "tuntap":
+		return strings.HasPrefix(name, "flannel")
+	}
+	return false
+}
+
+func linkSteps() ([]cleanupStep, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %v", err)
+	}
+
+	var steps []cleanupStep
+	for _, link := range links {
+		if isFlannelLink(link) {
+			link := link
+			steps = append(steps, cleanupStep{
+				fmt.Sprintf("%s device %s", link.Type(), link.Attrs().Name),
+				func() error { return netlink.LinkDel(link) },
+			})
+		}
+	}
+	return steps, nil
+}
+
+// routeSteps finds the host-gw routes and removes them
+func routeSteps(nets []*hostNetwork) ([]cleanupStep, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %v", err)
+	}
+	flannelLinks := make(map[int]bool)
+	for _, link := range links {
+		if isFlannelLink(link) {
+			flannelLinks[link.Attrs().Index] = true
+		}
+	}
+
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rs, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %v", err)
+		}
+		routes = append(routes, rs...)
+	}
+
+	var steps []cleanupStep
+	for _, route := range hostGWRoutes(routes, flannelLinks, nets) {
+		route := route
+		steps = append(steps, cleanupStep{
+			fmt.Sprintf("route to %v via %v", route.Dst, route.Gw),
+			func() error {
+				err := netlink.RouteDel(&route)
+				if err == syscall.ESRCH {
+					return nil
+				}
+				return err
+			},
+		})
+	}
+	return steps, nil
+}
+
+// hostGWRoutes picks the host-gw routes: routes into the networks via a
+// gateway on a device other than flannel's own, which take their routes
+// with them
+func hostGWRoutes(routes []netlink.Route, flannelLinks map[int]bool, nets []*hostNetwork) []netlink.Route {
+	var hostGW []netlink.Route
+	for _, route := range routes {
+		if route.Dst == nil || route.Gw == nil || flannelLinks[route.LinkIndex] || !inHostNetworks(nets, route.Dst) {
+			continue
+		}
+		hostGW = append(hostGW, route)
+	}
+	return hostGW
+}
+
+func inHostNetworks(nets []*hostNetwork, dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	for _, n := range nets {
+		if dst.IP.To4() != nil {
+			d := ip.FromIPNet(dst)
+			for _, nw := range n.networks {
+				if nw.Contains(d.IP) && uint(ones) >= nw.PrefixLen {
+					return true
+				}
+			}
+		} else if !n.network6.Empty() {
+			if n.network6.Contains(ip.FromIP6(dst.IP)) && uint(ones) >= n.network6.PrefixLen {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ipMasqSteps(nets []*hostNetwork) []cleanupStep {
+	ipt, err := iptables.New()
+	if err != nil {
+		log.Warning("iptables was not found, skipping IP masquerade rules")
+		return nil
+	}
+
+	var steps []cleanupStep
+	for _, n := range nets {
+		for _, rule := range rules(n.networks) {
+			if ok, err := ipt.Exists("nat", "POSTROUTING", rule...); err != nil || !ok {
+				continue
+			}
+
+			rule := rule
+			steps = append(steps, cleanupStep{
+				"iptables rule -t nat -A POSTROUTING " + strings.Join(rule, " "),
+				func() error { return ipt.Delete("nat", "POSTROUTING", rule...) },
+			})
+		}
+	}
+	return steps
+}
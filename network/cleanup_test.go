@@ -0,0 +1,215 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func mustParseIP4Net(t *testing.T, s string) ip.IP4Net {
+	n, err := parseIP4Net(s)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", s, err)
+	}
+	return n
+}
+
+func mustParseIP6Net(t *testing.T, s string) ip.IP6Net {
+	var n ip.IP6Net
+	if err := n.UnmarshalJSON([]byte(s)); err != nil {
+		t.Fatalf("failed to parse %q: %v", s, err)
+	}
+	return n
+}
+
+func TestReadHostNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-cleanup")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	nw6, sn6, gw6 := mustParseIP6Net(t, "fd00:10::/48"), mustParseIP6Net(t, "fd00:10:0:5::/64"), ip.MustParseIP6("fd00:10:0:5::1")
+	c := &SubnetFileContext{
+		Name:        "blue",
+		Networks:    []ip.IP4Net{mustParseIP4Net(t, "10.3.0.0/16"), mustParseIP4Net(t, "10.4.0.0/16")},
+		Subnet:      mustParseIP4Net(t, "10.3.5.0/24"),
+		Gateway:     ip.MustParseIP4("10.3.5.1"),
+		IPv6Network: &nw6,
+		IPv6Subnet:  &sn6,
+		IPv6Gateway: &gw6,
+		MTU:         1450,
+		BackendType: "vxlan",
+		Expiration:  time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	files := map[string]string{
+		// as flanneld wrote it before there were formats
+		"legacy.env": "FLANNEL_NETWORK=10.3.0.0/16\nFLANNEL_SUBNET=10.3.5.1/24\nFLANNEL_MTU=1450\nFLANNEL_IPMASQ=false\n",
+	}
+	for _, format := range []string{"env", "json", "yaml"} {
+		tmpl, err := parseSubnetTemplate(format)
+		if err != nil {
+			t.Fatalf("failed to parse the %v format: %v", format, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, c); err != nil {
+			t.Fatalf("failed to render the %v format: %v", format, err)
+		}
+		files["blue."+format] = buf.String()
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %v: %v", path, err)
+		}
+
+		n, err := readHostNetwork("blue", path)
+		if err != nil {
+			t.Errorf("failed to read %v: %v", name, err)
+			continue
+		}
+
+		want := &hostNetwork{name: "blue", file: path, networks: c.Networks, network6: nw6, lease: c.Subnet}
+		if name == "legacy.env" {
+			want.networks = c.Networks[:1]
+			want.network6 = ip.IP6Net{}
+		}
+		if !reflect.DeepEqual(n, want) {
+			t.Errorf("read %+v from %v, want %+v", n, name, want)
+		}
+	}
+
+	if _, err := readHostNetwork("blue", filepath.Join(dir, "missing.env")); !os.IsNotExist(err) {
+		t.Errorf("reading a missing file returned %v", err)
+	}
+}
+
+func TestInHostNetworks(t *testing.T) {
+	nets := []*hostNetwork{
+		{networks: []ip.IP4Net{mustParseIP4Net(t, "10.3.0.0/16"), mustParseIP4Net(t, "10.4.0.0/16")}},
+		{networks: []ip.IP4Net{mustParseIP4Net(t, "10.8.0.0/16")}, network6: mustParseIP6Net(t, "fd00:10::/48")},
+	}
+
+	for _, tc := range []struct {
+		dst  string
+		want bool
+	}{
+		{"10.3.5.0/24", true},
+		{"10.4.5.0/24", true},
+		{"10.8.0.0/16", true},
+		{"10.3.0.0/15", false},
+		{"10.5.5.0/24", false},
+		{"0.0.0.0/0", false},
+		{"fd00:10:0:5::/64", true},
+		{"fd00:11:0:5::/64", false},
+		{"fd00::/16", false},
+	} {
+		_, dst, err := net.ParseCIDR(tc.dst)
+		if err != nil {
+			t.Fatalf("failed to parse %v: %v", tc.dst, err)
+		}
+		if got := inHostNetworks(nets, dst); got != tc.want {
+			t.Errorf("inHostNetworks(%v) = %v, want %v", tc.dst, got, tc.want)
+		}
+	}
+}
+
+func TestHostGWRoutes(t *testing.T) {
+	nets := []*hostNetwork{{networks: []ip.IP4Net{mustParseIP4Net(t, "10.3.0.0/16")}}}
+
+	route := func(dst, gw string, link int) netlink.Route {
+		r := netlink.Route{LinkIndex: link}
+		if dst != "" {
+			_, r.Dst, _ = net.ParseCIDR(dst)
+		}
+		if gw != "" {
+			r.Gw = net.ParseIP(gw)
+		}
+		return r
+	}
+	routes := []netlink.Route{
+		route("10.3.5.0/24", "192.168.1.5", 2),
+		route("10.3.6.0/24", "192.168.1.6", 2),
+		// the default route
+		route("", "192.168.1.1", 2),
+		// the route of the subnet of the host through docker0
+		route("10.3.7.0/24", "", 3),
+		// a route through a flannel device
+		route("10.3.8.0/24", "10.3.8.0", 4),
+		route("10.5.5.0/24", "192.168.1.7", 2),
+	}
+
+	got := hostGWRoutes(routes, map[int]bool{4: true}, nets)
+	if want := routes[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("hostGWRoutes returned %v, want %v", got, want)
+	}
+}
+
+func TestLeaseStepsByNodeID(t *testing.T) {
+	exp := time.Now().Add(time.Hour)
+	msr := subnet.NewMockRegistry("blue", `{ "Network": "10.3.0.0/16" }`, []subnet.Lease{
+		{Subnet: mustParseIP4Net(t, "10.3.5.0/24"), Attrs: subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}, Expiration: exp},
+		{Subnet: mustParseIP4Net(t, "10.3.6.0/24"), Attrs: subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5"), NodeID: "node-b"}, Expiration: exp},
+	})
+	sm := subnet.NewMockManager(msr)
+	ctx := context.Background()
+
+	// without a subnet file the lease is found by node ID
+	nets := []*hostNetwork{{name: "blue", networks: []ip.IP4Net{mustParseIP4Net(t, "10.3.0.0/16")}}}
+	if steps := leaseSteps(ctx, sm, nets, ""); len(steps) != 0 {
+		t.Fatalf("leases revoked without a node ID: %v", steps[0].desc)
+	}
+	if steps := leaseSteps(ctx, sm, nets, "node-c"); len(steps) != 0 {
+		t.Fatalf("leases revoked for an unknown node ID: %v", steps[0].desc)
+	}
+
+	steps := leaseSteps(ctx, sm, nets, "node-a")
+	if len(steps) != 1 {
+		t.Fatalf("expected one step, got %d", len(steps))
+	}
+	if err := steps[0].run(); err != nil {
+		t.Fatalf("failed to revoke the lease: %v", err)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "blue", nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(wr.Snapshot) != 1 || wr.Snapshot[0].Attrs.NodeID != "node-b" {
+		t.Errorf("unexpected leases after revoking that of node-a: %v", wr.Snapshot)
+	}
+
+	// the lease in the subnet file wins
+	nets[0].lease = mustParseIP4Net(t, "10.3.6.0/24")
+	steps = leaseSteps(ctx, sm, nets, "node-a")
+	if len(steps) != 1 || steps[0].desc != `lease 10.3.6.0/24 of network "blue"` {
+		t.Errorf("unexpected steps for the lease of the subnet file: %v", steps)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func (n *Network) setHookAcquired(ok bool) {
+	n.mux.Lock()
+	n.hookAcquired = ok
+	n.mux.Unlock()
+}
+
+func (n *Network) isHookAcquired() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.hookAcquired
+}
+
+func (n *Network) leaseExpiration() (time.Time, time.Duration) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.expiration, n.renewMargin
+}
+
+// expectedNetworks returns the names of the networks flanneld is meant to
+// run: the allowed ones if there is a list, otherwise the ones it found,
+// except those that were stopped
+func (m *Manager) expectedNetworks() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var names []string
+	if len(m.allowedNetworks) > 0 {
+		for name := range m.allowedNetworks {
+			if !m.stoppedNetworks[name] {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for name := range m.networks {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func healthError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// Ready returns nil once every network has a lease, its backend has taken
+// the initial snapshot of the other hosts' leases, its watches of the
+// registry are live and, if so configured, its acquired hook has succeeded.
+// Otherwise the error lists what is missing.
+func (m *Manager) Ready() error {
+	m.mux.Lock()
+	started := m.started
+	m.mux.Unlock()
+	if !started {
+		return errors.New("networks not retrieved yet")
+	}
+
+	var problems []string
+	for _, name := range m.expectedNetworks() {
+		n, ok := m.getNetwork(name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("network %q is not running", name))
+			continue
+		}
+
+		if exp, _ := n.leaseExpiration(); exp.IsZero() {
+			problems = append(problems, fmt.Sprintf("network %q has no lease", name))
+			continue
+		}
+
+		st := subnet.GetWatchStatus(name)
+		if !st.Live {
+			problems = append(problems, fmt.Sprintf("network %q is not watching the registry", name))
+		} else if !st.Synced {
+			problems = append(problems, fmt.Sprintf("network %q has not handled the other hosts' leases yet", name))
+		}
+
+		if n.hook != "" && m.opts.HookBlocksReady && !n.isHookAcquired() {
+			problems = append(problems, fmt.Sprintf("the acquired hook of network %q has not succeeded yet", name))
+		}
+	}
+	return healthError(problems)
+}
+
+// Healthy returns an error if a lease is about to expire without having
+// been renewed, which happens well before, or if a watch of the registry
+// has been failing for longer than the threshold
+func (m *Manager) Healthy() error {
+	now := time.Now()
+
+	var problems []string
+	m.forEachNetwork(func(n *Network) {
+		exp, margin := n.leaseExpiration()
+		if !exp.IsZero() && exp.Sub(now) < margin/2 {
+			problems = append(problems, fmt.Sprintf("lease of network %q expires at %v and has not been renewed", n.Name, exp))
+		}
+
+		st := subnet.GetWatchStatus(n.Name)
+		if !st.FailingSince.IsZero() && now.Sub(st.FailingSince) > m.opts.HealthzWatchThreshold {
+			problems = append(problems, fmt.Sprintf("watch of network %q has been failing since %v", n.Name, st.FailingSince))
+		}
+	})
+	sort.Strings(problems)
+	return healthError(problems)
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// newTestManager returns a manager of the networks of the env that runs
+// none of them by itself
+func newTestManager(e *testEnv, opts Options) *Manager {
+	opts.setDefaults()
+	return &Manager{
+		ctx:             e.ctx,
+		sm:              e.sm,
+		opts:            opts,
+		allowedNetworks: make(map[string]bool),
+		stoppedNetworks: make(map[string]bool),
+		networks:        make(map[string]*Network),
+		backends:        map[string]*backendEnv{"": {e.extIface, e.bm}},
+	}
+}
+
+// errContains tells whether err is set and mentions s
+func errContains(err error, s string) bool {
+	return err != nil && strings.Contains(err.Error(), s)
+}
+
+func TestReady(t *testing.T) {
+	e := newTestEnv("ready", `{ "Network": "10.3.0.0/16", "Backend": { "Type": "fake" } }`)
+	defer e.cancel()
+	e.hold = make(chan struct{})
+
+	// another host, for the backend to handle
+	if _, err := e.sm.AcquireLease(e.ctx, "ready", &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.1.20")}); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	m := newTestManager(e, Options{})
+	m.allowedNetworks["ready"] = true
+	if err := m.Ready(); !errContains(err, "not retrieved") {
+		t.Errorf("Ready before the networks were retrieved returned %v", err)
+	}
+
+	m.started = true
+	if err := m.Ready(); !errContains(err, `network "ready" is not running`) {
+		t.Errorf("Ready before the network runs returned %v", err)
+	}
+
+	n := NewNetwork(e.ctx, e.sm, e.bm, "ready", false)
+	if err := m.addNetwork(n); err != nil {
+		t.Fatalf("addNetwork failed: %v", err)
+	}
+	done := e.runNetwork(n)
+	e.nextRegistration(t)
+
+	// the backend has been handed the other host's lease but not handled it
+	waitFor(t, "the backend to be handed the leases", func() bool {
+		return errContains(m.Ready(), `network "ready" has not handled the other hosts' leases yet`)
+	})
+	time.Sleep(50 * time.Millisecond)
+	if err := m.Ready(); !errContains(err, "has not handled") {
+		t.Errorf("Ready while the backend handles the leases returned %v", err)
+	}
+
+	close(e.hold)
+	waitFor(t, "the network to be ready", func() bool {
+		return m.Ready() == nil
+	})
+
+	e.cancel()
+	<-done
+	n.Cleanup(false, false)
+	if err := m.Ready(); !errContains(err, `network "ready" has no lease`) {
+		t.Errorf("Ready after the network stopped returned %v", err)
+	}
+}
+
+// failingWatchManager fails every watch of a lease until it is canceled
+type failingWatchManager struct {
+	subnet.Manager
+}
+
+func (failingWatchManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	return subnet.LeaseWatchResult{}, errors.New("registry unavailable")
+}
+
+func TestHealthy(t *testing.T) {
+	e := newTestEnv("healthy", `{ "Network": "10.3.0.0/16", "Backend": { "Type": "fake" } }`)
+	defer e.cancel()
+
+	m := newTestManager(e, Options{HealthzWatchThreshold: time.Nanosecond})
+	n := NewNetwork(e.ctx, e.sm, e.bm, "healthy", false)
+	if err := m.addNetwork(n); err != nil {
+		t.Fatalf("addNetwork failed: %v", err)
+	}
+
+	if err := m.Healthy(); err != nil {
+		t.Errorf("Healthy without a lease returned %v", err)
+	}
+
+	n.setLeaseExpiration(time.Now().Add(2*time.Hour), time.Hour)
+	if err := m.Healthy(); err != nil {
+		t.Errorf("Healthy with a lease that is far from expiring returned %v", err)
+	}
+
+	// the renewal is due at the margin and failed for half of it
+	n.setLeaseExpiration(time.Now().Add(20*time.Minute), time.Hour)
+	if err := m.Healthy(); !errContains(err, `lease of network "healthy" expires`) {
+		t.Errorf("Healthy with an unrenewed lease returned %v", err)
+	}
+	n.setLeaseExpiration(time.Now().Add(2*time.Hour), time.Hour)
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	done := make(chan struct{})
+	go func() {
+		subnet.WatchLease(ctx, failingWatchManager{e.sm}, "healthy", ip.IP4Net{}, make(chan subnet.Event))
+		close(done)
+	}()
+	waitFor(t, "the failing watch to make the network unhealthy", func() bool {
+		return errContains(m.Healthy(), `watch of network "healthy" has been failing since`)
+	})
+
+	cancel()
+	<-done
+	if err := m.Healthy(); err != nil {
+		t.Errorf("Healthy after the failing watch stopped returned %v", err)
+	}
+}
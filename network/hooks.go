@@ -0,0 +1,273 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The events hooks are run for
+const (
+	hookAcquired    = "acquired"
+	hookRenewed     = "renewed"
+	hookLost        = "lost"
+	hookRevoked     = "revoked"
+	hookPeerAdded   = "peer-added"
+	hookPeerRemoved = "peer-removed"
+)
+
+// hookAcquiredRetry is how long to wait before running a failed acquired
+// hook again
+var hookAcquiredRetry = 10 * time.Second
+
+// hookQueueLimit is how many hooks may wait to run before peer events are
+// dropped
+const hookQueueLimit = 100
+
+// HookPeer is the lease of the other host a peer event is about
+type HookPeer struct {
+	Subnet     ip.IP4Net
+	IPv6Subnet *ip.IP6Net `json:",omitempty"`
+	PublicIP   ip.IP4
+}
+
+// HookEvent is passed as JSON on the standard input of the hook
+type HookEvent struct {
+	Event       string
+	Network     string
+	Subnet      ip.IP4Net
+	IPv6Subnet  *ip.IP6Net `json:",omitempty"`
+	MTU         int
+	BackendType string
+	Expiration  time.Time
+	Peer        *HookPeer `json:",omitempty"`
+}
+
+func newHookEvent(event, network string, config *subnet.Config, bn backend.Network) *HookEvent {
+	l := bn.Lease()
+	e := &HookEvent{
+		Event:       event,
+		Network:     network,
+		Subnet:      l.Subnet,
+		MTU:         bn.MTU(),
+		BackendType: config.BackendType,
+		Expiration:  l.Expiration,
+	}
+	if !l.IPv6Subnet.Empty() {
+		sn6 := l.IPv6Subnet
+		e.IPv6Subnet = &sn6
+	}
+	return e
+}
+
+func (e *HookEvent) withPeer(l *subnet.Lease) *HookEvent {
+	pe := *e
+	pe.Peer = &HookPeer{
+		Subnet:   l.Subnet,
+		PublicIP: l.Attrs.PublicIP,
+	}
+	if !l.IPv6Subnet.Empty() {
+		sn6 := l.IPv6Subnet
+		pe.Peer.IPv6Subnet = &sn6
+	}
+	return &pe
+}
+
+// runHook runs the hook with the event type as its argument and the event
+// as JSON on its standard input, killing it after the timeout
+func runHook(path string, timeout time.Duration, e *HookEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(path, e.Event)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+
+	if err != nil {
+		if s := strings.TrimSpace(out.String()); s != "" {
+			return fmt.Errorf("%v: %s", err, s)
+		}
+		return err
+	}
+	return nil
+}
+
+// hookRunner runs the hooks of a network one at a time, in the order of
+// the events, so that the network doesn't wait for them
+type hookRunner struct {
+	path    string
+	timeout time.Duration
+	network string
+	// acquired is called once the acquired hook has succeeded
+	acquired func()
+
+	mux    sync.Mutex
+	queue  []*HookEvent
+	closed bool
+	// wake is signaled when an event is queued or the runner is closed
+	wake chan struct{}
+}
+
+func newHookRunner(path string, timeout time.Duration, network string, acquired func()) *hookRunner {
+	return &hookRunner{
+		path:     path,
+		timeout:  timeout,
+		network:  network,
+		acquired: acquired,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (r *hookRunner) run(e *HookEvent) error {
+	err := runHook(r.path, r.timeout, e)
+	if err != nil {
+		log.Errorf("Hook %v for %v event of network %q failed: %v", r.path, e.Event, r.network, err)
+	} else {
+		log.V(1).Infof("Hook %v for %v event of network %q succeeded", r.path, e.Event, r.network)
+	}
+	return err
+}
+
+// next takes the first queued event. It returns nil if there is none and
+// false once the queue is empty and closed.
+func (r *hookRunner) next() (*HookEvent, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if len(r.queue) == 0 {
+		return nil, !r.closed
+	}
+	e := r.queue[0]
+	r.queue[0] = nil
+	r.queue = r.queue[1:]
+	return e, true
+}
+
+func (r *hookRunner) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the queued hooks until the queue is closed. A failed acquired
+// hook is run again until it succeeds or the lease is lost.
+func (r *hookRunner) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var retry *HookEvent
+	var retryC <-chan time.Time
+
+	acquired := func(e *HookEvent) {
+		if r.run(e) != nil {
+			retry, retryC = e, time.After(hookAcquiredRetry)
+		} else {
+			retry, retryC = nil, nil
+			r.acquired()
+		}
+	}
+
+	for {
+		// a due retry goes ahead of the queued hooks
+		select {
+		case <-retryC:
+			acquired(retry)
+			continue
+		default:
+		}
+
+		e, ok := r.next()
+		if !ok {
+			return
+		}
+		if e == nil {
+			select {
+			case <-r.wake:
+			case <-retryC:
+				acquired(retry)
+			}
+			continue
+		}
+
+		switch e.Event {
+		case hookAcquired:
+			acquired(e)
+		case hookLost:
+			// no point in retrying for a lease that is gone
+			retry, retryC = nil, nil
+			r.run(e)
+		default:
+			r.run(e)
+		}
+	}
+}
+
+// Queue adds an event to the queue without waiting for the hooks to run.
+// Peer events are dropped while the queue is full, so that a slow hook
+// can't hold up the network when many hosts come and go.
+func (r *hookRunner) Queue(e *HookEvent) {
+	r.mux.Lock()
+	if e.Peer != nil && len(r.queue) >= hookQueueLimit {
+		r.mux.Unlock()
+		log.Warningf("Dropped %v hook of network %q for peer %v: %d hooks are waiting to run", e.Event, r.network, e.Peer.Subnet, hookQueueLimit)
+		return
+	}
+	r.queue = append(r.queue, e)
+	r.mux.Unlock()
+
+	r.signal()
+}
+
+// Close makes Run return once it has run the queued hooks
+func (r *hookRunner) Close() {
+	r.mux.Lock()
+	r.closed = true
+	r.mux.Unlock()
+
+	r.signal()
+}
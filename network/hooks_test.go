@@ -0,0 +1,217 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// writeHook writes a shell script to run as a hook into dir
+func writeHook(t *testing.T, dir, script string) string {
+	path := filepath.Join(dir, "hook")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("failed to write the hook: %v", err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flannel-hooks")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestRunHook(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	e := &HookEvent{Event: hookRenewed, Network: "blue", Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.5.0"), PrefixLen: 24}, MTU: 1450}
+
+	// the event type is the argument and the event is on stdin
+	out := filepath.Join(dir, "out")
+	hook := writeHook(t, dir, `echo "$1" > `+out+` && cat >> `+out+"\n")
+	if err := runHook(hook, time.Second, e); err != nil {
+		t.Fatalf("runHook failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read the output of the hook: %v", err)
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	if lines[0] != hookRenewed {
+		t.Errorf("hook got argument %q, want %q", lines[0], hookRenewed)
+	}
+	var got HookEvent
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatalf("hook got invalid JSON %q: %v", lines[1], err)
+	}
+	if got.Event != e.Event || got.Network != e.Network || got.Subnet != e.Subnet || got.MTU != e.MTU {
+		t.Errorf("hook got %+v, want %+v", got, e)
+	}
+
+	// the output of a failed hook is in the error
+	hook = writeHook(t, dir, "echo firewall unreachable\nexit 3\n")
+	if err := runHook(hook, time.Second, e); !errContains(err, "exit status 3: firewall unreachable") {
+		t.Errorf("failed hook returned %v", err)
+	}
+
+	// a hook that runs too long is killed
+	hook = writeHook(t, dir, "exec sleep 10\n")
+	start := time.Now()
+	if err := runHook(hook, 100*time.Millisecond, e); !errContains(err, "timed out after 100ms") {
+		t.Errorf("slow hook returned %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("slow hook was killed after %v", d)
+	}
+}
+
+func TestHookAcquiredRetry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	defer func(d time.Duration) { hookAcquiredRetry = d }(hookAcquiredRetry)
+	hookAcquiredRetry = 50 * time.Millisecond
+
+	// the hook fails until the ok file exists and counts its runs
+	runs, ok := filepath.Join(dir, "runs"), filepath.Join(dir, "ok")
+	hook := writeHook(t, dir, "echo $1 >> "+runs+"\ntest -e "+ok+"\n")
+
+	acquired := make(chan struct{}, 1)
+	r := newHookRunner(hook, time.Second, "blue", func() { acquired <- struct{}{} })
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go r.Run(&wg)
+
+	r.Queue(&HookEvent{Event: hookAcquired})
+	waitFor(t, "the acquired hook to be run again", func() bool {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), hookAcquired) >= 3
+	})
+	select {
+	case <-acquired:
+		t.Fatal("acquired called while the hook fails")
+	default:
+	}
+
+	if err := ioutil.WriteFile(ok, nil, 0644); err != nil {
+		t.Fatalf("failed to write %v: %v", ok, err)
+	}
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquired not called once the hook succeeded")
+	}
+
+	// the hook isn't run again after it has succeeded
+	data, _ := ioutil.ReadFile(runs)
+	time.Sleep(200 * time.Millisecond)
+	if after, _ := ioutil.ReadFile(runs); string(after) != string(data) {
+		t.Errorf("hook run again after it succeeded: %q", after)
+	}
+
+	r.Close()
+	wg.Wait()
+}
+
+func TestHookQueueFull(t *testing.T) {
+	r := newHookRunner("/bin/true", time.Second, "blue", func() {})
+	lease := &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.6.0"), PrefixLen: 24}}
+
+	// nothing runs the hooks, yet queueing doesn't wait
+	done := make(chan struct{})
+	go func() {
+		r.Queue(&HookEvent{Event: hookAcquired})
+		for i := 0; i < 2*hookQueueLimit; i++ {
+			r.Queue((&HookEvent{Event: hookPeerAdded}).withPeer(lease))
+		}
+		r.Queue(&HookEvent{Event: hookRenewed})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queue blocked on a full queue")
+	}
+
+	// peer events were dropped but not those of the lease
+	if len(r.queue) != hookQueueLimit+1 {
+		t.Fatalf("%d events queued, want %d", len(r.queue), hookQueueLimit+1)
+	}
+	if first, last := r.queue[0].Event, r.queue[len(r.queue)-1].Event; first != hookAcquired || last != hookRenewed {
+		t.Errorf("queue runs from %v to %v, want from %v to %v", first, last, hookAcquired, hookRenewed)
+	}
+
+	// the queued hooks are run before Run returns
+	r.Close()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	r.Run(&wg)
+	if e, ok := r.next(); e != nil || ok {
+		t.Errorf("Run returned with %v queued", e)
+	}
+}
+
+func TestHookBlocksReady(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	defer func(d time.Duration) { hookAcquiredRetry = d }(hookAcquiredRetry)
+	hookAcquiredRetry = 50 * time.Millisecond
+
+	e := newTestEnv("hook-ready", `{ "Network": "10.3.0.0/16", "Backend": { "Type": "fake" } }`)
+	defer e.cancel()
+	// the backend handles the leases right away
+	e.hold = make(chan struct{})
+	close(e.hold)
+
+	ok := filepath.Join(dir, "ok")
+	m := newTestManager(e, Options{HookBlocksReady: true})
+	m.started = true
+	n := NewNetwork(e.ctx, e.sm, e.bm, "hook-ready", false)
+	n.hook, n.hookTimeout = writeHook(t, dir, "test -e "+ok+"\n"), time.Second
+	if err := m.addNetwork(n); err != nil {
+		t.Fatalf("addNetwork failed: %v", err)
+	}
+	done := e.runNetwork(n)
+	e.nextRegistration(t)
+
+	waitFor(t, "the failing acquired hook to be the only thing holding up readiness", func() bool {
+		err := m.Ready()
+		return errContains(err, `the acquired hook of network "hook-ready" has not succeeded yet`) && !errContains(err, "handled")
+	})
+
+	if err := ioutil.WriteFile(ok, nil, 0644); err != nil {
+		t.Fatalf("failed to write %v: %v", ok, err)
+	}
+	waitFor(t, "the network to be ready", func() bool {
+		return m.Ready() == nil
+	})
+
+	e.cancel()
+	<-done
+}
@@ -24,26 +24,37 @@ import (
 	"github.com/coreos/flannel/pkg/ip"
 )
 
-func rules(ipn ip.IP4Net) [][]string {
-	n := ipn.String()
+func rules(networks []ip.IP4Net) [][]string {
+	var rules [][]string
 
-	return [][]string{
-		// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
-		{"-s", n, "-d", n, "-j", "RETURN"},
-		// NAT if it's not multicast traffic
-		{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"},
-		// Masquerade anything headed towards flannel from the host
-		{"!", "-s", n, "-d", n, "-j", "MASQUERADE"},
+	// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0),
+	// which spans all of the network's blocks
+	for _, src := range networks {
+		for _, dst := range networks {
+			rules = append(rules, []string{"-s", src.String(), "-d", dst.String(), "-j", "RETURN"})
+		}
+	}
+
+	for _, ipn := range networks {
+		n := ipn.String()
+		rules = append(rules,
+			// NAT if it's not multicast traffic
+			[]string{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"},
+			// Masquerade anything headed towards flannel from the host
+			[]string{"!", "-s", n, "-d", n, "-j", "MASQUERADE"},
+		)
 	}
+
+	return rules
 }
 
-func setupIPMasq(ipn ip.IP4Net) error {
+func setupIPMasq(networks []ip.IP4Net) error {
 	ipt, err := iptables.New()
 	if err != nil {
 		return fmt.Errorf("failed to set up IP Masquerade. iptables was not found")
 	}
 
-	for _, rule := range rules(ipn) {
+	for _, rule := range rules(networks) {
 		log.Info("Adding iptables rule: ", strings.Join(rule, " "))
 		err = ipt.AppendUnique("nat", "POSTROUTING", rule...)
 		if err != nil {
@@ -54,13 +65,13 @@ func setupIPMasq(ipn ip.IP4Net) error {
 	return nil
 }
 
-func teardownIPMasq(ipn ip.IP4Net) error {
+func teardownIPMasq(networks []ip.IP4Net) error {
 	ipt, err := iptables.New()
 	if err != nil {
 		return fmt.Errorf("failed to teardown IP Masquerade. iptables was not found")
 	}
 
-	for _, rule := range rules(ipn) {
+	for _, rule := range rules(networks) {
 		log.Info("Deleting iptables rule: ", strings.Join(rule, " "))
 		err = ipt.Delete("nat", "POSTROUTING", rule...)
 		if err != nil {
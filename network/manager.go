@@ -17,13 +17,13 @@ package network
 
 import (
 	"errors"
-	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
@@ -35,43 +35,113 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-type CmdLineOpts struct {
-	publicIP      string
-	ipMasq        bool
-	subnetFile    string
-	subnetDir     string
-	iface         string
-	networks      string
-	watchNetworks bool
+// Options configures a Manager. The zero value of a field picks its
+// default, if it has one.
+type Options struct {
+	// Backends are the backend types the networks may use. Required.
+	Backends *backend.Registry
+
+	// Iface is the name or IP of the interface to use for inter-host
+	// communication, by default the interface of the default route
+	Iface string
+	// PublicIP and PublicIPv6 are the addresses other hosts reach this host
+	// at, by default the addresses of Iface
+	PublicIP   string
+	PublicIPv6 string
+	// IPMasq sets up IP masquerading for traffic leaving the networks
+	IPMasq bool
+
+	// Networks lists the networks to run. With a list or WatchNetworks the
+	// manager runs in multi-network mode, otherwise it runs the default
+	// network.
+	Networks []string
+	// WatchNetworks runs the networks added to the registry while the
+	// manager runs, the listed ones only if there is a list
+	WatchNetworks bool
+	// Overrides holds the settings of single networks, by name
+	Overrides map[string]NetworkOptions
+
+	// SubnetFile is where the subnet file of the default network is
+	// written and SubnetDir where those of the networks of multi-network
+	// mode are. Empty to write none.
+	SubnetFile string
+	SubnetDir  string
+	// SubnetFileFormat is env (the default), json or yaml
+	SubnetFileFormat string
+	// SubnetTemplates are rendered whenever a subnet file is written, given
+	// as template:dest
+	SubnetTemplates []string
+
+	// SubnetLen is the prefix length of the subnets to request, by default
+	// the SubnetLen of the network
+	SubnetLen uint
+	// NodeID identifies this host to find its lease again when its public
+	// IP changes, by default its /etc/machine-id
+	NodeID string
+
+	// Teardown removes the devices and routes of the networks and
+	// RevokeLease gives up their leases when they stop
+	Teardown    bool
+	RevokeLease bool
+
+	// HealthzWatchThreshold is how long a watch of the registry may keep
+	// failing before Healthy fails, 5 minutes by default
+	HealthzWatchThreshold time.Duration
+
+	// Hook is run on lease and peer events, for up to HookTimeout (30
+	// seconds by default). With HookBlocksReady, Ready fails until the hook
+	// has succeeded for the acquired lease.
+	Hook            string
+	HookTimeout     time.Duration
+	HookBlocksReady bool
 }
 
-var errAlreadyExists = errors.New("already exists")
-
-var opts CmdLineOpts
-
-func init() {
-	flag.StringVar(&opts.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication")
-	flag.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where env variables (subnet, MTU, ... ) will be written to")
-	flag.StringVar(&opts.subnetDir, "subnet-dir", "/run/flannel/networks", "directory where files with env variables (subnet, MTU, ...) will be written to")
-	flag.StringVar(&opts.iface, "iface", "", "interface to use (IP or name) for inter-host communication")
-	flag.StringVar(&opts.networks, "networks", "", "run in multi-network mode and service the specified networks")
-	flag.BoolVar(&opts.watchNetworks, "watch-networks", false, "run in multi-network mode and watch for networks from 'networks' or all networks")
-	flag.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
+func (o *Options) setDefaults() {
+	if o.SubnetFileFormat == "" {
+		o.SubnetFileFormat = "env"
+	}
+	if o.HealthzWatchThreshold == 0 {
+		o.HealthzWatchThreshold = 5 * time.Minute
+	}
+	if o.HookTimeout == 0 {
+		o.HookTimeout = 30 * time.Second
+	}
 }
 
+var errAlreadyExists = errors.New("already exists")
+
 type Manager struct {
 	ctx             context.Context
 	sm              subnet.Manager
-	bm              backend.Manager
+	opts            Options
 	allowedNetworks map[string]bool
+	// stoppedNetworks were stopped with StopNetwork and aren't started
+	// again, allowed or not, until StartNetwork
+	stoppedNetworks map[string]bool
+	overrides       map[string]NetworkOptions
 	mux             sync.Mutex
 	networks        map[string]*Network
-	watch           bool
-	ipMasq          bool
-	extIface        *backend.ExternalInterface
+	multiNetwork    bool
+	// backends holds the backend manager of the networks using the
+	// interface of the options under "" and those of the interfaces and
+	// public IPs networks override
+	backends map[string]*backendEnv
+	wg       sync.WaitGroup
+	// started is set once the networks to run have been retrieved
+	started         bool
+	subnetFormat    *template.Template
+	subnetExt       string
+	subnetTemplates []subnetTemplate
 }
 
 func (m *Manager) isNetAllowed(name string) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.stoppedNetworks[name] {
+		return false
+	}
+
 	// If allowedNetworks is empty all networks are allowed
 	if len(m.allowedNetworks) > 0 {
 		_, ok := m.allowedNetworks[name]
@@ -80,39 +150,97 @@ func (m *Manager) isNetAllowed(name string) bool {
 	return true
 }
 
+// isMultiNetwork is decided at startup, a reload can't change it
 func (m *Manager) isMultiNetwork() bool {
-	return len(m.allowedNetworks) > 0 || m.watch
+	return m.multiNetwork
 }
 
-func NewNetworkManager(ctx context.Context, sm subnet.Manager) (*Manager, error) {
-	extIface, err := lookupExtIface(opts.iface)
+func NewNetworkManager(ctx context.Context, sm subnet.Manager, opts Options) (*Manager, error) {
+	if opts.Backends == nil {
+		return nil, fmt.Errorf("no backend registry")
+	}
+	opts.setDefaults()
+
+	extIface, err := lookupExtIface(opts.Iface, opts.PublicIP, opts.PublicIPv6)
 	if err != nil {
 		return nil, err
 	}
 
-	bm := backend.NewManager(ctx, sm, extIface)
+	nodeID := opts.NodeID
+	if nodeID == "" {
+		nodeID = machineID()
+	}
+
+	if opts.SubnetLen != 0 || nodeID != "" {
+		sm = &nodeSubnetManager{sm, opts.SubnetLen, nodeID}
+	}
+
+	ext, ok := subnetFileExt[opts.SubnetFileFormat]
+	if !ok {
+		return nil, fmt.Errorf("unknown subnet file format %q", opts.SubnetFileFormat)
+	}
+	format, err := parseSubnetTemplate(opts.SubnetFileFormat)
+	if err != nil {
+		return nil, err
+	}
+	tmpls, err := parseSubnetTemplates(opts.SubnetTemplates)
+	if err != nil {
+		return nil, err
+	}
+
+	bm := backend.NewManager(ctx, sm, extIface, opts.Backends)
 
 	manager := &Manager{
 		ctx:             ctx,
 		sm:              sm,
-		bm:              bm,
+		opts:            opts,
 		allowedNetworks: make(map[string]bool),
+		stoppedNetworks: make(map[string]bool),
+		overrides:       opts.Overrides,
 		networks:        make(map[string]*Network),
-		watch:           opts.watchNetworks,
-		ipMasq:          opts.ipMasq,
-		extIface:        extIface,
+		backends:        map[string]*backendEnv{"": {extIface, bm}},
+		subnetFormat:    format,
+		subnetExt:       ext,
+		subnetTemplates: tmpls,
 	}
 
-	for _, name := range strings.Split(opts.networks, ",") {
+	for _, name := range opts.Networks {
 		if name != "" {
 			manager.allowedNetworks[name] = true
 		}
 	}
+	manager.multiNetwork = len(manager.allowedNetworks) > 0 || opts.WatchNetworks
 
 	return manager, nil
 }
 
-func lookupExtIface(ifname string) (*backend.ExternalInterface, error) {
+// nodeSubnetManager fills in the attributes of this node the backends
+// don't know about when they acquire a lease: the prefix length of the
+// subnet to request and the node's identity
+type nodeSubnetManager struct {
+	subnet.Manager
+	subnetLen uint
+	nodeID    string
+}
+
+func (sm *nodeSubnetManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	attrs.SubnetLen = sm.subnetLen
+	attrs.NodeID = sm.nodeID
+	return sm.Manager.AcquireLease(ctx, network, attrs)
+}
+
+// machineID returns the systemd machine ID of this host, or "" if there is
+// none, in which case leases are found by public IP alone
+func machineID() string {
+	id, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		log.Warningf("Failed to read machine ID, leases will be matched by public IP only: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+func lookupExtIface(ifname, publicIP, publicIPv6 string) (*backend.ExternalInterface, error) {
 	var iface *net.Interface
 	var iaddr net.IP
 	var err error
@@ -149,10 +277,10 @@ func lookupExtIface(ifname string) (*backend.ExternalInterface, error) {
 
 	var eaddr net.IP
 
-	if len(opts.publicIP) > 0 {
-		eaddr = net.ParseIP(opts.publicIP)
+	if len(publicIP) > 0 {
+		eaddr = net.ParseIP(publicIP)
 		if eaddr == nil {
-			return nil, fmt.Errorf("invalid public IP address: %s", opts.publicIP)
+			return nil, fmt.Errorf("invalid public IP address: %s", publicIP)
 		}
 	}
 
@@ -163,40 +291,28 @@ func lookupExtIface(ifname string) (*backend.ExternalInterface, error) {
 	log.Infof("Using %s as external interface", iaddr)
 	log.Infof("Using %s as external endpoint", eaddr)
 
-	return &backend.ExternalInterface{
-		Iface:     iface,
-		IfaceAddr: iaddr,
-		ExtAddr:   eaddr,
-	}, nil
-}
-
-func writeSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
-	dir, name := filepath.Split(path)
-	os.MkdirAll(dir, 0755)
-
-	tempFile := filepath.Join(dir, "."+name)
-	f, err := os.Create(tempFile)
-	if err != nil {
-		return err
+	// IPv6 is optional: it is only needed by backends routing dual-stack
+	// networks over the underlay
+	iaddr6, _ := ip.GetIfaceIP6Addr(iface)
+	eaddr6 := iaddr6
+	if len(publicIPv6) > 0 {
+		eaddr6 = net.ParseIP(publicIPv6)
+		if eaddr6 == nil || eaddr6.To4() != nil {
+			return nil, fmt.Errorf("invalid public IPv6 address: %s", publicIPv6)
+		}
 	}
 
-	// Write out the first usable IP by incrementing
-	// sn.IP by one
-	sn := bn.Lease().Subnet
-	sn.IP += 1
-
-	fmt.Fprintf(f, "FLANNEL_NETWORK=%s\n", nw)
-	fmt.Fprintf(f, "FLANNEL_SUBNET=%s\n", sn)
-	fmt.Fprintf(f, "FLANNEL_MTU=%d\n", bn.MTU())
-	_, err = fmt.Fprintf(f, "FLANNEL_IPMASQ=%v\n", ipMasq)
-	f.Close()
-	if err != nil {
-		return err
+	if eaddr6 != nil {
+		log.Infof("Using %s as external IPv6 endpoint", eaddr6)
 	}
 
-	// rename(2) the temporary file to the desired location so that it becomes
-	// atomically visible with the contents
-	return os.Rename(tempFile, path)
+	return &backend.ExternalInterface{
+		Iface:       iface,
+		IfaceAddr:   iaddr,
+		ExtAddr:     eaddr,
+		IfaceV6Addr: iaddr6,
+		ExtV6Addr:   eaddr6,
+	}, nil
 }
 
 func (m *Manager) addNetwork(n *Network) error {
@@ -232,20 +348,160 @@ func (m *Manager) forEachNetwork(f func(n *Network)) {
 	m.mux.Unlock()
 }
 
+// SetAllowedNetworks changes the networks run in multi-network mode.
+// Networks that are no longer allowed are torn down and their leases given
+// up, and the newly allowed ones in the registry are started. Without
+// WatchNetworks the list can't be emptied, as that would mean running the
+// default network instead. Stopped networks stay stopped.
+func (m *Manager) SetAllowedNetworks(names []string) error {
+	if !m.isMultiNetwork() {
+		return fmt.Errorf("not in multi-network mode")
+	}
+
+	allowed := make(map[string]bool)
+	for _, name := range names {
+		if name != "" {
+			allowed[name] = true
+		}
+	}
+	if len(allowed) == 0 && !m.opts.WatchNetworks {
+		return fmt.Errorf("the list of networks can't be emptied without watching networks")
+	}
+
+	m.mux.Lock()
+	m.allowedNetworks = allowed
+	started := m.started
+	var removed []*Network
+	for name, n := range m.networks {
+		if len(allowed) > 0 && !allowed[name] {
+			removed = append(removed, n)
+		}
+	}
+	m.mux.Unlock()
+
+	for _, n := range removed {
+		log.Infof("Network %q is no longer allowed, removing it", n.Name)
+		n.Remove()
+	}
+
+	if !started {
+		// Run starts the allowed networks
+		return nil
+	}
+
+	result, err := m.sm.WatchNetworks(m.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve networks: %v", err)
+	}
+	for _, name := range result.Snapshot {
+		if m.isNetAllowed(name) {
+			if err := m.startNetwork(name); err != nil && err != errAlreadyExists {
+				log.Errorf("Network %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// startNetwork runs the network unless it is running already
+func (m *Manager) startNetwork(name string) error {
+	if _, ok := m.getNetwork(name); ok {
+		return errAlreadyExists
+	}
+
+	n, err := m.newNetwork(m.ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := m.addNetwork(n); err != nil {
+		return err
+	}
+
+	log.Infof("Network added: %v", name)
+	m.wg.Add(1)
+	go func() {
+		m.runNetwork(n)
+		m.wg.Done()
+	}()
+	return nil
+}
+
+// Networks returns the names of the running networks
+func (m *Manager) Networks() []string {
+	var names []string
+	m.forEachNetwork(func(n *Network) {
+		names = append(names, n.Name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+// StartNetwork runs a network of the registry, adding it to the allowed
+// networks if there is a list of them, even if it was stopped. Only the default network ("") can
+// be started outside multi-network mode.
+func (m *Manager) StartNetwork(name string) error {
+	if m.isMultiNetwork() == (name == "") {
+		if name == "" {
+			return fmt.Errorf("the default network can't be run in multi-network mode")
+		}
+		return fmt.Errorf("network %q can't be run outside multi-network mode", name)
+	}
+
+	m.mux.Lock()
+	if name != "" && (len(m.allowedNetworks) > 0 || !m.opts.WatchNetworks) {
+		m.allowedNetworks[name] = true
+	}
+	delete(m.stoppedNetworks, name)
+	m.mux.Unlock()
+
+	if err := m.startNetwork(name); err != nil {
+		return fmt.Errorf("network %q: %v", name, err)
+	}
+	return nil
+}
+
+// StopNetwork stops a network and waits until it has been cleaned up, torn
+// down and its lease given up if the options say so. It isn't started
+// again, not even when watching all networks, until StartNetwork.
+func (m *Manager) StopNetwork(name string) error {
+	m.mux.Lock()
+	n, ok := m.networks[name]
+	if ok {
+		m.stoppedNetworks[name] = true
+	}
+	m.mux.Unlock()
+
+	if !ok {
+		return fmt.Errorf("network %q isn't running", name)
+	}
+
+	n.Cancel()
+	<-n.done
+	return nil
+}
+
+// NetworkStatus reports on a running network like Status does
+func (m *Manager) NetworkStatus(name string, diff bool) (NetworkStatus, error) {
+	n, ok := m.getNetwork(name)
+	if !ok {
+		return NetworkStatus{}, fmt.Errorf("network %q isn't running", name)
+	}
+	return n.status(diff), nil
+}
+
 func (m *Manager) runNetwork(n *Network) {
-	n.Run(m.extIface, func(bn backend.Network) {
+	n.Run(n.extIface, func(bn backend.Network) {
 		if m.isMultiNetwork() {
 			log.Infof("%v: lease acquired: %v", n.Name, bn.Lease().Subnet)
 
-			path := filepath.Join(opts.subnetDir, n.Name) + ".env"
-			if err := writeSubnetFile(path, n.Config.Network, m.ipMasq, bn); err != nil {
+			if err := m.writeSubnetFiles(n.subnetFile, newSubnetFileContext(n.Name, n.config(), n.ipMasq, bn)); err != nil {
 				log.Warningf("%v failed to write subnet file: %s", n.Name, err)
 				return
 			}
 		} else {
 			log.Infof("Lease acquired: %v", bn.Lease().Subnet)
 
-			if err := writeSubnetFile(opts.subnetFile, n.Config.Network, m.ipMasq, bn); err != nil {
+			if err := m.writeSubnetFiles(n.subnetFile, newSubnetFileContext(n.Name, n.config(), n.ipMasq, bn)); err != nil {
 				log.Warningf("%v failed to write subnet file: %s", n.Name, err)
 				return
 			}
@@ -253,25 +509,31 @@ func (m *Manager) runNetwork(n *Network) {
 		}
 	})
 
+	n.Cleanup(m.opts.Teardown, m.opts.RevokeLease)
 	m.delNetwork(n)
+	close(n.done)
 }
 
-func (m *Manager) watchNetworks() {
+func (m *Manager) watchNetworks(ctx context.Context) {
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 
 	events := make(chan []subnet.Event)
 	wg.Add(1)
 	go func() {
-		subnet.WatchNetworks(m.ctx, m.sm, events)
+		subnet.WatchNetworks(ctx, m.sm, events)
 		wg.Done()
 	}()
 	// skip over the initial snapshot
-	<-events
+	select {
+	case <-events:
+	case <-ctx.Done():
+		return
+	}
 
 	for {
 		select {
-		case <-m.ctx.Done():
+		case <-ctx.Done():
 			return
 
 		case evtBatch := <-events:
@@ -284,20 +546,10 @@ func (m *Manager) watchNetworks() {
 
 				switch e.Type {
 				case subnet.EventAdded:
-					n := NewNetwork(m.ctx, m.sm, m.bm, netname, m.ipMasq)
-					if err := m.addNetwork(n); err != nil {
+					if err := m.startNetwork(netname); err != nil {
 						log.Infof("Network %q: %v", netname, err)
-						continue
 					}
 
-					log.Infof("Network added: %v", netname)
-
-					wg.Add(1)
-					go func() {
-						m.runNetwork(n)
-						wg.Done()
-					}()
-
 				case subnet.EventRemoved:
 					log.Infof("Network removed: %v", netname)
 
@@ -306,24 +558,28 @@ func (m *Manager) watchNetworks() {
 						log.Warningf("Network %v unknown; ignoring EventRemoved", netname)
 						continue
 					}
-					n.Cancel()
+					n.Remove()
 				}
 			}
 		}
 	}
 }
 
+// Run runs the networks until ctx is done. In multi-network mode these are
+// the allowed networks of the registry and, with WatchNetworks, those
+// added later on. Networks can also be started and stopped with
+// StartNetwork and StopNetwork.
 func (m *Manager) Run(ctx context.Context) {
-	wg := sync.WaitGroup{}
-
 	if m.isMultiNetwork() {
 		for {
 			// Try adding initial networks
 			result, err := m.sm.WatchNetworks(ctx, nil)
 			if err == nil {
-				for _, n := range result.Snapshot {
-					if m.isNetAllowed(n) {
-						m.networks[n] = NewNetwork(ctx, m.sm, m.bm, n, m.ipMasq)
+				for _, name := range result.Snapshot {
+					if m.isNetAllowed(name) {
+						if err := m.startNetwork(name); err != nil && err != errAlreadyExists {
+							log.Errorf("Network %q: %v", name, err)
+						}
 					}
 				}
 				break
@@ -337,23 +593,31 @@ func (m *Manager) Run(ctx context.Context) {
 			case <-time.After(time.Second):
 			}
 		}
-	} else {
-		m.networks[""] = NewNetwork(ctx, m.sm, m.bm, "", m.ipMasq)
+	} else if err := m.startNetwork(""); err != nil && err != errAlreadyExists {
+		log.Errorf("Network %q: %v", "", err)
+	}
+
+	m.mux.Lock()
+	m.started = true
+	m.mux.Unlock()
+
+	if m.opts.WatchNetworks {
+		m.watchNetworks(ctx)
 	}
 
-	// Run existing networks
+	<-ctx.Done()
 	m.forEachNetwork(func(n *Network) {
-		wg.Add(1)
-		go func(n *Network) {
-			m.runNetwork(n)
-			wg.Done()
-		}(n)
+		n.Cancel()
 	})
+	m.wg.Wait()
 
-	if opts.watchNetworks {
-		m.watchNetworks()
+	m.mux.Lock()
+	backends := make([]*backendEnv, 0, len(m.backends))
+	for _, be := range m.backends {
+		backends = append(backends, be)
+	}
+	m.mux.Unlock()
+	for _, be := range backends {
+		be.bm.Wait()
 	}
-
-	wg.Wait()
-	m.bm.Wait()
 }
@@ -0,0 +1,146 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const managerTestConfig = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "fake" } }`
+
+// runManager runs the networks of a multi-network manager until the env is
+// canceled and closes the returned channel once Run has returned
+func (e *testEnv) runManager(m *Manager) chan struct{} {
+	m.multiNetwork = true
+	done := make(chan struct{})
+	go func() {
+		m.Run(e.ctx)
+		close(done)
+	}()
+	return done
+}
+
+func expectNetworks(t *testing.T, m *Manager, want ...string) {
+	waitFor(t, fmt.Sprintf("the running networks to be %v", want), func() bool {
+		return reflect.DeepEqual(m.Networks(), want)
+	})
+}
+
+// addNetwork adds a network to the registry and waits for it to be
+// registered. As the mock registry reports networks by diffing its
+// snapshots, this also means the events before have been handled.
+func (e *testEnv) addNetwork(t *testing.T, name string) *fakeNetwork {
+	if err := e.msr.CreateNetwork(e.ctx, name, managerTestConfig); err != nil {
+		t.Fatalf("CreateNetwork failed: %v", err)
+	}
+	return e.nextRegistration(t)
+}
+
+func TestStartStopNetwork(t *testing.T) {
+	e := newTestEnv("blue", managerTestConfig)
+	defer e.cancel()
+
+	m := newTestManager(e, Options{WatchNetworks: true})
+	done := e.runManager(m)
+	e.nextRegistration(t)
+	e.addNetwork(t, "green")
+	expectNetworks(t, m, "blue", "green")
+
+	st, err := m.NetworkStatus("green", false)
+	if err != nil {
+		t.Fatalf("NetworkStatus failed: %v", err)
+	}
+	if st.Name != "green" || st.BackendType != "fake" || st.Subnet == nil {
+		t.Errorf("unexpected status of a running network: %+v", st)
+	}
+	if _, err := m.NetworkStatus("red", false); !errContains(err, `network "red" isn't running`) {
+		t.Errorf("NetworkStatus of an unknown network returned %v", err)
+	}
+
+	if err := m.StopNetwork("green"); err != nil {
+		t.Fatalf("StopNetwork failed: %v", err)
+	}
+	expectNetworks(t, m, "blue")
+	if _, err := m.NetworkStatus("green", false); err == nil {
+		t.Errorf("NetworkStatus of a stopped network succeeded")
+	}
+	if got := m.expectedNetworks(); !reflect.DeepEqual(got, []string{"blue"}) {
+		t.Errorf("expected networks are %v after stopping green", got)
+	}
+	if err := m.StopNetwork("green"); !errContains(err, `network "green" isn't running`) {
+		t.Errorf("StopNetwork of a stopped network returned %v", err)
+	}
+
+	// the network is not started again when it reappears in the registry
+	if err := e.msr.DeleteNetwork(e.ctx, "green"); err != nil {
+		t.Fatalf("DeleteNetwork failed: %v", err)
+	}
+	e.addNetwork(t, "red")
+	if err := e.msr.CreateNetwork(e.ctx, "green", managerTestConfig); err != nil {
+		t.Fatalf("CreateNetwork failed: %v", err)
+	}
+	e.addNetwork(t, "yellow")
+	expectNetworks(t, m, "blue", "red", "yellow")
+
+	if err := m.StartNetwork("green"); err != nil {
+		t.Fatalf("StartNetwork failed: %v", err)
+	}
+	e.nextRegistration(t)
+	expectNetworks(t, m, "blue", "green", "red", "yellow")
+	if err := m.StartNetwork("green"); !errContains(err, "already exists") {
+		t.Errorf("StartNetwork of a running network returned %v", err)
+	}
+	if err := m.StartNetwork(""); !errContains(err, "can't be run in multi-network mode") {
+		t.Errorf("StartNetwork of the default network returned %v", err)
+	}
+
+	e.cancel()
+	<-done
+}
+
+func TestStopLastAllowedNetwork(t *testing.T) {
+	e := newTestEnv("blue", managerTestConfig)
+	defer e.cancel()
+
+	m := newTestManager(e, Options{Networks: []string{"blue"}, WatchNetworks: true})
+	m.allowedNetworks["blue"] = true
+	done := e.runManager(m)
+	e.nextRegistration(t)
+
+	// with blue stopped the list of networks isn't empty, which would let
+	// any network run
+	if err := m.StopNetwork("blue"); err != nil {
+		t.Fatalf("StopNetwork failed: %v", err)
+	}
+	if err := e.msr.CreateNetwork(e.ctx, "red", managerTestConfig); err != nil {
+		t.Fatalf("CreateNetwork failed: %v", err)
+	}
+	e.expectNoRegistration(t)
+	expectNetworks(t, m)
+	if got := m.expectedNetworks(); len(got) != 0 {
+		t.Errorf("expected networks are %v with the only allowed one stopped", got)
+	}
+
+	if err := m.StartNetwork("blue"); err != nil {
+		t.Fatalf("StartNetwork failed: %v", err)
+	}
+	e.nextRegistration(t)
+	expectNetworks(t, m, "blue")
+
+	e.cancel()
+	<-done
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"time"
+
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+var (
+	leaseExpiration = metrics.NewGaugeVec("flannel_lease_expiration_timestamp_seconds",
+		"Time the subnet lease of this host in a network expires, in seconds since the epoch.", "network")
+	leaseRenewals = metrics.NewCounterVec("flannel_lease_renewals_total",
+		"Number of attempts to renew the subnet lease of this host in a network, by result (success or failure).", "network", "result")
+)
+
+// setLeaseExpiration records when the lease expires for the metrics and the
+// health checks. A zero exp means the network has no lease.
+func (n *Network) setLeaseExpiration(exp time.Time, margin time.Duration) {
+	n.mux.Lock()
+	n.expiration = exp
+	n.renewMargin = margin
+	n.mux.Unlock()
+
+	if exp.IsZero() {
+		leaseExpiration.Delete(n.Name)
+	} else {
+		leaseExpiration.Set(float64(exp.UnixNano())/float64(time.Second), n.Name)
+	}
+}
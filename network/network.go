@@ -15,8 +15,12 @@
 package network
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,25 +31,47 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-const (
-	renewMargin = time.Hour
-)
-
 var (
 	errInterrupted = errors.New("interrupted")
-	errCanceled    = errors.New("canceled")
+	// errBackendChanged interrupts the network to register it with another
+	// backend type or backend settings
+	errBackendChanged = errors.New("backend changed")
+	errCanceled       = errors.New("canceled")
 )
 
 type Network struct {
-	Name   string
+	Name string
+	// Config is the config the network runs with. It is replaced when the
+	// config changes, with mux held.
 	Config *subnet.Config
 
-	ctx        context.Context
-	cancelFunc context.CancelFunc
-	sm         subnet.Manager
-	bm         backend.Manager
-	ipMasq     bool
-	bn         backend.Network
+	ctx         context.Context
+	cancelFunc  context.CancelFunc
+	sm          subnet.Manager
+	bm          backend.Manager
+	ipMasq      bool
+	extIface    *backend.ExternalInterface
+	subnetFile  string
+	hook        string
+	hookTimeout time.Duration
+	// teardown removes the devices and routes of the backend when the
+	// network is registered again with the same backend
+	teardown bool
+	// done is closed once the network has stopped and been cleaned up
+	done chan struct{}
+	bn   backend.Network
+	// removed is set when the network has been deleted from the registry
+	removed bool
+
+	// mux guards what the health checks and the status read while the
+	// network runs, along with bn which is only set with it held
+	mux         sync.Mutex
+	backendType string
+	// expiration of the lease, zero while there is none
+	expiration  time.Time
+	renewMargin time.Duration
+	// hookAcquired is set once the acquired hook has succeeded
+	hookAcquired bool
 }
 
 func NewNetwork(ctx context.Context, sm subnet.Manager, bm backend.Manager, name string, ipMasq bool) *Network {
@@ -58,6 +84,7 @@ func NewNetwork(ctx context.Context, sm subnet.Manager, bm backend.Manager, name
 		ipMasq:     ipMasq,
 		ctx:        ctx,
 		cancelFunc: cf,
+		done:       make(chan struct{}),
 	}
 }
 
@@ -69,25 +96,29 @@ func wrapError(desc string, err error) error {
 }
 
 func (n *Network) init() error {
-	var err error
-
-	n.Config, err = n.sm.GetNetworkConfig(n.ctx, n.Name)
+	config, err := n.sm.GetNetworkConfig(n.ctx, n.Name)
 	if err != nil {
 		return wrapError("retrieve network config", err)
 	}
+	n.setConfig(config)
 
 	be, err := n.bm.GetBackend(n.Config.BackendType)
 	if err != nil {
 		return wrapError("create and initialize network", err)
 	}
 
-	n.bn, err = be.RegisterNetwork(n.ctx, n.Name, n.Config)
+	bn, err := be.RegisterNetwork(n.ctx, n.Name, n.Config)
 	if err != nil {
 		return wrapError("register network", err)
 	}
 
+	n.mux.Lock()
+	n.bn = bn
+	n.backendType = n.Config.BackendType
+	n.mux.Unlock()
+
 	if n.ipMasq {
-		err = setupIPMasq(n.Config.Network)
+		err = setupIPMasq(n.Config.Networks)
 		if err != nil {
 			return wrapError("set up IP Masquerade", err)
 		}
@@ -113,17 +144,48 @@ func (n *Network) retryInit() error {
 	}
 }
 
+func (n *Network) setConfig(config *subnet.Config) {
+	n.mux.Lock()
+	n.Config = config
+	n.mux.Unlock()
+}
+
+// config returns the config the network runs with
+func (n *Network) config() *subnet.Config {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.Config
+}
+
 func (n *Network) runOnce(extIface *backend.ExternalInterface, inited func(bn backend.Network)) error {
 	if err := n.retryInit(); err != nil {
 		return errCanceled
 	}
 
 	inited(n.bn)
+	n.setLeaseExpiration(n.bn.Lease().Expiration, n.Config.RenewMargin.Duration)
 
 	ctx, interruptFunc := context.WithCancel(n.ctx)
 
 	wg := sync.WaitGroup{}
 
+	var hooks *hookRunner
+	var peerEvts chan []subnet.Event
+	if n.hook != "" {
+		n.setHookAcquired(false)
+		hooks = newHookRunner(n.hook, n.hookTimeout, n.Name, func() { n.setHookAcquired(true) })
+		wg.Add(1)
+		go hooks.Run(&wg)
+		hooks.Queue(newHookEvent(hookAcquired, n.Name, n.Config, n.bn))
+
+		peerEvts = make(chan []subnet.Event)
+		wg.Add(1)
+		go func() {
+			subnet.WatchPeers(ctx, n.sm, n.Name, n.bn.Lease(), peerEvts)
+			wg.Done()
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		n.bn.Run(ctx)
@@ -138,9 +200,17 @@ func (n *Network) runOnce(extIface *backend.ExternalInterface, inited func(bn ba
 		wg.Done()
 	}()
 
+	configs := make(chan *subnet.Config)
+
+	wg.Add(1)
+	go func() {
+		subnet.WatchNetworkConfig(ctx, n.sm, n.Name, configs)
+		wg.Done()
+	}()
+
 	defer func() {
 		if n.ipMasq {
-			if err := teardownIPMasq(n.Config.Network); err != nil {
+			if err := teardownIPMasq(n.Config.Networks); err != nil {
 				log.Errorf("Failed to tear down IP Masquerade for network %v: %v", n.Name, err)
 			}
 		}
@@ -148,42 +218,179 @@ func (n *Network) runOnce(extIface *backend.ExternalInterface, inited func(bn ba
 
 	defer wg.Wait()
 
-	dur := n.bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+	// queue a hook for the event if there are hooks
+	hook := func(event string) {
+		if hooks != nil {
+			hooks.Queue(newHookEvent(event, n.Name, n.Config, n.bn))
+		}
+	}
+	if hooks != nil {
+		// let the hooks run out before waiting for the runner
+		defer hooks.Close()
+	}
+
+	margin := n.Config.RenewMargin.Duration
+	dur := renewIn(n.bn.Lease().Expiration, margin)
 	for {
 		select {
 		case <-time.After(dur):
 			err := n.sm.RenewLease(n.ctx, n.Name, n.bn.Lease())
+			if err == subnet.ErrLeaseExcluded {
+				leaseRenewals.Inc(n.Name, "failure")
+				log.Warning("Lease is in an excluded subnet and has been given up")
+				hook(hookLost)
+				interruptFunc()
+				return errInterrupted
+			}
 			if err != nil {
-				log.Error("Error renewing lease (trying again in 1 min): ", err)
-				dur = time.Minute
+				leaseRenewals.Inc(n.Name, "failure")
+				dur = renewRetryIn(margin)
+				log.Errorf("Error renewing lease (trying again in %v): %v", dur, err)
 				continue
 			}
 
+			leaseRenewals.Inc(n.Name, "success")
 			log.Info("Lease renewed, new expiration: ", n.bn.Lease().Expiration)
-			dur = n.bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+			n.setLeaseExpiration(n.bn.Lease().Expiration, margin)
+			dur = renewIn(n.bn.Lease().Expiration, margin)
+			hook(hookRenewed)
 
 		case e := <-evts:
 			switch e.Type {
 			case subnet.EventAdded:
 				n.bn.Lease().Expiration = e.Lease.Expiration
-				dur = n.bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+				n.setLeaseExpiration(n.bn.Lease().Expiration, margin)
+				dur = renewIn(n.bn.Lease().Expiration, margin)
 
 			case subnet.EventRemoved:
 				log.Warning("Lease has been revoked")
+				hook(hookLost)
 				interruptFunc()
 				return errInterrupted
 			}
 
+		case batch := <-peerEvts:
+			for _, e := range batch {
+				event := hookPeerAdded
+				if e.Type == subnet.EventRemoved {
+					event = hookPeerRemoved
+				}
+				lease := e.Lease
+				hooks.Queue(newHookEvent(event, n.Name, n.Config, n.bn).withPeer(&lease))
+			}
+
+		case config := <-configs:
+			changed, reregister := diffConfig(n.Config, config)
+			if len(changed) == 0 {
+				continue
+			}
+
+			if reregister {
+				log.Infof("Config of network %q changed (%s), registering it again", n.Name, strings.Join(changed, ", "))
+				interruptFunc()
+				if backendChanged(n.Config, config) {
+					return errBackendChanged
+				}
+				return errInterrupted
+			}
+
+			log.Infof("Config of network %q changed (%s), applied in place", n.Name, strings.Join(changed, ", "))
+			n.setConfig(config)
+			margin = config.RenewMargin.Duration
+			n.setLeaseExpiration(n.bn.Lease().Expiration, margin)
+			dur = renewIn(n.bn.Lease().Expiration, margin)
+
 		case <-n.ctx.Done():
 			return errCanceled
 		}
 	}
 }
 
+// reregisterSettings are the config settings the backend network and the
+// lease are set up with. Changes to any of them are only applied by tearing
+// down the network and registering it again. The subnet lengths are among
+// them as the IPv6 subnets are indexed in units of MaxSubnetLen, which
+// defaults from the others. The remaining settings only matter to the subnet
+// manager or to lease renewal and are applied in place.
+var reregisterSettings = map[string]bool{
+	"Network":       true,
+	"Networks":      true,
+	"SubnetLen":     true,
+	"MinSubnetLen":  true,
+	"MaxSubnetLen":  true,
+	"IPv6Network":   true,
+	"IPv6SubnetLen": true,
+	"BackendType":   true,
+	"Backend":       true,
+}
+
+// diffConfig returns the names of the settings that differ between the old
+// and the new config of a network and whether the network has to be
+// registered again for them to take effect
+func diffConfig(old, new *subnet.Config) (changed []string, reregister bool) {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+
+		equal := false
+		if name == "Backend" {
+			equal = jsonEqual(old.Backend, new.Backend)
+		} else {
+			equal = reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface())
+		}
+
+		if !equal {
+			changed = append(changed, name)
+			reregister = reregister || reregisterSettings[name]
+		}
+	}
+	return changed, reregister
+}
+
+// backendChanged tells whether the backend of a network, and with it the
+// devices it sets up, changes between the two configs
+func backendChanged(old, new *subnet.Config) bool {
+	return old.BackendType != new.BackendType || !jsonEqual(old.Backend, new.Backend)
+}
+
+// jsonEqual compares two JSON documents ignoring formatting
+func jsonEqual(a, b json.RawMessage) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// renewIn returns how long to wait before renewing a lease that expires at
+// exp. The renewal is brought forward by up to a quarter of the margin at
+// random so that hosts which got their leases at the same time don't keep
+// renewing them in lockstep.
+func renewIn(exp time.Time, margin time.Duration) time.Duration {
+	jitter := time.Duration(rand.Int63n(int64(margin)/4 + 1))
+	return exp.Sub(time.Now()) - margin - jitter
+}
+
+// renewRetryIn returns how long to wait before retrying a failed renewal:
+// a minute, or less if the margin is too short for a few tries
+func renewRetryIn(margin time.Duration) time.Duration {
+	if margin/4 < time.Minute {
+		return margin / 4
+	}
+	return time.Minute
+}
+
 func (n *Network) Run(extIface *backend.ExternalInterface, inited func(bn backend.Network)) {
 	for {
 		switch n.runOnce(extIface, inited) {
 		case errInterrupted:
+			// the network is registered again with the same backend, which
+			// takes over the devices and routes left in place
+			n.cleanupBackend(n.teardown)
+
+		case errBackendChanged:
+			// the old devices and routes would be left behind for good
+			n.cleanupBackend(true)
 
 		case errCanceled:
 			return
@@ -196,3 +403,54 @@ func (n *Network) Run(extIface *backend.ExternalInterface, inited func(bn backen
 func (n *Network) Cancel() {
 	n.cancelFunc()
 }
+
+// Remove cancels the network after it has been deleted from the registry
+func (n *Network) Remove() {
+	n.removed = true
+	n.cancelFunc()
+}
+
+// Cleanup is called once Run has returned. It tears down the backend's
+// devices and routes if teardown is set and gives up the lease if revoke is
+// set. Both are always done for a network that has been removed.
+func (n *Network) Cleanup(teardown, revoke bool) {
+	n.setLeaseExpiration(time.Time{}, 0)
+
+	if n.removed {
+		teardown, revoke = true, true
+	}
+
+	if revoke && n.bn != nil {
+		// n.ctx is done by now
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		sn := n.bn.Lease().Subnet
+		if err := n.sm.RevokeLease(ctx, n.Name, sn); err != nil {
+			log.Errorf("Failed to revoke lease %v of network %q: %v", sn, n.Name, err)
+		} else {
+			log.Infof("Revoked lease %v of network %q", sn, n.Name)
+			if n.hook != "" {
+				if err := runHook(n.hook, n.hookTimeout, newHookEvent(hookRevoked, n.Name, n.config(), n.bn)); err != nil {
+					log.Errorf("Hook %v for %v event of network %q failed: %v", n.hook, hookRevoked, n.Name, err)
+				}
+			}
+		}
+	}
+
+	n.cleanupBackend(teardown)
+}
+
+func (n *Network) cleanupBackend(teardown bool) {
+	if n.bn == nil {
+		return
+	}
+
+	if err := n.bn.Cleanup(teardown); err != nil {
+		log.Errorf("Failed to clean up network %q: %v", n.Name, err)
+	}
+	n.mux.Lock()
+	n.bn = nil
+	n.mux.Unlock()
+	n.setLeaseExpiration(time.Time{}, 0)
+}
@@ -0,0 +1,322 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// fakeBackend registers networks that acquire a lease and record how they
+// are cleaned up
+type fakeBackend struct {
+	sm         subnet.Manager
+	extIface   *backend.ExternalInterface
+	registered chan *fakeNetwork
+	hold       chan struct{}
+}
+
+func (be *fakeBackend) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (be *fakeBackend) RegisterNetwork(ctx context.Context, network string, config *subnet.Config) (backend.Network, error) {
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.FromIP(be.extIface.ExtAddr)}
+	l, err := be.sm.AcquireLease(ctx, network, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &fakeNetwork{
+		SimpleNetwork: backend.SimpleNetwork{SubnetLease: l, ExtIface: be.extIface},
+		sm:            be.sm,
+		name:          network,
+		config:        config,
+		hold:          be.hold,
+		cleanups:      make(chan bool, 10),
+	}
+	be.registered <- n
+	return n, nil
+}
+
+type fakeNetwork struct {
+	backend.SimpleNetwork
+	sm     subnet.Manager
+	name   string
+	config *subnet.Config
+	// hold, if set, makes the network watch the leases and handle each
+	// batch once it can receive from hold
+	hold chan struct{}
+	// cleanups receives the teardown argument of every Cleanup
+	cleanups chan bool
+}
+
+func (n *fakeNetwork) Run(ctx context.Context) {
+	if n.hold == nil {
+		<-ctx.Done()
+		return
+	}
+
+	evts := make(chan []subnet.Event)
+	go subnet.WatchLeases(ctx, n.sm, n.name, n.SubnetLease, evts)
+	for {
+		select {
+		case <-evts:
+			select {
+			case <-n.hold:
+			case <-ctx.Done():
+				return
+			}
+			subnet.LeasesHandled(n.name)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *fakeNetwork) Cleanup(teardown bool) error {
+	n.cleanups <- teardown
+	return nil
+}
+
+// testEnv is a mock registry with a network and a backend manager for the
+// "fake" and "other" backend types
+type testEnv struct {
+	msr        *subnet.MockSubnetRegistry
+	sm         subnet.Manager
+	extIface   *backend.ExternalInterface
+	backends   *backend.Registry
+	bm         backend.Manager
+	registered chan *fakeNetwork
+	// hold is handed to the networks registered
+	hold   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newTestEnv(network, config string) *testEnv {
+	e := &testEnv{
+		msr: subnet.NewMockRegistry(network, config, nil),
+		extIface: &backend.ExternalInterface{
+			Iface:     &net.Interface{Name: "eth0", MTU: 1500},
+			IfaceAddr: net.ParseIP("192.168.1.10"),
+			ExtAddr:   net.ParseIP("192.168.1.10"),
+		},
+		backends:   backend.NewRegistry(),
+		registered: make(chan *fakeNetwork, 10),
+	}
+	e.sm = subnet.NewMockManager(e.msr)
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+
+	ctor := func(sm subnet.Manager, ei *backend.ExternalInterface) (backend.Backend, error) {
+		return &fakeBackend{sm, ei, e.registered, e.hold}, nil
+	}
+	e.backends.Register("fake", ctor)
+	e.backends.Register("other", ctor)
+	e.bm = backend.NewManager(e.ctx, e.sm, e.extIface, e.backends)
+	return e
+}
+
+// runNetwork runs a network until the env is canceled and closes the
+// returned channel once Run has returned
+func (e *testEnv) runNetwork(n *Network) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		n.Run(e.extIface, func(bn backend.Network) {})
+		close(done)
+	}()
+	return done
+}
+
+func (e *testEnv) nextRegistration(t *testing.T) *fakeNetwork {
+	select {
+	case n := <-e.registered:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the network to be registered")
+		return nil
+	}
+}
+
+func (e *testEnv) expectNoRegistration(t *testing.T) {
+	select {
+	case n := <-e.registered:
+		t.Fatalf("network registered again with %+v", n.config)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mustParseConfig(t *testing.T, s string) *subnet.Config {
+	c, err := subnet.ParseConfig(s)
+	if err != nil {
+		t.Fatalf("failed to parse config %q: %v", s, err)
+	}
+	return c
+}
+
+func TestDiffConfig(t *testing.T) {
+	base := `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 1 } }`
+
+	for _, tc := range []struct {
+		new        string
+		changed    []string
+		reregister bool
+	}{
+		{
+			new: `{ "Network": "10.3.0.0/16", "Backend": { "VNI": 1, "Type": "vxlan" } }`,
+		},
+		{
+			new:     `{ "Network": "10.3.0.0/16", "RenewMargin": "2h", "Backend": { "Type": "vxlan", "VNI": 1 } }`,
+			changed: []string{"RenewMargin"},
+		},
+		{
+			new:     `{ "Network": "10.3.0.0/16", "LeaseTTL": "12h", "AllocationStrategy": "sequential", "Backend": { "Type": "vxlan", "VNI": 1 } }`,
+			changed: []string{"AllocationStrategy", "LeaseTTL"},
+		},
+		{
+			new:        `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 2 } }`,
+			changed:    []string{"Backend"},
+			reregister: true,
+		},
+		{
+			new:        `{ "Network": "10.3.0.0/16", "Backend": { "Type": "host-gw" } }`,
+			changed:    []string{"BackendType", "Backend"},
+			reregister: true,
+		},
+		{
+			new:        `{ "Network": "10.3.0.0/16", "Networks": ["10.3.0.0/16", "10.4.0.0/16"], "Backend": { "Type": "vxlan", "VNI": 1 } }`,
+			changed:    []string{"Networks"},
+			reregister: true,
+		},
+		{
+			// the IPv6 subnets are indexed in units of MaxSubnetLen, which
+			// defaults from SubnetLen
+			new:        `{ "Network": "10.3.0.0/16", "SubnetLen": 26, "Backend": { "Type": "vxlan", "VNI": 1 } }`,
+			changed:    []string{"SubnetMin", "SubnetMax", "SubnetLen", "MinSubnetLen", "MaxSubnetLen"},
+			reregister: true,
+		},
+		{
+			new:        `{ "Network": "10.3.0.0/16", "MaxSubnetLen": 26, "Backend": { "Type": "vxlan", "VNI": 1 } }`,
+			changed:    []string{"MaxSubnetLen"},
+			reregister: true,
+		},
+	} {
+		changed, reregister := diffConfig(mustParseConfig(t, base), mustParseConfig(t, tc.new))
+		if !reflect.DeepEqual(changed, tc.changed) || reregister != tc.reregister {
+			t.Errorf("diffConfig to %v = %v, %v; want %v, %v", tc.new, changed, reregister, tc.changed, tc.reregister)
+		}
+	}
+}
+
+func TestConfigChange(t *testing.T) {
+	e := newTestEnv("config-change", `{ "Network": "10.3.0.0/16", "Backend": { "Type": "fake", "Answer": 42 } }`)
+	defer e.cancel()
+
+	n := NewNetwork(e.ctx, e.sm, e.bm, "config-change", false)
+	done := e.runNetwork(n)
+
+	first := e.nextRegistration(t)
+
+	// renewal settings are applied in place
+	if err := e.msr.SetConfig("config-change", `{ "Network": "10.3.0.0/16", "RenewMargin": "2h", "Backend": { "Type": "fake", "Answer": 42 } }`); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	waitFor(t, "the renew margin to change", func() bool {
+		return n.config().RenewMargin.Duration == 2*time.Hour
+	})
+	e.expectNoRegistration(t)
+	if _, margin := n.leaseExpiration(); margin != 2*time.Hour {
+		t.Errorf("renew margin of the lease is %v, want 2h", margin)
+	}
+
+	// backend settings make the network register again
+	if err := e.msr.SetConfig("config-change", `{ "Network": "10.3.0.0/16", "RenewMargin": "2h", "Backend": { "Type": "fake", "Answer": 43 } }`); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	second := e.nextRegistration(t)
+	if string(second.config.Backend) == string(first.config.Backend) {
+		t.Errorf("network registered again with the old backend config %s", second.config.Backend)
+	}
+	select {
+	case <-first.cleanups:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the network registered before was not cleaned up")
+	}
+
+	e.cancel()
+	<-done
+}
+
+func expectCleanup(t *testing.T, n *fakeNetwork, teardown bool) {
+	select {
+	case td := <-n.cleanups:
+		if td != teardown {
+			t.Errorf("network cleaned up with teardown %v, want %v", td, teardown)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the network registered before was not cleaned up")
+	}
+}
+
+func TestReregisterTeardown(t *testing.T) {
+	const config = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "fake" } }`
+
+	for _, teardown := range []bool{false, true} {
+		e := newTestEnv("reregister", config)
+
+		n := NewNetwork(e.ctx, e.sm, e.bm, "reregister", false)
+		n.teardown = teardown
+		done := e.runNetwork(n)
+		first := e.nextRegistration(t)
+
+		// the same backend takes over after config changes that leave it
+		// alone, so the dataplane is only torn down if the options say so
+		if err := e.msr.SetConfig("reregister", `{ "Network": "10.3.0.0/16", "Networks": ["10.3.0.0/16", "10.4.0.0/16"], "Backend": { "Type": "fake" } }`); err != nil {
+			t.Fatalf("SetConfig failed: %v", err)
+		}
+		expectCleanup(t, first, teardown)
+		second := e.nextRegistration(t)
+
+		// another backend type or backend settings replace the dataplane
+		if err := e.msr.SetConfig("reregister", `{ "Network": "10.3.0.0/16", "Networks": ["10.3.0.0/16", "10.4.0.0/16"], "Backend": { "Type": "other" } }`); err != nil {
+			t.Fatalf("SetConfig failed: %v", err)
+		}
+		expectCleanup(t, second, true)
+		e.nextRegistration(t)
+
+		e.cancel()
+		<-done
+	}
+}
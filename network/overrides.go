@@ -0,0 +1,144 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+)
+
+// NetworkOptions overrides the command line options for one network. Empty
+// fields keep the command line values.
+type NetworkOptions struct {
+	Iface      string `json:"iface"`
+	PublicIP   string `json:"public-ip"`
+	PublicIPv6 string `json:"public-ipv6"`
+	IPMasq     *bool  `json:"ip-masq"`
+	SubnetFile string `json:"subnet-file"`
+	Hook       string `json:"hook"`
+}
+
+// SetNetworkOptions replaces the overrides of the networks, by name. They
+// apply to the networks started afterwards.
+func (m *Manager) SetNetworkOptions(o map[string]NetworkOptions) {
+	m.mux.Lock()
+	m.overrides = o
+	m.mux.Unlock()
+}
+
+func (m *Manager) networkOptions(name string) NetworkOptions {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.overrides[name]
+}
+
+// subnetFilePath returns where the subnet file of a network goes, "" for
+// nowhere
+func (m *Manager) subnetFilePath(name string, o NetworkOptions) string {
+	switch {
+	case o.SubnetFile != "":
+		return o.SubnetFile
+	case !m.isMultiNetwork():
+		return m.opts.SubnetFile
+	case m.opts.SubnetDir != "":
+		return filepath.Join(m.opts.SubnetDir, name) + m.subnetExt
+	}
+	return ""
+}
+
+// backendEnv is a backend manager for the networks using an external
+// interface
+type backendEnv struct {
+	extIface *backend.ExternalInterface
+	bm       backend.Manager
+}
+
+// backendFor returns the external interface and backend manager of a
+// network, setting them up for the interface and public IPs it overrides
+func (m *Manager) backendFor(o NetworkOptions) (*backendEnv, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if o.Iface == "" && o.PublicIP == "" && o.PublicIPv6 == "" {
+		return m.backends[""], nil
+	}
+
+	iface, publicIP, publicIPv6 := m.opts.Iface, m.opts.PublicIP, m.opts.PublicIPv6
+	if o.Iface != "" {
+		iface = o.Iface
+	}
+	if o.PublicIP != "" {
+		publicIP = o.PublicIP
+	}
+	if o.PublicIPv6 != "" {
+		publicIPv6 = o.PublicIPv6
+	}
+	key := strings.Join([]string{iface, publicIP, publicIPv6}, "|")
+
+	if be, ok := m.backends[key]; ok {
+		return be, nil
+	}
+
+	extIface, err := lookupExtIface(iface, publicIP, publicIPv6)
+	if err != nil {
+		return nil, err
+	}
+	be := &backendEnv{extIface, backend.NewManager(m.ctx, m.sm, extIface, m.opts.Backends)}
+	m.backends[key] = be
+	return be, nil
+}
+
+// newNetwork creates a network with its overrides applied
+func (m *Manager) newNetwork(ctx context.Context, name string) (*Network, error) {
+	o := m.networkOptions(name)
+
+	be, err := m.backendFor(o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the external interface: %v", err)
+	}
+
+	ipMasq := m.opts.IPMasq
+	if o.IPMasq != nil {
+		ipMasq = *o.IPMasq
+	}
+
+	n := NewNetwork(ctx, m.sm, be.bm, name, ipMasq)
+	n.extIface = be.extIface
+	n.subnetFile = m.subnetFilePath(name, o)
+	n.hookTimeout = m.opts.HookTimeout
+	n.teardown = m.opts.Teardown
+	n.hook = m.opts.Hook
+	if o.Hook != "" {
+		n.hook = o.Hook
+	}
+	return n, nil
+}
+
+// subnetFileOverrides returns the subnet files the overrides point to, by
+// network name
+func subnetFileOverrides(opts *Options) map[string]string {
+	paths := make(map[string]string)
+	for name, o := range opts.Overrides {
+		if o.SubnetFile != "" {
+			paths[name] = o.SubnetFile
+		}
+	}
+	return paths
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"sort"
+	"time"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// PeerStatus is the lease of another host
+type PeerStatus struct {
+	Subnet     ip.IP4Net
+	IPv6Subnet *ip.IP6Net `json:",omitempty"`
+	PublicIP   ip.IP4
+	Expiration time.Time
+}
+
+// DataplaneDrift is how the kernel tables differ from what a network
+// believes it has programmed
+type DataplaneDrift struct {
+	// Missing entries were programmed but aren't in the kernel
+	Missing backend.Dataplane
+	// Unexpected entries are in the kernel but weren't programmed
+	Unexpected backend.Dataplane
+	// Error is set if the kernel tables couldn't be read
+	Error string `json:",omitempty"`
+}
+
+// NetworkStatus is what flanneld knows about a network it runs
+type NetworkStatus struct {
+	Name        string
+	BackendType string     `json:",omitempty"`
+	Subnet      *ip.IP4Net `json:",omitempty"`
+	IPv6Subnet  *ip.IP6Net `json:",omitempty"`
+	Expiration  *time.Time `json:",omitempty"`
+	Peers       []PeerStatus
+	// Programmed is nil for backends that don't program kernel state for
+	// the other hosts
+	Programmed *backend.Dataplane `json:",omitempty"`
+	Drift      *DataplaneDrift    `json:",omitempty"`
+}
+
+func (n *Network) status(diff bool) NetworkStatus {
+	n.mux.Lock()
+	bn, betype, exp := n.bn, n.backendType, n.expiration
+	n.mux.Unlock()
+
+	st := NetworkStatus{Name: n.Name}
+	if bn == nil {
+		return st
+	}
+
+	st.BackendType = betype
+	// the subnets of a lease don't change, unlike its expiration
+	sn := bn.Lease().Subnet
+	st.Subnet = &sn
+	if sn6 := bn.Lease().IPv6Subnet; !sn6.Empty() {
+		st.IPv6Subnet = &sn6
+	}
+	if !exp.IsZero() {
+		st.Expiration = &exp
+	}
+
+	for _, l := range subnet.GetWatchStatus(n.Name).Peers {
+		p := PeerStatus{
+			Subnet:     l.Subnet,
+			PublicIP:   l.Attrs.PublicIP,
+			Expiration: l.Expiration,
+		}
+		if !l.IPv6Subnet.Empty() {
+			sn6 := l.IPv6Subnet
+			p.IPv6Subnet = &sn6
+		}
+		st.Peers = append(st.Peers, p)
+	}
+	sort.Sort(peersBySubnet(st.Peers))
+
+	if in, ok := bn.(backend.Inspector); ok {
+		dp := in.Programmed()
+		dp.Sort()
+		st.Programmed = &dp
+
+		if diff {
+			st.Drift = &DataplaneDrift{}
+			if have, err := in.Installed(); err != nil {
+				st.Drift.Error = err.Error()
+			} else {
+				st.Drift.Missing, st.Drift.Unexpected = backend.DiffDataplane(dp, have)
+				st.Drift.Missing.Sort()
+				st.Drift.Unexpected.Sort()
+			}
+		}
+	}
+
+	return st
+}
+
+type peersBySubnet []PeerStatus
+
+func (p peersBySubnet) Len() int           { return len(p) }
+func (p peersBySubnet) Less(i, j int) bool { return p[i].Subnet.IP < p[j].Subnet.IP }
+func (p peersBySubnet) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Status reports on the networks flanneld runs. With diff it also compares
+// what their backends have programmed with the kernel tables.
+func (m *Manager) Status(diff bool) []NetworkStatus {
+	var nets []*Network
+	m.forEachNetwork(func(n *Network) {
+		nets = append(nets, n)
+	})
+
+	statuses := make([]NetworkStatus, 0, len(nets))
+	for _, n := range nets {
+		statuses = append(statuses, n.status(diff))
+	}
+	sort.Sort(statusesByName(statuses))
+	return statuses
+}
+
+type statusesByName []NetworkStatus
+
+func (s statusesByName) Len() int           { return len(s) }
+func (s statusesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s statusesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
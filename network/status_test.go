@@ -0,0 +1,150 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// inspectedNetwork reports fixed programmed and installed entries
+type inspectedNetwork struct {
+	backend.SimpleNetwork
+	programmed backend.Dataplane
+	installed  backend.Dataplane
+	err        error
+}
+
+func (n *inspectedNetwork) Programmed() backend.Dataplane {
+	return n.programmed
+}
+
+func (n *inspectedNetwork) Installed() (backend.Dataplane, error) {
+	return n.installed, n.err
+}
+
+func TestStatusDrift(t *testing.T) {
+	route := func(dst, gw string) backend.Route {
+		return backend.Route{Dst: dst, Gw: gw, Dev: "flannel.1"}
+	}
+	fdb := func(ip, mac string) backend.Neighbor {
+		return backend.Neighbor{IP: ip, MAC: mac, Dev: "flannel.1"}
+	}
+	programmed := backend.Dataplane{
+		Routes: []backend.Route{route("10.3.6.0/24", "10.3.6.0"), route("10.3.5.0/24", "10.3.5.0")},
+		FDB:    []backend.Neighbor{fdb("192.168.1.5", "aa:aa:aa:aa:aa:05"), fdb("192.168.1.6", "aa:aa:aa:aa:aa:06")},
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		installed backend.Dataplane
+		err       error
+		drift     *DataplaneDrift
+	}{
+		{
+			desc:      "in sync",
+			installed: backend.Dataplane{Routes: programmed.Routes, FDB: programmed.FDB},
+			drift:     &DataplaneDrift{},
+		},
+		{
+			desc: "in sync in another order",
+			installed: backend.Dataplane{
+				Routes: []backend.Route{programmed.Routes[1], programmed.Routes[0]},
+				FDB:    []backend.Neighbor{programmed.FDB[1], programmed.FDB[0]},
+			},
+			drift: &DataplaneDrift{},
+		},
+		{
+			desc: "a route deleted behind the back of flannel",
+			installed: backend.Dataplane{
+				Routes: []backend.Route{route("10.3.6.0/24", "10.3.6.0")},
+				FDB:    programmed.FDB,
+			},
+			drift: &DataplaneDrift{
+				Missing: backend.Dataplane{Routes: []backend.Route{route("10.3.5.0/24", "10.3.5.0")}},
+			},
+		},
+		{
+			desc: "a stale FDB entry and a changed MAC",
+			installed: backend.Dataplane{
+				Routes: programmed.Routes,
+				FDB: []backend.Neighbor{
+					fdb("192.168.1.7", "aa:aa:aa:aa:aa:07"),
+					fdb("192.168.1.6", "bb:bb:bb:bb:bb:06"),
+					fdb("192.168.1.5", "aa:aa:aa:aa:aa:05"),
+				},
+			},
+			drift: &DataplaneDrift{
+				Missing: backend.Dataplane{FDB: []backend.Neighbor{fdb("192.168.1.6", "aa:aa:aa:aa:aa:06")}},
+				Unexpected: backend.Dataplane{FDB: []backend.Neighbor{
+					fdb("192.168.1.6", "bb:bb:bb:bb:bb:06"),
+					fdb("192.168.1.7", "aa:aa:aa:aa:aa:07"),
+				}},
+			},
+		},
+		{
+			desc:  "unreadable kernel tables",
+			err:   errors.New("netlink failed"),
+			drift: &DataplaneDrift{Error: "netlink failed"},
+		},
+	} {
+		bn := &inspectedNetwork{
+			SimpleNetwork: backend.SimpleNetwork{SubnetLease: &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.7.0"), PrefixLen: 24}}},
+			programmed:    backend.Dataplane{Routes: append([]backend.Route(nil), programmed.Routes...), FDB: append([]backend.Neighbor(nil), programmed.FDB...)},
+			installed:     tc.installed,
+			err:           tc.err,
+		}
+		n := &Network{Name: "status-drift", bn: bn, backendType: "vxlan"}
+
+		if st := n.status(false); st.Drift != nil {
+			t.Errorf("%v: status without diff has drift %+v", tc.desc, st.Drift)
+		}
+
+		st := n.status(true)
+		wantProgrammed := backend.Dataplane{
+			Routes: []backend.Route{route("10.3.5.0/24", "10.3.5.0"), route("10.3.6.0/24", "10.3.6.0")},
+			FDB:    programmed.FDB,
+		}
+		if st.Programmed == nil || !reflect.DeepEqual(*st.Programmed, wantProgrammed) {
+			t.Errorf("%v: programmed %+v, want %+v", tc.desc, st.Programmed, wantProgrammed)
+		}
+		if !reflect.DeepEqual(st.Drift, tc.drift) {
+			t.Errorf("%v: drift %+v, want %+v", tc.desc, st.Drift, tc.drift)
+		}
+	}
+}
+
+func TestStatusWithoutInspector(t *testing.T) {
+	n := &Network{Name: "status-plain"}
+	if st := n.status(true); !reflect.DeepEqual(st, NetworkStatus{Name: "status-plain"}) {
+		t.Errorf("status of a network without a backend is %+v", st)
+	}
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.7.0"), PrefixLen: 24}
+	n.bn = &backend.SimpleNetwork{SubnetLease: &subnet.Lease{Subnet: sn}}
+	n.backendType = "alloc"
+	st := n.status(true)
+	if st.Programmed != nil || st.Drift != nil {
+		t.Errorf("backend that doesn't program the kernel has programmed %+v and drift %+v", st.Programmed, st.Drift)
+	}
+	if st.Subnet == nil || *st.Subnet != sn || st.BackendType != "alloc" {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
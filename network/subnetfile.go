@@ -0,0 +1,216 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// SubnetFileContext is what the subnet file formats and templates are
+// rendered with
+type SubnetFileContext struct {
+	// Name is the name of the network, empty for the default network
+	Name     string
+	Networks []ip.IP4Net
+	// Subnet is the lease of this host and Gateway its first usable IP
+	Subnet      ip.IP4Net
+	Gateway     ip.IP4
+	IPv6Network *ip.IP6Net `json:",omitempty"`
+	IPv6Subnet  *ip.IP6Net `json:",omitempty"`
+	IPv6Gateway *ip.IP6    `json:",omitempty"`
+	MTU         int
+	IPMasq      bool
+	BackendType string
+	// Expiration is that of the lease when the file was written
+	Expiration time.Time
+}
+
+func newSubnetFileContext(name string, config *subnet.Config, ipMasq bool, bn backend.Network) *SubnetFileContext {
+	l := bn.Lease()
+	c := &SubnetFileContext{
+		Name:        name,
+		Networks:    config.Networks,
+		Subnet:      l.Subnet,
+		Gateway:     l.Subnet.IP + 1,
+		MTU:         bn.MTU(),
+		IPMasq:      ipMasq,
+		BackendType: config.BackendType,
+		Expiration:  l.Expiration,
+	}
+	if !l.IPv6Subnet.Empty() {
+		nw6, sn6, gw6 := config.IPv6Network, l.IPv6Subnet, l.IPv6Subnet.IP.Next()
+		c.IPv6Network, c.IPv6Subnet, c.IPv6Gateway = &nw6, &sn6, &gw6
+	}
+	return c
+}
+
+// The formats of the subnet file and the templates built into flanneld
+var builtinTemplates = map[string]string{
+	"env": `FLANNEL_NETWORK={{join .Networks ","}}
+FLANNEL_SUBNET={{.Gateway}}/{{.Subnet.PrefixLen}}
+{{if .IPv6Subnet}}FLANNEL_IPV6_NETWORK={{.IPv6Network}}
+FLANNEL_IPV6_SUBNET={{.IPv6Gateway}}/{{.IPv6Subnet.PrefixLen}}
+{{end}}FLANNEL_MTU={{.MTU}}
+FLANNEL_IPMASQ={{.IPMasq}}
+`,
+
+	"json": `{{json .}}
+`,
+
+	// every value is written as JSON, which YAML accepts as flow style
+	"yaml": `Name: {{json .Name}}
+Networks: {{json .Networks}}
+Subnet: {{json .Subnet}}
+Gateway: {{json .Gateway}}
+{{if .IPv6Subnet}}IPv6Network: {{json .IPv6Network}}
+IPv6Subnet: {{json .IPv6Subnet}}
+IPv6Gateway: {{json .IPv6Gateway}}
+{{end}}MTU: {{.MTU}}
+IPMasq: {{.IPMasq}}
+BackendType: {{json .BackendType}}
+Expiration: {{json .Expiration}}
+`,
+
+	// the options for the Docker daemon, byte for byte as mk-docker-opts.sh
+	// writes them, leading space in DOCKER_OPTS included
+	"docker": `{{$bip := printf "--bip=%v/%v" .Gateway .Subnet.PrefixLen}}{{$ipmasq := printf "--ip-masq=%v" (not .IPMasq)}}{{$mtu := printf "--mtu=%v" .MTU}}DOCKER_OPT_BIP="{{$bip}}"
+DOCKER_OPT_IPMASQ="{{$ipmasq}}"
+DOCKER_OPT_MTU="{{$mtu}}"
+DOCKER_OPTS=" {{$bip}} {{$ipmasq}} {{$mtu}}"
+`,
+}
+
+// subnetFileExt maps the subnet file formats to the extension of the files
+// in the subnet dir
+var subnetFileExt = map[string]string{
+	"env":  ".env",
+	"json": ".json",
+	"yaml": ".yaml",
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// join formats the elements of a slice and joins them with sep
+	"join": func(v interface{}, sep string) (string, error) {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			return "", fmt.Errorf("join of %T", v)
+		}
+		s := make([]string, rv.Len())
+		for i := range s {
+			s[i] = fmt.Sprint(rv.Index(i).Interface())
+		}
+		return strings.Join(s, sep), nil
+	},
+}
+
+// parseSubnetTemplate returns the built-in template called src or else
+// parses the template file at src
+func parseSubnetTemplate(src string) (*template.Template, error) {
+	text, ok := builtinTemplates[src]
+	if !ok {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	return template.New(src).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// subnetTemplate renders a template to the file at dest, which is a
+// template itself so that every network can have its own file
+type subnetTemplate struct {
+	tmpl *template.Template
+	dest *template.Template
+}
+
+// parseSubnetTemplates parses templates given as template:dest
+func parseSubnetTemplates(specs []string) ([]subnetTemplate, error) {
+	var tmpls []subnetTemplate
+	for _, v := range specs {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("subnet template %q is not of the form template:dest", v)
+		}
+		tmpl, err := parseSubnetTemplate(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse subnet template %v: %v", parts[0], err)
+		}
+		dest, err := template.New(parts[1]).Funcs(templateFuncs).Option("missingkey=error").Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse subnet template destination %v: %v", parts[1], err)
+		}
+		tmpls = append(tmpls, subnetTemplate{tmpl, dest})
+	}
+	return tmpls, nil
+}
+
+// writeSubnetFile renders the template to path
+func writeSubnetFile(path string, tmpl *template.Template, c *SubnetFileContext) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, c); err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(path)
+	os.MkdirAll(dir, 0755)
+
+	tempFile := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tempFile, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	// rename(2) the temporary file to the desired location so that it becomes
+	// atomically visible with the contents
+	return os.Rename(tempFile, path)
+}
+
+// writeSubnetFiles writes the subnet file in the configured format to path,
+// unless it is empty, and renders the subnet templates
+func (m *Manager) writeSubnetFiles(path string, c *SubnetFileContext) error {
+	if path != "" {
+		if err := writeSubnetFile(path, m.subnetFormat, c); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range m.subnetTemplates {
+		var dest bytes.Buffer
+		if err := t.dest.Execute(&dest, c); err != nil {
+			return fmt.Errorf("failed to render the destination of template %v: %v", t.tmpl.Name(), err)
+		}
+		if err := writeSubnetFile(dest.String(), t.tmpl, c); err != nil {
+			return fmt.Errorf("failed to write template %v to %v: %v", t.tmpl.Name(), dest.String(), err)
+		}
+	}
+	return nil
+}
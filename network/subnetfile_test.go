@@ -0,0 +1,272 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func renderSubnetTemplate(t *testing.T, src string, c *SubnetFileContext) string {
+	tmpl, err := parseSubnetTemplate(src)
+	if err != nil {
+		t.Fatalf("failed to parse the %v template: %v", src, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, c); err != nil {
+		t.Fatalf("failed to render the %v template: %v", src, err)
+	}
+	return buf.String()
+}
+
+// legacySubnetFile is the subnet file as flanneld wrote it before there were
+// formats
+func legacySubnetFile(nw ip.IP4Net, ipMasq bool, bn backend.Network) string {
+	var buf bytes.Buffer
+
+	sn := bn.Lease().Subnet
+	sn.IP += 1
+
+	fmt.Fprintf(&buf, "FLANNEL_NETWORK=%s\n", nw)
+	fmt.Fprintf(&buf, "FLANNEL_SUBNET=%s\n", sn)
+	fmt.Fprintf(&buf, "FLANNEL_MTU=%d\n", bn.MTU())
+	fmt.Fprintf(&buf, "FLANNEL_IPMASQ=%v\n", ipMasq)
+	return buf.String()
+}
+
+func TestEnvFormatLegacy(t *testing.T) {
+	for _, tc := range []struct {
+		network string
+		subnet  string
+		mtu     int
+		ipMasq  bool
+	}{
+		{"10.3.0.0/16", "10.3.5.0/24", 1450, false},
+		{"10.3.0.0/16", "10.3.5.0/24", 1500, true},
+		{"172.16.0.0/12", "172.16.64.64/26", 8951, true},
+		{"10.0.0.0/8", "10.254.0.0/16", 1472, false},
+	} {
+		config := mustParseConfig(t, `{ "Network": "`+tc.network+`", "Backend": { "Type": "vxlan" } }`)
+		bn := &backend.SimpleNetwork{
+			SubnetLease: &subnet.Lease{Subnet: mustParseIP4Net(t, tc.subnet)},
+			ExtIface:    &backend.ExternalInterface{Iface: &net.Interface{MTU: tc.mtu}},
+		}
+
+		got := renderSubnetTemplate(t, "env", newSubnetFileContext("", config, tc.ipMasq, bn))
+		if want := legacySubnetFile(config.Network, tc.ipMasq, bn); got != want {
+			t.Errorf("env format for %+v is\n%s\nwant\n%s", tc, got, want)
+		}
+	}
+}
+
+func testSubnetFileContext(t *testing.T, dualStack bool) *SubnetFileContext {
+	c := &SubnetFileContext{
+		Name:        "blue",
+		Networks:    []ip.IP4Net{mustParseIP4Net(t, "10.3.0.0/16"), mustParseIP4Net(t, "10.4.0.0/16")},
+		Subnet:      mustParseIP4Net(t, "10.3.5.0/24"),
+		Gateway:     ip.MustParseIP4("10.3.5.1"),
+		MTU:         1450,
+		IPMasq:      true,
+		BackendType: "vxlan",
+		Expiration:  time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if dualStack {
+		nw6, sn6, gw6 := mustParseIP6Net(t, "fd00:10::/48"), mustParseIP6Net(t, "fd00:10:0:5::/64"), ip.MustParseIP6("fd00:10:0:5::1")
+		c.IPv6Network, c.IPv6Subnet, c.IPv6Gateway = &nw6, &sn6, &gw6
+	}
+	return c
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	for _, tc := range []struct {
+		src       string
+		dualStack bool
+		want      string
+	}{
+		{
+			src: "env",
+			want: `FLANNEL_NETWORK=10.3.0.0/16,10.4.0.0/16
+FLANNEL_SUBNET=10.3.5.1/24
+FLANNEL_MTU=1450
+FLANNEL_IPMASQ=true
+`,
+		},
+		{
+			src:       "env",
+			dualStack: true,
+			want: `FLANNEL_NETWORK=10.3.0.0/16,10.4.0.0/16
+FLANNEL_SUBNET=10.3.5.1/24
+FLANNEL_IPV6_NETWORK=fd00:10::/48
+FLANNEL_IPV6_SUBNET=fd00:10:0:5::1/64
+FLANNEL_MTU=1450
+FLANNEL_IPMASQ=true
+`,
+		},
+		{
+			src: "json",
+			want: `{"Name":"blue","Networks":["10.3.0.0/16","10.4.0.0/16"],"Subnet":"10.3.5.0/24","Gateway":"10.3.5.1","MTU":1450,"IPMasq":true,"BackendType":"vxlan","Expiration":"2016-11-01T00:00:00Z"}
+`,
+		},
+		{
+			src:       "json",
+			dualStack: true,
+			want: `{"Name":"blue","Networks":["10.3.0.0/16","10.4.0.0/16"],"Subnet":"10.3.5.0/24","Gateway":"10.3.5.1","IPv6Network":"fd00:10::/48","IPv6Subnet":"fd00:10:0:5::/64","IPv6Gateway":"fd00:10:0:5::1","MTU":1450,"IPMasq":true,"BackendType":"vxlan","Expiration":"2016-11-01T00:00:00Z"}
+`,
+		},
+		{
+			src: "yaml",
+			want: `Name: "blue"
+Networks: ["10.3.0.0/16","10.4.0.0/16"]
+Subnet: "10.3.5.0/24"
+Gateway: "10.3.5.1"
+MTU: 1450
+IPMasq: true
+BackendType: "vxlan"
+Expiration: "2016-11-01T00:00:00Z"
+`,
+		},
+		{
+			src:       "yaml",
+			dualStack: true,
+			want: `Name: "blue"
+Networks: ["10.3.0.0/16","10.4.0.0/16"]
+Subnet: "10.3.5.0/24"
+Gateway: "10.3.5.1"
+IPv6Network: "fd00:10::/48"
+IPv6Subnet: "fd00:10:0:5::/64"
+IPv6Gateway: "fd00:10:0:5::1"
+MTU: 1450
+IPMasq: true
+BackendType: "vxlan"
+Expiration: "2016-11-01T00:00:00Z"
+`,
+		},
+		{
+			// as written by dist/mk-docker-opts.sh for the env format
+			src: "docker",
+			want: `DOCKER_OPT_BIP="--bip=10.3.5.1/24"
+DOCKER_OPT_IPMASQ="--ip-masq=false"
+DOCKER_OPT_MTU="--mtu=1450"
+DOCKER_OPTS=" --bip=10.3.5.1/24 --ip-masq=false --mtu=1450"
+`,
+		},
+	} {
+		if got := renderSubnetTemplate(t, tc.src, testSubnetFileContext(t, tc.dualStack)); got != tc.want {
+			t.Errorf("%v template (dual-stack %v) rendered\n%s\nwant\n%s", tc.src, tc.dualStack, got, tc.want)
+		}
+	}
+}
+
+func TestDockerTemplateIPMasq(t *testing.T) {
+	// flannel masquerading means docker must not
+	c := testSubnetFileContext(t, false)
+	c.IPMasq, c.MTU = false, 8951
+	want := `DOCKER_OPT_BIP="--bip=10.3.5.1/24"
+DOCKER_OPT_IPMASQ="--ip-masq=true"
+DOCKER_OPT_MTU="--mtu=8951"
+DOCKER_OPTS=" --bip=10.3.5.1/24 --ip-masq=true --mtu=8951"
+`
+	if got := renderSubnetTemplate(t, "docker", c); got != want {
+		t.Errorf("docker template rendered\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteSubnetFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-subnetfile")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	custom := filepath.Join(dir, "custom.tmpl")
+	if err := ioutil.WriteFile(custom, []byte(`{{.Name}} {{.Subnet}} via {{.BackendType}}`+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write %v: %v", custom, err)
+	}
+
+	format, err := parseSubnetTemplate("json")
+	if err != nil {
+		t.Fatalf("failed to parse the json format: %v", err)
+	}
+	tmpls, err := parseSubnetTemplates([]string{
+		"docker:" + filepath.Join(dir, "{{.Name}}", "docker.env"),
+		custom + ":" + filepath.Join(dir, "{{.Name}}-{{.Subnet.IP}}.txt"),
+	})
+	if err != nil {
+		t.Fatalf("failed to parse the subnet templates: %v", err)
+	}
+	m := &Manager{subnetFormat: format, subnetTemplates: tmpls}
+
+	// every network gets its own files
+	for _, name := range []string{"blue", "green"} {
+		c := testSubnetFileContext(t, false)
+		c.Name = name
+		if err := m.writeSubnetFiles(filepath.Join(dir, name+".json"), c); err != nil {
+			t.Fatalf("writeSubnetFiles of %v failed: %v", name, err)
+		}
+
+		for path, want := range map[string]string{
+			filepath.Join(dir, name+".json"):         renderSubnetTemplate(t, "json", c),
+			filepath.Join(dir, name, "docker.env"):   renderSubnetTemplate(t, "docker", c),
+			filepath.Join(dir, name+"-10.3.5.0.txt"): name + " 10.3.5.0/24 via vxlan\n",
+		} {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Errorf("failed to read %v: %v", path, err)
+				continue
+			}
+			if string(data) != want {
+				t.Errorf("%v is\n%s\nwant\n%s", path, data, want)
+			}
+		}
+	}
+
+	// the subnet file is optional
+	c := testSubnetFileContext(t, false)
+	c.Name = "red"
+	if err := m.writeSubnetFiles("", c); err != nil {
+		t.Fatalf("writeSubnetFiles without a subnet file failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "red", "docker.env")); err != nil {
+		t.Errorf("template not written without a subnet file: %v", err)
+	}
+
+	// a destination that can't be rendered is an error
+	tmpls, err = parseSubnetTemplates([]string{"env:" + filepath.Join(dir, "{{.Missing}}.env")})
+	if err != nil {
+		t.Fatalf("failed to parse the subnet templates: %v", err)
+	}
+	m.subnetTemplates = tmpls
+	if err := m.writeSubnetFiles("", c); !errContains(err, "failed to render the destination") {
+		t.Errorf("writeSubnetFiles with a bad destination returned %v", err)
+	}
+}
+
+func TestParseSubnetTemplates(t *testing.T) {
+	for _, spec := range []string{"docker", "docker:", ":/run/flannel/docker", "missing.tmpl:/run/flannel/x", "docker:/run/{{.Name"} {
+		if _, err := parseSubnetTemplates([]string{spec}); err == nil {
+			t.Errorf("parseSubnetTemplates accepted %q", spec)
+		}
+	}
+}
@@ -63,6 +63,28 @@ func GetIfaceIP4Addr(iface *net.Interface) (net.IP, error) {
 	return nil, errors.New("No IPv4 address found for given interface")
 }
 
+// GetIfaceIP6Addr returns the first global unicast IPv6 address of iface
+func GetIfaceIP6Addr(iface *net.Interface) (net.IP, error) {
+	link := &netlink.Device{
+		LinkAttrs: netlink.LinkAttrs{
+			Index: iface.Index,
+		},
+	}
+
+	addrs, err := netlink.AddrList(link, syscall.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil && addr.IP.IsGlobalUnicast() {
+			return addr.IP, nil
+		}
+	}
+
+	return nil, errors.New("No IPv6 address found for given interface")
+}
+
 func GetIfaceIP4AddrMatch(iface *net.Interface, matchAddr net.IP) error {
 	addrs, err := getIfaceAddrs(iface)
 	if err != nil {
@@ -0,0 +1,211 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IP6 is an IPv6 address in network byte order. Unlike net.IP it is
+// comparable with == and can be used as a map key.
+type IP6 [16]byte
+
+func FromIP6(ip net.IP) IP6 {
+	var ip6 IP6
+	copy(ip6[:], ip.To16())
+	return ip6
+}
+
+func ParseIP6(s string) (IP6, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return IP6{}, errors.New("Invalid IPv6 address format")
+	}
+	return FromIP6(ip), nil
+}
+
+func MustParseIP6(s string) IP6 {
+	ip, err := ParseIP6(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func (ip IP6) ToIP() net.IP {
+	return net.IP(append([]byte(nil), ip[:]...))
+}
+
+func (ip IP6) String() string {
+	return ip.ToIP().String()
+}
+
+// json.Marshaler impl
+func (ip IP6) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, ip)), nil
+}
+
+// json.Unmarshaler impl
+func (ip *IP6) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if val, err := ParseIP6(string(j)); err != nil {
+		return err
+	} else {
+		*ip = val
+		return nil
+	}
+}
+
+// Next returns the address following ip
+func (ip IP6) Next() IP6 {
+	return ip.add(1, 0)
+}
+
+func (ip IP6) halves() (hi, lo uint64) {
+	return binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])
+}
+
+func fromHalves(hi, lo uint64) IP6 {
+	var ip IP6
+	binary.BigEndian.PutUint64(ip[:8], hi)
+	binary.BigEndian.PutUint64(ip[8:], lo)
+	return ip
+}
+
+func (ip IP6) and(hi, lo uint64) IP6 {
+	iphi, iplo := ip.halves()
+	return fromHalves(iphi&hi, iplo&lo)
+}
+
+// add returns ip + (x << shift)
+func (ip IP6) add(x uint64, shift uint) IP6 {
+	var xhi, xlo uint64
+	switch {
+	case shift >= 128:
+	case shift >= 64:
+		xhi = x << (shift - 64)
+	case shift == 0:
+		xlo = x
+	default:
+		xhi, xlo = x>>(64-shift), x<<shift
+	}
+
+	hi, lo := ip.halves()
+	lo += xlo
+	if lo < xlo {
+		hi++
+	}
+	return fromHalves(hi+xhi, lo)
+}
+
+// similar to net.IPNet but comparable, the IPv6 counterpart of IP4Net
+type IP6Net struct {
+	IP        IP6
+	PrefixLen uint
+}
+
+func (n IP6Net) String() string {
+	return fmt.Sprintf("%s/%d", n.IP.String(), n.PrefixLen)
+}
+
+// Empty returns true for the zero value, used for "no IPv6 network"
+func (n IP6Net) Empty() bool {
+	return n == IP6Net{}
+}
+
+func (n IP6Net) mask() (hi, lo uint64) {
+	const ones = ^uint64(0)
+	if n.PrefixLen >= 64 {
+		return ones, ones << (128 - n.PrefixLen)
+	}
+	return ones << (64 - n.PrefixLen), 0
+}
+
+func (n IP6Net) Network() IP6Net {
+	return IP6Net{
+		n.IP.and(n.mask()),
+		n.PrefixLen,
+	}
+}
+
+func (n IP6Net) Next() IP6Net {
+	return IP6Net{
+		n.IP.add(1, 128-n.PrefixLen),
+		n.PrefixLen,
+	}
+}
+
+// Subnet returns the index-th subnet of the given prefix length inside n
+func (n IP6Net) Subnet(prefixLen uint, index uint64) IP6Net {
+	return IP6Net{
+		n.Network().IP.add(index, 128-prefixLen),
+		prefixLen,
+	}
+}
+
+func FromIP6Net(n *net.IPNet) IP6Net {
+	prefixLen, _ := n.Mask.Size()
+	return IP6Net{
+		FromIP6(n.IP),
+		uint(prefixLen),
+	}
+}
+
+func (n IP6Net) ToIPNet() *net.IPNet {
+	return &net.IPNet{
+		IP:   n.IP.ToIP(),
+		Mask: net.CIDRMask(int(n.PrefixLen), 128),
+	}
+}
+
+func (n IP6Net) Overlaps(other IP6Net) bool {
+	m := n
+	if other.PrefixLen < n.PrefixLen {
+		m = other
+	}
+	hi, lo := m.mask()
+	return n.IP.and(hi, lo) == other.IP.and(hi, lo)
+}
+
+func (n IP6Net) Equal(other IP6Net) bool {
+	return n == other
+}
+
+func (n IP6Net) Contains(ip IP6) bool {
+	hi, lo := n.mask()
+	return n.IP.and(hi, lo) == ip.and(hi, lo)
+}
+
+// json.Marshaler impl
+func (n IP6Net) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, n)), nil
+}
+
+// json.Unmarshaler impl
+func (n *IP6Net) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if _, val, err := net.ParseCIDR(string(j)); err != nil {
+		return err
+	} else if val.IP.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 network", j)
+	} else {
+		*n = FromIP6Net(val)
+		return nil
+	}
+}
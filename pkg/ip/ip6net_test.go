@@ -0,0 +1,123 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func mkIP6Net(s string, plen uint) IP6Net {
+	return IP6Net{MustParseIP6(s), plen}
+}
+
+func TestIP6(t *testing.T) {
+	ip, err := ParseIP6("fc00::1")
+	if err != nil {
+		t.Fatal("ParseIP6 failed with: ", err)
+	}
+
+	if !ip.ToIP().Equal(net.ParseIP("fc00::1")) {
+		t.Error("ToIP failed")
+	}
+
+	if ip.String() != "fc00::1" {
+		t.Error("String failed")
+	}
+
+	if _, err := ParseIP6("1.2.3.4"); err == nil {
+		t.Error("ParseIP6 accepted an IPv4 address")
+	}
+
+	j, err := json.Marshal(ip)
+	if err != nil {
+		t.Error("Marshal of IP6 failed: ", err)
+	} else if string(j) != `"fc00::1"` {
+		t.Error("Marshal of IP6 failed with unexpected value: ", j)
+	}
+
+	var ip2 IP6
+	if err := json.Unmarshal(j, &ip2); err != nil || ip2 != ip {
+		t.Errorf("Unmarshal of IP6 failed: %v, %v", ip2, err)
+	}
+}
+
+func TestIP6Net(t *testing.T) {
+	n1 := mkIP6Net("fc00:0:0:1::", 64)
+
+	if n1.ToIPNet().String() != "fc00:0:0:1::/64" {
+		t.Error("ToIPNet failed")
+	}
+
+	if !n1.Overlaps(n1) {
+		t.Errorf("%s does not overlap %s", n1, n1)
+	}
+
+	n2 := mkIP6Net("fc00::", 48)
+	if !n1.Overlaps(n2) || !n2.Overlaps(n1) {
+		t.Errorf("%s does not overlap %s", n1, n2)
+	}
+
+	n2 = mkIP6Net("fc00:0:0:2::", 64)
+	if n1.Overlaps(n2) {
+		t.Errorf("%s overlaps %s", n1, n2)
+	}
+
+	if !n1.Contains(MustParseIP6("fc00:0:0:1::1234")) {
+		t.Error("Contains failed")
+	}
+
+	if n1.Contains(MustParseIP6("fc00:0:0:2::")) {
+		t.Error("Contains failed")
+	}
+
+	if n := mkIP6Net("fc00::1:2", 112).Network(); n.String() != "fc00::1:0/112" {
+		t.Errorf("Network failed: %s", n)
+	}
+
+	// carry from the low into the high half
+	if n := mkIP6Net("fc00:0:0:1:ffff:ffff:ffff:ff00", 120).Next(); n.String() != "fc00:0:0:2::/120" {
+		t.Errorf("Next failed: %s", n)
+	}
+
+	if n := mkIP6Net("fc00::", 48).Subnet(64, 5); n.String() != "fc00:0:0:5::/64" {
+		t.Errorf("Subnet failed: %s", n)
+	}
+
+	if n := mkIP6Net("fc00::", 48).Subnet(80, 0x10001); n.String() != "fc00:0:0:1:1::/80" {
+		t.Errorf("Subnet failed: %s", n)
+	}
+
+	if !(IP6Net{}).Empty() || n1.Empty() {
+		t.Error("Empty failed")
+	}
+
+	j, err := json.Marshal(n1)
+	if err != nil {
+		t.Error("Marshal of IP6Net failed: ", err)
+	} else if string(j) != `"fc00:0:0:1::/64"` {
+		t.Error("Marshal of IP6Net failed with unexpected value: ", j)
+	}
+
+	var n3 IP6Net
+	if err := json.Unmarshal(j, &n3); err != nil || !n3.Equal(n1) {
+		t.Errorf("Unmarshal of IP6Net failed: %v, %v", n3, err)
+	}
+
+	if err := json.Unmarshal([]byte(`"10.0.0.0/8"`), &n3); err == nil {
+		t.Error("Unmarshal of IP6Net accepted an IPv4 network")
+	}
+}
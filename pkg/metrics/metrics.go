@@ -0,0 +1,249 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics keeps counters and gauges and serves them in the
+// Prometheus text exposition format. It covers the little flanneld needs
+// without pulling in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricType string
+
+const (
+	counterType metricType = "counter"
+	gaugeType   metricType = "gauge"
+)
+
+// Registry holds a set of metrics
+type Registry struct {
+	mux     sync.Mutex
+	metrics []*vec
+}
+
+// DefaultRegistry is the registry NewCounterVec and NewGaugeVec add to
+var DefaultRegistry = &Registry{}
+
+// vec is a metric with a value for every combination of label values
+type vec struct {
+	name   string
+	help   string
+	typ    metricType
+	labels []string
+
+	mux     sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) register(v *vec) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, m := range r.metrics {
+		if m.name == v.name {
+			panic(fmt.Sprintf("metric %q registered twice", v.name))
+		}
+	}
+	r.metrics = append(r.metrics, v)
+}
+
+func newVec(r *Registry, name, help string, typ metricType, labels []string) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+	r.register(v)
+	return v
+}
+
+// key joins the label values into the map key for them. The values are
+// quoted so that no two combinations share a key.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %q takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	parts := make([]string, len(values))
+	for i, val := range values {
+		parts[i] = strconv.Quote(val)
+	}
+	return strings.Join(parts, ",")
+}
+
+// sample returns the sample for the label values, creating it if need be.
+// v.mux must be held.
+func (v *vec) sample(values []string) *sample {
+	k := v.key(values)
+	s, ok := v.samples[k]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), values...)}
+		v.samples[k] = s
+	}
+	return s
+}
+
+func (v *vec) add(delta float64, values []string) {
+	v.mux.Lock()
+	v.sample(values).value += delta
+	v.mux.Unlock()
+}
+
+func (v *vec) set(val float64, values []string) {
+	v.mux.Lock()
+	v.sample(values).value = val
+	v.mux.Unlock()
+}
+
+func (v *vec) get(values []string) float64 {
+	k := v.key(values)
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if s, ok := v.samples[k]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (v *vec) delete(values []string) {
+	k := v.key(values)
+	v.mux.Lock()
+	delete(v.samples, k)
+	v.mux.Unlock()
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	keys := make([]string, 0, len(v.samples))
+	for k := range v.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+	for _, k := range keys {
+		s := v.samples[k]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(s.labelValues), strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// labelPairs formats the label values as {label="value",...}
+func (v *vec) labelPairs(values []string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(v.labels))
+	for i, l := range v.labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", l, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// Write writes all metrics of the registry in the text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mux.Lock()
+	metrics := append([]*vec(nil), r.metrics...)
+	r.mux.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ServeHTTP serves the metrics of the registry
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// Handler returns the handler serving the default registry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// CounterVec is a counter partitioned by a set of labels
+type CounterVec struct {
+	v *vec
+}
+
+// NewCounterVec creates a counter in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(DefaultRegistry, name, help, counterType, labels)}
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.v.add(1, labelValues)
+}
+
+// Add adds delta, which must not be negative, to the counter with the
+// given label values
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counter cannot decrease")
+	}
+	c.v.add(delta, labelValues)
+}
+
+// Get returns the value of the counter with the given label values
+func (c *CounterVec) Get(labelValues ...string) float64 {
+	return c.v.get(labelValues)
+}
+
+// GaugeVec is a gauge partitioned by a set of labels
+type GaugeVec struct {
+	v *vec
+}
+
+// NewGaugeVec creates a gauge in the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(DefaultRegistry, name, help, gaugeType, labels)}
+}
+
+// Set sets the gauge with the given label values
+func (g *GaugeVec) Set(val float64, labelValues ...string) {
+	g.v.set(val, labelValues)
+}
+
+// Get returns the value of the gauge with the given label values
+func (g *GaugeVec) Get(labelValues ...string) float64 {
+	return g.v.get(labelValues)
+}
+
+// Delete drops the gauge with the given label values, e.g. once the
+// network it describes is gone
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.v.delete(labelValues)
+}
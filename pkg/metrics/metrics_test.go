@@ -0,0 +1,66 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := &Registry{}
+	c := &CounterVec{newVec(r, "test_events_total", "Number of events.", counterType, []string{"network", "result"})}
+	g := &GaugeVec{newVec(r, "test_peers", "Number of peers.", gaugeType, []string{"network"})}
+
+	c.Inc("b", "success")
+	c.Inc("a", "failure")
+	c.Add(2, "a", "failure")
+	g.Set(3, "a")
+	g.Set(1.5, `x"y`)
+	g.Set(4, "gone")
+	g.Delete("gone")
+
+	if v := c.Get("a", "failure"); v != 3 {
+		t.Errorf("expected counter to be 3, got %v", v)
+	}
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+
+	expected := `# HELP test_events_total Number of events.
+# TYPE test_events_total counter
+test_events_total{network="a",result="failure"} 3
+test_events_total{network="b",result="success"} 1
+# HELP test_peers Number of peers.
+# TYPE test_peers gauge
+test_peers{network="a"} 3
+test_peers{network="x\"y"} 1.5
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	r := &Registry{}
+	g := &GaugeVec{newVec(r, "test_gauge", "A gauge.", gaugeType, []string{"network"})}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for missing label values")
+		}
+	}()
+	g.Set(1)
+}
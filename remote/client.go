@@ -258,6 +258,29 @@ func (m *RemoteManager) WatchNetworks(ctx context.Context, cursor interface{}) (
 	return wr, nil
 }
 
+func (m *RemoteManager) WatchNetworkConfig(ctx context.Context, network string, cursor interface{}) (subnet.ConfigWatchResult, error) {
+	url := m.mkurl(network, "config", "watch")
+
+	wr := configWatchResult{}
+	err := m.watch(ctx, url, cursor, &wr)
+	if err != nil {
+		return subnet.ConfigWatchResult{}, err
+	}
+	if _, ok := wr.Cursor.(string); !ok {
+		return subnet.ConfigWatchResult{}, fmt.Errorf("watch returned non-string cursor")
+	}
+
+	config, err := subnet.ParseConfig(string(wr.Config))
+	if err != nil {
+		return subnet.ConfigWatchResult{}, err
+	}
+
+	return subnet.ConfigWatchResult{
+		Config: config,
+		Cursor: wr.Cursor,
+	}, nil
+}
+
 func (m *RemoteManager) AddReservation(ctx context.Context, network string, r *subnet.Reservation) error {
 	url := m.mkurl(network, "reservations")
 
@@ -61,6 +61,49 @@ func handleGetNetworkConfig(ctx context.Context, sm subnet.Manager, w http.Respo
 	jsonResponse(w, http.StatusOK, c)
 }
 
+// configWatchResult is subnet.ConfigWatchResult on the wire. The config is
+// parsed again on the client as parsing fills in derived settings.
+type configWatchResult struct {
+	Config json.RawMessage `json:"config"`
+	Cursor interface{}     `json:"cursor"`
+}
+
+// GET /{network}/config/watch?next=cursor
+func handleWatchNetworkConfig(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
+	network := mux.Vars(r)["network"]
+	if network == "_" {
+		network = ""
+	}
+
+	cursor := getCursor(r.URL)
+
+	wr, err := sm.WatchNetworkConfig(ctx, network, cursor)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	switch wr.Cursor.(type) {
+	case string:
+	case fmt.Stringer:
+		wr.Cursor = wr.Cursor.(fmt.Stringer).String()
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, fmt.Errorf("internal error: watch cursor is of unknown type"))
+		return
+	}
+
+	config, err := json.Marshal(wr.Config)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, configWatchResult{config, wr.Cursor})
+}
+
 // POST /{network}/leases
 func handleAcquireLease(ctx context.Context, sm subnet.Manager, w http.ResponseWriter, r *http.Request) {
 	network := mux.Vars(r)["network"]
@@ -368,6 +411,7 @@ func RunServer(ctx context.Context, sm subnet.Manager, listenAddr, cafile, certf
 
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/{network}/config", bindHandler(handleGetNetworkConfig, ctx, sm)).Methods("GET")
+	r.HandleFunc("/v1/{network}/config/watch", bindHandler(handleWatchNetworkConfig, ctx, sm)).Methods("GET")
 
 	r.HandleFunc("/v1/{network}/leases", bindHandler(handleAcquireLease, ctx, sm)).Methods("POST")
 	r.HandleFunc("/v1/{network}/leases/{subnet}", bindHandler(handleWatchLease, ctx, sm)).Methods("GET")
@@ -0,0 +1,206 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/network"
+)
+
+const statusPath = "/v1/status"
+
+// listenStatus serves the status of the networks on a unix socket that only
+// root can connect to
+func listenStatus(nm *network.Manager, path string) error {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	// a stale socket from an earlier run would make the listen fail
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(statusPath, func(w http.ResponseWriter, r *http.Request) {
+		diff := r.URL.Query().Get("diff") == "true"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nm.Status(diff))
+	})
+
+	log.Infof("Serving status on %v", path)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Error("Status listener failed: ", err)
+		}
+	}()
+	return nil
+}
+
+// runStatus implements 'flanneld status': it asks the running flanneld for
+// the status of its networks and prints it. It returns the exit code: 1 if
+// the status couldn't be retrieved and, with --diff, 2 if the kernel tables
+// have drifted from what flanneld programmed.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	diff := fs.Bool("diff", false, "compare the routes, FDB and neighbor entries flanneld programmed with the kernel tables")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", opts.statusSocket)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	// the host is ignored, the request goes to the socket
+	resp, err := client.Get(fmt.Sprintf("http://flanneld%s?diff=%v", statusPath, *diff))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get the status from %v: %v\n", opts.statusSocket, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%v", resp.Status)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get the status from %v: %v\n", opts.statusSocket, err)
+		return 1
+	}
+
+	var statuses []network.NetworkStatus
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to decode the status: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		os.Stdout.Write(body)
+	} else {
+		printStatus(os.Stdout, statuses)
+	}
+
+	for _, st := range statuses {
+		if st.Drift != nil && (st.Drift.Error != "" || !st.Drift.Missing.Empty() || !st.Drift.Unexpected.Empty()) {
+			return 2
+		}
+	}
+	return 0
+}
+
+func printStatus(w io.Writer, statuses []network.NetworkStatus) {
+	for i, st := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		if st.Name == "" {
+			fmt.Fprintln(w, "Network:")
+		} else {
+			fmt.Fprintf(w, "Network %s:\n", st.Name)
+		}
+
+		if st.Subnet == nil {
+			fmt.Fprintln(w, "  No lease")
+			continue
+		}
+
+		fmt.Fprintf(w, "  Backend:   %s\n", st.BackendType)
+		fmt.Fprintf(w, "  Subnet:    %s\n", st.Subnet)
+		if st.IPv6Subnet != nil {
+			fmt.Fprintf(w, "  IPv6:      %s\n", st.IPv6Subnet)
+		}
+		if st.Expiration != nil {
+			fmt.Fprintf(w, "  Expires:   %s (in %s)\n", st.Expiration.Format(time.RFC3339), st.Expiration.Sub(time.Now())/time.Second*time.Second)
+		}
+
+		fmt.Fprintf(w, "  Peers:     %d\n", len(st.Peers))
+		for _, p := range st.Peers {
+			if p.IPv6Subnet != nil {
+				fmt.Fprintf(w, "    %s %s via %s\n", p.Subnet, p.IPv6Subnet, p.PublicIP)
+			} else {
+				fmt.Fprintf(w, "    %s via %s\n", p.Subnet, p.PublicIP)
+			}
+		}
+
+		if st.Programmed != nil {
+			printDataplane(w, "  ", *st.Programmed)
+		}
+
+		if d := st.Drift; d != nil {
+			switch {
+			case d.Error != "":
+				fmt.Fprintf(w, "  Drift:     unknown, %s\n", d.Error)
+			case d.Missing.Empty() && d.Unexpected.Empty():
+				fmt.Fprintln(w, "  Drift:     none")
+			default:
+				fmt.Fprintln(w, "  Drift:")
+				if !d.Missing.Empty() {
+					fmt.Fprintln(w, "    Missing from the kernel:")
+					printDataplane(w, "      ", d.Missing)
+				}
+				if !d.Unexpected.Empty() {
+					fmt.Fprintln(w, "    Not programmed by flanneld:")
+					printDataplane(w, "      ", d.Unexpected)
+				}
+			}
+		}
+	}
+}
+
+func printDataplane(w io.Writer, indent string, dp backend.Dataplane) {
+	if len(dp.Routes) > 0 {
+		fmt.Fprintf(w, "%sRoutes:\n", indent)
+		for _, r := range dp.Routes {
+			fmt.Fprintf(w, "%s  %s\n", indent, r)
+		}
+	}
+	if len(dp.FDB) > 0 {
+		fmt.Fprintf(w, "%sFDB:\n", indent)
+		for _, n := range dp.FDB {
+			fmt.Fprintf(w, "%s  %s\n", indent, n)
+		}
+	}
+	if len(dp.Neighbors) > 0 {
+		fmt.Fprintf(w, "%sNeighbors:\n", indent)
+		for _, n := range dp.Neighbors {
+			fmt.Fprintf(w, "%s  %s\n", indent, n)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"errors"
+	"hash/fnv"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	AllocateRandom     = "random"
+	AllocateSequential = "sequential"
+	AllocateHashIP     = "hash-of-public-ip"
+)
+
+var errOutOfSubnets = errors.New("out of subnets")
+
+// An allocationStrategy picks one of the free blocks of span subnets in b
+// for the host with the given attributes and returns the index of its first
+// subnet. b has at least one such free block.
+type allocationStrategy func(b *subnetBitmap, span int, attrs *LeaseAttrs) int
+
+var allocationStrategies = map[string]allocationStrategy{
+	// uniformly random over all free blocks
+	AllocateRandom: func(b *subnetBitmap, span int, attrs *LeaseAttrs) int {
+		n := b.countFreeBlocks(span)
+		return b.nthFreeBlock(int(rnd.Int63n(int64(n))), span)
+	},
+
+	// the lowest free block
+	AllocateSequential: func(b *subnetBitmap, span int, attrs *LeaseAttrs) int {
+		return b.nextFreeBlock(0, span)
+	},
+
+	// the first free block at or after the one the public IP hashes to,
+	// so that a host tends to get the same subnet back after its lease
+	// has expired
+	AllocateHashIP: func(b *subnetBitmap, span int, attrs *LeaseAttrs) int {
+		h := fnv.New32a()
+		pubIP := attrs.PublicIP.ToIP().To4()
+		h.Write(pubIP)
+		nblocks := uint64(len(b.words)*64) / uint64(span)
+		start := int(uint64(h.Sum32())%nblocks) * span
+		if i := b.nextFreeBlock(start, span); i >= 0 {
+			return i
+		}
+		return b.nextFreeBlock(0, span)
+	},
+}
+
+// subnetBitmap is the free-space index of a range of a network: one bit per
+// subnet of the smallest size hosts can get (MaxSubnetLen), set if the subnet
+// is outside of the range or overlaps an existing lease or excluded subnet.
+//
+// The bitmap starts on a boundary of the largest subnet size hosts can get
+// (MinSubnetLen), so a subnet of prefix length l is an aligned block of
+// 1 << (MaxSubnetLen - l) bits. Blocks of up to 64 bits never straddle two
+// words and larger blocks are made of whole words.
+type subnetBitmap struct {
+	first ip.IP4
+	shift uint
+	free  int
+	words []uint64
+}
+
+func newSubnetBitmap(config *Config, r subnetRange, leases []Lease) *subnetBitmap {
+	b := &subnetBitmap{
+		first: r.min &^ ip.IP4(uint64(1)<<(32-config.MinSubnetLen)-1),
+		shift: 32 - config.MaxSubnetLen,
+	}
+
+	size := 0
+	if r.max >= r.min {
+		last := uint64(r.max) + uint64(1)<<(32-config.SubnetLen) - 1
+		size = int((last-uint64(b.first))>>b.shift) + 1
+	}
+
+	// round up to whole words and whole blocks of the largest size
+	maxSpan := 1 << (config.MaxSubnetLen - config.MinSubnetLen)
+	nwords := (size + 63) / 64
+	if wordsPerSpan := maxSpan / 64; wordsPerSpan > 1 {
+		nwords = (nwords + wordsPerSpan - 1) / wordsPerSpan * wordsPerSpan
+	}
+	b.words = make([]uint64, nwords)
+	b.free = nwords * 64
+
+	// the bits before and past the end of the range are never free
+	for i := 0; i < int(uint64(r.min-b.first)>>b.shift); i++ {
+		b.set(i)
+	}
+	for i := size; i < nwords*64; i++ {
+		b.set(i)
+	}
+
+	for _, l := range leases {
+		b.markUsed(l.Subnet)
+	}
+	for _, ex := range config.ExcludeSubnets {
+		b.markUsed(ex)
+	}
+
+	return b
+}
+
+// markUsed marks all the subnets overlapping sn as used
+func (b *subnetBitmap) markUsed(sn ip.IP4Net) {
+	if len(b.words) == 0 {
+		return
+	}
+
+	first := uint64(b.first)
+	last := first + uint64(len(b.words)*64)<<b.shift - 1
+	lo := uint64(sn.Network().IP)
+	hi := lo + uint64(1)<<(32-sn.PrefixLen) - 1
+
+	if hi < first || lo > last {
+		return
+	}
+	if lo < first {
+		lo = first
+	}
+	if hi > last {
+		hi = last
+	}
+
+	for i := (lo - first) >> b.shift; i <= (hi-first)>>b.shift; i++ {
+		b.set(int(i))
+	}
+}
+
+func (b *subnetBitmap) set(i int) {
+	w, bit := i/64, uint64(1)<<uint(i%64)
+	if b.words[w]&bit == 0 {
+		b.words[w] |= bit
+		b.free--
+	}
+}
+
+func (b *subnetBitmap) isFree(i int) bool {
+	return b.words[i/64]&(uint64(1)<<uint(i%64)) == 0
+}
+
+// freeBlocks returns the mask of the free blocks of span (at most 64)
+// subnets in word w: bit j is set if subnets j ... j+span-1 are all free.
+func (b *subnetBitmap) freeBlocks(w, span int) uint64 {
+	free := ^b.words[w]
+	for s := 1; s < span; s <<= 1 {
+		free &= free >> uint(s)
+	}
+
+	// every span-th bit
+	aligned := uint64(1)
+	if span < 64 {
+		aligned = ^uint64(0) / (uint64(1)<<uint(span) - 1)
+	}
+	return free & aligned
+}
+
+// wordsFree returns true if the block of span (a multiple of 64) subnets
+// starting at i is free
+func (b *subnetBitmap) wordsFree(i, span int) bool {
+	for w := i / 64; w < (i+span)/64; w++ {
+		if b.words[w] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nextFreeBlock returns the index of the first free block of span subnets
+// at or after i, or -1
+func (b *subnetBitmap) nextFreeBlock(i, span int) int {
+	i = (i + span - 1) / span * span
+
+	if span > 64 {
+		for ; i+span <= len(b.words)*64; i += span {
+			if b.wordsFree(i, span) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for w := i / 64; w < len(b.words); w++ {
+		free := b.freeBlocks(w, span)
+		if w == i/64 {
+			free &= ^uint64(0) << uint(i%64)
+		}
+		if free != 0 {
+			return w*64 + trailingZeros(free)
+		}
+	}
+	return -1
+}
+
+func (b *subnetBitmap) countFreeBlocks(span int) int {
+	n := 0
+	if span > 64 {
+		for i := 0; i+span <= len(b.words)*64; i += span {
+			if b.wordsFree(i, span) {
+				n++
+			}
+		}
+		return n
+	}
+
+	for w := range b.words {
+		n += onesCount(b.freeBlocks(w, span))
+	}
+	return n
+}
+
+// nthFreeBlock returns the index of the n-th (counting from 0) free block
+// of span subnets
+func (b *subnetBitmap) nthFreeBlock(n, span int) int {
+	if span > 64 {
+		for i := 0; i+span <= len(b.words)*64; i += span {
+			if b.wordsFree(i, span) {
+				if n == 0 {
+					return i
+				}
+				n--
+			}
+		}
+		return -1
+	}
+
+	for w := range b.words {
+		free := b.freeBlocks(w, span)
+		c := onesCount(free)
+		if n >= c {
+			n -= c
+			continue
+		}
+		for ; n > 0; n-- {
+			free &= free - 1
+		}
+		return w*64 + trailingZeros(free)
+	}
+	return -1
+}
+
+// deBruijn64 and deBruijnIdx find the lowest set bit of a word without
+// math/bits, which older Go releases lack
+const deBruijn64 = 0x03f79d71b4ca8b09
+
+var deBruijnIdx = [64]byte{
+	0, 1, 56, 2, 57, 49, 28, 3, 61, 58, 42, 50, 38, 29, 17, 4,
+	62, 47, 59, 36, 45, 43, 51, 22, 53, 39, 33, 30, 24, 18, 12, 5,
+	63, 55, 48, 27, 60, 41, 37, 16, 46, 35, 44, 21, 52, 32, 23, 11,
+	54, 26, 40, 15, 34, 20, 31, 10, 25, 14, 19, 9, 13, 8, 7, 6,
+}
+
+// trailingZeros returns the number of trailing zero bits of x, 64 for 0
+func trailingZeros(x uint64) int {
+	if x == 0 {
+		return 64
+	}
+	return int(deBruijnIdx[(x&-x)*deBruijn64>>58])
+}
+
+// onesCount returns the number of set bits of x
+func onesCount(x uint64) int {
+	n := 0
+	for ; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+func (b *subnetBitmap) subnet(i int, prefixLen uint) ip.IP4Net {
+	return ip.IP4Net{
+		IP:        b.first + ip.IP4(uint32(i)<<b.shift),
+		PrefixLen: prefixLen,
+	}
+}
+
+// allocate picks a free subnet of the given prefix length using the given
+// strategy
+func (b *subnetBitmap) allocate(strategy string, prefixLen uint, attrs *LeaseAttrs) (ip.IP4Net, error) {
+	span := 1 << (32 - b.shift - prefixLen)
+	if b.free < span || b.countFreeBlocks(span) == 0 {
+		return ip.IP4Net{}, errOutOfSubnets
+	}
+
+	pick, ok := allocationStrategies[strategy]
+	if !ok {
+		pick = allocationStrategies[AllocateRandom]
+	}
+
+	return b.subnet(pick(b, span, attrs), prefixLen), nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func mustParseConfig(t testing.TB, s string) *Config {
+	config, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	return config
+}
+
+// fillLeases returns leases for the first n subnets of the network
+func fillLeases(config *Config, n int) []Lease {
+	var leases []Lease
+	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
+	for i := 0; i < n && sn.IP <= config.SubnetMax; i++ {
+		leases = append(leases, Lease{Subnet: sn})
+		sn = sn.Next()
+	}
+	return leases
+}
+
+func TestAllocateSequential(t *testing.T) {
+	config := mustParseConfig(t, `{ "Network": "10.3.0.0/16", "AllocationStrategy": "sequential" }`)
+	leases := []Lease{
+		{Subnet: newIP4Net("10.3.1.0", 24)},
+		{Subnet: newIP4Net("10.3.2.0", 23)},
+		{Subnet: newIP4Net("10.3.5.128", 25)},
+	}
+
+	sn, err := newSubnetBitmap(config, config.subnetRanges()[0], leases).allocate(config.AllocationStrategy, config.SubnetLen, &LeaseAttrs{})
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+	if !sn.Equal(newIP4Net("10.3.4.0", 24)) {
+		t.Errorf("expected 10.3.4.0/24, got %v", sn)
+	}
+
+	b := newSubnetBitmap(config, config.subnetRanges()[0], leases)
+	if b.free != 251 {
+		t.Errorf("expected 251 free subnets, got %d", b.free)
+	}
+	if b.isFree(4) != false || b.isFree(3) != true {
+		t.Errorf("unexpected bitmap contents")
+	}
+}
+
+func TestAllocateExhausted(t *testing.T) {
+	config := mustParseConfig(t, `{ "Network": "10.3.0.0/20" }`)
+	leases := fillLeases(config, 1<<16)
+
+	if _, err := newSubnetBitmap(config, config.subnetRanges()[0], leases).allocate(config.AllocationStrategy, config.SubnetLen, &LeaseAttrs{}); err != errOutOfSubnets {
+		t.Fatalf("expected out of subnets, got %v", err)
+	}
+
+	// a lease covering the whole range
+	leases = []Lease{{Subnet: newIP4Net("10.0.0.0", 8)}}
+	if _, err := newSubnetBitmap(config, config.subnetRanges()[0], leases).allocate(config.AllocationStrategy, config.SubnetLen, &LeaseAttrs{}); err != errOutOfSubnets {
+		t.Fatalf("expected out of subnets, got %v", err)
+	}
+}
+
+func TestAllocateRandom(t *testing.T) {
+	config := mustParseConfig(t, `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.10.0", "SubnetMax": "10.3.200.0" }`)
+	if config.AllocationStrategy != AllocateRandom {
+		t.Fatalf("expected random allocation by default, got %q", config.AllocationStrategy)
+	}
+
+	leases := fillLeases(config, 150)
+	b := newSubnetBitmap(config, config.subnetRanges()[0], leases)
+
+	seen := make(map[ip.IP4Net]bool)
+	for i := 0; i < 200; i++ {
+		sn, err := b.allocate(config.AllocationStrategy, config.SubnetLen, &LeaseAttrs{})
+		if err != nil {
+			t.Fatalf("allocate failed: %v", err)
+		}
+		if sn.IP < ip.MustParseIP4("10.3.160.0") || sn.IP > config.SubnetMax {
+			t.Fatalf("allocated subnet %v outside of the free range", sn)
+		}
+		seen[sn] = true
+	}
+
+	if len(seen) < 10 {
+		t.Errorf("random allocation is not spread out: %v", seen)
+	}
+}
+
+func TestAllocateHashIP(t *testing.T) {
+	config := mustParseConfig(t, `{ "Network": "10.3.0.0/16", "AllocationStrategy": "hash-of-public-ip" }`)
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+
+	sn1, err := newSubnetBitmap(config, config.subnetRanges()[0], nil).allocate(config.AllocationStrategy, config.SubnetLen, attrs)
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+
+	// stable across allocations
+	sn2, _ := newSubnetBitmap(config, config.subnetRanges()[0], nil).allocate(config.AllocationStrategy, config.SubnetLen, attrs)
+	if !sn1.Equal(sn2) {
+		t.Errorf("expected %v, got %v", sn1, sn2)
+	}
+
+	// and moves on to the next free subnet if taken
+	sn3, _ := newSubnetBitmap(config, config.subnetRanges()[0], []Lease{{Subnet: sn1}}).allocate(config.AllocationStrategy, config.SubnetLen, attrs)
+	if sn3.Equal(sn1) {
+		t.Errorf("allocated subnet %v that is in use", sn3)
+	}
+
+	// wrapping around the end of the range
+	all := fillLeases(config, 1<<16)
+	b := newSubnetBitmap(config, config.subnetRanges()[0], all[1:])
+	if sn, err := b.allocate(config.AllocationStrategy, config.SubnetLen, attrs); err != nil || !sn.Equal(b.subnet(0, config.SubnetLen)) {
+		t.Errorf("expected %v, got %v, %v", b.subnet(0, config.SubnetLen), sn, err)
+	}
+}
+
+func TestAllocateMixedSizes(t *testing.T) {
+	config := mustParseConfig(t, `{ "Network": "10.3.0.0/16", "SubnetLen": 24, "MinSubnetLen": 20, "MaxSubnetLen": 28, "AllocationStrategy": "sequential" }`)
+	leases := []Lease{
+		{Subnet: newIP4Net("10.3.1.0", 24)},
+		{Subnet: newIP4Net("10.3.16.0", 20)},
+		{Subnet: newIP4Net("10.3.2.16", 28)},
+	}
+
+	for _, tc := range []struct {
+		prefixLen uint
+		expected  ip.IP4Net
+	}{
+		// the /20 at 10.3.0.0 is partly below SubnetMin
+		{20, newIP4Net("10.3.32.0", 20)},
+		{24, newIP4Net("10.3.3.0", 24)},
+		{26, newIP4Net("10.3.2.64", 26)},
+		{28, newIP4Net("10.3.2.0", 28)},
+	} {
+		sn, err := newSubnetBitmap(config, config.subnetRanges()[0], leases).allocate(config.AllocationStrategy, tc.prefixLen, &LeaseAttrs{})
+		if err != nil {
+			t.Fatalf("allocate /%d failed: %v", tc.prefixLen, err)
+		}
+		if !sn.Equal(tc.expected) {
+			t.Errorf("expected %v, got %v", tc.expected, sn)
+		}
+	}
+
+	// random allocations never overlap anything
+	config.AllocationStrategy = AllocateRandom
+	for i := 0; i < 100; i++ {
+		prefixLen := uint(20 + rnd.Intn(9))
+		sn, err := newSubnetBitmap(config, config.subnetRanges()[0], leases).allocate(config.AllocationStrategy, prefixLen, &LeaseAttrs{})
+		switch {
+		case err == errOutOfSubnets:
+			// the large ones run out quickly
+			continue
+		case err != nil:
+			t.Fatalf("allocate /%d failed: %v", prefixLen, err)
+		}
+		if !isSubnetConfigCompat(config, sn) {
+			t.Fatalf("allocated subnet %v is not compatible with the config", sn)
+		}
+		for _, l := range leases {
+			if l.Subnet.Overlaps(sn) {
+				t.Fatalf("allocated subnet %v overlaps %v", sn, l.Subnet)
+			}
+		}
+		leases = append(leases, Lease{Subnet: sn})
+	}
+}
+
+func TestAllocateExcluded(t *testing.T) {
+	config := mustParseConfig(t, `{ "Network": "10.3.0.0/20", "ExcludeSubnets": ["10.3.4.0/22", "10.3.1.128/25"] }`)
+
+	for i := 0; i < 100; i++ {
+		sn, err := newSubnetBitmap(config, config.subnetRanges()[0], nil).allocate(config.AllocationStrategy, config.SubnetLen, &LeaseAttrs{})
+		if err != nil {
+			t.Fatalf("allocate failed: %v", err)
+		}
+		if ex, ok := config.excludedBy(sn); ok {
+			t.Fatalf("allocated subnet %v overlaps excluded %v", sn, ex)
+		}
+	}
+
+	// 15 subnets less the 5 excluded
+	if b := newSubnetBitmap(config, config.subnetRanges()[0], nil); b.free != 10 {
+		t.Errorf("expected 10 free subnets, got %d", b.free)
+	}
+}
+
+func TestUnknownAllocationStrategy(t *testing.T) {
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "AllocationStrategy": "best-fit" }`); err == nil {
+		t.Fatalf("ParseConfig accepted an unknown AllocationStrategy")
+	}
+}
+
+// allocateSubnetLinear is the allocator LocalManager used before the
+// bitmap, kept as a baseline for the benchmarks
+func allocateSubnetLinear(config *Config, leases []Lease) (ip.IP4Net, error) {
+	var bag []ip.IP4
+	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
+
+OuterLoop:
+	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
+		for _, l := range leases {
+			if sn.Overlaps(l.Subnet) {
+				continue OuterLoop
+			}
+		}
+		bag = append(bag, sn.IP)
+	}
+
+	if len(bag) == 0 {
+		return ip.IP4Net{}, errOutOfSubnets
+	}
+	return ip.IP4Net{IP: bag[rnd.Intn(len(bag))], PrefixLen: config.SubnetLen}, nil
+}
+
+func benchmarkAllocate(b *testing.B, nleases int, alloc func(*Config, []Lease) (ip.IP4Net, error)) {
+	config := mustParseConfig(b, `{ "Network": "10.0.0.0/8" }`)
+	leases := fillLeases(config, nleases)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := alloc(config, leases); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAllocate(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000, 50000} {
+		// the linear allocator takes seconds per op beyond this
+		if n <= 10000 {
+			b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+				benchmarkAllocate(b, n, allocateSubnetLinear)
+			})
+		}
+		for _, strategy := range []string{AllocateRandom, AllocateSequential, AllocateHashIP} {
+			b.Run(fmt.Sprintf("%s/%d", strategy, n), func(b *testing.B) {
+				attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+				benchmarkAllocate(b, n, func(config *Config, leases []Lease) (ip.IP4Net, error) {
+					return newSubnetBitmap(config, config.subnetRanges()[0], leases).allocate(strategy, config.SubnetLen, attrs)
+				})
+			})
+		}
+	}
+}
+
+func TestBitHelpers(t *testing.T) {
+	for i := uint(0); i < 64; i++ {
+		x := uint64(1) << i
+		if tz := trailingZeros(x); tz != int(i) {
+			t.Errorf("trailingZeros(%#x) = %d, want %d", x, tz, i)
+		}
+		if tz := trailingZeros(^uint64(0) << i); tz != int(i) {
+			t.Errorf("trailingZeros(%#x) = %d, want %d", ^uint64(0)<<i, tz, i)
+		}
+		if c := onesCount(^uint64(0) >> i); c != 64-int(i) {
+			t.Errorf("onesCount(%#x) = %d, want %d", ^uint64(0)>>i, c, 64-i)
+		}
+	}
+	if tz := trailingZeros(0); tz != 64 {
+		t.Errorf("trailingZeros(0) = %d, want 64", tz)
+	}
+	if c := onesCount(0xa5a5); c != 8 {
+		t.Errorf("onesCount(0xa5a5) = %d, want 8", c)
+	}
+}
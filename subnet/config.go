@@ -18,17 +18,65 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
 
 type Config struct {
-	Network     ip.IP4Net
-	SubnetMin   ip.IP4
-	SubnetMax   ip.IP4
-	SubnetLen   uint
-	BackendType string          `json:"-"`
-	Backend     json.RawMessage `json:",omitempty"`
+	Network ip.IP4Net
+	// Networks is Network followed by any blocks added to the network later,
+	// allocation moves on to the next block when one is full
+	Networks           []ip.IP4Net `json:",omitempty"`
+	SubnetMin          ip.IP4
+	SubnetMax          ip.IP4
+	SubnetLen          uint
+	MinSubnetLen       uint
+	MaxSubnetLen       uint
+	AllocationStrategy string `json:",omitempty"`
+	// ExcludeSubnets are never handed out. Existing leases overlapping
+	// them are given up on renewal if MigrateExcludedLeases is set.
+	ExcludeSubnets        []ip.IP4Net `json:",omitempty"`
+	MigrateExcludedLeases bool        `json:",omitempty"`
+	// LeaseTTL is how long a lease lives without being renewed, and
+	// RenewMargin how long before its expiration it is renewed
+	LeaseTTL      Duration
+	RenewMargin   Duration
+	IPv6Network   ip.IP6Net
+	IPv6SubnetLen uint
+	BackendType   string          `json:"-"`
+	Backend       json.RawMessage `json:",omitempty"`
+}
+
+// Duration is a time.Duration that is a string like "1h30m" in JSON. A
+// number is taken as seconds.
+type Duration struct {
+	time.Duration
+}
+
+// json.Marshaler impl
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// json.Unmarshaler impl
+func (d *Duration) UnmarshalJSON(j []byte) error {
+	var s string
+	if err := json.Unmarshal(j, &s); err != nil {
+		var secs float64
+		if err := json.Unmarshal(j, &secs); err != nil {
+			return fmt.Errorf("invalid duration %s", j)
+		}
+		d.Duration = time.Duration(secs * float64(time.Second))
+		return nil
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
 }
 
 func parseBackendType(be json.RawMessage) (string, error) {
@@ -54,6 +102,10 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.parseNetworks(); err != nil {
+		return nil, err
+	}
+
 	if cfg.SubnetLen > 0 {
 		if cfg.SubnetLen < cfg.Network.PrefixLen {
 			return nil, errors.New("HostSubnet is larger network than Network")
@@ -68,6 +120,26 @@ func ParseConfig(s string) (*Config, error) {
 		}
 	}
 
+	// hosts may ask for a subnet of any size between MinSubnetLen (the
+	// largest) and MaxSubnetLen (the smallest), SubnetLen is the default
+	if cfg.MinSubnetLen == 0 {
+		cfg.MinSubnetLen = cfg.SubnetLen
+	}
+	if cfg.MaxSubnetLen == 0 {
+		cfg.MaxSubnetLen = cfg.SubnetLen
+	}
+	if cfg.MinSubnetLen > cfg.SubnetLen {
+		return nil, errors.New("MinSubnetLen is out of the range of SubnetLen")
+	}
+	for _, n := range cfg.Networks {
+		if cfg.MinSubnetLen < n.PrefixLen {
+			return nil, fmt.Errorf("MinSubnetLen is larger than network %v", n)
+		}
+	}
+	if cfg.MaxSubnetLen < cfg.SubnetLen || cfg.MaxSubnetLen > 32 {
+		return nil, errors.New("MaxSubnetLen is out of the range of SubnetLen")
+	}
+
 	subnetSize := ip.IP4(1 << (32 - cfg.SubnetLen))
 
 	if cfg.SubnetMin == ip.IP4(0) {
@@ -85,6 +157,40 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, errors.New("SubnetMax is not in the range of the Network")
 	}
 
+	if cfg.LeaseTTL.Duration == 0 {
+		cfg.LeaseTTL.Duration = subnetTTL
+	}
+	if cfg.RenewMargin.Duration == 0 {
+		cfg.RenewMargin.Duration = renewMargin
+		if cfg.RenewMargin.Duration >= cfg.LeaseTTL.Duration {
+			// short TTL, renew half way through
+			cfg.RenewMargin.Duration = cfg.LeaseTTL.Duration / 2
+		}
+	}
+	if cfg.LeaseTTL.Duration < 0 || cfg.RenewMargin.Duration < 0 {
+		return nil, errors.New("LeaseTTL and RenewMargin must be positive")
+	}
+	if cfg.RenewMargin.Duration >= cfg.LeaseTTL.Duration {
+		return nil, fmt.Errorf("RenewMargin (%v) must be smaller than LeaseTTL (%v)", cfg.RenewMargin, cfg.LeaseTTL)
+	}
+
+	for i, ex := range cfg.ExcludeSubnets {
+		cfg.ExcludeSubnets[i] = ex.Network()
+		if _, ok := cfg.NetworkOf(ex); !ok {
+			return nil, fmt.Errorf("excluded subnet %v is not in the range of the Network", ex)
+		}
+	}
+
+	if cfg.AllocationStrategy == "" {
+		cfg.AllocationStrategy = AllocateRandom
+	} else if _, ok := allocationStrategies[cfg.AllocationStrategy]; !ok {
+		return nil, fmt.Errorf("unknown AllocationStrategy %q", cfg.AllocationStrategy)
+	}
+
+	if err := cfg.checkIPv6(); err != nil {
+		return nil, err
+	}
+
 	bt, err := parseBackendType(cfg.Backend)
 	if err != nil {
 		return nil, err
@@ -93,3 +199,148 @@ func ParseConfig(s string) (*Config, error) {
 
 	return cfg, nil
 }
+
+func (c *Config) parseNetworks() error {
+	switch {
+	case len(c.Networks) == 0:
+		c.Networks = []ip.IP4Net{c.Network}
+	case c.Network == ip.IP4Net{}:
+		c.Network = c.Networks[0]
+	case !c.Networks[0].Equal(c.Network):
+		c.Networks = append([]ip.IP4Net{c.Network}, c.Networks...)
+	}
+
+	for i, n := range c.Networks {
+		c.Networks[i] = n.Network()
+		for _, other := range c.Networks[:i] {
+			if other.Overlaps(n) {
+				return fmt.Errorf("network %v overlaps %v", n, other)
+			}
+		}
+	}
+	c.Network = c.Networks[0]
+
+	return nil
+}
+
+// NetworkOf returns the block of Networks that contains sn
+func (c *Config) NetworkOf(sn ip.IP4Net) (ip.IP4Net, bool) {
+	for _, n := range c.Networks {
+		if n.PrefixLen <= sn.PrefixLen && n.Contains(sn.IP) {
+			return n, true
+		}
+	}
+	return ip.IP4Net{}, false
+}
+
+// excludedBy returns the excluded subnet that sn overlaps
+func (c *Config) excludedBy(sn ip.IP4Net) (ip.IP4Net, bool) {
+	for _, ex := range c.ExcludeSubnets {
+		if ex.Overlaps(sn) {
+			return ex, true
+		}
+	}
+	return ip.IP4Net{}, false
+}
+
+// subnetRange is a range of subnets to allocate from: min and max are the
+// first and last subnet of the default size
+type subnetRange struct {
+	network  ip.IP4Net
+	min, max ip.IP4
+}
+
+// subnetRanges returns SubnetMin ... SubnetMax in Network followed by the
+// whole of the later Networks
+func (c *Config) subnetRanges() []subnetRange {
+	subnetSize := ip.IP4(1 << (32 - c.SubnetLen))
+
+	ranges := []subnetRange{{c.Network, c.SubnetMin, c.SubnetMax}}
+	for _, n := range c.Networks[1:] {
+		r := subnetRange{n, n.IP, n.Next().IP - subnetSize}
+		// skip the first subnet like SubnetMin does, unless it's the only one
+		if r.max > r.min {
+			r.min += subnetSize
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// subnetCount returns the number of subnets of the smallest size in Networks
+func (c *Config) subnetCount() uint64 {
+	var count uint64
+	for _, n := range c.Networks {
+		count += uint64(1) << (c.MaxSubnetLen - n.PrefixLen)
+	}
+	return count
+}
+
+func (c *Config) checkIPv6() error {
+	if !c.IPv6Enabled() {
+		if c.IPv6SubnetLen > 0 {
+			return errors.New("IPv6SubnetLen is set but IPv6Network is not")
+		}
+		return nil
+	}
+
+	c.IPv6Network = c.IPv6Network.Network()
+
+	if c.IPv6SubnetLen > 0 {
+		if c.IPv6SubnetLen < c.IPv6Network.PrefixLen || c.IPv6SubnetLen > 128 {
+			return errors.New("IPv6SubnetLen is out of the range of IPv6Network")
+		}
+	} else if c.IPv6Network.PrefixLen < 64 {
+		c.IPv6SubnetLen = 64
+	} else {
+		c.IPv6SubnetLen = c.IPv6Network.PrefixLen + 1
+	}
+
+	// Every IPv4 subnet maps to an IPv6 subnet so there must be at least as
+	// many of the latter.
+	if bits := c.IPv6SubnetLen - c.IPv6Network.PrefixLen; bits < 64 && uint64(1)<<bits < c.subnetCount() {
+		return fmt.Errorf("IPv6Network %v has fewer /%d subnets than Networks have /%d subnets",
+			c.IPv6Network, c.IPv6SubnetLen, c.MaxSubnetLen)
+	}
+
+	return nil
+}
+
+// IPv6Enabled returns true if the network is dual-stack
+func (c *Config) IPv6Enabled() bool {
+	return !c.IPv6Network.Empty()
+}
+
+// IPv6SubnetFor returns the IPv6 subnet that goes with the IPv4 subnet sn.
+// Hosts get the IPv6 subnet at the same index in IPv6Network as their IPv4
+// subnet has in Networks, counted in subnets of the smallest size, so it
+// needs no allocation of its own. It returns an empty IP6Net if the network
+// is not dual-stack or sn is not in it.
+func (c *Config) IPv6SubnetFor(sn ip.IP4Net) ip.IP6Net {
+	if !c.IPv6Enabled() {
+		return ip.IP6Net{}
+	}
+
+	var base uint64
+	for _, n := range c.Networks {
+		if n.Contains(sn.IP) {
+			index := base + uint64(sn.IP-n.IP)>>(32-c.MaxSubnetLen)
+			return c.IPv6Network.Subnet(c.IPv6SubnetLen, index)
+		}
+		base += uint64(1) << (c.MaxSubnetLen - n.PrefixLen)
+	}
+	return ip.IP6Net{}
+}
+
+// subnetLenFor returns the prefix length of the subnet to give to a host
+// asking for one of prefixLen, 0 meaning the default SubnetLen
+func (c *Config) subnetLenFor(prefixLen uint) (uint, error) {
+	switch {
+	case prefixLen == 0:
+		return c.SubnetLen, nil
+	case prefixLen < c.MinSubnetLen || prefixLen > c.MaxSubnetLen:
+		return 0, fmt.Errorf("requested subnet length %d is out of the configured range %d-%d", prefixLen, c.MinSubnetLen, c.MaxSubnetLen)
+	default:
+		return prefixLen, nil
+	}
+}
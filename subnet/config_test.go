@@ -15,7 +15,11 @@
 package subnet
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -69,3 +73,191 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestConfigIPv6(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "IPv6Network": "fc00:0:0:0:1::/48" }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if !cfg.IPv6Enabled() {
+		t.Fatalf("IPv6 not enabled")
+	}
+
+	if cfg.IPv6Network.String() != "fc00::/48" {
+		t.Errorf("IPv6Network mismatch: expected fc00::/48, got %s", cfg.IPv6Network)
+	}
+
+	if cfg.IPv6SubnetLen != 64 {
+		t.Errorf("IPv6SubnetLen mismatch: expected 64, got %d", cfg.IPv6SubnetLen)
+	}
+
+	sn := newIP4Net("10.3.5.0", 24)
+	if sn6 := cfg.IPv6SubnetFor(sn); sn6.String() != "fc00:0:0:5::/64" {
+		t.Errorf("IPv6SubnetFor mismatch: expected fc00:0:0:5::/64, got %s", sn6)
+	}
+
+	// 65536 /24s do not fit into 256 /56s
+	s = `{ "Network": "10.0.0.0/8", "IPv6Network": "fc00::/48", "IPv6SubnetLen": 56 }`
+	if _, err := ParseConfig(s); err == nil {
+		t.Errorf("ParseConfig accepted an IPv6 network that is too small")
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.IPv6Enabled() || !cfg.IPv6SubnetFor(sn).Empty() {
+		t.Errorf("IPv6 enabled without IPv6Network")
+	}
+}
+
+func TestConfigSubnetLenRange(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "MinSubnetLen": 22, "MaxSubnetLen": 28 }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if cfg.SubnetLen != 24 || cfg.MinSubnetLen != 22 || cfg.MaxSubnetLen != 28 {
+		t.Errorf("unexpected subnet lengths: %d, %d-%d", cfg.SubnetLen, cfg.MinSubnetLen, cfg.MaxSubnetLen)
+	}
+
+	if l, err := cfg.subnetLenFor(0); err != nil || l != 24 {
+		t.Errorf("subnetLenFor(0) returned %d, %v", l, err)
+	}
+	if l, err := cfg.subnetLenFor(26); err != nil || l != 26 {
+		t.Errorf("subnetLenFor(26) returned %d, %v", l, err)
+	}
+	if _, err := cfg.subnetLenFor(20); err == nil {
+		t.Errorf("subnetLenFor(20) accepted a length out of range")
+	}
+
+	cfg, _ = ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if cfg.MinSubnetLen != 24 || cfg.MaxSubnetLen != 24 {
+		t.Errorf("subnet lengths do not default to SubnetLen: %d-%d", cfg.MinSubnetLen, cfg.MaxSubnetLen)
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "MinSubnetLen": 12 }`,
+		`{ "Network": "10.3.0.0/16", "MinSubnetLen": 26 }`,
+		`{ "Network": "10.3.0.0/16", "MaxSubnetLen": 20 }`,
+		`{ "Network": "10.3.0.0/16", "MaxSubnetLen": 33 }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("ParseConfig accepted %s", s)
+		}
+	}
+}
+
+func TestConfigNetworks(t *testing.T) {
+	s := `{ "Networks": ["10.3.0.0/16", "10.5.0.0/24"], "IPv6Network": "fc00::/48" }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if cfg.Network.String() != "10.3.0.0/16" {
+		t.Errorf("Network is not the first of Networks: %s", cfg.Network)
+	}
+
+	if nw, ok := cfg.NetworkOf(newIP4Net("10.5.0.0", 24)); !ok || nw.String() != "10.5.0.0/24" {
+		t.Errorf("NetworkOf returned %v, %v", nw, ok)
+	}
+	if _, ok := cfg.NetworkOf(newIP4Net("10.4.0.0", 24)); ok {
+		t.Errorf("NetworkOf found a subnet outside of the network")
+	}
+
+	// the single /24 of the second block is not skipped
+	ranges := cfg.subnetRanges()
+	if len(ranges) != 2 || ranges[1].min != ranges[1].max || ranges[1].min != ip.MustParseIP4("10.5.0.0") {
+		t.Errorf("unexpected subnet ranges: %v", ranges)
+	}
+
+	// IPv6 subnets of the second block follow the 256 of the first
+	if sn6 := cfg.IPv6SubnetFor(newIP4Net("10.5.0.0", 24)); sn6.String() != "fc00:0:0:100::/64" {
+		t.Errorf("IPv6SubnetFor mismatch: expected fc00:0:0:100::/64, got %s", sn6)
+	}
+
+	// Network goes in front of Networks
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16", "Networks": ["10.5.0.0/16"] }`)
+	if err != nil || len(cfg.Networks) != 2 || !cfg.Networks[0].Equal(cfg.Network) {
+		t.Errorf("unexpected Networks: %v, %v", cfg, err)
+	}
+
+	if _, err := ParseConfig(`{ "Networks": ["10.3.0.0/16", "10.3.128.0/17"] }`); err == nil {
+		t.Errorf("ParseConfig accepted overlapping networks")
+	}
+}
+
+func TestConfigLeaseTTL(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.LeaseTTL.Duration != subnetTTL || cfg.RenewMargin.Duration != renewMargin {
+		t.Errorf("unexpected defaults: LeaseTTL %v, RenewMargin %v", cfg.LeaseTTL, cfg.RenewMargin)
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16", "LeaseTTL": "5m", "RenewMargin": 60 }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.LeaseTTL.Duration != 5*time.Minute || cfg.RenewMargin.Duration != time.Minute {
+		t.Errorf("unexpected LeaseTTL %v, RenewMargin %v", cfg.LeaseTTL, cfg.RenewMargin)
+	}
+
+	// the default margin does not fit into a short TTL
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16", "LeaseTTL": "30m" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.RenewMargin.Duration != 15*time.Minute {
+		t.Errorf("unexpected RenewMargin %v", cfg.RenewMargin)
+	}
+
+	// survives a round trip, as done by the remote server
+	j, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	if cfg2, err := ParseConfig(string(j)); err != nil || cfg2.LeaseTTL != cfg.LeaseTTL || cfg2.RenewMargin != cfg.RenewMargin {
+		t.Errorf("round trip of %s failed: %v, %v", j, cfg2, err)
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "LeaseTTL": "1h", "RenewMargin": "1h" }`,
+		`{ "Network": "10.3.0.0/16", "LeaseTTL": "-1h" }`,
+		`{ "Network": "10.3.0.0/16", "LeaseTTL": "forever" }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("ParseConfig accepted %s", s)
+		}
+	}
+}
+
+func TestConfigExcludeSubnets(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16", "ExcludeSubnets": ["10.3.8.7/21", "10.3.200.0/24"] }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if cfg.ExcludeSubnets[0].String() != "10.3.8.0/21" {
+		t.Errorf("excluded subnet not normalized: %v", cfg.ExcludeSubnets[0])
+	}
+
+	if ex, ok := cfg.excludedBy(newIP4Net("10.3.15.0", 24)); !ok || !ex.Equal(cfg.ExcludeSubnets[0]) {
+		t.Errorf("excludedBy returned %v, %v", ex, ok)
+	}
+	if _, ok := cfg.excludedBy(newIP4Net("10.3.16.0", 24)); ok {
+		t.Errorf("excludedBy matched a subnet that is not excluded")
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "ExcludeSubnets": ["10.4.0.0/24"] }`); err == nil {
+		t.Errorf("ParseConfig accepted an excluded subnet outside of the network")
+	}
+}
@@ -0,0 +1,624 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// The etcd v3 API is spoken through the JSON gateway that every etcd v3
+// server exposes next to its gRPC endpoint. This keeps flannel free of a
+// gRPC dependency while still giving us leases, revisions and transactions.
+
+const etcdV3APIPrefix = "/v3"
+
+var errV3Compacted = errors.New("etcdv3: required revision has been compacted")
+
+type v3KeyValue struct {
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+	Lease          int64
+}
+
+type v3EventType int
+
+const (
+	v3EventPut v3EventType = iota
+	v3EventDelete
+)
+
+type v3Event struct {
+	Type v3EventType
+	Kv   v3KeyValue
+}
+
+// v3Compare is a single transaction guard. Target is either "CREATE" or
+// "MOD" and the guard holds when the key's create/mod revision equals Revision.
+type v3Compare struct {
+	Target   string
+	Revision int64
+}
+
+type etcdV3Client interface {
+	// get returns the key (or all keys under it if prefix is set) along
+	// with the store revision the read was served at.
+	get(ctx context.Context, key string, prefix bool) ([]v3KeyValue, int64, error)
+	// put stores key unconditionally or, if cmp is given, only when cmp
+	// holds. It reports whether the put happened and the store revision.
+	put(ctx context.Context, key, value string, lease int64, cmp *v3Compare) (bool, int64, error)
+	// delete removes key and returns the deleted pair, if any.
+	delete(ctx context.Context, key string) (*v3KeyValue, int64, error)
+	grant(ctx context.Context, ttl time.Duration) (int64, time.Duration, error)
+	// keepAliveOnce refreshes the lease and returns its new TTL or 0 if
+	// the lease no longer exists.
+	keepAliveOnce(ctx context.Context, id int64) (time.Duration, error)
+	// timeToLive returns the remaining TTL of the lease or 0 if the lease
+	// no longer exists.
+	timeToLive(ctx context.Context, id int64) (time.Duration, error)
+	revoke(ctx context.Context, id int64) error
+	// watch blocks until there are events for key (or keys under it)
+	// at or after startRev. It returns errV3Compacted if startRev is
+	// no longer in the history window.
+	watch(ctx context.Context, key string, prefix bool, startRev int64) ([]v3Event, error)
+	// revision returns the current store revision.
+	revision(ctx context.Context) (int64, error)
+}
+
+// prefixEnd returns the range end that selects every key starting with key
+func prefixEnd(key string) string {
+	end := []byte(key)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] = end[i] + 1
+			return string(end[:i+1])
+		}
+	}
+	// key is all 0xff: select to the end of the keyspace
+	return "\x00"
+}
+
+// v3Int64 decodes the gateway's int64 fields which are encoded as JSON strings
+type v3Int64 int64
+
+func (i *v3Int64) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = v3Int64(v)
+	return nil
+}
+
+type v3Header struct {
+	Revision v3Int64 `json:"revision"`
+}
+
+type v3KV struct {
+	Key            []byte  `json:"key"`
+	Value          []byte  `json:"value"`
+	CreateRevision v3Int64 `json:"create_revision"`
+	ModRevision    v3Int64 `json:"mod_revision"`
+	Lease          v3Int64 `json:"lease"`
+}
+
+func (kv *v3KV) toKeyValue() v3KeyValue {
+	return v3KeyValue{
+		Key:            string(kv.Key),
+		Value:          string(kv.Value),
+		CreateRevision: int64(kv.CreateRevision),
+		ModRevision:    int64(kv.ModRevision),
+		Lease:          int64(kv.Lease),
+	}
+}
+
+type v3RangeRequest struct {
+	Key       []byte `json:"key"`
+	RangeEnd  []byte `json:"range_end,omitempty"`
+	KeysOnly  bool   `json:"keys_only,omitempty"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type v3RangeResponse struct {
+	Header v3Header `json:"header"`
+	Kvs    []v3KV   `json:"kvs"`
+}
+
+type v3PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type v3DeleteRangeRequest struct {
+	Key    []byte `json:"key"`
+	PrevKv bool   `json:"prev_kv"`
+}
+
+type v3DeleteRangeResponse struct {
+	Header  v3Header `json:"header"`
+	Deleted v3Int64  `json:"deleted"`
+	PrevKvs []v3KV   `json:"prev_kvs"`
+}
+
+type v3TxnCompare struct {
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+}
+
+type v3TxnOp struct {
+	RequestPut *v3PutRequest `json:"request_put,omitempty"`
+}
+
+type v3TxnRequest struct {
+	Compare []v3TxnCompare `json:"compare"`
+	Success []v3TxnOp      `json:"success"`
+}
+
+type v3TxnResponse struct {
+	Header    v3Header `json:"header"`
+	Succeeded bool     `json:"succeeded"`
+}
+
+type v3LeaseRequest struct {
+	TTL int64 `json:"TTL,string,omitempty"`
+	ID  int64 `json:"ID,string,omitempty"`
+}
+
+type v3LeaseResponse struct {
+	Header v3Header `json:"header"`
+	ID     v3Int64  `json:"ID"`
+	TTL    v3Int64  `json:"TTL"`
+	Error  string   `json:"error"`
+}
+
+type v3WatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+}
+
+type v3WatchRequest struct {
+	CreateRequest v3WatchCreateRequest `json:"create_request"`
+}
+
+type v3WatchEvent struct {
+	Type string `json:"type"`
+	Kv   v3KV   `json:"kv"`
+}
+
+type v3WatchResponse struct {
+	Header          v3Header       `json:"header"`
+	Created         bool           `json:"created"`
+	Canceled        bool           `json:"canceled"`
+	CompactRevision v3Int64        `json:"compact_revision"`
+	Events          []v3WatchEvent `json:"events"`
+}
+
+// streamed gateway responses wrap each message in a "result" object
+type v3StreamMessage struct {
+	Result json.RawMessage `json:"result"`
+	Error  *v3GatewayError `json:"error"`
+}
+
+type v3GatewayError struct {
+	Message string `json:"error"`
+	Code    int    `json:"code"`
+}
+
+func (e *v3GatewayError) Error() string {
+	return fmt.Sprintf("etcdv3: %s (code %d)", e.Message, e.Code)
+}
+
+type httpEtcdV3Client struct {
+	endpoints []string
+	client    *http.Client
+	username  string
+	password  string
+
+	mux   sync.Mutex
+	pin   int
+	token string
+}
+
+func newEtcdV3Client(c *EtcdConfig) (etcdV3Client, error) {
+	tlsInfo := transport.TLSInfo{
+		CertFile: c.Certfile,
+		KeyFile:  c.Keyfile,
+		CAFile:   c.CAFile,
+	}
+
+	t, err := transport.NewTransport(tlsInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints specified")
+	}
+
+	return &httpEtcdV3Client{
+		endpoints: c.Endpoints,
+		client:    &http.Client{Transport: t},
+		username:  c.Username,
+		password:  c.Password,
+	}, nil
+}
+
+func (c *httpEtcdV3Client) authToken(ctx context.Context, endpoint string) (string, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.username == "" || c.token != "" {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"name": c.username, "password": c.password})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.post(ctx, endpoint, "/auth/authenticate", "", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", gatewayError(resp)
+	}
+
+	auth := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+
+	c.token = auth.Token
+	return c.token, nil
+}
+
+func (c *httpEtcdV3Client) resetToken() {
+	c.mux.Lock()
+	c.token = ""
+	c.mux.Unlock()
+}
+
+func (c *httpEtcdV3Client) post(ctx context.Context, endpoint, path, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+etcdV3APIPrefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	return ctxhttp.Do(ctx, c.client, req)
+}
+
+// do sends the request to the pinned endpoint, failing over to the next
+// endpoint on transport errors. The caller must close the response body.
+func (c *httpEtcdV3Client) do(ctx context.Context, path string, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mux.Lock()
+	pin := c.pin
+	c.mux.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(c.endpoints); i++ {
+		endpoint := c.endpoints[(pin+i)%len(c.endpoints)]
+
+		token, err := c.authToken(ctx, endpoint)
+		if err == nil {
+			var resp *http.Response
+			resp, err = c.post(ctx, endpoint, path, token, body)
+			if err == nil {
+				if resp.StatusCode == http.StatusUnauthorized {
+					// token has likely expired; authenticate again on next call
+					c.resetToken()
+				}
+
+				c.mux.Lock()
+				c.pin = (pin + i) % len(c.endpoints)
+				c.mux.Unlock()
+				return resp, nil
+			}
+		}
+
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func (c *httpEtcdV3Client) call(ctx context.Context, path string, req, resp interface{}) error {
+	r, err := c.do(ctx, path, req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return gatewayError(r)
+	}
+
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// stream sends a request to a streaming endpoint and returns the decoder
+// positioned at the first message. Closing the returned body ends the stream.
+func (c *httpEtcdV3Client) stream(ctx context.Context, path string, req interface{}) (*json.Decoder, io.Closer, error) {
+	r, err := c.do(ctx, path, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if r.StatusCode != http.StatusOK {
+		defer r.Body.Close()
+		return nil, nil, gatewayError(r)
+	}
+
+	return json.NewDecoder(r.Body), r.Body, nil
+}
+
+func nextStreamMessage(dec *json.Decoder, v interface{}) error {
+	msg := v3StreamMessage{}
+	if err := dec.Decode(&msg); err != nil {
+		return err
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	return json.Unmarshal(msg.Result, v)
+}
+
+func gatewayError(resp *http.Response) error {
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	gerr := &v3GatewayError{}
+	if err := json.Unmarshal(b, gerr); err != nil || gerr.Message == "" {
+		return fmt.Errorf("etcdv3: %v: %v", resp.Status, string(b))
+	}
+	return gerr
+}
+
+func (c *httpEtcdV3Client) get(ctx context.Context, key string, prefix bool) ([]v3KeyValue, int64, error) {
+	req := v3RangeRequest{Key: []byte(key)}
+	if prefix {
+		req.RangeEnd = []byte(prefixEnd(key))
+	}
+
+	resp := v3RangeResponse{}
+	if err := c.call(ctx, "/kv/range", &req, &resp); err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make([]v3KeyValue, 0, len(resp.Kvs))
+	for i := range resp.Kvs {
+		kvs = append(kvs, resp.Kvs[i].toKeyValue())
+	}
+
+	return kvs, int64(resp.Header.Revision), nil
+}
+
+func (c *httpEtcdV3Client) put(ctx context.Context, key, value string, lease int64, cmp *v3Compare) (bool, int64, error) {
+	put := &v3PutRequest{
+		Key:   []byte(key),
+		Value: []byte(value),
+		Lease: lease,
+	}
+
+	req := v3TxnRequest{
+		Compare: []v3TxnCompare{},
+		Success: []v3TxnOp{{RequestPut: put}},
+	}
+
+	if cmp != nil {
+		tc := v3TxnCompare{
+			Result: "EQUAL",
+			Target: cmp.Target,
+			Key:    []byte(key),
+		}
+
+		switch cmp.Target {
+		case "CREATE":
+			tc.CreateRevision = cmp.Revision
+		case "MOD":
+			tc.ModRevision = cmp.Revision
+		default:
+			return false, 0, fmt.Errorf("etcdv3: unsupported compare target %q", cmp.Target)
+		}
+
+		req.Compare = append(req.Compare, tc)
+	}
+
+	resp := v3TxnResponse{}
+	if err := c.call(ctx, "/kv/txn", &req, &resp); err != nil {
+		return false, 0, err
+	}
+
+	return resp.Succeeded, int64(resp.Header.Revision), nil
+}
+
+func (c *httpEtcdV3Client) delete(ctx context.Context, key string) (*v3KeyValue, int64, error) {
+	req := v3DeleteRangeRequest{
+		Key:    []byte(key),
+		PrevKv: true,
+	}
+
+	resp := v3DeleteRangeResponse{}
+	if err := c.call(ctx, "/kv/deleterange", &req, &resp); err != nil {
+		return nil, 0, err
+	}
+
+	if len(resp.PrevKvs) == 0 {
+		return nil, int64(resp.Header.Revision), nil
+	}
+
+	kv := resp.PrevKvs[0].toKeyValue()
+	return &kv, int64(resp.Header.Revision), nil
+}
+
+func (c *httpEtcdV3Client) grant(ctx context.Context, ttl time.Duration) (int64, time.Duration, error) {
+	req := v3LeaseRequest{TTL: int64(ttl / time.Second)}
+
+	resp := v3LeaseResponse{}
+	if err := c.call(ctx, "/lease/grant", &req, &resp); err != nil {
+		return 0, 0, err
+	}
+	if resp.Error != "" {
+		return 0, 0, fmt.Errorf("etcdv3: failed to grant lease: %v", resp.Error)
+	}
+
+	return int64(resp.ID), time.Duration(resp.TTL) * time.Second, nil
+}
+
+func (c *httpEtcdV3Client) keepAliveOnce(ctx context.Context, id int64) (time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dec, body, err := c.stream(ctx, "/lease/keepalive", &v3LeaseRequest{ID: id})
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	resp := v3LeaseResponse{}
+	if err := nextStreamMessage(dec, &resp); err != nil {
+		return 0, err
+	}
+
+	if resp.TTL <= 0 {
+		return 0, nil
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+func (c *httpEtcdV3Client) timeToLive(ctx context.Context, id int64) (time.Duration, error) {
+	resp := v3LeaseResponse{}
+	if err := c.call(ctx, "/lease/timetolive", &v3LeaseRequest{ID: id}, &resp); err != nil {
+		return 0, err
+	}
+
+	if resp.TTL <= 0 {
+		return 0, nil
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+func (c *httpEtcdV3Client) revoke(ctx context.Context, id int64) error {
+	resp := v3LeaseResponse{}
+	return c.call(ctx, "/lease/revoke", &v3LeaseRequest{ID: id}, &resp)
+}
+
+func (c *httpEtcdV3Client) watch(ctx context.Context, key string, prefix bool, startRev int64) ([]v3Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req := v3WatchRequest{
+		CreateRequest: v3WatchCreateRequest{
+			Key:           []byte(key),
+			StartRevision: startRev,
+		},
+	}
+	if prefix {
+		req.CreateRequest.RangeEnd = []byte(prefixEnd(key))
+	}
+
+	dec, body, err := c.stream(ctx, "/watch", &req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	for {
+		resp := v3WatchResponse{}
+		if err := nextStreamMessage(dec, &resp); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		if resp.CompactRevision > 0 {
+			return nil, errV3Compacted
+		}
+
+		if resp.Canceled {
+			return nil, fmt.Errorf("etcdv3: watch of %q canceled by server", key)
+		}
+
+		if len(resp.Events) == 0 {
+			// watch creation acknowledgement or progress notification
+			continue
+		}
+
+		evts := make([]v3Event, 0, len(resp.Events))
+		for _, e := range resp.Events {
+			evt := v3Event{Type: v3EventPut, Kv: e.Kv.toKeyValue()}
+			if e.Type == "DELETE" {
+				evt.Type = v3EventDelete
+			}
+			evts = append(evts, evt)
+		}
+		return evts, nil
+	}
+}
+
+func (c *httpEtcdV3Client) revision(ctx context.Context) (int64, error) {
+	req := v3RangeRequest{Key: []byte{0}, CountOnly: true}
+
+	resp := v3RangeResponse{}
+	if err := c.call(ctx, "/kv/range", &req, &resp); err != nil {
+		return 0, err
+	}
+
+	return int64(resp.Header.Revision), nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"sync"
+	"time"
+)
+
+// watchState is how the last attempt of a watch loop went
+type watchState struct {
+	live bool
+	// synced is set once the initial snapshot has been handled
+	synced bool
+	// peers are the other hosts' leases the watch knows about
+	peers []Lease
+	// failingSince is when the attempts started failing, zero while they
+	// succeed
+	failingSince time.Time
+}
+
+type watchKey struct {
+	network string
+	kind    string
+}
+
+var watches = struct {
+	sync.Mutex
+	m map[watchKey]*watchState
+}{m: make(map[watchKey]*watchState)}
+
+func watchStarted(network, kind string) {
+	watches.Lock()
+	watches.m[watchKey{network, kind}] = &watchState{}
+	watches.Unlock()
+}
+
+func watchSucceeded(network, kind string) {
+	watches.Lock()
+	if s, ok := watches.m[watchKey{network, kind}]; ok {
+		s.live = true
+		s.failingSince = time.Time{}
+	}
+	watches.Unlock()
+}
+
+func watchSynced(network, kind string) {
+	watches.Lock()
+	if s, ok := watches.m[watchKey{network, kind}]; ok {
+		s.synced = true
+	}
+	watches.Unlock()
+}
+
+func watchPeers(network string, peers []Lease) {
+	watches.Lock()
+	if s, ok := watches.m[watchKey{network, "leases"}]; ok {
+		s.peers = peers
+	}
+	watches.Unlock()
+}
+
+func watchFailed(network, kind string) {
+	watches.Lock()
+	if s, ok := watches.m[watchKey{network, kind}]; ok {
+		s.live = false
+		if s.failingSince.IsZero() {
+			s.failingSince = clock.Now()
+		}
+	}
+	watches.Unlock()
+}
+
+func watchStopped(network, kind string) {
+	watches.Lock()
+	delete(watches.m, watchKey{network, kind})
+	watches.Unlock()
+}
+
+// WatchStatus is the state of the watches running for a network
+type WatchStatus struct {
+	// Live is set once every watch has had a result from the registry and
+	// for as long as their last attempts succeeded
+	Live bool
+	// Synced is set once the backend has handled the initial snapshot of
+	// the other hosts' leases, or if the backend doesn't watch them
+	Synced bool
+	// FailingSince is when the watch that has been failing the longest
+	// started to, zero if none is failing
+	FailingSince time.Time
+	// Peers are the other hosts' leases the lease watch knows about
+	Peers []Lease
+}
+
+// GetWatchStatus returns the state of the watches WatchLeases and
+// WatchLease run for a network
+func GetWatchStatus(network string) WatchStatus {
+	watches.Lock()
+	defer watches.Unlock()
+
+	running := false
+	st := WatchStatus{Live: true, Synced: true}
+	for k, s := range watches.m {
+		if k.network != network {
+			continue
+		}
+
+		running = true
+		st.Live = st.Live && s.live
+		if k.kind == "leases" {
+			st.Synced = s.synced
+			st.Peers = append([]Lease(nil), s.peers...)
+		}
+		if !s.failingSince.IsZero() && (st.FailingSince.IsZero() || s.failingSince.Before(st.FailingSince)) {
+			st.FailingSince = s.failingSince
+		}
+	}
+	st.Live = st.Live && running
+	return st
+}
@@ -0,0 +1,376 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/transport"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	defaultTokenFile  = serviceAccountDir + "token"
+	defaultCAFile     = serviceAccountDir + "ca.crt"
+)
+
+// errGone is returned by a watch whose resource version is too old
+var errGone = errors.New("resource version too old")
+
+// watchRetryDelay is the delay before watching again after the server
+// closed a watch without any changes, doubled each time that repeats up to
+// maxWatchRetryDelay
+var (
+	watchRetryDelay    = 100 * time.Millisecond
+	maxWatchRetryDelay = 10 * time.Second
+)
+
+// The subset of the Kubernetes API objects used by the subnet manager
+
+type objectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type nodeSpec struct {
+	PodCIDR  string   `json:"podCIDR,omitempty"`
+	PodCIDRs []string `json:"podCIDRs,omitempty"`
+}
+
+type node struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     nodeSpec   `json:"spec"`
+}
+
+type nodeList struct {
+	Metadata listMeta `json:"metadata"`
+	Items    []node   `json:"items"`
+}
+
+type configMap struct {
+	Metadata objectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+type status struct {
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+type nodeWatchEvent struct {
+	Type   string `json:"type"`
+	Object node   `json:"object"`
+}
+
+type configMapWatchEvent struct {
+	Type   string    `json:"type"`
+	Object configMap `json:"object"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// client is a minimal Kubernetes REST client that understands just enough
+// of the API to manage nodes and read config maps.
+type client struct {
+	base  string
+	token string
+	hc    *http.Client
+}
+
+// inClusterAPIServer returns the API server address advertised to pods
+func inClusterAPIServer() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return ""
+	}
+	return "https://" + net.JoinHostPort(host, port)
+}
+
+func newClient(cfg *Config) (*client, error) {
+	apiServer := cfg.APIServer
+	tokenFile := cfg.TokenFile
+	caFile := cfg.CAFile
+
+	if apiServer == "" {
+		// Assume we're running in a pod
+		if apiServer = inClusterAPIServer(); apiServer == "" {
+			return nil, fmt.Errorf("kubernetes API server address not specified and not running in a cluster")
+		}
+		if tokenFile == "" {
+			tokenFile = defaultTokenFile
+		}
+		if caFile == "" {
+			caFile = defaultCAFile
+		}
+	}
+
+	c := &client{
+		base: strings.TrimSuffix(apiServer, "/"),
+	}
+
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %v", err)
+		}
+		c.token = strings.TrimSpace(string(token))
+	}
+
+	tls := transport.TLSInfo{
+		CAFile:   caFile,
+		CertFile: cfg.CertFile,
+		KeyFile:  cfg.KeyFile,
+	}
+
+	tlsCfg, err := tls.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c.hc = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			// timeouts taken from http.DefaultTransport
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsCfg,
+		},
+	}
+
+	return c, nil
+}
+
+func (c *client) do(ctx context.Context, method, path, contentType string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	return ctxhttp.Do(ctx, c.hc, req)
+}
+
+func (c *client) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, "GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return httpError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func httpError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	s := status{}
+	if json.Unmarshal(body, &s) == nil && s.Message != "" {
+		return fmt.Errorf("%v: %v", resp.Status, s.Message)
+	}
+	return fmt.Errorf("%v: %v", resp.Status, string(body))
+}
+
+func (c *client) getNode(ctx context.Context, name string) (*node, error) {
+	n := &node{}
+	if err := c.getJSON(ctx, "/api/v1/nodes/"+url.QueryEscape(name), n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (c *client) listNodes(ctx context.Context) (*nodeList, error) {
+	nl := &nodeList{}
+	if err := c.getJSON(ctx, "/api/v1/nodes", nl); err != nil {
+		return nil, err
+	}
+	return nl, nil
+}
+
+func (c *client) getConfigMap(ctx context.Context, namespace, name string) (*configMap, error) {
+	cm := &configMap{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", url.QueryEscape(namespace), url.QueryEscape(name))
+	if err := c.getJSON(ctx, path, cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// patchNodeAnnotations sets the given annotations on the node; a nil value
+// removes the annotation.
+func (c *client) patchNodeAnnotations(ctx context.Context, name string, annotations map[string]*string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+
+	resp, err := c.do(ctx, "PATCH", "/api/v1/nodes/"+url.QueryEscape(name), "application/merge-patch+json", patch)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return httpError(resp)
+	}
+	return nil
+}
+
+// watch blocks until the next change to the objects at path after
+// resourceVersion. If name is not empty, only that object is watched.
+func (c *client) watch(ctx context.Context, path, name, resourceVersion string) (*watchEvent, error) {
+	delay := watchRetryDelay
+	for {
+		evt, err := c.watchOnce(ctx, path, name, resourceVersion)
+		if err != io.EOF {
+			return evt, err
+		}
+
+		// the server closed the watch without any changes
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxWatchRetryDelay {
+			delay = maxWatchRetryDelay
+		}
+	}
+}
+
+// watchOnce is watch with a single request; it returns io.EOF if the server
+// closes the watch without any changes.
+func (c *client) watchOnce(ctx context.Context, path, name, resourceVersion string) (*watchEvent, error) {
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", resourceVersion)
+	if name != "" {
+		q.Set("fieldSelector", "metadata.name="+name)
+	}
+
+	resp, err := c.do(ctx, "GET", path+"?"+q.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return nil, errGone
+	default:
+		return nil, httpError(resp)
+	}
+
+	evt := &watchEvent{}
+	if err := json.NewDecoder(resp.Body).Decode(evt); err != nil {
+		return nil, err
+	}
+
+	if evt.Type == "ERROR" {
+		s := status{}
+		if err := json.Unmarshal(evt.Object, &s); err != nil {
+			return nil, err
+		}
+		if s.Code == http.StatusGone {
+			return nil, errGone
+		}
+		return nil, fmt.Errorf("watch error: %v", s.Message)
+	}
+
+	return evt, nil
+}
+
+// watchNodes blocks until the next change to the nodes after
+// resourceVersion. If name is not empty, only that node is watched.
+func (c *client) watchNodes(ctx context.Context, name, resourceVersion string) (*nodeWatchEvent, error) {
+	evt, err := c.watch(ctx, "/api/v1/nodes", name, resourceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &nodeWatchEvent{Type: evt.Type}
+	if err := json.Unmarshal(evt.Object, &n.Object); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// watchConfigMap blocks until the next change to the config map after
+// resourceVersion.
+func (c *client) watchConfigMap(ctx context.Context, namespace, name, resourceVersion string) (*configMapWatchEvent, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", url.QueryEscape(namespace))
+	evt, err := c.watch(ctx, path, name, resourceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &configMapWatchEvent{Type: evt.Type}
+	if err := json.Unmarshal(evt.Object, &cm.Object); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
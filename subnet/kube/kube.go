@@ -0,0 +1,555 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+var ErrUnimplemented = errors.New("unimplemented by the kubernetes subnet manager")
+
+const (
+	annotationPrefix      = "flannel.alpha.coreos.com/"
+	publicIPAnnotation    = annotationPrefix + "public-ip"
+	publicIPv6Annotation  = annotationPrefix + "public-ipv6"
+	backendTypeAnnotation = annotationPrefix + "backend-type"
+	backendDataAnnotation = annotationPrefix + "backend-data"
+
+	defaultConfigMapKey = "net-conf.json"
+
+	// Node podCIDRs are owned by the node object and never expire. Leases
+	// are still handed out with an expiration so that the renewal loop
+	// keeps its usual cadence.
+	leaseTTL = 24 * time.Hour
+)
+
+type Config struct {
+	// API server URL, e.g. https://10.0.0.1:443
+	APIServer string
+	// Bearer token file used to authenticate to the API server
+	TokenFile string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+
+	// Name of the Node object that represents this host
+	NodeName string
+
+	// ConfigMap holding the network config under ConfigMapKey
+	ConfigMapNamespace string
+	ConfigMapName      string
+	ConfigMapKey       string
+}
+
+// kubeSubnetManager implements subnet.Manager by treating each Node's
+// spec.podCIDR as its lease. The lease attributes are stored in flannel
+// annotations on the Node object.
+type kubeSubnetManager struct {
+	cli      *client
+	cfg      *Config
+	mux      sync.Mutex
+	observed map[string]subnet.Lease
+	own      *subnet.Lease
+}
+
+func NewSubnetManager(cfg *Config) (subnet.Manager, error) {
+	if cfg.NodeName == "" {
+		return nil, fmt.Errorf("kubernetes node name must be specified")
+	}
+
+	if cfg.ConfigMapKey == "" {
+		cfg.ConfigMapKey = defaultConfigMapKey
+	}
+
+	cli, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKubeSubnetManager(cli, cfg), nil
+}
+
+func newKubeSubnetManager(cli *client, cfg *Config) *kubeSubnetManager {
+	return &kubeSubnetManager{
+		cli:      cli,
+		cfg:      cfg,
+		observed: make(map[string]subnet.Lease),
+	}
+}
+
+func checkNetwork(network string) error {
+	if network != "" {
+		return fmt.Errorf("kubernetes subnet manager only supports the default network, got %q", network)
+	}
+	return nil
+}
+
+func (ksm *kubeSubnetManager) GetNetworkConfig(ctx context.Context, network string) (*subnet.Config, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
+	cm, err := ksm.cli.getConfigMap(ctx, ksm.cfg.ConfigMapNamespace, ksm.cfg.ConfigMapName)
+	if err != nil {
+		return nil, err
+	}
+
+	return ksm.parseConfigMap(cm)
+}
+
+func (ksm *kubeSubnetManager) parseConfigMap(cm *configMap) (*subnet.Config, error) {
+	data, ok := cm.Data[ksm.cfg.ConfigMapKey]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s/%s has no %q key", ksm.cfg.ConfigMapNamespace, ksm.cfg.ConfigMapName, ksm.cfg.ConfigMapKey)
+	}
+
+	return subnet.ParseConfig(data)
+}
+
+// WatchNetworkConfig watches the config map holding the network config
+func (ksm *kubeSubnetManager) WatchNetworkConfig(ctx context.Context, network string, cursor interface{}) (subnet.ConfigWatchResult, error) {
+	if err := checkNetwork(network); err != nil {
+		return subnet.ConfigWatchResult{}, err
+	}
+
+	if cursor == nil {
+		return ksm.configWatchReset(ctx)
+	}
+
+	rv, ok := cursor.(string)
+	if !ok {
+		return subnet.ConfigWatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+
+	for {
+		evt, err := ksm.cli.watchConfigMap(ctx, ksm.cfg.ConfigMapNamespace, ksm.cfg.ConfigMapName, rv)
+		switch {
+		case err == errGone:
+			log.Warning("Watch of network config failed because resource version is too old")
+			return ksm.configWatchReset(ctx)
+		case err != nil:
+			return subnet.ConfigWatchResult{}, err
+		}
+		rv = evt.Object.Metadata.ResourceVersion
+
+		if evt.Type == "DELETED" {
+			log.Warningf("Configmap %s/%s has been deleted, keeping the last network config", ksm.cfg.ConfigMapNamespace, ksm.cfg.ConfigMapName)
+			continue
+		}
+
+		config, err := ksm.parseConfigMap(&evt.Object)
+		if err != nil {
+			log.Errorf("Ignoring invalid network config: %v", err)
+			continue
+		}
+
+		return subnet.ConfigWatchResult{
+			Config: config,
+			Cursor: rv,
+		}, nil
+	}
+}
+
+func (ksm *kubeSubnetManager) configWatchReset(ctx context.Context) (subnet.ConfigWatchResult, error) {
+	cm, err := ksm.cli.getConfigMap(ctx, ksm.cfg.ConfigMapNamespace, ksm.cfg.ConfigMapName)
+	if err != nil {
+		return subnet.ConfigWatchResult{}, err
+	}
+
+	config, err := ksm.parseConfigMap(cm)
+	if err != nil {
+		return subnet.ConfigWatchResult{}, err
+	}
+
+	return subnet.ConfigWatchResult{
+		Config: config,
+		Cursor: cm.Metadata.ResourceVersion,
+	}, nil
+}
+
+func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, network string, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
+	n, err := ksm.cli.getNode(ctx, ksm.cfg.NodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Spec.PodCIDR == "" {
+		return nil, fmt.Errorf("node %q has no podCIDR assigned", ksm.cfg.NodeName)
+	}
+
+	sn, err := parsePodCIDR(n.Spec.PodCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	// the node object is the identity of the host and its podCIDR the
+	// subnet, so only the attributes published in annotations are compared
+	published := *attrs
+	published.SubnetLen, published.NodeID = 0, ""
+	if !reflect.DeepEqual(nodeLeaseAttrs(n), &published) {
+		annotations := map[string]*string{
+			publicIPAnnotation:    stringPtr(attrs.PublicIP.String()),
+			publicIPv6Annotation:  nil,
+			backendTypeAnnotation: stringPtr(attrs.BackendType),
+			backendDataAnnotation: nil,
+		}
+		if attrs.PublicIPv6 != nil {
+			annotations[publicIPv6Annotation] = stringPtr(attrs.PublicIPv6.String())
+		}
+		if len(attrs.BackendData) > 0 {
+			annotations[backendDataAnnotation] = stringPtr(string(attrs.BackendData))
+		}
+
+		if err := ksm.cli.patchNodeAnnotations(ctx, ksm.cfg.NodeName, annotations); err != nil {
+			return nil, fmt.Errorf("failed to set lease annotations on node %q: %v", ksm.cfg.NodeName, err)
+		}
+	}
+
+	return &subnet.Lease{
+		Subnet:     sn,
+		IPv6Subnet: nodeIPv6PodCIDR(n),
+		Attrs:      *attrs,
+		Expiration: time.Now().Add(leaseTTL),
+	}, nil
+}
+
+func (ksm *kubeSubnetManager) RenewLease(ctx context.Context, network string, lease *subnet.Lease) error {
+	if err := checkNetwork(network); err != nil {
+		return err
+	}
+
+	n, err := ksm.cli.getNode(ctx, ksm.cfg.NodeName)
+	if err != nil {
+		return err
+	}
+
+	if sn, err := parsePodCIDR(n.Spec.PodCIDR); err != nil || !sn.Equal(lease.Subnet) {
+		return fmt.Errorf("node %q no longer owns %v", ksm.cfg.NodeName, lease.Subnet)
+	}
+
+	lease.Expiration = time.Now().Add(leaseTTL)
+	return nil
+}
+
+// RevokeLease drops the lease annotations. The podCIDR itself is owned by
+// the Kubernetes controller manager and is released when the node is deleted.
+func (ksm *kubeSubnetManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
+	if err := checkNetwork(network); err != nil {
+		return err
+	}
+
+	return ksm.cli.patchNodeAnnotations(ctx, ksm.cfg.NodeName, map[string]*string{
+		publicIPAnnotation:    nil,
+		publicIPv6Annotation:  nil,
+		backendTypeAnnotation: nil,
+		backendDataAnnotation: nil,
+	})
+}
+
+func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if err := checkNetwork(network); err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+
+	if cursor == nil {
+		n, err := ksm.cli.getNode(ctx, ksm.cfg.NodeName)
+		if err != nil {
+			return subnet.LeaseWatchResult{}, err
+		}
+
+		l, ok := nodeToLease(n)
+		if !ok || !l.Subnet.Equal(sn) {
+			return subnet.LeaseWatchResult{}, fmt.Errorf("node %q does not hold lease %v", ksm.cfg.NodeName, sn)
+		}
+		ksm.ownUnchanged(l)
+
+		return subnet.LeaseWatchResult{
+			Snapshot: []subnet.Lease{l},
+			Cursor:   n.Metadata.ResourceVersion,
+		}, nil
+	}
+
+	rv, ok := cursor.(string)
+	if !ok {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+
+	for {
+		evt, err := ksm.cli.watchNodes(ctx, ksm.cfg.NodeName, rv)
+		switch {
+		case err == errGone:
+			log.Warning("Watch of own node failed because resource version is too old")
+			return ksm.WatchLease(ctx, network, sn, nil)
+		case err != nil:
+			return subnet.LeaseWatchResult{}, err
+		}
+		rv = evt.Object.Metadata.ResourceVersion
+
+		l, ok := nodeToLease(&evt.Object)
+		if evt.Type == "DELETED" || !ok || !l.Subnet.Equal(sn) {
+			return subnet.LeaseWatchResult{
+				Events: []subnet.Event{{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: sn}}},
+				Cursor: rv,
+			}, nil
+		}
+
+		if evt.Type == "MODIFIED" && ksm.ownUnchanged(l) {
+			continue
+		}
+
+		return subnet.LeaseWatchResult{
+			Events: []subnet.Event{{Type: subnet.EventAdded, Lease: l}},
+			Cursor: rv,
+		}, nil
+	}
+}
+
+func (ksm *kubeSubnetManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if err := checkNetwork(network); err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+
+	if cursor == nil {
+		return ksm.leasesWatchReset(ctx)
+	}
+
+	rv, ok := cursor.(string)
+	if !ok {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+
+	for {
+		evt, err := ksm.cli.watchNodes(ctx, "", rv)
+		switch {
+		case err == errGone:
+			log.Warning("Watch of nodes failed because resource version is too old")
+			return ksm.leasesWatchReset(ctx)
+		case err != nil:
+			return subnet.LeaseWatchResult{}, err
+		}
+		rv = evt.Object.Metadata.ResourceVersion
+
+		if evts := ksm.nodeEvents(evt); len(evts) > 0 {
+			return subnet.LeaseWatchResult{
+				Events: evts,
+				Cursor: rv,
+			}, nil
+		}
+	}
+}
+
+// nodeEvents converts a node watch event into lease events. Nodes get
+// modified all the time (e.g. status heartbeats) so only changes to the
+// lease itself are reported.
+func (ksm *kubeSubnetManager) nodeEvents(evt *nodeWatchEvent) []subnet.Event {
+	name := evt.Object.Metadata.Name
+
+	ksm.mux.Lock()
+	defer ksm.mux.Unlock()
+
+	prev, known := ksm.observed[name]
+	l, ok := nodeToLease(&evt.Object)
+
+	if evt.Type == "DELETED" || !ok {
+		if !known {
+			return nil
+		}
+		delete(ksm.observed, name)
+		return []subnet.Event{{Type: subnet.EventRemoved, Lease: prev}}
+	}
+
+	if known && leaseEqual(prev, l) {
+		return nil
+	}
+	ksm.observed[name] = l
+
+	if known && !prev.Subnet.Equal(l.Subnet) {
+		// podCIDR changed: the old subnet is gone and the new one replaces it
+		return []subnet.Event{
+			{Type: subnet.EventRemoved, Lease: prev},
+			{Type: subnet.EventAdded, Lease: l},
+		}
+	}
+
+	return []subnet.Event{{Type: subnet.EventAdded, Lease: l}}
+}
+
+// ownUnchanged records l as the last seen lease of this node and reports
+// whether it is the same as the previously seen one.
+func (ksm *kubeSubnetManager) ownUnchanged(l subnet.Lease) bool {
+	ksm.mux.Lock()
+	defer ksm.mux.Unlock()
+
+	prev := ksm.own
+	ksm.own = &l
+	return prev != nil && leaseEqual(*prev, l)
+}
+
+func (ksm *kubeSubnetManager) leasesWatchReset(ctx context.Context) (subnet.LeaseWatchResult, error) {
+	nl, err := ksm.cli.listNodes(ctx)
+	if err != nil {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	ksm.mux.Lock()
+	defer ksm.mux.Unlock()
+
+	leases := []subnet.Lease{}
+	ksm.observed = make(map[string]subnet.Lease)
+	for i := range nl.Items {
+		if l, ok := nodeToLease(&nl.Items[i]); ok {
+			leases = append(leases, l)
+			ksm.observed[nl.Items[i].Metadata.Name] = l
+		}
+	}
+
+	return subnet.LeaseWatchResult{
+		Snapshot: leases,
+		Cursor:   nl.Metadata.ResourceVersion,
+	}, nil
+}
+
+// WatchNetworks reports the single default network; multi-network mode is
+// not supported with Kubernetes.
+func (ksm *kubeSubnetManager) WatchNetworks(ctx context.Context, cursor interface{}) (subnet.NetworkWatchResult, error) {
+	if cursor == nil {
+		return subnet.NetworkWatchResult{
+			Snapshot: []string{""},
+			Cursor:   "0",
+		}, nil
+	}
+
+	<-ctx.Done()
+	return subnet.NetworkWatchResult{}, ctx.Err()
+}
+
+func (ksm *kubeSubnetManager) AddReservation(ctx context.Context, network string, r *subnet.Reservation) error {
+	return ErrUnimplemented
+}
+
+func (ksm *kubeSubnetManager) RemoveReservation(ctx context.Context, network string, subnet ip.IP4Net) error {
+	return ErrUnimplemented
+}
+
+func (ksm *kubeSubnetManager) ListReservations(ctx context.Context, network string) ([]subnet.Reservation, error) {
+	return nil, ErrUnimplemented
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func parsePodCIDR(s string) (ip.IP4Net, error) {
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		return ip.IP4Net{}, fmt.Errorf("error parsing podCIDR %q: %v", s, err)
+	}
+	if cidr.IP.To4() == nil {
+		return ip.IP4Net{}, fmt.Errorf("podCIDR %q is not an IPv4 network", s)
+	}
+	return ip.FromIPNet(cidr), nil
+}
+
+// nodeLeaseAttrs returns the lease attributes stored in the node's
+// annotations or nil if the node has not published any.
+func nodeLeaseAttrs(n *node) *subnet.LeaseAttrs {
+	pubIP, ok := n.Metadata.Annotations[publicIPAnnotation]
+	if !ok {
+		return nil
+	}
+
+	attrs := &subnet.LeaseAttrs{
+		BackendType: n.Metadata.Annotations[backendTypeAnnotation],
+	}
+
+	var err error
+	if attrs.PublicIP, err = ip.ParseIP4(pubIP); err != nil {
+		log.Warningf("Ignoring node %q with bad %s annotation: %v", n.Metadata.Name, publicIPAnnotation, err)
+		return nil
+	}
+
+	if s, ok := n.Metadata.Annotations[publicIPv6Annotation]; ok {
+		pubIPv6, err := ip.ParseIP6(s)
+		if err != nil {
+			log.Warningf("Ignoring node %q with bad %s annotation: %v", n.Metadata.Name, publicIPv6Annotation, err)
+			return nil
+		}
+		attrs.PublicIPv6 = &pubIPv6
+	}
+
+	if data := n.Metadata.Annotations[backendDataAnnotation]; data != "" {
+		attrs.BackendData = json.RawMessage(data)
+	}
+
+	return attrs
+}
+
+// nodeToLease returns the lease held by the node, if the node has both a
+// podCIDR and flannel annotations.
+func nodeToLease(n *node) (subnet.Lease, bool) {
+	if n.Spec.PodCIDR == "" {
+		return subnet.Lease{}, false
+	}
+
+	attrs := nodeLeaseAttrs(n)
+	if attrs == nil {
+		return subnet.Lease{}, false
+	}
+
+	sn, err := parsePodCIDR(n.Spec.PodCIDR)
+	if err != nil {
+		log.Warningf("Ignoring node %q: %v", n.Metadata.Name, err)
+		return subnet.Lease{}, false
+	}
+
+	return subnet.Lease{
+		Subnet:     sn,
+		IPv6Subnet: nodeIPv6PodCIDR(n),
+		Attrs:      *attrs,
+		Expiration: time.Now().Add(leaseTTL),
+	}, true
+}
+
+// nodeIPv6PodCIDR returns the IPv6 entry of a dual-stack node's podCIDRs,
+// if there is one.
+func nodeIPv6PodCIDR(n *node) ip.IP6Net {
+	for _, s := range n.Spec.PodCIDRs {
+		_, cidr, err := net.ParseCIDR(s)
+		if err == nil && cidr.IP.To4() == nil {
+			return ip.FromIP6Net(cidr)
+		}
+	}
+	return ip.IP6Net{}
+}
+
+func leaseEqual(a, b subnet.Lease) bool {
+	return a.Subnet.Equal(b.Subnet) && a.IPv6Subnet.Equal(b.IPv6Subnet) && reflect.DeepEqual(a.Attrs, b.Attrs)
+}
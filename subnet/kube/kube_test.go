@@ -0,0 +1,577 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// fakeAPIServer implements the handful of Kubernetes API endpoints used by
+// the subnet manager, including watches with resource versions.
+type fakeAPIServer struct {
+	mux        sync.Mutex
+	rv         int
+	compacted  int
+	nodes      map[string]*node
+	configMaps map[string]*configMap
+	history    []nodeWatchEvent
+	changed    chan struct{}
+	token      string
+	// closeWatches is the number of watches to close right away, as the
+	// API server does when they time out
+	closeWatches int
+	watches      int
+}
+
+func newFakeAPIServer() *fakeAPIServer {
+	return &fakeAPIServer{
+		rv:         100,
+		nodes:      make(map[string]*node),
+		configMaps: make(map[string]*configMap),
+		changed:    make(chan struct{}),
+	}
+}
+
+// must be called with mux held
+func (f *fakeAPIServer) record(typ string, n *node) {
+	f.rv++
+	n.Metadata.ResourceVersion = strconv.Itoa(f.rv)
+	f.history = append(f.history, nodeWatchEvent{Type: typ, Object: *n})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeAPIServer) setNode(name, podCIDR string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	typ := "MODIFIED"
+	n, ok := f.nodes[name]
+	if !ok {
+		typ = "ADDED"
+		n = &node{Metadata: objectMeta{Name: name}}
+		f.nodes[name] = n
+	}
+	n.Spec.PodCIDR = podCIDR
+	f.record(typ, n)
+}
+
+// touchNode simulates a status heartbeat
+func (f *fakeAPIServer) touchNode(name string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.record("MODIFIED", f.nodes[name])
+}
+
+func (f *fakeAPIServer) deleteNode(name string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	n := f.nodes[name]
+	delete(f.nodes, name)
+	f.record("DELETED", n)
+}
+
+func (f *fakeAPIServer) compact() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.compacted = f.rv
+	f.history = nil
+}
+
+func (f *fakeAPIServer) writeStatus(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status{Kind: "Status", Status: "Failure", Message: msg, Code: code})
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		f.writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[2] == "nodes" && r.URL.Query().Get("watch") == "true":
+		f.watch(w, r)
+
+	case len(parts) == 3 && parts[2] == "nodes":
+		f.mux.Lock()
+		nl := nodeList{Metadata: listMeta{ResourceVersion: strconv.Itoa(f.rv)}}
+		names := []string{}
+		for name := range f.nodes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			nl.Items = append(nl.Items, *f.nodes[name])
+		}
+		f.mux.Unlock()
+		json.NewEncoder(w).Encode(nl)
+
+	case len(parts) == 4 && parts[2] == "nodes":
+		f.mux.Lock()
+		defer f.mux.Unlock()
+
+		n, ok := f.nodes[parts[3]]
+		if !ok {
+			f.writeStatus(w, http.StatusNotFound, "node not found")
+			return
+		}
+
+		if r.Method == "PATCH" {
+			if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+				f.writeStatus(w, http.StatusUnsupportedMediaType, "bad content type")
+				return
+			}
+			patch := struct {
+				Metadata struct {
+					Annotations map[string]*string `json:"annotations"`
+				} `json:"metadata"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				f.writeStatus(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if n.Metadata.Annotations == nil {
+				n.Metadata.Annotations = make(map[string]string)
+			}
+			for k, v := range patch.Metadata.Annotations {
+				if v == nil {
+					delete(n.Metadata.Annotations, k)
+				} else {
+					n.Metadata.Annotations[k] = *v
+				}
+			}
+			f.record("MODIFIED", n)
+		}
+		json.NewEncoder(w).Encode(n)
+
+	case len(parts) == 6 && parts[2] == "namespaces" && parts[4] == "configmaps":
+		f.mux.Lock()
+		cm, ok := f.configMaps[parts[3]+"/"+parts[5]]
+		f.mux.Unlock()
+		if !ok {
+			f.writeStatus(w, http.StatusNotFound, "configmap not found")
+			return
+		}
+		json.NewEncoder(w).Encode(cm)
+
+	default:
+		f.writeStatus(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeAPIServer) watch(w http.ResponseWriter, r *http.Request) {
+	rv, err := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	if err != nil {
+		f.writeStatus(w, http.StatusBadRequest, "bad resourceVersion")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Query().Get("fieldSelector"), "metadata.name=")
+
+	f.mux.Lock()
+	f.watches++
+	if f.closeWatches > 0 {
+		f.closeWatches--
+		f.mux.Unlock()
+		return
+	}
+	f.mux.Unlock()
+
+	enc := json.NewEncoder(w)
+	for {
+		f.mux.Lock()
+		if rv < f.compacted {
+			f.mux.Unlock()
+			s, _ := json.Marshal(status{Kind: "Status", Status: "Failure", Reason: "Gone", Code: http.StatusGone})
+			enc.Encode(watchEvent{Type: "ERROR", Object: s})
+			return
+		}
+
+		evts := []nodeWatchEvent{}
+		for _, e := range f.history {
+			erv, _ := strconv.Atoi(e.Object.Metadata.ResourceVersion)
+			if erv > rv && (name == "" || e.Object.Metadata.Name == name) {
+				evts = append(evts, e)
+			}
+		}
+		changed := f.changed
+		f.mux.Unlock()
+
+		for _, e := range evts {
+			obj, _ := json.Marshal(e.Object)
+			enc.Encode(watchEvent{Type: e.Type, Object: obj})
+			rv, _ = strconv.Atoi(e.Object.Metadata.ResourceVersion)
+		}
+		if len(evts) > 0 {
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+const netConf = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" } }`
+
+func newTestManager(t *testing.T, nodeName string) (*fakeAPIServer, *httptest.Server, *kubeSubnetManager) {
+	f := newFakeAPIServer()
+	f.configMaps["kube-system/kube-flannel-cfg"] = &configMap{Data: map[string]string{"net-conf.json": netConf}}
+
+	s := httptest.NewServer(f)
+
+	sm, err := NewSubnetManager(&Config{
+		APIServer:          s.URL,
+		NodeName:           nodeName,
+		ConfigMapNamespace: "kube-system",
+		ConfigMapName:      "kube-flannel-cfg",
+	})
+	if err != nil {
+		t.Fatalf("NewSubnetManager failed: %v", err)
+	}
+
+	return f, s, sm.(*kubeSubnetManager)
+}
+
+func newAttrs(t *testing.T, pubIP string) *subnet.LeaseAttrs {
+	attrs := &subnet.LeaseAttrs{BackendType: "vxlan"}
+	var err error
+	if attrs.PublicIP, err = ip.ParseIP4(pubIP); err != nil {
+		t.Fatalf("bad IP %q: %v", pubIP, err)
+	}
+	attrs.BackendData = json.RawMessage(`{"VtepMAC":"12:34:56:78:9a:bc"}`)
+	return attrs
+}
+
+func TestGetNetworkConfig(t *testing.T) {
+	_, s, sm := newTestManager(t, "node1")
+	defer s.Close()
+
+	cfg, err := sm.GetNetworkConfig(context.Background(), "")
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+
+	if cfg.Network.String() != "10.3.0.0/16" {
+		t.Errorf("unexpected network: %v", cfg.Network)
+	}
+	if cfg.BackendType != "vxlan" {
+		t.Errorf("unexpected backend type: %v", cfg.BackendType)
+	}
+
+	if _, err := sm.GetNetworkConfig(context.Background(), "blue"); err == nil {
+		t.Errorf("GetNetworkConfig should fail for non-default networks")
+	}
+
+	sm.cfg.ConfigMapName = "missing"
+	if _, err := sm.GetNetworkConfig(context.Background(), ""); err == nil {
+		t.Errorf("GetNetworkConfig should fail for a missing configmap")
+	}
+}
+
+func TestAcquireLease(t *testing.T) {
+	f, s, sm := newTestManager(t, "node1")
+	defer s.Close()
+
+	ctx := context.Background()
+	attrs := newAttrs(t, "1.1.1.1")
+
+	f.setNode("node1", "")
+	if _, err := sm.AcquireLease(ctx, "", attrs); err == nil {
+		t.Fatalf("AcquireLease should fail without a podCIDR")
+	}
+
+	f.setNode("node1", "10.3.5.0/24")
+	l, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	if l.Subnet.String() != "10.3.5.0/24" {
+		t.Errorf("unexpected subnet: %v", l.Subnet)
+	}
+	if !l.Expiration.After(time.Now()) {
+		t.Errorf("lease already expired: %v", l.Expiration)
+	}
+
+	n := f.nodes["node1"]
+	if n.Metadata.Annotations[publicIPAnnotation] != "1.1.1.1" {
+		t.Errorf("unexpected public-ip annotation: %v", n.Metadata.Annotations)
+	}
+	if n.Metadata.Annotations[backendTypeAnnotation] != "vxlan" {
+		t.Errorf("unexpected backend-type annotation: %v", n.Metadata.Annotations)
+	}
+	if n.Metadata.Annotations[backendDataAnnotation] != string(attrs.BackendData) {
+		t.Errorf("unexpected backend-data annotation: %v", n.Metadata.Annotations)
+	}
+
+	// Re-acquiring with the same attrs must not patch the node again
+	rv := f.rv
+	if _, err := sm.AcquireLease(ctx, "", attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if f.rv != rv {
+		t.Errorf("node was patched even though annotations did not change")
+	}
+
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Errorf("RenewLease failed: %v", err)
+	}
+
+	f.setNode("node1", "10.3.6.0/24")
+	if err := sm.RenewLease(ctx, "", l); err == nil {
+		t.Errorf("RenewLease should fail after podCIDR changed")
+	}
+
+	if err := sm.RevokeLease(ctx, "", l.Subnet); err != nil {
+		t.Fatalf("RevokeLease failed: %v", err)
+	}
+	if len(f.nodes["node1"].Metadata.Annotations) != 0 {
+		t.Errorf("annotations not removed: %v", f.nodes["node1"].Metadata.Annotations)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	f, s, _ := newTestManager(t, "node1")
+	defer s.Close()
+
+	f.token = "sekret"
+	f.setNode("node1", "10.3.5.0/24")
+
+	if _, err := NewSubnetManager(&Config{APIServer: s.URL, NodeName: "node1", TokenFile: "/nonexistent"}); err == nil {
+		t.Errorf("NewSubnetManager should fail with a missing token file")
+	}
+
+	cli := &client{base: s.URL, hc: http.DefaultClient}
+	if _, err := cli.getNode(context.Background(), "node1"); err == nil {
+		t.Errorf("getNode should fail without a token")
+	}
+
+	cli.token = "sekret"
+	if _, err := cli.getNode(context.Background(), "node1"); err != nil {
+		t.Errorf("getNode failed: %v", err)
+	}
+}
+
+func watchLeases(t *testing.T, sm *kubeSubnetManager, cursor interface{}) subnet.LeaseWatchResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wr, err := sm.WatchLeases(ctx, "", cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	return wr
+}
+
+func expectEvent(t *testing.T, wr subnet.LeaseWatchResult, typ subnet.EventType, sn string) {
+	if len(wr.Events) != 1 {
+		t.Fatalf("expected 1 event, got %#v", wr)
+	}
+	if wr.Events[0].Type != typ || wr.Events[0].Lease.Subnet.String() != sn {
+		t.Fatalf("expected event %v for %v, got %#v", typ, sn, wr.Events[0])
+	}
+}
+
+func TestWatchLeases(t *testing.T) {
+	f, s, sm := newTestManager(t, "node1")
+	defer s.Close()
+
+	ctx := context.Background()
+
+	f.setNode("node1", "10.3.1.0/24")
+	f.setNode("node2", "10.3.2.0/24")
+	f.setNode("node3", "")
+
+	if _, err := sm.AcquireLease(ctx, "", newAttrs(t, "1.1.1.1")); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	// node2 has a podCIDR but has not joined yet, node3 has neither
+	wr := watchLeases(t, sm, nil)
+	if len(wr.Snapshot) != 1 || wr.Snapshot[0].Subnet.String() != "10.3.1.0/24" {
+		t.Fatalf("unexpected snapshot: %#v", wr.Snapshot)
+	}
+
+	// node2 joins
+	node2, err := newKubeSubnetManager(sm.cli, &Config{NodeName: "node2"}).AcquireLease(ctx, "", newAttrs(t, "2.2.2.2"))
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	wr = watchLeases(t, sm, wr.Cursor)
+	expectEvent(t, wr, subnet.EventAdded, "10.3.2.0/24")
+	if wr.Events[0].Lease.Attrs.PublicIP != node2.Attrs.PublicIP {
+		t.Errorf("unexpected lease attrs: %#v", wr.Events[0].Lease.Attrs)
+	}
+
+	// a new podCIDR replaces the lease in one result
+	f.setNode("node2", "10.3.12.0/24")
+	wr = watchLeases(t, sm, wr.Cursor)
+	if len(wr.Events) != 2 {
+		t.Fatalf("expected 2 events, got %#v", wr)
+	}
+	if e := wr.Events[0]; e.Type != subnet.EventRemoved || e.Lease.Subnet.String() != "10.3.2.0/24" {
+		t.Fatalf("expected removal of 10.3.2.0/24, got %#v", e)
+	}
+	if e := wr.Events[1]; e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.3.12.0/24" || e.Lease.Attrs.PublicIP != node2.Attrs.PublicIP {
+		t.Fatalf("expected addition of 10.3.12.0/24, got %#v", e)
+	}
+
+	// heartbeats are not lease changes
+	f.touchNode("node1")
+	f.touchNode("node2")
+	f.deleteNode("node1")
+
+	wr = watchLeases(t, sm, wr.Cursor)
+	expectEvent(t, wr, subnet.EventRemoved, "10.3.1.0/24")
+
+	// nodes that never joined are not reported
+	f.deleteNode("node3")
+	f.setNode("node4", "10.3.4.0/24")
+	f.deleteNode("node2")
+
+	wr = watchLeases(t, sm, wr.Cursor)
+	expectEvent(t, wr, subnet.EventRemoved, "10.3.12.0/24")
+
+	// an expired resource version results in a fresh snapshot
+	f.compact()
+	f.setNode("node5", "10.3.5.0/24")
+	wr = watchLeases(t, sm, "0")
+	if len(wr.Events) != 0 || len(wr.Snapshot) != 0 {
+		t.Fatalf("expected empty snapshot, got %#v", wr)
+	}
+}
+
+func TestWatchClosedByServer(t *testing.T) {
+	f, s, sm := newTestManager(t, "node1")
+	defer s.Close()
+
+	defer func(d time.Duration) { watchRetryDelay = d }(watchRetryDelay)
+	watchRetryDelay = 10 * time.Millisecond
+
+	// the watch is made again until it gets the change
+	f.setNode("node1", "10.3.1.0/24")
+	f.mux.Lock()
+	f.closeWatches = 3
+	f.mux.Unlock()
+	evt, err := sm.cli.watchNodes(context.Background(), "", "100")
+	if err != nil || evt.Object.Metadata.Name != "node1" {
+		t.Fatalf("watchNodes returned %#v, %v", evt, err)
+	}
+	f.mux.Lock()
+	if f.watches != 4 {
+		t.Errorf("watched %d times, want 4", f.watches)
+	}
+
+	// with a growing delay, until ctx is done
+	f.closeWatches, f.watches = 1000, 0
+	f.mux.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := sm.cli.watchNodes(ctx, "", "101"); err != context.DeadlineExceeded {
+		t.Fatalf("watchNodes returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.watches > 6 {
+		t.Errorf("watched %d times in 200ms", f.watches)
+	}
+}
+
+func TestWatchLease(t *testing.T) {
+	f, s, sm := newTestManager(t, "node1")
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f.setNode("node1", "10.3.1.0/24")
+	l, err := sm.AcquireLease(ctx, "", newAttrs(t, "1.1.1.1"))
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	wr, err := sm.WatchLease(ctx, "", l.Subnet, nil)
+	if err != nil {
+		t.Fatalf("WatchLease failed: %v", err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Fatalf("unexpected snapshot: %#v", wr)
+	}
+
+	f.setNode("node2", "10.3.2.0/24")
+	f.touchNode("node1")
+	f.setNode("node1", "10.3.9.0/24")
+
+	wr, err = sm.WatchLease(ctx, "", l.Subnet, wr.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLease failed: %v", err)
+	}
+	expectEvent(t, wr, subnet.EventRemoved, "10.3.1.0/24")
+}
+
+func TestDualStackNode(t *testing.T) {
+	pubIPv6 := ip.MustParseIP6("fd00::1")
+	n := &node{
+		Metadata: objectMeta{
+			Name: "node1",
+			Annotations: map[string]string{
+				publicIPAnnotation:    "1.1.1.1",
+				publicIPv6Annotation:  pubIPv6.String(),
+				backendTypeAnnotation: "host-gw",
+			},
+		},
+		Spec: nodeSpec{
+			PodCIDR:  "10.3.1.0/24",
+			PodCIDRs: []string{"10.3.1.0/24", "fc00:0:0:1::/64"},
+		},
+	}
+
+	l, ok := nodeToLease(n)
+	if !ok {
+		t.Fatalf("nodeToLease failed")
+	}
+	if l.IPv6Subnet.String() != "fc00:0:0:1::/64" {
+		t.Errorf("unexpected IPv6 subnet: %v", l.IPv6Subnet)
+	}
+	if l.Attrs.PublicIPv6 == nil || *l.Attrs.PublicIPv6 != pubIPv6 {
+		t.Errorf("unexpected IPv6 public IP: %v", l.Attrs.PublicIPv6)
+	}
+
+	n.Spec.PodCIDRs = n.Spec.PodCIDRs[:1]
+	if l, _ := nodeToLease(n); !l.IPv6Subnet.Empty() {
+		t.Errorf("unexpected IPv6 subnet on single stack node: %v", l.IPv6Subnet)
+	}
+}
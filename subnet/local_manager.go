@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
@@ -28,15 +29,22 @@ import (
 
 const (
 	raceRetries = 10
+
+	// defaults for the network config's LeaseTTL and RenewMargin
 	subnetTTL   = 24 * time.Hour
+	renewMargin = time.Hour
 )
 
 type LocalManager struct {
 	registry Registry
 }
 
+// watchCursor is where a watch continues: after the events at index or,
+// with seen set, after the first seen of them, as an etcd v3 revision can
+// have several events
 type watchCursor struct {
 	index uint64
+	seen  int
 }
 
 func isErrEtcdTestFailed(e error) bool {
@@ -64,7 +72,10 @@ func isErrEtcdKeyNotFound(e error) bool {
 }
 
 func (c watchCursor) String() string {
-	return strconv.FormatUint(c.index, 10)
+	if c.seen == 0 {
+		return strconv.FormatUint(c.index, 10)
+	}
+	return fmt.Sprintf("%d.%d", c.index, c.seen)
 }
 
 func NewLocalManager(config *EtcdConfig) (Manager, error) {
@@ -75,6 +86,26 @@ func NewLocalManager(config *EtcdConfig) (Manager, error) {
 	return newLocalManager(r), nil
 }
 
+// NewLocalManagerV3 is like NewLocalManager but keeps the subnet registry
+// in the etcd v3 keyspace, with subnet TTLs implemented as v3 leases.
+func NewLocalManagerV3(config *EtcdConfig) (Manager, error) {
+	r, err := newEtcdV3SubnetRegistry(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalManager(r), nil
+}
+
+// NewLocalManagerFile is like NewLocalManager but keeps the subnet registry
+// in a local file instead of etcd. Only one process may use the file.
+func NewLocalManagerFile(path string) (Manager, error) {
+	r, err := newFileSubnetRegistry(path)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalManager(r), nil
+}
+
 func newLocalManager(r Registry) Manager {
 	return &LocalManager{
 		registry: r,
@@ -96,10 +127,16 @@ func (m *LocalManager) AcquireLease(ctx context.Context, network string, attrs *
 		return nil, err
 	}
 
+	prefixLen, err := config.subnetLenFor(attrs.SubnetLen)
+	if err != nil {
+		return nil, err
+	}
+
 	for i := 0; i < raceRetries; i++ {
-		l, err := m.tryAcquireLease(ctx, network, config, attrs.PublicIP, attrs)
+		l, err := m.tryAcquireLease(ctx, network, config, attrs.PublicIP, prefixLen, attrs)
 		switch err {
 		case nil:
+			l.IPv6Subnet = config.IPv6SubnetFor(l.Subnet)
 			return l, nil
 		case errTryAgain:
 			continue
@@ -111,9 +148,27 @@ func (m *LocalManager) AcquireLease(ctx context.Context, network string, attrs *
 	return nil, errors.New("Max retries reached trying to acquire a subnet")
 }
 
-func findLeaseByIP(leases []Lease, pubIP ip.IP4) *Lease {
+// findLease returns the lease of the host with the given attributes: the
+// one with its NodeID or else one with its PublicIP and no NodeID, so that
+// a host that comes up with a recycled IP doesn't take over the lease of
+// another one. A lease with our NodeID is reused even when it is unexpired
+// and has another PublicIP, as after a DHCP renumbering, but that is logged
+// since hosts cloned from one image may share a machine-id.
+func findLease(leases []Lease, attrs *LeaseAttrs) *Lease {
+	if attrs.NodeID != "" {
+		for _, l := range leases {
+			if l.Attrs.NodeID == attrs.NodeID {
+				if !l.Expiration.IsZero() && l.Expiration.After(clock.Now()) && l.Attrs.PublicIP != attrs.PublicIP {
+					log.Warningf("Taking over lease %v of node %q held by %v until %v; if that host is still up, the node ID (or /etc/machine-id) is shared with it",
+						l.Subnet, attrs.NodeID, l.Attrs.PublicIP, l.Expiration)
+				}
+				return &l
+			}
+		}
+	}
+
 	for _, l := range leases {
-		if pubIP == l.Attrs.PublicIP {
+		if l.Attrs.NodeID == "" && l.Attrs.PublicIP == attrs.PublicIP {
 			return &l
 		}
 	}
@@ -121,22 +176,24 @@ func findLeaseByIP(leases []Lease, pubIP ip.IP4) *Lease {
 	return nil
 }
 
-func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, config *Config, extIaddr ip.IP4, attrs *LeaseAttrs) (*Lease, error) {
+func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, config *Config, extIaddr ip.IP4, prefixLen uint, attrs *LeaseAttrs) (*Lease, error) {
 	leases, _, err := m.registry.getSubnets(ctx, network)
 	if err != nil {
 		return nil, err
 	}
 
-	// try to reuse a subnet if there's one that matches our IP
-	if l := findLeaseByIP(leases, extIaddr); l != nil {
+	// try to reuse a subnet if there's one that matches our identity or IP,
+	// updating its attributes in place if the IP has changed
+	if l := findLease(leases, attrs); l != nil {
 		// make sure the existing subnet is still within the configured network
-		if isSubnetConfigCompat(config, l.Subnet) {
-			log.Infof("Found lease (%v) for current IP (%v), reusing", l.Subnet, extIaddr)
+		// and, unless it is a reservation, of the size asked for
+		if isSubnetConfigCompat(config, l.Subnet) && (l.Expiration.IsZero() || l.Subnet.PrefixLen == prefixLen) && keepExcluded(config, l) {
+			log.Infof("Found lease (%v) for this node (%v, %v), reusing", l.Subnet, attrs.NodeID, extIaddr)
 
 			ttl := time.Duration(0)
 			if !l.Expiration.IsZero() {
 				// Not a reservation
-				ttl = subnetTTL
+				ttl = config.LeaseTTL.Duration
 			}
 			exp, err := m.registry.updateSubnet(ctx, network, l.Subnet, attrs, ttl, 0)
 			if err != nil {
@@ -147,7 +204,7 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, conf
 			l.Expiration = exp
 			return l, nil
 		} else {
-			log.Infof("Found lease (%v) for current IP (%v) but not compatible with current config, deleting", l.Subnet, extIaddr)
+			log.Infof("Found lease (%v) for this node (%v, %v) but not compatible with current config, deleting", l.Subnet, attrs.NodeID, extIaddr)
 			if err := m.registry.deleteSubnet(ctx, network, l.Subnet); err != nil {
 				return nil, err
 			}
@@ -155,14 +212,19 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, conf
 	}
 
 	// no existing match, grab a new one
-	sn, err := m.allocateSubnet(config, leases)
+	sn, err := m.allocateSubnet(config, leases, prefixLen, attrs)
 	if err != nil {
 		return nil, err
 	}
 
-	exp, err := m.registry.createSubnet(ctx, network, sn, attrs, subnetTTL)
+	exp, err := m.registry.createSubnet(ctx, network, sn, attrs, config.LeaseTTL.Duration)
 	switch {
 	case err == nil:
+		if config.MinSubnetLen != config.MaxSubnetLen {
+			if err := m.checkOverlap(ctx, network, sn); err != nil {
+				return nil, err
+			}
+		}
 		return &Lease{
 			Subnet:     sn,
 			Attrs:      *attrs,
@@ -175,28 +237,41 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, network string, conf
 	}
 }
 
-func (m *LocalManager) allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
-	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
+func (m *LocalManager) allocateSubnet(config *Config, leases []Lease, prefixLen uint, attrs *LeaseAttrs) (ip.IP4Net, error) {
+	for _, r := range config.subnetRanges() {
+		log.Infof("Picking /%d subnet in range %s ... %s (%s)", prefixLen, r.min, r.max, config.AllocationStrategy)
+
+		sn, err := newSubnetBitmap(config, r, leases).allocate(config.AllocationStrategy, prefixLen, attrs)
+		if err != errOutOfSubnets {
+			return sn, err
+		}
+	}
 
-	var bag []ip.IP4
-	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
+	return ip.IP4Net{}, errOutOfSubnets
+}
 
-OuterLoop:
-	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
-		for _, l := range leases {
-			if sn.Overlaps(l.Subnet) {
-				continue OuterLoop
+// checkOverlap is called after creating the subnet sn in a network with
+// subnets of different sizes. The registry only keeps two hosts from
+// creating the very same subnet so another host may have concurrently
+// created one overlapping it. If so, sn is deleted again and errTryAgain
+// returned; both hosts may back off but neither keeps an overlapping subnet.
+func (m *LocalManager) checkOverlap(ctx context.Context, network string, sn ip.IP4Net) error {
+	leases, _, err := m.registry.getSubnets(ctx, network)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range leases {
+		if !l.Subnet.Equal(sn) && l.Subnet.Overlaps(sn) {
+			log.Infof("Subnet %v overlaps %v created concurrently, trying again", sn, l.Subnet)
+			if err := m.registry.deleteSubnet(ctx, network, sn); err != nil && !isErrEtcdKeyNotFound(err) {
+				return err
 			}
+			return errTryAgain
 		}
-		bag = append(bag, sn.IP)
 	}
 
-	if len(bag) == 0 {
-		return ip.IP4Net{}, errors.New("out of subnets")
-	} else {
-		i := randInt(0, len(bag))
-		return ip.IP4Net{IP: bag[i], PrefixLen: config.SubnetLen}, nil
-	}
+	return nil
 }
 
 func (m *LocalManager) RevokeLease(ctx context.Context, network string, sn ip.IP4Net) error {
@@ -204,7 +279,19 @@ func (m *LocalManager) RevokeLease(ctx context.Context, network string, sn ip.IP
 }
 
 func (m *LocalManager) RenewLease(ctx context.Context, network string, lease *Lease) error {
-	exp, err := m.registry.updateSubnet(ctx, network, lease.Subnet, &lease.Attrs, subnetTTL, 0)
+	config, err := m.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return err
+	}
+
+	if !keepExcluded(config, lease) {
+		if err := m.registry.deleteSubnet(ctx, network, lease.Subnet); err != nil && !isErrEtcdKeyNotFound(err) {
+			return err
+		}
+		return ErrLeaseExcluded
+	}
+
+	exp, err := m.registry.updateSubnet(ctx, network, lease.Subnet, &lease.Attrs, config.LeaseTTL.Duration, 0)
 	if err != nil {
 		return err
 	}
@@ -214,21 +301,35 @@ func (m *LocalManager) RenewLease(ctx context.Context, network string, lease *Le
 }
 
 func getNextIndex(cursor interface{}) (uint64, error) {
-	nextIndex := uint64(0)
+	wc, err := getWatchCursor(cursor)
+	return wc.index, err
+}
 
+// getWatchCursor returns a cursor handed out before, as is or as the string
+// a RemoteManager got
+func getWatchCursor(cursor interface{}) (watchCursor, error) {
 	if wc, ok := cursor.(watchCursor); ok {
-		nextIndex = wc.index
-	} else if s, ok := cursor.(string); ok {
-		var err error
-		nextIndex, err = strconv.ParseUint(s, 10, 64)
-		if err != nil {
-			return 0, fmt.Errorf("failed to parse cursor: %v", err)
+		return wc, nil
+	}
+
+	s, ok := cursor.(string)
+	if !ok {
+		return watchCursor{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+
+	wc := watchCursor{}
+	parts := strings.SplitN(s, ".", 2)
+	var err error
+	if wc.index, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return watchCursor{}, fmt.Errorf("failed to parse cursor: %v", err)
+	}
+	if len(parts) == 2 {
+		if wc.seen, err = strconv.Atoi(parts[1]); err != nil || wc.seen < 0 {
+			return watchCursor{}, fmt.Errorf("failed to parse cursor: %q", s)
 		}
-	} else {
-		return 0, fmt.Errorf("internal error: watch cursor is of unknown type")
 	}
 
-	return nextIndex, nil
+	return wc, nil
 }
 
 func (m *LocalManager) leaseWatchReset(ctx context.Context, network string, sn ip.IP4Net) (LeaseWatchResult, error) {
@@ -239,11 +340,19 @@ func (m *LocalManager) leaseWatchReset(ctx context.Context, network string, sn i
 
 	return LeaseWatchResult{
 		Snapshot: []Lease{*l},
-		Cursor:   watchCursor{index},
+		Cursor:   watchCursor{index: index},
 	}, nil
 }
 
 func (m *LocalManager) WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	wr, err := m.watchLease(ctx, network, sn, cursor)
+	if err != nil {
+		return wr, err
+	}
+	return wr, m.addIPv6Subnets(ctx, network, &wr)
+}
+
+func (m *LocalManager) watchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
 	if cursor == nil {
 		return m.leaseWatchReset(ctx, network, sn)
 	}
@@ -259,7 +368,7 @@ func (m *LocalManager) WatchLease(ctx context.Context, network string, sn ip.IP4
 	case err == nil:
 		return LeaseWatchResult{
 			Events: []Event{evt},
-			Cursor: watchCursor{index},
+			Cursor: watchCursor{index: index},
 		}, nil
 
 	case isIndexTooSmall(err):
@@ -272,22 +381,30 @@ func (m *LocalManager) WatchLease(ctx context.Context, network string, sn ip.IP4
 }
 
 func (m *LocalManager) WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error) {
+	wr, err := m.watchLeases(ctx, network, cursor)
+	if err != nil {
+		return wr, err
+	}
+	return wr, m.addIPv6Subnets(ctx, network, &wr)
+}
+
+func (m *LocalManager) watchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error) {
 	if cursor == nil {
 		return m.leasesWatchReset(ctx, network)
 	}
 
-	nextIndex, err := getNextIndex(cursor)
+	since, err := getWatchCursor(cursor)
 	if err != nil {
 		return LeaseWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchSubnets(ctx, network, nextIndex)
+	evt, next, err := m.registry.watchSubnets(ctx, network, since)
 
 	switch {
 	case err == nil:
 		return LeaseWatchResult{
 			Events: []Event{evt},
-			Cursor: watchCursor{index},
+			Cursor: next,
 		}, nil
 
 	case isIndexTooSmall(err):
@@ -304,23 +421,23 @@ func (m *LocalManager) WatchNetworks(ctx context.Context, cursor interface{}) (N
 		return m.networkWatchReset(ctx)
 	}
 
-	nextIndex, err := getNextIndex(cursor)
+	since, err := getWatchCursor(cursor)
 	if err != nil {
 		return NetworkWatchResult{}, err
 	}
 
 	for {
-		evt, index, err := m.registry.watchNetworks(ctx, nextIndex)
+		evt, next, err := m.registry.watchNetworks(ctx, since)
 
 		switch {
 		case err == nil:
 			return NetworkWatchResult{
 				Events: []Event{evt},
-				Cursor: watchCursor{index},
+				Cursor: next,
 			}, nil
 
 		case err == errTryAgain:
-			nextIndex = index
+			since = next
 
 		case isIndexTooSmall(err):
 			log.Warning("Watch of networks failed because etcd index outside history window")
@@ -332,6 +449,67 @@ func (m *LocalManager) WatchNetworks(ctx context.Context, cursor interface{}) (N
 	}
 }
 
+func (m *LocalManager) WatchNetworkConfig(ctx context.Context, network string, cursor interface{}) (ConfigWatchResult, error) {
+	nextIndex := uint64(0)
+	if cursor != nil {
+		var err error
+		if nextIndex, err = getNextIndex(cursor); err != nil {
+			return ConfigWatchResult{}, err
+		}
+	}
+
+	for {
+		cfg, index, err := m.registry.watchNetworkConfig(ctx, network, nextIndex)
+
+		switch {
+		case err == nil && cfg == "":
+			log.Warningf("Config of network %q has been deleted, keeping the last one", network)
+			nextIndex = index
+
+		case err == nil:
+			config, err := ParseConfig(cfg)
+			if err != nil {
+				log.Errorf("Ignoring invalid config of network %q: %v", network, err)
+				nextIndex = index
+				continue
+			}
+			return ConfigWatchResult{
+				Config: config,
+				Cursor: watchCursor{index: index},
+			}, nil
+
+		case isIndexTooSmall(err):
+			log.Warning("Watch of network config failed because etcd index outside history window")
+			nextIndex = 0
+
+		default:
+			return ConfigWatchResult{}, err
+		}
+	}
+}
+
+// addIPv6Subnets fills in the IPv6 subnets of the leases in a dual-stack
+// network. They are derived from the IPv4 subnets and not stored in the registry.
+func (m *LocalManager) addIPv6Subnets(ctx context.Context, network string, wr *LeaseWatchResult) error {
+	if len(wr.Events) == 0 && len(wr.Snapshot) == 0 {
+		return nil
+	}
+
+	config, err := m.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return err
+	}
+
+	for i := range wr.Events {
+		wr.Events[i].Lease.IPv6Subnet = config.IPv6SubnetFor(wr.Events[i].Lease.Subnet)
+	}
+	for i := range wr.Snapshot {
+		wr.Snapshot[i].IPv6Subnet = config.IPv6SubnetFor(wr.Snapshot[i].Subnet)
+	}
+
+	return nil
+}
+
 func isIndexTooSmall(err error) bool {
 	etcdErr, ok := err.(etcd.Error)
 	return ok && etcdErr.Code == etcd.ErrorCodeEventIndexCleared
@@ -346,7 +524,7 @@ func (m *LocalManager) leasesWatchReset(ctx context.Context, network string) (Le
 		return wr, fmt.Errorf("failed to retrieve subnet leases: %v", err)
 	}
 
-	wr.Cursor = watchCursor{index}
+	wr.Cursor = watchCursor{index: index}
 	wr.Snapshot = leases
 	return wr, nil
 }
@@ -360,25 +538,63 @@ func (m *LocalManager) networkWatchReset(ctx context.Context) (NetworkWatchResul
 		return wr, fmt.Errorf("failed to retrieve networks: %v", err)
 	}
 
-	wr.Cursor = watchCursor{index}
+	wr.Cursor = watchCursor{index: index}
 	wr.Snapshot = networks
 	return wr, nil
 }
 
+// keepExcluded reports a lease that overlaps an excluded subnet and returns
+// false if it should be given up. Reservations are always kept.
+func keepExcluded(config *Config, l *Lease) bool {
+	ex, ok := config.excludedBy(l.Subnet)
+	if !ok {
+		return true
+	}
+
+	if config.MigrateExcludedLeases && !l.Expiration.IsZero() {
+		log.Warningf("Lease %v overlaps excluded subnet %v, migrating it to another subnet", l.Subnet, ex)
+		return false
+	}
+
+	log.Warningf("Lease %v overlaps excluded subnet %v", l.Subnet, ex)
+	return true
+}
+
 func isSubnetConfigCompat(config *Config, sn ip.IP4Net) bool {
-	if sn.IP < config.SubnetMin || sn.IP > config.SubnetMax {
+	if sn.PrefixLen < config.MinSubnetLen || sn.PrefixLen > config.MaxSubnetLen {
 		return false
 	}
 
-	return sn.PrefixLen == config.SubnetLen
+	// the ranges end with the start of the last subnet of the default size
+	end := uint64(sn.IP) + uint64(1)<<(32-sn.PrefixLen)
+	for _, r := range config.subnetRanges() {
+		last := uint64(r.max) + uint64(1)<<(32-config.SubnetLen)
+		if sn.IP >= r.min && end <= last {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *LocalManager) tryAddReservation(ctx context.Context, network string, r *Reservation) error {
 	attrs := &LeaseAttrs{
 		PublicIP: r.PublicIP,
+		NodeID:   r.NodeID,
 	}
 
-	_, err := m.registry.createSubnet(ctx, network, r.Subnet, attrs, 0)
+	// with subnets of different sizes, the reservation may overlap a
+	// subnet under a different key
+	leases, _, err := m.registry.getSubnets(ctx, network)
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		if !l.Subnet.Equal(r.Subnet) && l.Subnet.Overlaps(r.Subnet) {
+			return ErrLeaseTaken
+		}
+	}
+
+	_, err = m.registry.createSubnet(ctx, network, r.Subnet, attrs, 0)
 	switch {
 	case err == nil:
 		return nil
@@ -389,7 +605,7 @@ func (m *LocalManager) tryAddReservation(ctx context.Context, network string, r
 
 	// This subnet or its reservation already exists.
 	// Get what's there and
-	// - if PublicIP matches, remove the TTL make it a reservation
+	// - if it belongs to the host the reservation is for, remove the TTL make it a reservation
 	// - otherwise, error out
 	sub, asof, err := m.registry.getSubnet(ctx, network, r.Subnet)
 	switch {
@@ -401,7 +617,7 @@ func (m *LocalManager) tryAddReservation(ctx context.Context, network string, r
 		return err
 	}
 
-	if sub.Attrs.PublicIP != r.PublicIP {
+	if !r.isFor(&sub.Attrs) {
 		// Subnet already taken
 		return ErrLeaseTaken
 	}
@@ -420,14 +636,18 @@ func (m *LocalManager) AddReservation(ctx context.Context, network string, r *Re
 		return err
 	}
 
-	if config.SubnetLen != r.Subnet.PrefixLen {
+	if r.Subnet.PrefixLen < config.MinSubnetLen || r.Subnet.PrefixLen > config.MaxSubnetLen {
 		return fmt.Errorf("reservation subnet has mask incompatible with network config")
 	}
 
-	if !config.Network.Overlaps(r.Subnet) {
+	if _, ok := config.NetworkOf(r.Subnet); !ok {
 		return fmt.Errorf("reservation subnet is outside of flannel network")
 	}
 
+	if ex, ok := config.excludedBy(r.Subnet); ok {
+		return fmt.Errorf("reservation subnet overlaps excluded subnet %v", ex)
+	}
+
 	for i := 0; i < raceRetries; i++ {
 		err := m.tryAddReservation(ctx, network, r)
 		switch {
@@ -443,24 +663,29 @@ func (m *LocalManager) AddReservation(ctx context.Context, network string, r *Re
 	return ErrNoMoreTries
 }
 
-func (m *LocalManager) tryRemoveReservation(ctx context.Context, network string, subnet ip.IP4Net) error {
+func (m *LocalManager) tryRemoveReservation(ctx context.Context, network string, config *Config, subnet ip.IP4Net) error {
 	sub, asof, err := m.registry.getSubnet(ctx, network, subnet)
 	if err != nil {
 		return err
 	}
 
 	// add back the TTL
-	_, err = m.registry.updateSubnet(ctx, network, subnet, &sub.Attrs, subnetTTL, asof)
+	_, err = m.registry.updateSubnet(ctx, network, subnet, &sub.Attrs, config.LeaseTTL.Duration, asof)
 	if isErrEtcdTestFailed(err) {
 		return errTryAgain
 	}
 	return err
 }
 
-//RemoveReservation removes the subnet by setting TTL back to subnetTTL (24hours)
+// RemoveReservation removes the subnet by setting TTL back to the network's LeaseTTL
 func (m *LocalManager) RemoveReservation(ctx context.Context, network string, subnet ip.IP4Net) error {
+	config, err := m.GetNetworkConfig(ctx, network)
+	if err != nil {
+		return err
+	}
+
 	for i := 0; i < raceRetries; i++ {
-		err := m.tryRemoveReservation(ctx, network, subnet)
+		err := m.tryRemoveReservation(ctx, network, config, subnet)
 		switch {
 		case err == nil:
 			return nil
@@ -490,6 +715,7 @@ func (m *LocalManager) ListReservations(ctx context.Context, network string) ([]
 		r := Reservation{
 			Subnet:   sub.Subnet,
 			PublicIP: sub.Attrs.PublicIP,
+			NodeID:   sub.Attrs.NodeID,
 		}
 		rsvs = append(rsvs, r)
 	}
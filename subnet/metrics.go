@@ -0,0 +1,28 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"github.com/coreos/flannel/pkg/metrics"
+)
+
+var (
+	leaseWatchErrors = metrics.NewCounterVec("flannel_lease_watch_errors_total",
+		"Number of failed watches of the subnet leases of a network.", "network")
+	leaseWatchResets = metrics.NewCounterVec("flannel_lease_watch_resets_total",
+		"Number of times the watch of the subnet leases of a network fell behind and started over from a snapshot.", "network")
+	peers = metrics.NewGaugeVec("flannel_peers",
+		"Number of other hosts with a subnet lease in a network.", "network")
+)
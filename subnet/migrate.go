@@ -0,0 +1,116 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// MigrateEtcdV2ToV3 copies everything under config.Prefix in the etcd v2
+// keyspace (network configs, subnet leases and reservations) into the v3
+// keyspace. Keys with a TTL are attached to a v3 lease with the remaining
+// TTL, keys without one (reservations, configs) are copied as is. Keys that
+// already exist in v3 are left untouched so the migration can be re-run.
+// It returns the number of keys copied.
+func MigrateEtcdV2ToV3(ctx context.Context, config *EtcdConfig) (int, error) {
+	v2, err := newEtcdClient(config)
+	if err != nil {
+		return 0, err
+	}
+
+	v3, err := newEtcdV3Client(config)
+	if err != nil {
+		return 0, err
+	}
+
+	return migrateV2ToV3(ctx, v2, v3, config.Prefix)
+}
+
+func migrateV2ToV3(ctx context.Context, v2 etcd.KeysAPI, v3 etcdV3Client, prefix string) (int, error) {
+	resp, err := v2.Get(ctx, prefix, &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			log.Infof("Nothing to migrate: %v does not exist in etcd v2", prefix)
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	copied := 0
+	var walk func(n *etcd.Node) error
+	walk = func(n *etcd.Node) error {
+		if n.Dir {
+			for _, child := range n.Nodes {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		ok, err := migrateV2Node(ctx, v3, n)
+		if err != nil {
+			return err
+		}
+		if ok {
+			copied++
+		}
+		return nil
+	}
+
+	if err := walk(resp.Node); err != nil {
+		return copied, err
+	}
+
+	return copied, nil
+}
+
+func migrateV2Node(ctx context.Context, v3 etcdV3Client, n *etcd.Node) (bool, error) {
+	lease := int64(0)
+	if n.Expiration != nil {
+		ttl := n.Expiration.Sub(time.Now())
+		if ttl < time.Second {
+			log.Infof("Skipping %v: already expired", n.Key)
+			return false, nil
+		}
+
+		var err error
+		if lease, _, err = v3.grant(ctx, ttl); err != nil {
+			return false, err
+		}
+	}
+
+	ok, _, err := v3.put(ctx, n.Key, n.Value, lease, &v3Compare{Target: "CREATE", Revision: 0})
+	if err != nil || !ok {
+		if lease != 0 {
+			v3.revoke(ctx, lease)
+		}
+		if err == nil {
+			log.Infof("Skipping %v: already present in etcd v3", n.Key)
+		}
+		return false, err
+	}
+
+	if lease != 0 {
+		log.Infof("Migrated %v (lease %x)", n.Key, lease)
+	} else {
+		log.Infof("Migrated %v", n.Key)
+	}
+	return true, nil
+}
@@ -201,9 +201,13 @@ func (me *mockEtcd) makeNode(path []string, value string, isDir bool, ttl time.D
 				child = me.newNode(part, "", true)
 			} else {
 				// Final node
-				exp := time.Now().Add(ttl)
 				child = me.newNode(part, value, isDir)
-				child.Expiration = &exp
+				child.Expiration = nil
+				if ttl > 0 {
+					exp := time.Now().Add(ttl)
+					child.Expiration = &exp
+					child.TTL = int64(ttl / time.Second)
+				}
 
 				resp = &etcd.Response{
 					Action: "create",
@@ -264,6 +268,7 @@ func (me *mockEtcd) set(ctx context.Context, key, value string, opts *etcd.SetOp
 		if opts.TTL > 0 {
 			exp := time.Now().Add(opts.TTL)
 			node.Expiration = &exp
+			node.TTL = int64(opts.TTL / time.Second)
 		}
 
 		resp = &etcd.Response{
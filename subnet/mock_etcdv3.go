@@ -0,0 +1,263 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type mockV3Lease struct {
+	ttl  time.Duration
+	keys map[string]bool
+}
+
+// mockEtcdV3 is an in-memory etcdV3Client with revisions, leases and a
+// bounded watch history.
+type mockEtcdV3 struct {
+	mux       sync.Mutex
+	kvs       map[string]v3KeyValue
+	leases    map[int64]*mockV3Lease
+	history   []v3Event
+	compacted int64
+	rev       int64
+	nextLease int64
+	changed   chan struct{}
+}
+
+func newMockEtcdV3() *mockEtcdV3 {
+	return &mockEtcdV3{
+		kvs:       make(map[string]v3KeyValue),
+		leases:    make(map[int64]*mockV3Lease),
+		rev:       1000,
+		nextLease: 1,
+		changed:   make(chan struct{}),
+	}
+}
+
+// must be called with mux held
+func (me *mockEtcdV3) record(e v3Event) {
+	me.history = append(me.history, e)
+	close(me.changed)
+	me.changed = make(chan struct{})
+}
+
+func matchKey(k, key string, prefix bool) bool {
+	if prefix {
+		return strings.HasPrefix(k, key)
+	}
+	return k == key
+}
+
+func (me *mockEtcdV3) get(ctx context.Context, key string, prefix bool) ([]v3KeyValue, int64, error) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	kvs := []v3KeyValue{}
+	for k, kv := range me.kvs {
+		if matchKey(k, key, prefix) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Sort(byKey(kvs))
+
+	return kvs, me.rev, nil
+}
+
+type byKey []v3KeyValue
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (me *mockEtcdV3) put(ctx context.Context, key, value string, lease int64, cmp *v3Compare) (bool, int64, error) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	cur, exists := me.kvs[key]
+	if cmp != nil {
+		switch cmp.Target {
+		case "CREATE":
+			if cur.CreateRevision != cmp.Revision {
+				return false, me.rev, nil
+			}
+		case "MOD":
+			if cur.ModRevision != cmp.Revision {
+				return false, me.rev, nil
+			}
+		}
+	}
+
+	if lease != 0 {
+		l, ok := me.leases[lease]
+		if !ok {
+			return false, me.rev, &v3GatewayError{Message: "etcdserver: requested lease not found", Code: 5}
+		}
+		l.keys[key] = true
+	}
+	if exists && cur.Lease != 0 && cur.Lease != lease {
+		if l, ok := me.leases[cur.Lease]; ok {
+			delete(l.keys, key)
+		}
+	}
+
+	me.rev++
+	kv := v3KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: cur.CreateRevision,
+		ModRevision:    me.rev,
+		Lease:          lease,
+	}
+	if !exists {
+		kv.CreateRevision = me.rev
+	}
+	me.kvs[key] = kv
+	me.record(v3Event{Type: v3EventPut, Kv: kv})
+
+	return true, me.rev, nil
+}
+
+// must be called with mux held
+func (me *mockEtcdV3) deleteLocked(key string) *v3KeyValue {
+	kv, ok := me.kvs[key]
+	if !ok {
+		return nil
+	}
+
+	delete(me.kvs, key)
+	me.rev++
+	me.record(v3Event{Type: v3EventDelete, Kv: v3KeyValue{Key: key, ModRevision: me.rev}})
+	return &kv
+}
+
+func (me *mockEtcdV3) delete(ctx context.Context, key string) (*v3KeyValue, int64, error) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	prev := me.deleteLocked(key)
+	if prev != nil && prev.Lease != 0 {
+		if l, ok := me.leases[prev.Lease]; ok {
+			delete(l.keys, key)
+		}
+	}
+	return prev, me.rev, nil
+}
+
+func (me *mockEtcdV3) grant(ctx context.Context, ttl time.Duration) (int64, time.Duration, error) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	id := me.nextLease
+	me.nextLease++
+	me.leases[id] = &mockV3Lease{ttl: ttl, keys: make(map[string]bool)}
+	return id, ttl, nil
+}
+
+func (me *mockEtcdV3) keepAliveOnce(ctx context.Context, id int64) (time.Duration, error) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	if l, ok := me.leases[id]; ok {
+		return l.ttl, nil
+	}
+	return 0, nil
+}
+
+func (me *mockEtcdV3) timeToLive(ctx context.Context, id int64) (time.Duration, error) {
+	return me.keepAliveOnce(ctx, id)
+}
+
+func (me *mockEtcdV3) revoke(ctx context.Context, id int64) error {
+	me.expireLease(id)
+	return nil
+}
+
+// expireLease drops the lease along with every key attached to it
+func (me *mockEtcdV3) expireLease(id int64) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	l, ok := me.leases[id]
+	if !ok {
+		return
+	}
+
+	// like etcd, delete all the keys of the lease in one revision
+	delete(me.leases, id)
+	me.rev++
+	for key := range l.keys {
+		if _, ok := me.kvs[key]; !ok {
+			continue
+		}
+		delete(me.kvs, key)
+		me.record(v3Event{Type: v3EventDelete, Kv: v3KeyValue{Key: key, ModRevision: me.rev}})
+	}
+}
+
+// compact discards watch history up to and including rev
+func (me *mockEtcdV3) compact(rev int64) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	i := 0
+	for ; i < len(me.history); i++ {
+		if me.history[i].Kv.ModRevision > rev {
+			break
+		}
+	}
+	me.history = me.history[i:]
+	me.compacted = rev
+}
+
+func (me *mockEtcdV3) watch(ctx context.Context, key string, prefix bool, startRev int64) ([]v3Event, error) {
+	for {
+		me.mux.Lock()
+		if startRev <= me.compacted {
+			me.mux.Unlock()
+			return nil, errV3Compacted
+		}
+
+		evts := []v3Event{}
+		for _, e := range me.history {
+			if e.Kv.ModRevision >= startRev && matchKey(e.Kv.Key, key, prefix) {
+				evts = append(evts, e)
+			}
+		}
+		changed := me.changed
+		me.mux.Unlock()
+
+		if len(evts) > 0 {
+			return evts, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (me *mockEtcdV3) revision(ctx context.Context) (int64, error) {
+	me.mux.Lock()
+	defer me.mux.Unlock()
+
+	return me.rev, nil
+}
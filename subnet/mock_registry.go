@@ -28,6 +28,7 @@ import (
 
 type netwk struct {
 	config        string
+	configEvents  chan configEvent
 	subnets       []Lease
 	subnetsEvents chan event
 
@@ -64,6 +65,11 @@ type event struct {
 	index uint64
 }
 
+type configEvent struct {
+	config string
+	index  uint64
+}
+
 type MockSubnetRegistry struct {
 	mux           sync.Mutex
 	networks      map[string]*netwk
@@ -80,6 +86,7 @@ func NewMockRegistry(network, config string, initialSubnets []Lease) *MockSubnet
 
 	msr.networks[network] = &netwk{
 		config:        config,
+		configEvents:  make(chan configEvent, 100),
 		subnets:       initialSubnets,
 		subnetsEvents: make(chan event, 1000),
 		subnetEvents:  make(map[ip.IP4Net]chan event),
@@ -98,7 +105,8 @@ func (msr *MockSubnetRegistry) getNetworkConfig(ctx context.Context, network str
 	return n.config, nil
 }
 
-func (msr *MockSubnetRegistry) setConfig(network, config string) error {
+// SetConfig changes the config of a network and notifies the watches of it
+func (msr *MockSubnetRegistry) SetConfig(network, config string) error {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
 
@@ -107,9 +115,40 @@ func (msr *MockSubnetRegistry) setConfig(network, config string) error {
 		return fmt.Errorf("Network %s not found", network)
 	}
 	n.config = config
+
+	msr.index += 1
+	n.configEvents <- configEvent{config, msr.index}
+
 	return nil
 }
 
+func (msr *MockSubnetRegistry) watchNetworkConfig(ctx context.Context, network string, since uint64) (string, uint64, error) {
+	msr.mux.Lock()
+	n, ok := msr.networks[network]
+	if !ok {
+		msr.mux.Unlock()
+		return "", 0, fmt.Errorf("Network %s not found", network)
+	}
+	config, index := n.config, msr.index
+	msr.mux.Unlock()
+
+	if since == 0 {
+		return config, index, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+
+		case e := <-n.configEvents:
+			if e.index > since {
+				return e.config, e.index, nil
+			}
+		}
+	}
+}
+
 func (msr *MockSubnetRegistry) getSubnets(ctx context.Context, network string) ([]Lease, uint64, error) {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
@@ -249,13 +288,13 @@ func (msr *MockSubnetRegistry) deleteSubnet(ctx context.Context, network string,
 	return nil
 }
 
-func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, network string, since uint64) (Event, uint64, error) {
+func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, network string, since watchCursor) (Event, watchCursor, error) {
 	msr.mux.Lock()
 	n, ok := msr.networks[network]
 	msr.mux.Unlock()
 
 	if !ok {
-		return Event{}, 0, fmt.Errorf("Network %s not found", network)
+		return Event{}, watchCursor{}, fmt.Errorf("Network %s not found", network)
 	}
 
 	for {
@@ -263,8 +302,8 @@ func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, network string,
 		index := msr.index
 		msr.mux.Unlock()
 
-		if since < index {
-			return Event{}, 0, etcd.Error{
+		if since.index < index {
+			return Event{}, watchCursor{}, etcd.Error{
 				Code:    etcd.ErrorCodeEventIndexCleared,
 				Cause:   "out of date",
 				Message: "cursor is out of date",
@@ -274,11 +313,11 @@ func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, network string,
 
 		select {
 		case <-ctx.Done():
-			return Event{}, 0, ctx.Err()
+			return Event{}, watchCursor{}, ctx.Err()
 
 		case e := <-n.subnetsEvents:
-			if e.index > since {
-				return e.evt, e.index, nil
+			if e.index > since.index {
+				return e.evt, watchCursor{index: e.index}, nil
 			}
 		}
 	}
@@ -362,14 +401,14 @@ func (msr *MockSubnetRegistry) getNetworks(ctx context.Context) ([]string, uint6
 	return ns, msr.index, nil
 }
 
-func (msr *MockSubnetRegistry) watchNetworks(ctx context.Context, since uint64) (Event, uint64, error) {
+func (msr *MockSubnetRegistry) watchNetworks(ctx context.Context, since watchCursor) (Event, watchCursor, error) {
 	msr.mux.Lock()
 	index := msr.index
 	msr.mux.Unlock()
 
 	for {
-		if since < index {
-			return Event{}, 0, etcd.Error{
+		if since.index < index {
+			return Event{}, watchCursor{}, etcd.Error{
 				Code:    etcd.ErrorCodeEventIndexCleared,
 				Cause:   "out of date",
 				Message: "cursor is out of date",
@@ -379,11 +418,11 @@ func (msr *MockSubnetRegistry) watchNetworks(ctx context.Context, since uint64)
 
 		select {
 		case <-ctx.Done():
-			return Event{}, 0, ctx.Err()
+			return Event{}, watchCursor{}, ctx.Err()
 
 		case e := <-msr.networkEvents:
-			if e.index > since {
-				return e.evt, e.index, nil
+			if e.index > since.index {
+				return e.evt, watchCursor{index: e.index}, nil
 			}
 		}
 	}
@@ -413,7 +452,8 @@ func (msr *MockSubnetRegistry) CreateNetwork(ctx context.Context, network, confi
 	msr.index += 1
 
 	n := &netwk{
-		config:        network,
+		config:        config,
+		configEvents:  make(chan configEvent, 100),
 		subnetsEvents: make(chan event, 1000),
 		subnetEvents:  make(map[ip.IP4Net]chan event),
 	}
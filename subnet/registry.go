@@ -38,15 +38,21 @@ var (
 
 type Registry interface {
 	getNetworkConfig(ctx context.Context, network string) (string, error)
+	// watchNetworkConfig returns the config after its first change past
+	// since, "" if it was deleted. With since 0, it returns the current
+	// config right away.
+	watchNetworkConfig(ctx context.Context, network string, since uint64) (string, uint64, error)
 	getSubnets(ctx context.Context, network string) ([]Lease, uint64, error)
 	getSubnet(ctx context.Context, network string, sn ip.IP4Net) (*Lease, uint64, error)
 	createSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error)
 	updateSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error)
 	deleteSubnet(ctx context.Context, network string, sn ip.IP4Net) error
-	watchSubnets(ctx context.Context, network string, since uint64) (Event, uint64, error)
+	// watchSubnets and watchNetworks continue from a cursor rather than
+	// an index, as several etcd v3 events can share a revision
+	watchSubnets(ctx context.Context, network string, since watchCursor) (Event, watchCursor, error)
 	watchSubnet(ctx context.Context, network string, since uint64, sn ip.IP4Net) (Event, uint64, error)
 	getNetworks(ctx context.Context) ([]string, uint64, error)
-	watchNetworks(ctx context.Context, since uint64) (Event, uint64, error)
+	watchNetworks(ctx context.Context, since watchCursor) (Event, watchCursor, error)
 }
 
 type EtcdConfig struct {
@@ -123,6 +129,29 @@ func (esr *etcdSubnetRegistry) getNetworkConfig(ctx context.Context, network str
 	return resp.Node.Value, nil
 }
 
+func (esr *etcdSubnetRegistry) watchNetworkConfig(ctx context.Context, network string, since uint64) (string, uint64, error) {
+	key := path.Join(esr.etcdCfg.Prefix, network, "config")
+	if since == 0 {
+		resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+		if err != nil {
+			return "", 0, err
+		}
+		return resp.Node.Value, resp.Index, nil
+	}
+
+	e, err := esr.client().Watcher(key, &etcd.WatcherOptions{AfterIndex: since}).Next(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch e.Action {
+	case "delete", "expire", "compareAndDelete":
+		return "", e.Node.ModifiedIndex, nil
+	default:
+		return e.Node.Value, e.Node.ModifiedIndex, nil
+	}
+}
+
 // getSubnets queries etcd to get a list of currently allocated leases for a given network.
 // It returns the leases along with the "as-of" etcd-index that can be used as the starting
 // point for etcd watch.
@@ -216,19 +245,19 @@ func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, network string,
 	return err
 }
 
-func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, network string, since uint64) (Event, uint64, error) {
+func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, network string, since watchCursor) (Event, watchCursor, error) {
 	key := path.Join(esr.etcdCfg.Prefix, network, "subnets")
 	opts := &etcd.WatcherOptions{
-		AfterIndex: since,
+		AfterIndex: since.index,
 		Recursive:  true,
 	}
 	e, err := esr.client().Watcher(key, opts).Next(ctx)
 	if err != nil {
-		return Event{}, 0, err
+		return Event{}, watchCursor{}, err
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	return evt, watchCursor{index: e.Node.ModifiedIndex}, err
 }
 
 func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, network string, since uint64, sn ip.IP4Net) (Event, uint64, error) {
@@ -276,18 +305,19 @@ func (esr *etcdSubnetRegistry) getNetworks(ctx context.Context) ([]string, uint6
 	return nil, 0, err
 }
 
-func (esr *etcdSubnetRegistry) watchNetworks(ctx context.Context, since uint64) (Event, uint64, error) {
+func (esr *etcdSubnetRegistry) watchNetworks(ctx context.Context, since watchCursor) (Event, watchCursor, error) {
 	key := esr.etcdCfg.Prefix
 	opts := &etcd.WatcherOptions{
-		AfterIndex: since,
+		AfterIndex: since.index,
 		Recursive:  true,
 	}
 	e, err := esr.client().Watcher(key, opts).Next(ctx)
 	if err != nil {
-		return Event{}, 0, err
+		return Event{}, watchCursor{}, err
 	}
 
-	return esr.parseNetworkWatchResponse(e)
+	evt, index, err := esr.parseNetworkWatchResponse(e)
+	return evt, watchCursor{index: index}, err
 }
 
 func (esr *etcdSubnetRegistry) client() etcd.KeysAPI {
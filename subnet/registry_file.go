@@ -0,0 +1,495 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// number of events kept for watchers, same as the etcd v2 event history
+const fileRegistryHistory = 1000
+
+type fileLease struct {
+	Attrs         LeaseAttrs `json:"attrs"`
+	Expiration    time.Time  `json:"expiration"`
+	ModifiedIndex uint64     `json:"modifiedIndex"`
+}
+
+type fileNetwork struct {
+	Config  json.RawMessage       `json:"config"`
+	Subnets map[string]*fileLease `json:"subnets,omitempty"`
+}
+
+// fileRegistryState is the on-disk format of the file registry. The default
+// network is stored under the "" name.
+type fileRegistryState struct {
+	Index    uint64                  `json:"index"`
+	Networks map[string]*fileNetwork `json:"networks"`
+}
+
+type fileEvent struct {
+	network string
+	evt     Event
+	index   uint64
+}
+
+// fileSubnetRegistry is a Registry kept in memory and persisted to a single
+// JSON file after every change. It is meant for small deployments without
+// etcd, typically with flanneld in server mode (--listen) acting as the
+// only writer. Subnet TTLs are enforced lazily: expired leases are removed
+// on the next access or when the earliest expiration passes during a watch.
+type fileSubnetRegistry struct {
+	path string
+
+	mux          sync.Mutex
+	state        fileRegistryState
+	history      []fileEvent
+	historyStart uint64
+	changed      chan struct{}
+}
+
+// newFileSubnetRegistry loads the registry from path. The file must exist
+// and contain at least the configuration of the networks to manage.
+func newFileSubnetRegistry(path string) (*fileSubnetRegistry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &fileSubnetRegistry{
+		path:    path,
+		changed: make(chan struct{}),
+	}
+
+	if err := json.Unmarshal(data, &r.state); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+
+	if r.state.Networks == nil {
+		r.state.Networks = make(map[string]*fileNetwork)
+	}
+	for _, n := range r.state.Networks {
+		if n.Subnets == nil {
+			n.Subnets = make(map[string]*fileLease)
+		}
+	}
+
+	// The event history is not persisted: watchers from before a restart
+	// have to resync.
+	r.historyStart = r.state.Index
+
+	return r, nil
+}
+
+// must be called with mux held
+func (r *fileSubnetRegistry) save() error {
+	data, err := json.MarshalIndent(&r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename so a crash never leaves a truncated registry
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path))
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save registry to %v: %v", r.path, err)
+	}
+
+	return nil
+}
+
+// must be called with mux held
+func (r *fileSubnetRegistry) record(network string, evt Event) {
+	r.history = append(r.history, fileEvent{network, evt, r.state.Index})
+	if len(r.history) > fileRegistryHistory {
+		r.historyStart = r.history[0].index
+		r.history = r.history[1:]
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// expire removes leases past their expiration and returns the time of the
+// next expiration, zero if none. Must be called with mux held.
+func (r *fileSubnetRegistry) expire() time.Time {
+	now := clock.Now()
+	next := time.Time{}
+	expired := false
+
+	for name, n := range r.state.Networks {
+		for key, l := range n.Subnets {
+			if l.Expiration.IsZero() {
+				continue
+			}
+
+			if !l.Expiration.After(now) {
+				sn := ParseSubnetKey(key)
+				delete(n.Subnets, key)
+				r.state.Index++
+				r.record(name, Event{Type: EventRemoved, Lease: Lease{Subnet: *sn}, Network: name})
+				expired = true
+				log.Infof("Subnet lease expired: %v", sn)
+				continue
+			}
+
+			if next.IsZero() || l.Expiration.Before(next) {
+				next = l.Expiration
+			}
+		}
+	}
+
+	if expired {
+		if err := r.save(); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return next
+}
+
+func (r *fileSubnetRegistry) keyNotFound(key string) error {
+	return etcd.Error{
+		Code:    etcd.ErrorCodeKeyNotFound,
+		Message: "Key not found",
+		Cause:   key,
+		Index:   r.state.Index,
+	}
+}
+
+// must be called with mux held
+func (r *fileSubnetRegistry) network(network string) (*fileNetwork, error) {
+	n, ok := r.state.Networks[network]
+	if !ok {
+		return nil, r.keyNotFound(network)
+	}
+	return n, nil
+}
+
+func (r *fileSubnetRegistry) getNetworkConfig(ctx context.Context, network string) (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	n, err := r.network(network)
+	if err != nil {
+		return "", err
+	}
+	return string(n.Config), nil
+}
+
+// watchNetworkConfig only returns the current config: like the set of
+// networks, configs are read from the file at startup and do not change
+// while running.
+func (r *fileSubnetRegistry) watchNetworkConfig(ctx context.Context, network string, since uint64) (string, uint64, error) {
+	if since == 0 {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+
+		n, err := r.network(network)
+		if err != nil {
+			return "", 0, err
+		}
+		return string(n.Config), r.state.Index, nil
+	}
+
+	<-ctx.Done()
+	return "", 0, ctx.Err()
+}
+
+func (r *fileSubnetRegistry) getSubnets(ctx context.Context, network string) ([]Lease, uint64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.expire()
+
+	leases := []Lease{}
+	n, ok := r.state.Networks[network]
+	if !ok {
+		// treat it as empty set, like a missing subnets directory in etcd
+		return leases, r.state.Index, nil
+	}
+
+	for key, l := range n.Subnets {
+		leases = append(leases, l.toLease(key))
+	}
+	sort.Sort(leasesBySubnet(leases))
+
+	return leases, r.state.Index, nil
+}
+
+func (r *fileSubnetRegistry) getSubnet(ctx context.Context, network string, sn ip.IP4Net) (*Lease, uint64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.expire()
+
+	key := MakeSubnetKey(sn)
+	n, err := r.network(network)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	l, ok := n.Subnets[key]
+	if !ok {
+		return nil, 0, r.keyNotFound(key)
+	}
+
+	lease := l.toLease(key)
+	return &lease, r.state.Index, nil
+}
+
+func (r *fileSubnetRegistry) createSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.expire()
+
+	key := MakeSubnetKey(sn)
+	n, err := r.network(network)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if _, ok := n.Subnets[key]; ok {
+		return time.Time{}, etcd.Error{
+			Code:    etcd.ErrorCodeNodeExist,
+			Message: "Key already exists",
+			Cause:   key,
+			Index:   r.state.Index,
+		}
+	}
+
+	return r.setSubnet(network, n, sn, attrs, ttl)
+}
+
+func (r *fileSubnetRegistry) updateSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.expire()
+
+	key := MakeSubnetKey(sn)
+	n, err := r.network(network)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if asof != 0 {
+		l, ok := n.Subnets[key]
+		if !ok {
+			return time.Time{}, r.keyNotFound(key)
+		}
+
+		// asof is the index the caller read the lease at; fail if it was
+		// modified since then
+		if l.ModifiedIndex > asof {
+			return time.Time{}, etcd.Error{
+				Code:    etcd.ErrorCodeTestFailed,
+				Message: "Compare failed",
+				Cause:   fmt.Sprintf("[%v < %v]", asof, l.ModifiedIndex),
+				Index:   r.state.Index,
+			}
+		}
+	}
+
+	return r.setSubnet(network, n, sn, attrs, ttl)
+}
+
+// must be called with mux held
+func (r *fileSubnetRegistry) setSubnet(network string, n *fileNetwork, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+	exp := time.Time{}
+	if ttl != 0 {
+		exp = clock.Now().Add(ttl)
+	}
+
+	r.state.Index++
+	l := &fileLease{
+		Attrs:         *attrs,
+		Expiration:    exp,
+		ModifiedIndex: r.state.Index,
+	}
+
+	key := MakeSubnetKey(sn)
+	prev := n.Subnets[key]
+	n.Subnets[key] = l
+
+	if err := r.save(); err != nil {
+		if prev != nil {
+			n.Subnets[key] = prev
+		} else {
+			delete(n.Subnets, key)
+		}
+		r.state.Index--
+		return time.Time{}, err
+	}
+
+	r.record(network, Event{Type: EventAdded, Lease: l.toLease(key), Network: network})
+
+	return exp, nil
+}
+
+func (r *fileSubnetRegistry) deleteSubnet(ctx context.Context, network string, sn ip.IP4Net) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.expire()
+
+	key := MakeSubnetKey(sn)
+	n, err := r.network(network)
+	if err != nil {
+		return err
+	}
+
+	prev, ok := n.Subnets[key]
+	if !ok {
+		return r.keyNotFound(key)
+	}
+
+	delete(n.Subnets, key)
+	r.state.Index++
+
+	if err := r.save(); err != nil {
+		n.Subnets[key] = prev
+		r.state.Index--
+		return err
+	}
+
+	r.record(network, Event{Type: EventRemoved, Lease: Lease{Subnet: sn}, Network: network})
+
+	return nil
+}
+
+// watch returns the first event after since for which match returns true.
+// It blocks until such an event occurs, expiring leases as their TTLs run out.
+func (r *fileSubnetRegistry) watch(ctx context.Context, since uint64, match func(e *fileEvent) bool) (Event, uint64, error) {
+	for {
+		r.mux.Lock()
+		next := r.expire()
+
+		if since < r.historyStart {
+			index := r.state.Index
+			r.mux.Unlock()
+			return Event{}, 0, etcd.Error{
+				Code:    etcd.ErrorCodeEventIndexCleared,
+				Message: "The event in requested index is outdated and cleared",
+				Cause:   fmt.Sprintf("the requested history has been cleared [%v/%v]", r.historyStart, since),
+				Index:   index,
+			}
+		}
+
+		for i := range r.history {
+			e := &r.history[i]
+			if e.index > since && match(e) {
+				r.mux.Unlock()
+				return e.evt, e.index, nil
+			}
+		}
+
+		changed := r.changed
+		r.mux.Unlock()
+
+		var expiry <-chan time.Time
+		if !next.IsZero() {
+			expiry = clock.After(next.Sub(clock.Now()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return Event{}, 0, ctx.Err()
+		case <-changed:
+		case <-expiry:
+		}
+	}
+}
+
+func (r *fileSubnetRegistry) watchSubnets(ctx context.Context, network string, since watchCursor) (Event, watchCursor, error) {
+	evt, index, err := r.watch(ctx, since.index, func(e *fileEvent) bool {
+		return e.network == network
+	})
+	return evt, watchCursor{index: index}, err
+}
+
+func (r *fileSubnetRegistry) watchSubnet(ctx context.Context, network string, since uint64, sn ip.IP4Net) (Event, uint64, error) {
+	return r.watch(ctx, since, func(e *fileEvent) bool {
+		return e.network == network && e.evt.Lease.Subnet.Equal(sn)
+	})
+}
+
+// getNetworks returns the named networks in the registry; like with etcd,
+// the default network is not part of the multi-network set.
+func (r *fileSubnetRegistry) getNetworks(ctx context.Context) ([]string, uint64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	networks := []string{}
+	for name := range r.state.Networks {
+		if name != "" {
+			networks = append(networks, name)
+		}
+	}
+	sort.Strings(networks)
+
+	return networks, r.state.Index, nil
+}
+
+// watchNetworks blocks until ctx is done: the set of networks is read from
+// the file at startup and does not change while running.
+func (r *fileSubnetRegistry) watchNetworks(ctx context.Context, since watchCursor) (Event, watchCursor, error) {
+	evt, index, err := r.watch(ctx, since.index, func(e *fileEvent) bool {
+		return false
+	})
+	return evt, watchCursor{index: index}, err
+}
+
+func (l *fileLease) toLease(key string) Lease {
+	return Lease{
+		Subnet:     *ParseSubnetKey(key),
+		Attrs:      l.Attrs,
+		Expiration: l.Expiration,
+		asof:       l.ModifiedIndex,
+	}
+}
+
+type leasesBySubnet []Lease
+
+func (b leasesBySubnet) Len() int           { return len(b) }
+func (b leasesBySubnet) Less(i, j int) bool { return b[i].Subnet.IP < b[j].Subnet.IP }
+func (b leasesBySubnet) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
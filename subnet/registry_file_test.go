@@ -0,0 +1,238 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const testFileRegistry = `{
+  "networks": {
+    "": { "config": { "Network": "10.3.0.0/16" } },
+    "blue": { "config": { "Network": "10.4.0.0/16" } }
+  }
+}`
+
+func newTestFileRegistry(t *testing.T) (*fileSubnetRegistry, string) {
+	dir, err := ioutil.TempDir("", "flannel-registry")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	path := filepath.Join(dir, "registry.json")
+	if err := ioutil.WriteFile(path, []byte(testFileRegistry), 0600); err != nil {
+		t.Fatalf("failed to write registry file: %v", err)
+	}
+
+	r, err := newFileSubnetRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+
+	return r, dir
+}
+
+func TestFileRegistry(t *testing.T) {
+	r, dir := newTestFileRegistry(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	config, err := r.getNetworkConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get network config: %v", err)
+	}
+	if _, err := ParseConfig(config); err != nil {
+		t.Fatalf("Failed to parse network config %q: %v", config, err)
+	}
+
+	if _, err := r.getNetworkConfig(ctx, "red"); !isErrEtcdKeyNotFound(err) {
+		t.Fatalf("Expected key not found for unknown network, got %v", err)
+	}
+
+	networks, _, err := r.getNetworks(ctx)
+	if err != nil || len(networks) != 1 || networks[0] != "blue" {
+		t.Fatalf("Unexpected networks: %v, %v", networks, err)
+	}
+
+	sn := newIP4Net("10.3.5.0", 24)
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), BackendType: "vxlan"}
+
+	exp, err := r.createSubnet(ctx, "", sn, attrs, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create subnet: %v", err)
+	}
+	if exp.IsZero() {
+		t.Fatalf("Expected an expiration for a subnet with TTL")
+	}
+
+	_, err = r.createSubnet(ctx, "", sn, attrs, time.Hour)
+	if etcdErr, ok := err.(etcd.Error); !ok || etcdErr.Code != etcd.ErrorCodeNodeExist {
+		t.Fatalf("Expected node exists error, got %v", err)
+	}
+
+	leases, index, err := r.getSubnets(ctx, "")
+	if err != nil || len(leases) != 1 || !leases[0].Subnet.Equal(sn) || !reflect.DeepEqual(leases[0].Attrs, *attrs) {
+		t.Fatalf("Unexpected subnets: %v, %v", leases, err)
+	}
+
+	// a stale asof must fail, a current one succeed
+	if _, err := r.updateSubnet(ctx, "", sn, attrs, time.Hour, index); err != nil {
+		t.Fatalf("Failed to update subnet: %v", err)
+	}
+	if _, err := r.updateSubnet(ctx, "", sn, attrs, time.Hour, index); !isErrEtcdTestFailed(err) {
+		t.Fatalf("Expected compare failure, got %v", err)
+	}
+
+	// the registry survives a restart
+	r2, err := newFileSubnetRegistry(r.path)
+	if err != nil {
+		t.Fatalf("Failed to reload registry: %v", err)
+	}
+	l, index2, err := r2.getSubnet(ctx, "", sn)
+	if err != nil || !reflect.DeepEqual(l.Attrs, *attrs) {
+		t.Fatalf("Unexpected subnet after reload: %v, %v", l, err)
+	}
+	if index2 != index+1 {
+		t.Fatalf("Index not persisted: expected %v, got %v", index+1, index2)
+	}
+
+	// and old watch cursors are invalidated by it
+	if _, _, err := r2.watchSubnets(ctx, "", watchCursor{index: index}); !isIndexTooSmall(err) {
+		t.Fatalf("Expected index cleared error after reload, got %v", err)
+	}
+
+	if err := r.deleteSubnet(ctx, "", sn); err != nil {
+		t.Fatalf("Failed to delete subnet: %v", err)
+	}
+	if err := r.deleteSubnet(ctx, "", sn); !isErrEtcdKeyNotFound(err) {
+		t.Fatalf("Expected key not found, got %v", err)
+	}
+}
+
+func TestFileRegistryWatch(t *testing.T) {
+	r, dir := newTestFileRegistry(t)
+	defer os.RemoveAll(dir)
+
+	fakeClock := clockwork.NewFakeClock()
+	clock = fakeClock
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, index, _ := r.getSubnets(ctx, "")
+
+	sn1 := newIP4Net("10.3.1.0", 24)
+	sn2 := newIP4Net("10.3.2.0", 24)
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+
+	r.createSubnet(ctx, "", sn1, attrs, time.Minute)
+	r.createSubnet(ctx, "blue", sn2, attrs, 0)
+	r.createSubnet(ctx, "", sn2, attrs, time.Hour)
+
+	evt, cursor, err := r.watchSubnets(ctx, "", watchCursor{index: index})
+	if err != nil || evt.Type != EventAdded || !evt.Lease.Subnet.Equal(sn1) {
+		t.Fatalf("Unexpected event: %v, %v", evt, err)
+	}
+
+	// skips the event in the blue network
+	evt, cursor, err = r.watchSubnets(ctx, "", cursor)
+	if err != nil || evt.Type != EventAdded || !evt.Lease.Subnet.Equal(sn2) || evt.Network != "" {
+		t.Fatalf("Unexpected event: %v, %v", evt, err)
+	}
+
+	// sn1 expires while being watched
+	errc := make(chan error, 1)
+	go func() {
+		evt, _, err := r.watchSubnet(ctx, "", cursor.index, sn1)
+		if err == nil && (evt.Type != EventRemoved || !evt.Lease.Subnet.Equal(sn1)) {
+			err = fmt.Errorf("unexpected event: %v", evt)
+		}
+		errc <- err
+	}()
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(2 * time.Minute)
+
+	if err := <-errc; err != nil {
+		t.Fatalf("Watch for expiry failed: %v", err)
+	}
+
+	leases, _, _ := r.getSubnets(ctx, "")
+	if len(leases) != 1 || !leases[0].Subnet.Equal(sn2) {
+		t.Fatalf("Unexpected subnets after expiry: %v", leases)
+	}
+
+	// leases without a TTL never expire
+	fakeClock.Advance(100 * time.Hour)
+	leases, _, _ = r.getSubnets(ctx, "blue")
+	if len(leases) != 1 {
+		t.Fatalf("Reservation expired: %v", leases)
+	}
+}
+
+func TestFileRegistryLocalManager(t *testing.T) {
+	r, dir := newTestFileRegistry(t)
+	defer os.RemoveAll(dir)
+
+	sm := newLocalManager(r)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "", nil)
+	if err != nil || len(wr.Snapshot) != 1 || !wr.Snapshot[0].Subnet.Equal(l.Subnet) {
+		t.Fatalf("Unexpected snapshot: %v, %v", wr, err)
+	}
+
+	if err := sm.RenewLease(ctx, "", l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+
+	wr, err = sm.WatchLeases(ctx, "", wr.Cursor)
+	if err != nil || len(wr.Events) != 1 || wr.Events[0].Type != EventAdded {
+		t.Fatalf("Unexpected watch result: %v, %v", wr, err)
+	}
+
+	r1 := Reservation{
+		Subnet:   newIP4Net("10.3.10.0", 24),
+		PublicIP: ip.MustParseIP4("52.195.12.13"),
+	}
+	if err := sm.AddReservation(ctx, "", &r1); err != nil {
+		t.Fatalf("failed to add reservation: %v", err)
+	}
+	rs, err := sm.ListReservations(ctx, "")
+	if err != nil || len(rs) != 1 || !resvEqual(rs[0], r1) {
+		t.Fatalf("Unexpected reservations: %v, %v", rs, err)
+	}
+}
@@ -55,11 +55,11 @@ func watchSubnets(t *testing.T, r Registry, ctx context.Context, sn ip.IP4Net, n
 
 	numFound := 0
 	for {
-		evt, index, err := r.watchSubnets(ctx, "foobar", nextIndex)
+		evt, cursor, err := r.watchSubnets(ctx, "foobar", watchCursor{index: nextIndex})
 
 		switch {
 		case err == nil:
-			nextIndex = index
+			nextIndex = cursor.index
 			for _, exp := range expectedEvents {
 				if evt.Type != exp.etype {
 					continue
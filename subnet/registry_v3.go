@@ -0,0 +1,520 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+type etcdV3NewFunc func(c *EtcdConfig) (etcdV3Client, error)
+
+// etcdV3SubnetRegistry implements Registry on top of the etcd v3 API.
+// Subnet TTLs are backed by v3 leases and indexes handed out to the
+// LocalManager are store revisions. Failures are reported as etcd v2
+// errors so that LocalManager's retry logic works unchanged.
+type etcdV3SubnetRegistry struct {
+	cli          etcdV3Client
+	etcdCfg      *EtcdConfig
+	networkRegex *regexp.Regexp
+
+	mux     sync.Mutex
+	pending map[string][]v3Event
+}
+
+// v3LeaseValue is the value of a subnet key. It has the expiration of the
+// etcd lease the key is attached to, so that listing the subnets does not
+// take a lookup of the TTL of each lease; keys written without it fall
+// back to that.
+type v3LeaseValue struct {
+	LeaseAttrs
+	Expiration *time.Time `json:",omitempty"`
+}
+
+func newEtcdV3SubnetRegistry(config *EtcdConfig, cliNewFunc etcdV3NewFunc) (Registry, error) {
+	r := &etcdV3SubnetRegistry{
+		etcdCfg:      config,
+		networkRegex: regexp.MustCompile(config.Prefix + `/([^/]*)(/|/config)?$`),
+		pending:      make(map[string][]v3Event),
+	}
+
+	if cliNewFunc == nil {
+		cliNewFunc = newEtcdV3Client
+	}
+
+	var err error
+	r.cli, err = cliNewFunc(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func v3Error(code int, rev int64, format string, args ...interface{}) etcd.Error {
+	return etcd.Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Index:   uint64(rev),
+	}
+}
+
+func (r *etcdV3SubnetRegistry) subnetKey(network string, sn ip.IP4Net) string {
+	return path.Join(r.etcdCfg.Prefix, network, "subnets", MakeSubnetKey(sn))
+}
+
+func (r *etcdV3SubnetRegistry) getNetworkConfig(ctx context.Context, network string) (string, error) {
+	key := path.Join(r.etcdCfg.Prefix, network, "config")
+	kvs, rev, err := r.cli.get(ctx, key, false)
+	if err != nil {
+		return "", err
+	}
+	if len(kvs) == 0 {
+		return "", v3Error(etcd.ErrorCodeKeyNotFound, rev, "key not found: %v", key)
+	}
+	return kvs[0].Value, nil
+}
+
+func (r *etcdV3SubnetRegistry) watchNetworkConfig(ctx context.Context, network string, since uint64) (string, uint64, error) {
+	key := path.Join(r.etcdCfg.Prefix, network, "config")
+	if since == 0 {
+		kvs, rev, err := r.cli.get(ctx, key, false)
+		if err != nil {
+			return "", 0, err
+		}
+		if len(kvs) == 0 {
+			return "", 0, v3Error(etcd.ErrorCodeKeyNotFound, rev, "key not found: %v", key)
+		}
+		return kvs[0].Value, uint64(rev), nil
+	}
+
+	e, _, err := r.watch(ctx, key, false, watchCursor{index: since})
+	if err != nil {
+		return "", 0, err
+	}
+
+	if e.Type == v3EventDelete {
+		return "", uint64(e.Kv.ModRevision), nil
+	}
+	return e.Kv.Value, uint64(e.Kv.ModRevision), nil
+}
+
+// expiration looks up the remaining TTL of a v3 lease and converts it into
+// an absolute expiration time. Keys without a lease (reservations) never expire.
+func (r *etcdV3SubnetRegistry) expiration(ctx context.Context, lease int64) (time.Time, error) {
+	if lease == 0 {
+		return time.Time{}, nil
+	}
+
+	ttl, err := r.cli.timeToLive(ctx, lease)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return clock.Now().Add(ttl), nil
+}
+
+func (r *etcdV3SubnetRegistry) kvToLease(ctx context.Context, kv *v3KeyValue) (*Lease, error) {
+	sn := ParseSubnetKey(kv.Key)
+	if sn == nil {
+		return nil, fmt.Errorf("failed to parse subnet key %q", kv.Key)
+	}
+
+	v := &v3LeaseValue{}
+	if err := json.Unmarshal([]byte(kv.Value), v); err != nil {
+		return nil, err
+	}
+
+	exp := time.Time{}
+	switch {
+	case kv.Lease == 0:
+	case v.Expiration != nil:
+		exp = *v.Expiration
+	default:
+		var err error
+		if exp, err = r.expiration(ctx, kv.Lease); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Lease{
+		Subnet:     *sn,
+		Attrs:      v.LeaseAttrs,
+		Expiration: exp,
+		asof:       uint64(kv.ModRevision),
+	}, nil
+}
+
+// getSubnets queries etcd to get a list of currently allocated leases for a given network.
+// It returns the leases along with the store revision that can be used as the starting
+// point for etcd watch.
+func (r *etcdV3SubnetRegistry) getSubnets(ctx context.Context, network string) ([]Lease, uint64, error) {
+	key := path.Join(r.etcdCfg.Prefix, network, "subnets") + "/"
+	kvs, rev, err := r.cli.get(ctx, key, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	leases := []Lease{}
+	for i := range kvs {
+		l, err := r.kvToLease(ctx, &kvs[i])
+		if err != nil {
+			log.Warningf("Ignoring bad subnet node: %v", err)
+			continue
+		}
+
+		leases = append(leases, *l)
+	}
+
+	return leases, uint64(rev), nil
+}
+
+func (r *etcdV3SubnetRegistry) getSubnet(ctx context.Context, network string, sn ip.IP4Net) (*Lease, uint64, error) {
+	key := r.subnetKey(network, sn)
+	kvs, rev, err := r.cli.get(ctx, key, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(kvs) == 0 {
+		return nil, 0, v3Error(etcd.ErrorCodeKeyNotFound, rev, "key not found: %v", key)
+	}
+
+	l, err := r.kvToLease(ctx, &kvs[0])
+	return l, uint64(rev), err
+}
+
+// leaseValue returns the value of a subnet key, with the expiration of its
+// etcd lease unless it has none
+func leaseValue(attrs *LeaseAttrs, exp time.Time) (string, error) {
+	v := &v3LeaseValue{LeaseAttrs: *attrs}
+	if !exp.IsZero() {
+		v.Expiration = &exp
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (r *etcdV3SubnetRegistry) createSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+	key := r.subnetKey(network, sn)
+
+	lease, exp := int64(0), time.Time{}
+	if ttl > 0 {
+		granted := time.Duration(0)
+		var err error
+		if lease, granted, err = r.cli.grant(ctx, ttl); err != nil {
+			return time.Time{}, err
+		}
+		exp = clock.Now().Add(granted)
+	}
+
+	value, err := leaseValue(attrs, exp)
+	if err == nil {
+		var ok bool
+		var rev int64
+		ok, rev, err = r.cli.put(ctx, key, value, lease, &v3Compare{Target: "CREATE", Revision: 0})
+		if err == nil && !ok {
+			err = v3Error(etcd.ErrorCodeNodeExist, rev, "key already exists: %v", key)
+		}
+	}
+	if err != nil {
+		if lease != 0 {
+			r.revokeLease(lease)
+		}
+		return time.Time{}, err
+	}
+
+	return exp, nil
+}
+
+// refreshLease keeps the existing lease alive if it was granted with the
+// requested TTL, otherwise a new lease is granted. It returns the lease to
+// attach to the key and its TTL.
+func (r *etcdV3SubnetRegistry) refreshLease(ctx context.Context, cur int64, ttl time.Duration) (int64, time.Duration, error) {
+	if cur != 0 {
+		left, err := r.cli.keepAliveOnce(ctx, cur)
+		if err != nil {
+			return 0, 0, err
+		}
+		if left == ttl {
+			return cur, left, nil
+		}
+	}
+
+	return r.cli.grant(ctx, ttl)
+}
+
+func (r *etcdV3SubnetRegistry) updateSubnet(ctx context.Context, network string, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+	key := r.subnetKey(network, sn)
+	kvs, _, err := r.cli.get(ctx, key, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	oldLease := int64(0)
+	if len(kvs) > 0 {
+		oldLease = kvs[0].Lease
+	}
+
+	lease, exp := int64(0), time.Time{}
+	if ttl > 0 {
+		granted := time.Duration(0)
+		if lease, granted, err = r.refreshLease(ctx, oldLease, ttl); err != nil {
+			return time.Time{}, err
+		}
+		exp = clock.Now().Add(granted)
+	}
+
+	var cmp *v3Compare
+	if asof != 0 {
+		cmp = &v3Compare{Target: "MOD", Revision: int64(asof)}
+	}
+
+	value, err := leaseValue(attrs, exp)
+	if err == nil {
+		var ok bool
+		var rev int64
+		ok, rev, err = r.cli.put(ctx, key, value, lease, cmp)
+		if err == nil && !ok {
+			err = v3Error(etcd.ErrorCodeTestFailed, rev, "compare failed: [%v != %v]", asof, key)
+		}
+	}
+	if err != nil {
+		if lease != 0 && lease != oldLease {
+			r.revokeLease(lease)
+		}
+		return time.Time{}, err
+	}
+
+	if oldLease != 0 && oldLease != lease {
+		// the key no longer references the old lease
+		r.revokeLease(oldLease)
+	}
+
+	return exp, nil
+}
+
+func (r *etcdV3SubnetRegistry) revokeLease(lease int64) {
+	if err := r.cli.revoke(context.Background(), lease); err != nil {
+		log.Warningf("Failed to revoke etcd lease %x: %v", lease, err)
+	}
+}
+
+func (r *etcdV3SubnetRegistry) deleteSubnet(ctx context.Context, network string, sn ip.IP4Net) error {
+	key := r.subnetKey(network, sn)
+	prev, rev, err := r.cli.delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		return v3Error(etcd.ErrorCodeKeyNotFound, rev, "key not found: %v", key)
+	}
+	if prev.Lease != 0 {
+		r.revokeLease(prev.Lease)
+	}
+	return nil
+}
+
+// watch waits for the first event past since: at a revision newer than
+// since.index or, with since.seen set, after the first seen events at it.
+// Several events can share a revision, as the deletions of the keys of an
+// expired lease do. The other events of the response are kept for the next
+// call from the cursor returned; one from a cursor without them, as of
+// another watcher of the key, fetches them again.
+func (r *etcdV3SubnetRegistry) watch(ctx context.Context, key string, prefix bool, since watchCursor) (*v3Event, watchCursor, error) {
+	qkey := fmt.Sprintf("%v %v %v", key, prefix, since)
+
+	r.mux.Lock()
+	evts, ok := r.pending[qkey]
+	delete(r.pending, qkey)
+	r.mux.Unlock()
+
+	if !ok {
+		var err error
+		if evts, err = r.watchFrom(ctx, key, prefix, since); err != nil {
+			return nil, watchCursor{}, err
+		}
+	}
+
+	e := &evts[0]
+	next := watchCursor{index: uint64(e.Kv.ModRevision), seen: 1}
+	if next.index == since.index {
+		next.seen = since.seen + 1
+	}
+	if len(evts) > 1 {
+		r.mux.Lock()
+		r.pending[fmt.Sprintf("%v %v %v", key, prefix, next)] = evts[1:]
+		r.mux.Unlock()
+	}
+	return e, next, nil
+}
+
+// watchFrom fetches the events past since, skipping those at since.index
+// that were handed out already
+func (r *etcdV3SubnetRegistry) watchFrom(ctx context.Context, key string, prefix bool, since watchCursor) ([]v3Event, error) {
+	rev := int64(since.index) + 1
+	if since.seen > 0 {
+		rev = int64(since.index)
+	}
+
+	for {
+		evts, err := r.cli.watch(ctx, key, prefix, rev)
+		switch {
+		case err == nil:
+
+		case err == errV3Compacted:
+			cur, rerr := r.cli.revision(ctx)
+			if rerr != nil {
+				return nil, rerr
+			}
+			return nil, v3Error(etcd.ErrorCodeEventIndexCleared, cur, "the requested history has been cleared [%v]", since.index)
+
+		default:
+			return nil, err
+		}
+
+		seen := 0
+		for seen < len(evts) && seen < since.seen && evts[seen].Kv.ModRevision == int64(since.index) {
+			seen++
+		}
+		if evts = evts[seen:]; len(evts) > 0 {
+			return evts, nil
+		}
+		// all the events at since.index were handed out already
+		rev = int64(since.index) + 1
+	}
+}
+
+func (r *etcdV3SubnetRegistry) watchSubnets(ctx context.Context, network string, since watchCursor) (Event, watchCursor, error) {
+	key := path.Join(r.etcdCfg.Prefix, network, "subnets") + "/"
+	e, next, err := r.watch(ctx, key, true, since)
+	if err != nil {
+		return Event{}, watchCursor{}, err
+	}
+
+	evt, err := r.parseSubnetWatchEvent(ctx, e)
+	return evt, next, err
+}
+
+func (r *etcdV3SubnetRegistry) watchSubnet(ctx context.Context, network string, since uint64, sn ip.IP4Net) (Event, uint64, error) {
+	e, _, err := r.watch(ctx, r.subnetKey(network, sn), false, watchCursor{index: since})
+	if err != nil {
+		return Event{}, 0, err
+	}
+
+	evt, err := r.parseSubnetWatchEvent(ctx, e)
+	return evt, uint64(e.Kv.ModRevision), err
+}
+
+// getNetworks queries etcd to get a list of network names.  It returns the
+// networks along with the store revision that can be used as the starting
+// point for etcd watch.
+func (r *etcdV3SubnetRegistry) getNetworks(ctx context.Context) ([]string, uint64, error) {
+	kvs, rev, err := r.cli.get(ctx, r.etcdCfg.Prefix+"/", true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	networks := []string{}
+	for _, kv := range kvs {
+		netname, isConfig := r.parseNetworkKey(kv.Key)
+		if isConfig {
+			networks = append(networks, netname)
+		}
+	}
+
+	return networks, uint64(rev), nil
+}
+
+func (r *etcdV3SubnetRegistry) watchNetworks(ctx context.Context, since watchCursor) (Event, watchCursor, error) {
+	e, next, err := r.watch(ctx, r.etcdCfg.Prefix+"/", true, since)
+	if err != nil {
+		return Event{}, watchCursor{}, err
+	}
+
+	evt, err := r.parseNetworkWatchEvent(e)
+	return evt, next, err
+}
+
+func (r *etcdV3SubnetRegistry) parseSubnetWatchEvent(ctx context.Context, e *v3Event) (Event, error) {
+	sn := ParseSubnetKey(e.Kv.Key)
+	if sn == nil {
+		return Event{}, fmt.Errorf("%q: not a subnet, skipping", e.Kv.Key)
+	}
+
+	if e.Type == v3EventDelete {
+		return Event{
+			EventRemoved,
+			Lease{Subnet: *sn},
+			"",
+		}, nil
+	}
+
+	l, err := r.kvToLease(ctx, &e.Kv)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		EventAdded,
+		*l,
+		"",
+	}, nil
+}
+
+func (r *etcdV3SubnetRegistry) parseNetworkWatchEvent(e *v3Event) (Event, error) {
+	netname, isConfig := r.parseNetworkKey(e.Kv.Key)
+	if netname == "" || !isConfig {
+		// v3 has no directories: only .../<netname>/config keys define
+		// a network; tell caller to try again on anything else
+		return Event{}, errTryAgain
+	}
+
+	if e.Type == v3EventDelete {
+		return Event{
+			EventRemoved,
+			Lease{},
+			netname,
+		}, nil
+	}
+
+	if _, err := ParseConfig(e.Kv.Value); err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		EventAdded,
+		Lease{},
+		netname,
+	}, nil
+}
+
+// Returns network name from config key (eg, /coreos.com/network/foobar/config),
+// if the 'config' key isn't present we don't consider the network valid
+func (r *etcdV3SubnetRegistry) parseNetworkKey(s string) (string, bool) {
+	if parts := r.networkRegex.FindStringSubmatch(s); len(parts) == 3 {
+		return parts[1], parts[2] == "/config"
+	}
+
+	return "", false
+}
@@ -0,0 +1,539 @@
+// Copyright 2016 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func newTestEtcdV3Registry(t *testing.T) (Registry, *mockEtcdV3) {
+	cfg := &EtcdConfig{
+		Endpoints: []string{"http://127.0.0.1:2379"},
+		Prefix:    "/coreos.com/network",
+	}
+
+	m := newMockEtcdV3()
+	r, err := newEtcdV3SubnetRegistry(cfg, func(c *EtcdConfig) (etcdV3Client, error) {
+		return m, nil
+	})
+	if err != nil {
+		t.Fatal("Failed to create etcd v3 subnet registry")
+	}
+
+	return r, m
+}
+
+func TestEtcdV3Registry(t *testing.T) {
+	r, m := newTestEtcdV3Registry(t)
+	ctx := context.Background()
+
+	networks, _, err := r.getNetworks(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get networks: %v", err)
+	}
+	if len(networks) != 0 {
+		t.Fatal("Networks should be empty")
+	}
+
+	netValue := `{ "Network": "10.1.0.0/16", "Backend": { "Type": "host-gw" } }`
+	m.put(ctx, "/coreos.com/network/foobar/config", netValue, 0, nil)
+
+	networks, index, err := r.getNetworks(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get networks the second time: %v", err)
+	}
+	if len(networks) != 1 || networks[0] != "foobar" {
+		t.Fatalf("Failed to find expected network foobar: %v", networks)
+	}
+
+	config, err := r.getNetworkConfig(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("Failed to get network config: %v", err)
+	}
+	if config != netValue {
+		t.Fatal("Failed to match network config")
+	}
+
+	sn := newIP4Net("10.1.5.0", 24)
+	attrs := &LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+
+	exp, err := r.createSubnet(ctx, "foobar", sn, attrs, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create subnet lease: %v", err)
+	}
+	if !exp.After(time.Now()) {
+		t.Fatalf("Subnet lease expiration %v not in the future", exp)
+	}
+
+	// The subnet key must be attached to a v3 lease
+	kvs, _, _ := m.get(ctx, "/coreos.com/network/foobar/subnets/10.1.5.0-24", false)
+	if len(kvs) != 1 {
+		t.Fatal("Failed to verify subnet lease directly in etcd")
+	}
+	if kvs[0].Lease == 0 {
+		t.Fatal("Subnet lease is not attached to an etcd lease")
+	}
+	v := &v3LeaseValue{}
+	if err := json.Unmarshal([]byte(kvs[0].Value), v); err != nil || v.PublicIP != attrs.PublicIP || v.Expiration == nil || !v.Expiration.Equal(exp) {
+		t.Fatalf("Unexpected subnet lease value %s", kvs[0].Value)
+	}
+
+	// Creating the same subnet again must fail like etcd v2 PrevNoExist
+	_, err = r.createSubnet(ctx, "foobar", sn, attrs, 24*time.Hour)
+	if etcdErr, ok := err.(etcd.Error); !ok || etcdErr.Code != etcd.ErrorCodeNodeExist {
+		t.Fatalf("Creating an existing subnet returned: %v", err)
+	}
+
+	lease, _, err := r.getSubnet(ctx, "foobar", sn)
+	if err != nil {
+		t.Fatalf("Failed to get subnet: %v", err)
+	}
+	if lease.Expiration.IsZero() {
+		t.Fatal("Subnet lease has no expiration")
+	}
+
+	// An update with a stale index must fail like etcd v2 PrevIndex
+	_, err = r.updateSubnet(ctx, "foobar", sn, attrs, 24*time.Hour, lease.asof-1)
+	if !isErrEtcdTestFailed(err) {
+		t.Fatalf("Stale update returned: %v", err)
+	}
+
+	// Renewal keeps the same v3 lease
+	if _, err = r.updateSubnet(ctx, "foobar", sn, attrs, 24*time.Hour, lease.asof); err != nil {
+		t.Fatalf("Failed to update subnet: %v", err)
+	}
+	kvs2, _, _ := m.get(ctx, "/coreos.com/network/foobar/subnets/10.1.5.0-24", false)
+	if kvs2[0].Lease != kvs[0].Lease {
+		t.Fatalf("Renewal replaced the etcd lease: %x vs %x", kvs2[0].Lease, kvs[0].Lease)
+	}
+
+	// Removing the TTL turns it into a reservation
+	exp, err = r.updateSubnet(ctx, "foobar", sn, attrs, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to update subnet: %v", err)
+	}
+	if !exp.IsZero() {
+		t.Fatal("Reservation has an expiration")
+	}
+
+	leases, _, err := r.getSubnets(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("Failed to get subnets: %v", err)
+	}
+	if len(leases) != 1 || !leases[0].Subnet.Equal(sn) || !leases[0].Expiration.IsZero() {
+		t.Fatalf("Unexpected leases: %v", leases)
+	}
+
+	// Watch from the revision of the initial getNetworks
+	evt, _, err := r.watchSubnets(ctx, "foobar", watchCursor{index: index})
+	if err != nil {
+		t.Fatalf("Failed to watch subnets: %v", err)
+	}
+	if evt.Type != EventAdded || !evt.Lease.Subnet.Equal(sn) {
+		t.Fatalf("Unexpected subnet event: %v", evt)
+	}
+
+	if err = r.deleteSubnet(ctx, "foobar", sn); err != nil {
+		t.Fatalf("Failed to delete subnet %v: %v", sn, err)
+	}
+	if err = r.deleteSubnet(ctx, "foobar", sn); !isErrEtcdKeyNotFound(err) {
+		t.Fatalf("Deleting a missing subnet returned: %v", err)
+	}
+}
+
+func TestEtcdV3WatchLeaseExpiry(t *testing.T) {
+	r, m := newTestEtcdV3Registry(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m.put(ctx, "/coreos.com/network/foobar/config", `{ "Network": "10.1.0.0/16" }`, 0, nil)
+
+	_, index, err := r.getSubnets(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("Failed to get subnets: %v", err)
+	}
+
+	sn := newIP4Net("10.1.7.0", 24)
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	if _, err := r.createSubnet(ctx, "foobar", sn, attrs, time.Minute); err != nil {
+		t.Fatalf("Failed to create subnet: %v", err)
+	}
+
+	evt, index, err := r.watchSubnet(ctx, "foobar", index, sn)
+	if err != nil || evt.Type != EventAdded {
+		t.Fatalf("Unexpected watch result: %v, %v", evt, err)
+	}
+
+	kvs, _, _ := m.get(ctx, "/coreos.com/network/foobar/subnets/10.1.7.0-24", false)
+	m.expireLease(kvs[0].Lease)
+
+	evt, _, err = r.watchSubnets(ctx, "foobar", watchCursor{index: index})
+	if err != nil {
+		t.Fatalf("Failed to watch subnets: %v", err)
+	}
+	if evt.Type != EventRemoved || !evt.Lease.Subnet.Equal(sn) {
+		t.Fatalf("Expected removal of %v, got %v", sn, evt)
+	}
+
+	m.compact(int64(index) + 1)
+	if _, _, err = r.watchSubnets(ctx, "foobar", watchCursor{index: index}); !isIndexTooSmall(err) {
+		t.Fatalf("Watch from compacted revision returned: %v", err)
+	}
+}
+
+func TestEtcdV3WatchNetworks(t *testing.T) {
+	r, m := newTestEtcdV3Registry(t)
+	ctx := context.Background()
+
+	_, index, err := r.getNetworks(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get networks: %v", err)
+	}
+
+	m.put(ctx, "/coreos.com/network/blue/subnets/10.1.2.0-24", `{"PublicIP":"1.2.3.4"}`, 0, nil)
+	m.put(ctx, "/coreos.com/network/blue/config", `{ "Network": "10.1.0.0/16" }`, 0, nil)
+	m.delete(ctx, "/coreos.com/network/blue/config")
+
+	_, cursor, err := r.watchNetworks(ctx, watchCursor{index: index})
+	if err != errTryAgain {
+		t.Fatalf("Watch of a non-config key returned: %v", err)
+	}
+
+	evt, cursor, err := r.watchNetworks(ctx, cursor)
+	if err != nil || evt.Type != EventAdded || evt.Network != "blue" {
+		t.Fatalf("Unexpected network event: %v, %v", evt, err)
+	}
+
+	evt, _, err = r.watchNetworks(ctx, cursor)
+	if err != nil || evt.Type != EventRemoved || evt.Network != "blue" {
+		t.Fatalf("Unexpected network event: %v, %v", evt, err)
+	}
+}
+
+func TestEtcdV3LocalManager(t *testing.T) {
+	r, m := newTestEtcdV3Registry(t)
+	sm := newLocalManager(r)
+	ctx := context.Background()
+
+	m.put(ctx, "/coreos.com/network/config", `{ "Network": "10.3.0.0/16" }`, 0, nil)
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	l2, err := sm.AcquireLease(ctx, "", attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if !l.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("AcquireLease did not reuse subnet; expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+
+	if err := sm.RenewLease(ctx, "", l2); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+
+	r1 := Reservation{
+		Subnet:   newIP4Net("10.3.10.0", 24),
+		PublicIP: ip.MustParseIP4("52.195.12.13"),
+	}
+	if err := sm.AddReservation(ctx, "", &r1); err != nil {
+		t.Fatalf("failed to add reservation: %v", err)
+	}
+	rs, err := sm.ListReservations(ctx, "")
+	if err != nil || len(rs) != 1 || !resvEqual(rs[0], r1) {
+		t.Fatalf("Unexpected reservations: %v, %v", rs, err)
+	}
+}
+
+func TestMigrateV2ToV3(t *testing.T) {
+	v2 := newMockEtcd()
+	v3 := newMockEtcdV3()
+	ctx := context.Background()
+
+	v2.Create(ctx, "/coreos.com/network/foobar/config", `{ "Network": "10.1.0.0/16" }`)
+	v2.Set(ctx, "/coreos.com/network/foobar/subnets/10.1.5.0-24", `{"PublicIP":"1.2.3.4"}`, &etcd.SetOptions{TTL: time.Hour})
+
+	// already present in v3: must not be overwritten
+	v3.put(ctx, "/coreos.com/network/foobar/subnets/10.1.6.0-24", "v3", 0, nil)
+	v2.Set(ctx, "/coreos.com/network/foobar/subnets/10.1.6.0-24", `{"PublicIP":"1.2.3.5"}`, &etcd.SetOptions{TTL: time.Hour})
+
+	n, err := migrateV2ToV3(ctx, v2, v3, "/coreos.com/network")
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("Unexpected number of migrated keys: %d (expected 2)", n)
+	}
+
+	kvs, _, _ := v3.get(ctx, "/coreos.com/network/foobar/config", false)
+	if len(kvs) != 1 || kvs[0].Lease != 0 {
+		t.Fatalf("Config not migrated: %v", kvs)
+	}
+
+	kvs, _, _ = v3.get(ctx, "/coreos.com/network/foobar/subnets/10.1.5.0-24", false)
+	if len(kvs) != 1 || kvs[0].Lease == 0 {
+		t.Fatalf("Subnet lease not migrated: %v", kvs)
+	}
+
+	kvs, _, _ = v3.get(ctx, "/coreos.com/network/foobar/subnets/10.1.6.0-24", false)
+	if len(kvs) != 1 || kvs[0].Value != "v3" {
+		t.Fatalf("Existing v3 key overwritten: %v", kvs)
+	}
+
+	// re-running is a no-op
+	if n, err = migrateV2ToV3(ctx, v2, v3, "/coreos.com/network"); err != nil || n != 0 {
+		t.Fatalf("Second migration copied %d keys: %v", n, err)
+	}
+}
+
+func TestEtcdV3GatewayClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			req := map[string]interface{}{}
+			json.Unmarshal(body, &req)
+			// "/a/" base64 encoded and its prefix end "/a0"
+			if req["key"] != "L2Ev" || req["range_end"] != "L2Ew" {
+				t.Errorf("Unexpected range request: %s", body)
+			}
+			w.Write([]byte(`{"header":{"revision":"42"},"kvs":[{"key":"L2EveA==","value":"eQ==","create_revision":"40","mod_revision":"41","lease":"7"}]}`))
+
+		case "/v3/kv/txn":
+			w.Write([]byte(`{"header":{"revision":"43"}}`))
+
+		case "/v3/watch":
+			w.Write([]byte(`{"result":{"header":{"revision":"43"},"created":true}}` + "\n"))
+			w.Write([]byte(`{"result":{"header":{"revision":"44"},"events":[{"type":"DELETE","kv":{"key":"L2EveA==","mod_revision":"44"}}]}}` + "\n"))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found","code":5}`))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := newEtcdV3Client(&EtcdConfig{Endpoints: []string{ts.URL}})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	ctx := context.Background()
+
+	kvs, rev, err := c.get(ctx, "/a/", true)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if rev != 42 || len(kvs) != 1 {
+		t.Fatalf("Unexpected get result: %v @ %v", kvs, rev)
+	}
+	expected := v3KeyValue{Key: "/a/x", Value: "y", CreateRevision: 40, ModRevision: 41, Lease: 7}
+	if kvs[0] != expected {
+		t.Fatalf("Unexpected key value: %#v", kvs[0])
+	}
+
+	ok, _, err := c.put(ctx, "/a/x", "z", 0, &v3Compare{Target: "MOD", Revision: 41})
+	if err != nil || ok {
+		t.Fatalf("Expected failed compare, got %v, %v", ok, err)
+	}
+
+	evts, err := c.watch(ctx, "/a/", true, 43)
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+	if len(evts) != 1 || evts[0].Type != v3EventDelete || evts[0].Kv.ModRevision != 44 {
+		t.Fatalf("Unexpected watch events: %v", evts)
+	}
+
+	if err := c.revoke(ctx, 7); err == nil {
+		t.Fatal("Expected revoke against missing endpoint to fail")
+	}
+}
+
+func TestEtcdV3WatchSameRevision(t *testing.T) {
+	r, m := newTestEtcdV3Registry(t)
+	ctx := context.Background()
+
+	m.put(ctx, "/coreos.com/network/foobar/config", `{ "Network": "10.1.0.0/16" }`, 0, nil)
+
+	lease, _, _ := m.grant(ctx, time.Minute)
+	subnets := []string{"10.1.7.0-24", "10.1.8.0-24", "10.1.9.0-24"}
+	for _, sn := range subnets {
+		m.put(ctx, "/coreos.com/network/foobar/subnets/"+sn, `{"PublicIP":"1.2.3.4"}`, lease, nil)
+	}
+
+	_, index, err := r.getSubnets(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("Failed to get subnets: %v", err)
+	}
+
+	// the keys of the lease are deleted in a single revision
+	m.expireLease(lease)
+
+	cursor := watchCursor{index: index}
+	removed := make(map[string]bool)
+	for range subnets {
+		var evt Event
+		evt, cursor, err = r.watchSubnets(ctx, "foobar", cursor)
+		if err != nil {
+			t.Fatalf("Failed to watch subnets: %v", err)
+		}
+		if evt.Type != EventRemoved {
+			t.Fatalf("Expected a removal, got %v", evt)
+		}
+		removed[MakeSubnetKey(evt.Lease.Subnet)] = true
+	}
+	for _, sn := range subnets {
+		if !removed[sn] {
+			t.Errorf("Removal of %v was not reported", sn)
+		}
+	}
+
+	m.put(ctx, "/coreos.com/network/foobar/subnets/10.1.10.0-24", `{"PublicIP":"1.2.3.5"}`, 0, nil)
+	evt, _, err := r.watchSubnets(ctx, "foobar", cursor)
+	if err != nil || evt.Type != EventAdded || !evt.Lease.Subnet.Equal(newIP4Net("10.1.10.0", 24)) {
+		t.Fatalf("Unexpected watch result: %v, %v", evt, err)
+	}
+}
+
+func TestEtcdV3WatchSameRevisionTwoWatchers(t *testing.T) {
+	r, m := newTestEtcdV3Registry(t)
+	ctx := context.Background()
+
+	m.put(ctx, "/coreos.com/network/foobar/config", `{ "Network": "10.1.0.0/16" }`, 0, nil)
+
+	lease, _, _ := m.grant(ctx, time.Minute)
+	subnets := []string{"10.1.7.0-24", "10.1.8.0-24", "10.1.9.0-24"}
+	for _, sn := range subnets {
+		m.put(ctx, "/coreos.com/network/foobar/subnets/"+sn, `{"PublicIP":"1.2.3.4"}`, lease, nil)
+	}
+
+	_, index, err := r.getSubnets(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("Failed to get subnets: %v", err)
+	}
+	m.expireLease(lease)
+
+	// both watchers get all the events of the revision, whichever comes
+	// first; the second one passes its cursor as a string like the
+	// RemoteManager does
+	cursors := []watchCursor{{index: index}, {index: index}}
+	removed := []map[string]bool{{}, {}}
+	for range subnets {
+		for i := range cursors {
+			since, err := getWatchCursor(cursors[i].String())
+			if err != nil || since != cursors[i] {
+				t.Fatalf("Cursor %v parsed as %v, %v", cursors[i], since, err)
+			}
+
+			var evt Event
+			evt, cursors[i], err = r.watchSubnets(ctx, "foobar", since)
+			if err != nil || evt.Type != EventRemoved {
+				t.Fatalf("Unexpected watch result of watcher %d: %v, %v", i, evt, err)
+			}
+			removed[i][MakeSubnetKey(evt.Lease.Subnet)] = true
+		}
+	}
+	for i := range cursors {
+		for _, sn := range subnets {
+			if !removed[i][sn] {
+				t.Errorf("Removal of %v was not reported to watcher %d", sn, i)
+			}
+		}
+	}
+
+	// a watcher continuing from the middle of the revision fetches the
+	// rest again
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	cursor := watchCursor{index: cursors[0].index, seen: 2}
+	evt, cursor, err := r.watchSubnets(ctx, "foobar", cursor)
+	if err != nil || evt.Type != EventRemoved || cursor.seen != 3 {
+		t.Fatalf("Unexpected watch result: %v, %v, %v", evt, cursor, err)
+	}
+	if _, _, err = r.watchSubnets(ctx, "foobar", cursor); err != context.DeadlineExceeded {
+		t.Fatalf("Watch past all the events returned: %v", err)
+	}
+}
+
+// ttlCountingEtcdV3 counts the lookups of lease TTLs
+type ttlCountingEtcdV3 struct {
+	*mockEtcdV3
+	lookups int
+}
+
+func (c *ttlCountingEtcdV3) timeToLive(ctx context.Context, id int64) (time.Duration, error) {
+	c.lookups++
+	return c.mockEtcdV3.timeToLive(ctx, id)
+}
+
+func TestEtcdV3GetSubnetsExpiration(t *testing.T) {
+	cfg := &EtcdConfig{
+		Endpoints: []string{"http://127.0.0.1:2379"},
+		Prefix:    "/coreos.com/network",
+	}
+	m := &ttlCountingEtcdV3{mockEtcdV3: newMockEtcdV3()}
+	r, err := newEtcdV3SubnetRegistry(cfg, func(c *EtcdConfig) (etcdV3Client, error) {
+		return m, nil
+	})
+	if err != nil {
+		t.Fatal("Failed to create etcd v3 subnet registry")
+	}
+	ctx := context.Background()
+
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	for _, sn := range []string{"10.1.7.0", "10.1.8.0", "10.1.9.0"} {
+		if _, err := r.createSubnet(ctx, "foobar", newIP4Net(sn, 24), attrs, time.Hour); err != nil {
+			t.Fatalf("Failed to create subnet %v: %v", sn, err)
+		}
+	}
+
+	// the expiration is in the value
+	leases, _, err := r.getSubnets(ctx, "foobar")
+	if err != nil || len(leases) != 3 {
+		t.Fatalf("Unexpected subnets: %v, %v", leases, err)
+	}
+	for _, l := range leases {
+		if l.Expiration.IsZero() {
+			t.Errorf("Lease of %v has no expiration", l.Subnet)
+		}
+	}
+	if m.lookups != 0 {
+		t.Errorf("Getting the subnets looked up %d TTLs", m.lookups)
+	}
+
+	// keys written without it have it looked up
+	lease, _, _ := m.grant(ctx, time.Hour)
+	m.put(ctx, "/coreos.com/network/foobar/subnets/10.1.10.0-24", `{"PublicIP":"1.2.3.5"}`, lease, nil)
+	l, _, err := r.getSubnet(ctx, "foobar", newIP4Net("10.1.10.0", 24))
+	if err != nil || l.Expiration.IsZero() || m.lookups != 1 {
+		t.Fatalf("Unexpected subnet: %v, %v, %d TTL lookups", l, err, m.lookups)
+	}
+}
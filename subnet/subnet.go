@@ -27,18 +27,27 @@ import (
 )
 
 var (
-	ErrLeaseTaken  = errors.New("subnet: lease already taken")
-	ErrNoMoreTries = errors.New("subnet: no more tries")
+	ErrLeaseTaken    = errors.New("subnet: lease already taken")
+	ErrNoMoreTries   = errors.New("subnet: no more tries")
+	ErrLeaseExcluded = errors.New("subnet: lease is in an excluded subnet")
 )
 
 type LeaseAttrs struct {
 	PublicIP    ip.IP4
+	PublicIPv6  *ip.IP6         `json:",omitempty"`
 	BackendType string          `json:",omitempty"`
 	BackendData json.RawMessage `json:",omitempty"`
+	// SubnetLen is the prefix length of the subnet the host asks for,
+	// 0 for the network's SubnetLen
+	SubnetLen uint `json:",omitempty"`
+	// NodeID identifies the host across changes of its PublicIP
+	NodeID string `json:",omitempty"`
 }
 
 type Lease struct {
-	Subnet     ip.IP4Net
+	Subnet ip.IP4Net
+	// IPv6Subnet is only set in dual-stack networks
+	IPv6Subnet ip.IP6Net
 	Attrs      LeaseAttrs
 	Expiration time.Time
 
@@ -49,9 +58,21 @@ func (l *Lease) Key() string {
 	return MakeSubnetKey(l.Subnet)
 }
 
+// A Reservation is for the host with NodeID or, if that is empty, the
+// host with PublicIP
 type Reservation struct {
 	Subnet   ip.IP4Net
 	PublicIP ip.IP4
+	NodeID   string `json:",omitempty"`
+}
+
+// isFor returns true if the reservation is for the host with the given
+// lease attributes
+func (r *Reservation) isFor(attrs *LeaseAttrs) bool {
+	if r.NodeID != "" {
+		return attrs.NodeID == r.NodeID
+	}
+	return attrs.PublicIP == r.PublicIP
 }
 
 type (
@@ -87,6 +108,13 @@ type NetworkWatchResult struct {
 	Cursor   interface{} `json:"cursor,omitempty"`
 }
 
+// ConfigWatchResult holds the config of a network after a change or, if the
+// watch was started without a cursor, the current one.
+type ConfigWatchResult struct {
+	Config *Config
+	Cursor interface{}
+}
+
 func (et EventType) MarshalJSON() ([]byte, error) {
 	s := ""
 
@@ -139,6 +167,7 @@ type Manager interface {
 	WatchLease(ctx context.Context, network string, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error)
 	WatchLeases(ctx context.Context, network string, cursor interface{}) (LeaseWatchResult, error)
 	WatchNetworks(ctx context.Context, cursor interface{}) (NetworkWatchResult, error)
+	WatchNetworkConfig(ctx context.Context, network string, cursor interface{}) (ConfigWatchResult, error)
 
 	AddReservation(ctx context.Context, network string, r *Reservation) error
 	RemoveReservation(ctx context.Context, network string, subnet ip.IP4Net) error
@@ -36,13 +36,13 @@ func newDummyRegistry() *MockSubnetRegistry {
 
 	subnets := []Lease{
 		// leases within SubnetMin-SubnetMax range
-		{ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, attrs, exp, 10},
-		{ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, attrs, exp, 11},
-		{ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, attrs, exp, 12},
-		{ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, attrs, exp, 13},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, Attrs: attrs, Expiration: exp, asof: 10},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, Attrs: attrs, Expiration: exp, asof: 11},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, Attrs: attrs, Expiration: exp, asof: 12},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, Attrs: attrs, Expiration: exp, asof: 13},
 
 		// hand created lease outside the range of subnetMin-SubnetMax for testing removal
-		{ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, attrs, exp, 13},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, Attrs: attrs, Expiration: exp, asof: 13},
 	}
 
 	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
@@ -98,7 +98,7 @@ func TestConfigChanged(t *testing.T) {
 
 	// Change config
 	config := `{ "Network": "10.4.0.0/16" }`
-	msr.setConfig("_", config)
+	msr.SetConfig("_", config)
 
 	// Acquire again, should not reuse
 	if l, err = sm.AcquireLease(context.Background(), "_", &attrs); err != nil {
@@ -548,5 +548,347 @@ func inAllocatableRange(ctx context.Context, sm Manager, ipn ip.IP4Net) bool {
 }
 
 func resvEqual(r1, r2 Reservation) bool {
-	return r1.Subnet.Equal(r2.Subnet) && r1.PublicIP == r2.PublicIP
+	return r1.Subnet.Equal(r2.Subnet) && r1.PublicIP == r2.PublicIP && r1.NodeID == r2.NodeID
+}
+
+func TestWatchLeasesIPv6(t *testing.T) {
+	config := `{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/48" }`
+	msr := NewMockRegistry("_", config, nil)
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+
+	cfg, _ := ParseConfig(config)
+	if l.IPv6Subnet.Empty() || !l.IPv6Subnet.Equal(cfg.IPv6SubnetFor(l.Subnet)) {
+		t.Fatalf("Unexpected IPv6 subnet %v for %v", l.IPv6Subnet, l.Subnet)
+	}
+
+	wr, err := sm.WatchLeases(ctx, "_", nil)
+	if err != nil {
+		t.Fatal("WatchLeases failed: ", err)
+	}
+	if len(wr.Snapshot) != 1 || !wr.Snapshot[0].IPv6Subnet.Equal(l.IPv6Subnet) {
+		t.Fatalf("Unexpected snapshot: %v", wr.Snapshot)
+	}
+}
+
+func TestAcquireLeaseSubnetLen(t *testing.T) {
+	config := `{ "Network": "10.3.0.0/16", "MinSubnetLen": 22, "MaxSubnetLen": 28, "AllocationStrategy": "sequential" }`
+	msr := NewMockRegistry("_", config, nil)
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var leases []*Lease
+	for i, prefixLen := range []uint{0, 22, 26, 28, 24} {
+		attrs := &LeaseAttrs{
+			PublicIP:  ip.IP4(ip.MustParseIP4("1.2.3.0") + ip.IP4(i)),
+			SubnetLen: prefixLen,
+		}
+		l, err := sm.AcquireLease(ctx, "_", attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease of /%d failed: %v", prefixLen, err)
+		}
+		if prefixLen == 0 {
+			prefixLen = 24
+		}
+		if l.Subnet.PrefixLen != prefixLen {
+			t.Fatalf("expected a /%d, got %v", prefixLen, l.Subnet)
+		}
+		for _, other := range leases {
+			if other.Subnet.Overlaps(l.Subnet) {
+				t.Fatalf("%v overlaps %v", l.Subnet, other.Subnet)
+			}
+		}
+		leases = append(leases, l)
+	}
+
+	// out of range
+	if _, err := sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.4.0"), SubnetLen: 30}); err == nil {
+		t.Fatalf("AcquireLease of a /30 unexpectedly succeeded")
+	}
+
+	// asking for another size replaces the lease
+	attrs := leases[1].Attrs
+	attrs.SubnetLen = 27
+	l, err := sm.AcquireLease(ctx, "_", &attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.PrefixLen != 27 {
+		t.Fatalf("expected a /27, got %v", l.Subnet)
+	}
+	if _, _, err := msr.getSubnet(ctx, "_", leases[1].Subnet); err == nil {
+		t.Fatalf("old lease %v was not removed: %v", leases[1].Subnet, err)
+	}
+
+	// reservations of other sizes than SubnetLen are fine, as long as
+	// they do not overlap another subnet
+	r := Reservation{
+		Subnet:   leases[0].Subnet,
+		PublicIP: ip.MustParseIP4("52.195.12.13"),
+	}
+	r.Subnet.PrefixLen = 22
+	r.Subnet = r.Subnet.Network()
+	if err := sm.AddReservation(ctx, "_", &r); err != ErrLeaseTaken {
+		t.Fatalf("overlapping reservation returned: %v", err)
+	}
+
+	r.Subnet = newIP4Net("10.3.252.0", 22)
+	if err := sm.AddReservation(ctx, "_", &r); err != nil {
+		t.Fatalf("failed to add reservation: %v", err)
+	}
+}
+
+func TestAcquireLeaseNetworks(t *testing.T) {
+	config := `{ "Networks": ["10.3.0.0/22", "10.5.0.0/23"] }`
+	msr := NewMockRegistry("_", config, nil)
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 3 subnets in the first block and 1 in the second
+	var subnets []ip.IP4Net
+	for i := 0; i < 4; i++ {
+		l, err := sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.0") + ip.IP4(i)})
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		subnets = append(subnets, l.Subnet)
+	}
+
+	if n := subnets[3]; !n.Equal(newIP4Net("10.5.1.0", 24)) {
+		t.Fatalf("allocation did not spill into the second block: %v", subnets)
+	}
+
+	if _, err := sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.4.0")}); err == nil {
+		t.Fatalf("AcquireLease in a full network unexpectedly succeeded")
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	msr := NewMockRegistry("_", `{ "Network": "10.3.0.0/16", "LeaseTTL": "10m", "RenewMargin": "2m" }`, nil)
+	sm := NewMockManager(msr)
+	now := time.Now()
+	fakeClock := clockwork.NewFakeClockAt(now)
+	clock = fakeClock
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if expected := now.Add(10 * time.Minute); !l.Expiration.Equal(expected) {
+		t.Errorf("bad expiration; expected %v, got %v", expected, l.Expiration)
+	}
+
+	fakeClock.Advance(8 * time.Minute)
+	if err := sm.RenewLease(ctx, "_", l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if expected := now.Add(18 * time.Minute); !l.Expiration.Equal(expected) {
+		t.Errorf("bad expiration after renewal; expected %v, got %v", expected, l.Expiration)
+	}
+}
+
+func TestExcludedLease(t *testing.T) {
+	attrs := LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	subnets := []Lease{
+		{Subnet: newIP4Net("10.3.5.0", 24), Attrs: attrs, Expiration: time.Now().Add(time.Hour)},
+	}
+	msr := NewMockRegistry("_", `{ "Network": "10.3.0.0/16", "ExcludeSubnets": ["10.3.4.0/22"] }`, subnets)
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the lease is only reported
+	l, err := sm.AcquireLease(ctx, "_", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(subnets[0].Subnet) {
+		t.Fatalf("existing lease not reused: got %v", l.Subnet)
+	}
+	if err := sm.RenewLease(ctx, "_", l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+
+	// and given up on renewal with MigrateExcludedLeases
+	config := `{ "Network": "10.3.0.0/16", "ExcludeSubnets": ["10.3.4.0/22"], "MigrateExcludedLeases": true }`
+	msr.SetConfig("_", config)
+	if err := sm.RenewLease(ctx, "_", l); err != ErrLeaseExcluded {
+		t.Fatalf("RenewLease of an excluded lease returned %v", err)
+	}
+	if _, _, err := msr.getSubnet(ctx, "_", l.Subnet); err == nil {
+		t.Fatalf("excluded lease %v was not removed", l.Subnet)
+	}
+
+	l, err = sm.AcquireLease(ctx, "_", &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	cfg, _ := ParseConfig(config)
+	if ex, ok := cfg.excludedBy(l.Subnet); ok {
+		t.Fatalf("acquired subnet %v overlaps excluded %v", l.Subnet, ex)
+	}
+
+	r := Reservation{Subnet: newIP4Net("10.3.6.0", 24), PublicIP: ip.MustParseIP4("52.195.12.13")}
+	if err := sm.AddReservation(ctx, "_", &r); err == nil {
+		t.Fatalf("reservation of an excluded subnet unexpectedly succeeded")
+	}
+}
+
+func TestAcquireLeaseNodeID(t *testing.T) {
+	subnets := []Lease{
+		{Subnet: newIP4Net("10.3.5.0", 24), Attrs: LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-a"}, Expiration: time.Now().Add(time.Hour)},
+	}
+	msr := NewMockRegistry("_", `{ "Network": "10.3.0.0/16" }`, subnets)
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a node whose IP changed gets its lease back, updated in place
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5"), NodeID: "node-a"}
+	l, err := sm.AcquireLease(ctx, "_", attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(subnets[0].Subnet) {
+		t.Fatalf("lease not reused by node ID: expected %v, got %v", subnets[0].Subnet, l.Subnet)
+	}
+	sub, _, err := msr.getSubnet(ctx, "_", l.Subnet)
+	if err != nil {
+		t.Fatal("getSubnet failed: ", err)
+	}
+	if sub.Attrs.PublicIP != attrs.PublicIP {
+		t.Errorf("public IP of the lease not updated: %v", sub.Attrs.PublicIP)
+	}
+
+	// another node with the IP the first one had doesn't take its lease
+	l, err = sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4"), NodeID: "node-b"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.Equal(subnets[0].Subnet) {
+		t.Fatalf("node with a recycled IP got the lease of another node")
+	}
+
+	// reservations are for a node ID
+	r := Reservation{Subnet: newIP4Net("10.3.10.0", 24), PublicIP: ip.MustParseIP4("1.2.3.6"), NodeID: "node-c"}
+	if err := sm.AddReservation(ctx, "_", &r); err != nil {
+		t.Fatal("AddReservation failed: ", err)
+	}
+	r2 := r
+	r2.NodeID = "node-d"
+	if err := sm.AddReservation(ctx, "_", &r2); err != ErrLeaseTaken {
+		t.Fatalf("reservation for another node returned: %v", err)
+	}
+
+	l, err = sm.AcquireLease(ctx, "_", &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.7"), NodeID: "node-c"})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(r.Subnet) || !l.Expiration.IsZero() {
+		t.Fatalf("reservation not used for its node: got %v", l.Subnet)
+	}
+
+	rs, err := sm.ListReservations(ctx, "_")
+	if err != nil {
+		t.Fatal("ListReservations failed: ", err)
+	}
+	if len(rs) != 1 || rs[0].NodeID != r.NodeID {
+		t.Fatalf("unexpected reservations: %v", rs)
+	}
+}
+
+func TestWatchNetworkConfig(t *testing.T) {
+	msr := NewMockRegistry("_", `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 1 } }`, nil)
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	configs := make(chan *Config)
+	go WatchNetworkConfig(ctx, sm, "_", configs)
+
+	// the current config first
+	config := <-configs
+	if config.BackendType != "vxlan" {
+		t.Fatalf("unexpected initial config: %+v", config)
+	}
+
+	// invalid configs are skipped over
+	msr.SetConfig("_", `{ "Network": "10.3.0.0/16", "SubnetLen": 8 }`)
+	msr.SetConfig("_", `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan", "VNI": 2 }, "LeaseTTL": "1h" }`)
+
+	select {
+	case config = <-configs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the config change")
+	}
+	if config.LeaseTTL.Duration != time.Hour || string(config.Backend) != `{ "Type": "vxlan", "VNI": 2 }` {
+		t.Fatalf("unexpected config after change: %+v", config)
+	}
+}
+
+func waitForWatchStatus(t *testing.T, network string, cond func(WatchStatus) bool) WatchStatus {
+	var st WatchStatus
+	for i := 0; i < 100; i++ {
+		if st = GetWatchStatus(network); cond(st) {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("watch status of %q never got there: %+v", network, st)
+	return st
+}
+
+func TestWatchStatus(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// watches of earlier tests may still be shutting down
+	waitForWatchStatus(t, "_", func(st WatchStatus) bool { return !st.Live })
+
+	l := acquireLease(ctx, t, sm)
+
+	wctx, wcancel := context.WithCancel(ctx)
+	events := make(chan []Event)
+	done := make(chan struct{})
+	go func() {
+		WatchLeases(wctx, sm, "_", l, events)
+		close(done)
+	}()
+
+	<-events
+	if st := GetWatchStatus("_"); st.Synced {
+		t.Errorf("watch is synced before the backend handled the snapshot: %+v", st)
+	}
+	LeasesHandled("_")
+	st := waitForWatchStatus(t, "_", func(st WatchStatus) bool { return st.Synced })
+	if !st.Live || !st.FailingSince.IsZero() {
+		t.Errorf("expected a live watch that isn't failing, got %+v", st)
+	}
+
+	wcancel()
+	<-done
+	if st := GetWatchStatus("_"); st.Live {
+		t.Errorf("watch is live after it stopped: %+v", st)
+	}
 }
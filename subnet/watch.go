@@ -26,13 +26,36 @@ import (
 // WatchLeases performs a long term watch of the given network's subnet leases
 // and communicates addition/deletion events on receiver channel. It takes care
 // of handling "fall-behind" logic where the history window has advanced too far
-// and it needs to diff the latest snapshot with its saved state and generate events
+// and it needs to diff the latest snapshot with its saved state and generate events.
+// The backend calls LeasesHandled once it has handled the first batch.
 func WatchLeases(ctx context.Context, sm Manager, network string, ownLease *Lease, receiver chan []Event) {
+	watchLeases(ctx, sm, network, ownLease, receiver, "leases")
+}
+
+// WatchPeers is WatchLeases for watchers other than the backend of the
+// network. Its watch counts towards the liveness in WatchStatus but not its
+// peers, and it isn't counted in the lease watch metrics.
+func WatchPeers(ctx context.Context, sm Manager, network string, ownLease *Lease, receiver chan []Event) {
+	watchLeases(ctx, sm, network, ownLease, receiver, "peers")
+}
+
+func watchLeases(ctx context.Context, sm Manager, network string, ownLease *Lease, receiver chan []Event, kind string) {
 	lw := &leaseWatcher{
 		ownLease: ownLease,
 	}
 	var cursor interface{}
 
+	isBackend := kind == "leases"
+	if isBackend {
+		defer peers.Delete(network)
+	}
+
+	watchStarted(network, kind)
+	defer watchStopped(network, kind)
+
+	// handedOver is set once a batch has been sent to the receiver
+	handedOver := false
+
 	for {
 		res, err := sm.WatchLeases(ctx, network, cursor)
 		if err != nil {
@@ -41,26 +64,56 @@ func WatchLeases(ctx context.Context, sm Manager, network string, ownLease *Leas
 			}
 
 			log.Errorf("Watch subnets: %v", err)
+			if isBackend {
+				leaseWatchErrors.Inc(network)
+			}
+			watchFailed(network, kind)
 			time.Sleep(time.Second)
 			continue
 		}
-
-		cursor = res.Cursor
+		watchSucceeded(network, kind)
 
 		batch := []Event{}
 
 		if len(res.Events) > 0 {
 			batch = lw.update(res.Events)
 		} else {
+			if cursor != nil && isBackend {
+				// not the snapshot the watch starts with
+				leaseWatchResets.Inc(network)
+			}
 			batch = lw.reset(res.Snapshot)
 		}
 
+		cursor = res.Cursor
+		if isBackend {
+			leases := lw.peers()
+			peers.Set(float64(len(leases)), network)
+			watchPeers(network, leases)
+		}
+
 		if len(batch) > 0 {
-			receiver <- batch
+			select {
+			case receiver <- batch:
+				handedOver = true
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !isBackend || !handedOver {
+			// otherwise the backend tells once it has handled the batch
+			watchSynced(network, kind)
 		}
 	}
 }
 
+// LeasesHandled is called by the backend of a network after it has handled
+// a batch of events from WatchLeases, so that WatchStatus tells when it has
+// handled the initial snapshot of the other hosts' leases
+func LeasesHandled(network string) {
+	watchSynced(network, "leases")
+}
+
 type leaseWatcher struct {
 	ownLease *Lease
 	leases   []Lease
@@ -104,6 +157,17 @@ func (lw *leaseWatcher) reset(leases []Lease) []Event {
 	return batch
 }
 
+// peers returns the leases held by other hosts
+func (lw *leaseWatcher) peers() []Lease {
+	var leases []Lease
+	for _, l := range lw.leases {
+		if lw.ownLease == nil || !l.Subnet.Equal(lw.ownLease.Subnet) {
+			leases = append(leases, l)
+		}
+	}
+	return leases
+}
+
 func (lw *leaseWatcher) update(events []Event) []Event {
 	batch := []Event{}
 
@@ -262,6 +326,9 @@ func (nw *netWatcher) remove(network string) Event {
 func WatchLease(ctx context.Context, sm Manager, network string, sn ip.IP4Net, receiver chan Event) {
 	var cursor interface{}
 
+	watchStarted(network, "lease")
+	defer watchStopped(network, "lease")
+
 	for {
 		wr, err := sm.WatchLease(ctx, network, sn, cursor)
 		if err != nil {
@@ -270,17 +337,54 @@ func WatchLease(ctx context.Context, sm Manager, network string, sn ip.IP4Net, r
 			}
 
 			log.Errorf("Subnet watch failed: %v", err)
+			watchFailed(network, "lease")
 			time.Sleep(time.Second)
 			continue
 		}
+		watchSucceeded(network, "lease")
 
+		evt := Event{}
 		if len(wr.Snapshot) > 0 {
-			receiver <- Event{
+			evt = Event{
 				Type:  EventAdded,
 				Lease: wr.Snapshot[0],
 			}
 		} else {
-			receiver <- wr.Events[0]
+			evt = wr.Events[0]
+		}
+
+		select {
+		case receiver <- evt:
+		case <-ctx.Done():
+			return
+		}
+
+		cursor = wr.Cursor
+	}
+}
+
+// WatchNetworkConfig performs a long term watch of the given network's config
+// and communicates it on receiver channel, first as it is when the watch
+// starts and then after every change.
+func WatchNetworkConfig(ctx context.Context, sm Manager, network string, receiver chan *Config) {
+	var cursor interface{}
+
+	for {
+		wr, err := sm.WatchNetworkConfig(ctx, network, cursor)
+		if err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+
+			log.Errorf("Network config watch failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		select {
+		case receiver <- wr.Config:
+		case <-ctx.Done():
+			return
 		}
 
 		cursor = wr.Cursor